@@ -1,36 +1,138 @@
 package config
 
 import (
-	"crypto/rand"
-	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"time"
 )
 
 type Config struct {
-	ServerPort           string `json:"server_port"`
-	DatabasePath         string `json:"database_path"`
-	ServerSecret         string `json:"server_secret"`
-	JWTSecret            string `json:"jwt_secret"`
-	Production           bool   `json:"production"`
-	SessionDurationHours int    `json:"session_duration_hours"`
+	ServerPort                 string `json:"server_port"`
+	DatabasePath               string `json:"database_path"`
+	ServerSecret               string `json:"server_secret"`
+	ServerSecretVersion        int    `json:"server_secret_version"`
+	Production                 bool   `json:"production"`
+	SessionDurationHours       int    `json:"session_duration_hours"`
+	AccessTokenMinutes         int    `json:"access_token_minutes"` // Renewed with the refresh cookie until the session ends
+	HostKeyPolicy              string `json:"host_key_policy"`      // "strict", "tofu" or "accept-new"
+	HostKeyScanDisabled        bool   `json:"host_key_scan_disabled"`
+	HostKeyScanIntervalMinutes int    `json:"host_key_scan_interval_minutes"`
+	LockoutThreshold           int    `json:"lockout_threshold"` // Failed sign-ins in a row that lock an account
+	LockoutMinutes             int    `json:"lockout_minutes"`
+	// Password policy for local accounts. The breached list is a file of
+	// passwords or their SHA-1 hashes, one per line.
+	PasswordMinLength        int    `json:"password_min_length"`
+	PasswordMinClasses       int    `json:"password_min_classes"`  // Of lowercase, uppercase, digits and symbols
+	PasswordMaxAgeDays       int    `json:"password_max_age_days"` // 0 never expires passwords
+	PasswordBreachedListFile string `json:"password_breached_list_file,omitempty"`
+	// Keys signing the JWTs, the current one first. Rotation adds a key every
+	// JWTKeyRotationDays; replaced keys still verify tokens and stay in the
+	// JWKS for JWTKeyOverlapHours.
+	JWTAlgorithm       string   `json:"jwt_algorithm,omitempty"` // "EdDSA" or "ES256", for new keys
+	JWTKeyRotationDays int      `json:"jwt_key_rotation_days,omitempty"`
+	JWTKeyOverlapHours int      `json:"jwt_key_overlap_hours,omitempty"`
+	JWTKeys            []JWTKey `json:"jwt_keys,omitempty"`
+	JWTIssuer          string   `json:"jwt_issuer,omitempty"` // The iss claim of every token
+	// Secrets replaced by rotation, by version. They stay here until nothing
+	// sealed with them is left, then they are removed automatically.
+	RetiredServerSecrets map[int]string `json:"retired_server_secrets,omitempty"`
+	// Key provider protecting the server secrets: "config" (kept in this file
+	// as is, the default), "file", "env", "kms" or "transit". With any other
+	// provider this file only holds every version wrapped by its master key.
+	KeyProvider          string         `json:"key_provider,omitempty"`
+	KeyProviderFile      string         `json:"key_provider_file,omitempty"`    // "file": path of the master key
+	KeyProviderAddress   string         `json:"key_provider_address,omitempty"` // "kms" and "transit": service URL
+	KeyProviderKeyName   string         `json:"key_provider_key_name,omitempty"`
+	KeyProviderToken     string         `json:"key_provider_token,omitempty"`
+	WrappedServerSecrets map[int]string `json:"wrapped_server_secrets,omitempty"`
+	// External secret store (Vault KV v2 compatible). The token can also be
+	// supplied through FARSEER_SECRET_STORE_TOKEN to keep it out of this file.
+	SecretStoreAddress   string `json:"secret_store_address,omitempty"`
+	SecretStoreToken     string `json:"secret_store_token,omitempty"`
+	SecretStoreMount     string `json:"secret_store_mount,omitempty"`
+	SecretStoreNamespace string `json:"secret_store_namespace,omitempty"`
+	// Non-admins may only use secret paths under this prefix, with
+	// {username} replaced by theirs, since every read uses the server's token
+	SecretStoreUserPrefix string `json:"secret_store_user_prefix,omitempty"`
+	// WebAuthn relying party. When unset, the ID and origin are taken from
+	// the Origin header of the browser's request.
+	WebAuthnRPID    string   `json:"webauthn_rp_id,omitempty"`
+	WebAuthnOrigins []string `json:"webauthn_origins,omitempty"`
+	// OpenID Connect single sign-on, enabled when the issuer and client ID are
+	// set. The client secret can also be supplied through
+	// FARSEER_OIDC_CLIENT_SECRET to keep it out of this file.
+	OIDCIssuer        string   `json:"oidc_issuer,omitempty"`
+	OIDCClientID      string   `json:"oidc_client_id,omitempty"`
+	OIDCClientSecret  string   `json:"oidc_client_secret,omitempty"`
+	OIDCRedirectURL   string   `json:"oidc_redirect_url,omitempty"` // https://<host>/api/auth/oidc/callback
+	OIDCScopes        []string `json:"oidc_scopes,omitempty"`
+	OIDCUsernameClaim string   `json:"oidc_username_claim,omitempty"`
+	OIDCGroupsClaim   string   `json:"oidc_groups_claim,omitempty"`
+	OIDCAdminGroups   []string `json:"oidc_admin_groups,omitempty"` // Members sign in as admins
+	OIDCUserGroups    []string `json:"oidc_user_groups,omitempty"`  // When set, only these groups and the admin groups may sign in
+	// SSO users must also enter a local password and pass the usual second
+	// factor after the identity provider has authenticated them
+	OIDCRequireLocalAuth bool `json:"oidc_require_local_auth,omitempty"`
+	// LDAP or Active Directory, enabled when the URL is set. Users are found
+	// by binding with the user DN template, or else by searching the base DN
+	// as the bind DN. The bind password can also be supplied through
+	// FARSEER_LDAP_BIND_PASSWORD to keep it out of this file.
+	LDAPURL                 string   `json:"ldap_url,omitempty"` // ldap://host:389 or ldaps://host:636
+	LDAPStartTLS            bool     `json:"ldap_start_tls,omitempty"`
+	LDAPInsecureSkipVerify  bool     `json:"ldap_insecure_skip_verify,omitempty"`
+	LDAPUserDNTemplate      string   `json:"ldap_user_dn_template,omitempty"` // e.g. uid=%s,ou=people,dc=example,dc=com
+	LDAPBindDN              string   `json:"ldap_bind_dn,omitempty"`
+	LDAPBindPassword        string   `json:"ldap_bind_password,omitempty"`
+	LDAPBaseDN              string   `json:"ldap_base_dn,omitempty"`
+	LDAPUserFilter          string   `json:"ldap_user_filter,omitempty"` // %s is the escaped username
+	LDAPGroupAttribute      string   `json:"ldap_group_attribute,omitempty"`
+	LDAPAdminGroups         []string `json:"ldap_admin_groups,omitempty"` // Group DNs or CNs whose members sign in as admins
+	LDAPUserGroups          []string `json:"ldap_user_groups,omitempty"`  // When set, only these groups and the admin groups may sign in
+	LDAPSyncIntervalMinutes int      `json:"ldap_sync_interval_minutes,omitempty"`
+	// SAML 2.0 single sign-on, enabled when the root URL is set and the
+	// identity provider's metadata has been imported. The service provider
+	// key and certificate are generated on first use.
+	SAMLRootURL           string   `json:"saml_root_url,omitempty"`  // https://<host>, where /api/auth/saml/* is served
+	SAMLEntityID          string   `json:"saml_entity_id,omitempty"` // Defaults to the metadata URL
+	SAMLIDPMetadata       string   `json:"saml_idp_metadata,omitempty"`
+	SAMLSPKey             string   `json:"saml_sp_key,omitempty"`
+	SAMLSPCertificate     string   `json:"saml_sp_certificate,omitempty"`
+	SAMLUsernameAttribute string   `json:"saml_username_attribute,omitempty"` // Attribute name or friendly name
+	SAMLGroupsAttribute   string   `json:"saml_groups_attribute,omitempty"`
+	SAMLAdminGroups       []string `json:"saml_admin_groups,omitempty"` // Members sign in as admins
+	SAMLUserGroups        []string `json:"saml_user_groups,omitempty"`  // When set, only these groups and the admin groups may sign in
+	// Authentication by a reverse proxy (oauth2-proxy, Authelia, ...), enabled
+	// when the user header and the trusted proxy addresses are set. The header
+	// is only believed from those addresses; from anywhere else it is refused.
+	ProxyAuthUserHeader    string   `json:"proxy_auth_user_header,omitempty"` // e.g. X-Forwarded-User
+	ProxyAuthTrustedCIDRs  []string `json:"proxy_auth_trusted_cidrs,omitempty"`
+	ProxyAuthGroupsHeader  string   `json:"proxy_auth_groups_header,omitempty"` // Comma-separated groups, e.g. X-Forwarded-Groups
+	ProxyAuthAutoProvision bool     `json:"proxy_auth_auto_provision,omitempty"`
+	ProxyAuthAdminGroups   []string `json:"proxy_auth_admin_groups,omitempty"` // Members are admins
+	ProxyAuthUserGroups    []string `json:"proxy_auth_user_groups,omitempty"`  // When set, only these groups and the admin groups are let in
+}
+
+// JWTKey is a JWT signing key
+type JWTKey struct {
+	KID               string     `json:"kid"`
+	Algorithm         string     `json:"alg"`
+	PrivateKey        string     `json:"private_key,omitempty"`         // PKCS #8 PEM, when no key provider is configured
+	WrappedPrivateKey string     `json:"wrapped_private_key,omitempty"` // The PEM wrapped by the key provider
+	CreatedAt         time.Time  `json:"created_at"`
+	RetiredAt         *time.Time `json:"retired_at,omitempty"` // When a newer key took over
 }
 
 var (
 	instance *Config
 	once     sync.Once
+	// secretsMu guards the server secret and JWT key fields, which change at runtime on rotation
+	secretsMu sync.RWMutex
 )
 
-func generateSecret(length int) string {
-	bytes := make([]byte, length)
-	if _, err := rand.Read(bytes); err != nil {
-		panic(err)
-	}
-	return hex.EncodeToString(bytes)
-}
-
 func getConfigPath() string {
 	configDir := os.Getenv("FARSEER_CONFIG_DIR")
 	if configDir == "" {
@@ -50,7 +152,6 @@ func GetConfig() *Config {
 			ServerPort:   "8080",
 			DatabasePath: "",
 			ServerSecret: "",
-			JWTSecret:    "",
 			Production:   false,
 		}
 
@@ -67,17 +168,72 @@ func GetConfig() *Config {
 		if instance.SessionDurationHours == 0 {
 			instance.SessionDurationHours = 24
 		}
-
-		// Generate secrets if not set
-		needsSave := false
-		if instance.ServerSecret == "" {
-			instance.ServerSecret = generateSecret(32)
-			needsSave = true
+		if instance.AccessTokenMinutes == 0 {
+			instance.AccessTokenMinutes = 15
 		}
-		if instance.JWTSecret == "" {
-			instance.JWTSecret = generateSecret(32)
-			needsSave = true
+		if instance.JWTAlgorithm == "" {
+			instance.JWTAlgorithm = "EdDSA"
+		}
+		if instance.JWTKeyRotationDays == 0 {
+			instance.JWTKeyRotationDays = 30
+		}
+		if instance.JWTKeyOverlapHours == 0 {
+			instance.JWTKeyOverlapHours = 24
+		}
+		if instance.JWTIssuer == "" {
+			instance.JWTIssuer = "farseer"
+		}
+		if instance.LockoutThreshold == 0 {
+			instance.LockoutThreshold = 10
+		}
+		if instance.LockoutMinutes == 0 {
+			instance.LockoutMinutes = 15
+		}
+		if instance.PasswordMinLength == 0 {
+			instance.PasswordMinLength = 8
 		}
+		if instance.SecretStoreUserPrefix == "" {
+			instance.SecretStoreUserPrefix = "users/{username}"
+		}
+		if instance.HostKeyPolicy == "" {
+			instance.HostKeyPolicy = "tofu"
+		}
+		if instance.HostKeyScanIntervalMinutes == 0 {
+			instance.HostKeyScanIntervalMinutes = 360
+		}
+		if len(instance.OIDCScopes) == 0 {
+			instance.OIDCScopes = []string{"openid", "profile", "email"}
+		}
+		if instance.OIDCUsernameClaim == "" {
+			instance.OIDCUsernameClaim = "preferred_username"
+		}
+		if instance.OIDCGroupsClaim == "" {
+			instance.OIDCGroupsClaim = "groups"
+		}
+		if instance.LDAPUserFilter == "" {
+			instance.LDAPUserFilter = "(uid=%s)"
+		}
+		if instance.LDAPGroupAttribute == "" {
+			instance.LDAPGroupAttribute = "memberOf"
+		}
+		if instance.LDAPSyncIntervalMinutes == 0 {
+			instance.LDAPSyncIntervalMinutes = 60
+		}
+		if instance.SAMLUsernameAttribute == "" {
+			instance.SAMLUsernameAttribute = "uid"
+		}
+		if instance.SAMLGroupsAttribute == "" {
+			instance.SAMLGroupsAttribute = "groups"
+		}
+		if instance.ServerSecretVersion == 0 {
+			// Data sealed before key versioning carries no version and uses the first secret
+			instance.ServerSecretVersion = 1
+		}
+
+		// Fill in paths if not set. The server secret is set up by the key
+		// provider (see services.InitServerKeys) and the JWT keys by
+		// services.InitJWTKeys.
+		needsSave := false
 		if instance.DatabasePath == "" {
 			configDir := filepath.Dir(configPath)
 			instance.DatabasePath = filepath.Join(configDir, "farseer.db")
@@ -91,6 +247,51 @@ func GetConfig() *Config {
 		if dbPath := os.Getenv("FARSEER_DB_PATH"); dbPath != "" {
 			instance.DatabasePath = dbPath
 		}
+		if addr := os.Getenv("FARSEER_SECRET_STORE_ADDR"); addr != "" {
+			instance.SecretStoreAddress = addr
+		}
+		if provider := os.Getenv("FARSEER_KEY_PROVIDER"); provider != "" {
+			instance.KeyProvider = provider
+		}
+		if file := os.Getenv("FARSEER_KEY_PROVIDER_FILE"); file != "" {
+			instance.KeyProviderFile = file
+		}
+		if addr := os.Getenv("FARSEER_KEY_PROVIDER_ADDR"); addr != "" {
+			instance.KeyProviderAddress = addr
+		}
+		if rpID := os.Getenv("FARSEER_WEBAUTHN_RP_ID"); rpID != "" {
+			instance.WebAuthnRPID = rpID
+		}
+		if origins := os.Getenv("FARSEER_WEBAUTHN_ORIGINS"); origins != "" {
+			instance.WebAuthnOrigins = strings.Split(origins, ",")
+		}
+		if issuer := os.Getenv("FARSEER_OIDC_ISSUER"); issuer != "" {
+			instance.OIDCIssuer = issuer
+		}
+		if clientID := os.Getenv("FARSEER_OIDC_CLIENT_ID"); clientID != "" {
+			instance.OIDCClientID = clientID
+		}
+		if redirect := os.Getenv("FARSEER_OIDC_REDIRECT_URL"); redirect != "" {
+			instance.OIDCRedirectURL = redirect
+		}
+		if ldapURL := os.Getenv("FARSEER_LDAP_URL"); ldapURL != "" {
+			instance.LDAPURL = ldapURL
+		}
+		if bindDN := os.Getenv("FARSEER_LDAP_BIND_DN"); bindDN != "" {
+			instance.LDAPBindDN = bindDN
+		}
+		if baseDN := os.Getenv("FARSEER_LDAP_BASE_DN"); baseDN != "" {
+			instance.LDAPBaseDN = baseDN
+		}
+		if rootURL := os.Getenv("FARSEER_SAML_ROOT_URL"); rootURL != "" {
+			instance.SAMLRootURL = rootURL
+		}
+		if header := os.Getenv("FARSEER_PROXY_AUTH_USER_HEADER"); header != "" {
+			instance.ProxyAuthUserHeader = header
+		}
+		if cidrs := os.Getenv("FARSEER_PROXY_AUTH_TRUSTED_CIDRS"); cidrs != "" {
+			instance.ProxyAuthTrustedCIDRs = strings.Split(cidrs, ",")
+		}
 		if os.Getenv("FARSEER_PRODUCTION") == "true" {
 			instance.Production = true
 		}
@@ -104,7 +305,56 @@ func GetConfig() *Config {
 	return instance
 }
 
+// UpdateServerSecrets applies fn to the server secret fields and saves the
+// config, restoring the previous values if saving fails
+func (c *Config) UpdateServerSecrets(fn func(c *Config)) error {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	secret, version := c.ServerSecret, c.ServerSecretVersion
+	retired, wrapped := copySecrets(c.RetiredServerSecrets), copySecrets(c.WrappedServerSecrets)
+	fn(c)
+	if err := c.save(); err != nil {
+		c.ServerSecret, c.ServerSecretVersion = secret, version
+		c.RetiredServerSecrets, c.WrappedServerSecrets = retired, wrapped
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
+}
+
+// UpdateJWTKeys replaces the JWT signing keys and saves the config,
+// restoring the previous keys if saving fails
+func (c *Config) UpdateJWTKeys(keys []JWTKey) error {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+
+	previous := c.JWTKeys
+	c.JWTKeys = keys
+	if err := c.save(); err != nil {
+		c.JWTKeys = previous
+		return fmt.Errorf("failed to save config: %w", err)
+	}
+	return nil
+}
+
+func copySecrets(secrets map[int]string) map[int]string {
+	if secrets == nil {
+		return nil
+	}
+	copied := make(map[int]string, len(secrets))
+	for version, secret := range secrets {
+		copied[version] = secret
+	}
+	return copied
+}
+
 func (c *Config) Save() error {
+	secretsMu.RLock()
+	defer secretsMu.RUnlock()
+	return c.save()
+}
+
+func (c *Config) save() error {
 	configPath := getConfigPath()
 
 	// Create config directory if it doesn't exist
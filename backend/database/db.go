@@ -23,7 +23,7 @@ func Connect() error {
 	}
 
 	// Auto-migrate models
-	err = DB.AutoMigrate(&models.User{}, &models.Machine{}, &models.Group{}, &models.AuditLog{})
+	err = DB.AutoMigrate(&models.User{}, &models.Machine{}, &models.Group{}, &models.AuditLog{}, &models.HostKeyRecord{}, &models.Notification{}, &models.RotationJob{}, &models.RotationResult{}, &models.Credential{}, &models.RecoveryCode{}, &models.WebAuthnCredential{}, &models.APIToken{}, &models.Session{}, &models.RefreshToken{})
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,118 @@
+package handlers
+
+import (
+	"errors"
+	"farseer/database"
+	"farseer/middleware"
+	"farseer/models"
+	"farseer/services"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type APITokenCreateRequest struct {
+	TOTPVerifyRequest
+	models.APITokenInput
+}
+
+// ListAPITokens returns the current user's API tokens
+func ListAPITokens(c *fiber.Ctx) error {
+	var tokens []models.APIToken
+	if result := database.DB.Where("user_id = ?", middleware.GetUserID(c)).Order("created_at").Find(&tokens); result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch API tokens",
+		})
+	}
+
+	responses := make([]models.APITokenResponse, len(tokens))
+	for i := range tokens {
+		responses[i] = tokens[i].ToResponse()
+	}
+	return c.JSON(responses)
+}
+
+// GetAPITokenScopes lists the scopes API tokens can be granted
+func GetAPITokenScopes(c *fiber.Ctx) error {
+	return c.JSON(models.APITokenScopes)
+}
+
+// CreateAPIToken creates an API token for the current user and returns it
+// once. A current second factor is required so a stolen session cannot mint
+// a long-lived token; users without one signed in through an external provider.
+func CreateAPIToken(c *fiber.Ctx) error {
+	var req APITokenCreateRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	var user models.User
+	if result := database.DB.First(&user, middleware.GetUserID(c)); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if hasSecondFactor(&user) {
+		if err := reverifySecondFactor(c, &user, &req.TOTPVerifyRequest); err != nil {
+			return err
+		}
+	}
+
+	// The token carries the data key so scripts need no password
+	dataKey, err := getEncryptionKey(c)
+	if err != nil {
+		return encryptionKeyError(c, err)
+	}
+
+	token, record, err := services.CreateAPIToken(&user, &req.APITokenInput, dataKey)
+	if errors.Is(err, services.ErrInvalidAPITokenInput) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create API token",
+		})
+	}
+
+	expiry := "never expires"
+	if record.ExpiresAt != nil {
+		expiry = "expires " + record.ExpiresAt.Format("2006-01-02")
+	}
+	services.LogAudit(user.ID, user.Username, models.AuditActionAPITokenCreate, nil, "",
+		fmt.Sprintf("API token %s (%s): %s, %s", record.Name, record.Prefix, strings.ReplaceAll(record.Scopes, ",", " "), expiry), c.IP())
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"token":     token,
+		"api_token": record.ToResponse(),
+	})
+}
+
+// DeleteAPIToken revokes one of the current user's API tokens
+func DeleteAPIToken(c *fiber.Ctx) error {
+	tokenID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid API token ID",
+		})
+	}
+
+	var token models.APIToken
+	if result := database.DB.Where("id = ? AND user_id = ?", tokenID, middleware.GetUserID(c)).First(&token); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "API token not found",
+		})
+	}
+	if result := database.DB.Delete(&token); result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke API token",
+		})
+	}
+
+	services.LogAudit(middleware.GetUserID(c), middleware.GetUsername(c), models.AuditActionAPITokenRevoke, nil, "", "API token revoked: "+token.Name+" ("+token.Prefix+")", c.IP())
+	return c.SendStatus(fiber.StatusNoContent)
+}
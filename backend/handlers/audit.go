@@ -87,6 +87,31 @@ func GetAuditActions(c *fiber.Ctx) error {
 		string(models.AuditActionUserCreate),
 		string(models.AuditActionUserUpdate),
 		string(models.AuditActionUserDelete),
+		string(models.AuditActionHostKeyMismatch),
+		string(models.AuditActionKeyDeploy),
+		string(models.AuditActionKeyRotate),
+		string(models.AuditActionPasswordRotate),
+		string(models.AuditActionCredentialCreate),
+		string(models.AuditActionCredentialUpdate),
+		string(models.AuditActionCredentialDelete),
+		string(models.AuditActionServerSecretRotate),
+		string(models.AuditActionRecoveryCodeUse),
+		string(models.AuditActionRecoveryCodesRegenerate),
+		string(models.AuditActionTOTPReset),
+		string(models.AuditActionWebAuthnRegister),
+		string(models.AuditActionWebAuthnDelete),
+		string(models.AuditActionUserDisable),
+		string(models.AuditActionUserEnable),
+		string(models.AuditActionSAMLMetadataImport),
+		string(models.AuditActionAPITokenCreate),
+		string(models.AuditActionAPITokenRevoke),
+		string(models.AuditActionSessionRevoke),
+		string(models.AuditActionJWTKeyRotate),
+		string(models.AuditActionLoginFailed),
+		string(models.AuditActionTOTPFailed),
+		string(models.AuditActionUserLock),
+		string(models.AuditActionUserUnlock),
+		string(models.AuditActionPasswordChange),
 	}
 
 	return c.JSON(actions)
@@ -1,11 +1,15 @@
 package handlers
 
 import (
+	"encoding/json"
+	"errors"
 	"farseer/config"
 	"farseer/database"
 	"farseer/middleware"
 	"farseer/models"
 	"farseer/services"
+	"fmt"
+	"log"
 	"strconv"
 	"time"
 
@@ -13,6 +17,7 @@ import (
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/pquerna/otp/totp"
 	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
 )
 
 type SetupRequest struct {
@@ -36,20 +41,44 @@ type LoginStepResponse struct {
 	User  *models.UserResponse `json:"user,omitempty"`
 	// Partial auth (needs TOTP)
 	RequiresTOTP      bool   `json:"requires_totp,omitempty"`
+	RequiresWebAuthn  bool   `json:"requires_webauthn,omitempty"`
+	PreferredFactor   string `json:"preferred_factor,omitempty"`
 	RequiresTOTPSetup bool   `json:"requires_totp_setup,omitempty"`
 	TempToken         string `json:"temp_token,omitempty"`
 	TOTPSecret        string `json:"totp_secret,omitempty"`
 	TOTPQRURL         string `json:"totp_qr_url,omitempty"`
+	// Shown once, after TOTP enrollment completes
+	RecoveryCodes []string `json:"recovery_codes,omitempty"`
+	// SSO users have no password to derive the credential key from, so the
+	// key is handed to the client with the full token
+	EncryptionKey string `json:"encryption_key,omitempty"`
+	// SSO sign-in that still needs the local password; set one if PasswordSetup
+	RequiresPassword bool `json:"requires_password,omitempty"`
+	PasswordSetup    bool `json:"password_setup,omitempty"`
+}
+
+// PasswordChangeRequest carries the current password and a second factor
+// along with the new password
+type PasswordChangeRequest struct {
+	TOTPVerifyRequest
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
 }
 
 type TOTPVerifyRequest struct {
-	Code string `json:"code"`
+	Code         string          `json:"code"`
+	RecoveryCode string          `json:"recovery_code,omitempty"` // Single-use alternative to a TOTP code
+	Assertion    json.RawMessage `json:"assertion,omitempty"`     // Security key answer to a verify challenge
 }
 
 // CheckSetup returns whether the initial setup has been completed
 func CheckSetup(c *fiber.Ctx) error {
 	return c.JSON(fiber.Map{
 		"setup_complete": database.IsSetupComplete(),
+		"oidc_enabled":   services.OIDCEnabled(),
+		"saml_enabled":   services.SAMLEnabled(),
+		"proxy_enabled":  services.ProxyAuthEnabled(),
+		"proxy_user":     middleware.ProxyUser(c),
 	})
 }
 
@@ -73,11 +102,14 @@ func Setup(c *fiber.Ctx) error {
 			"error": "Username must be at least 3 characters",
 		})
 	}
-	if len(req.Password) < 8 {
+	if !services.ValidUsername(req.Username) {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Password must be at least 8 characters",
+			"error": "Username may not contain '/'",
 		})
 	}
+	if err := checkPasswordPolicy(req.Password); err != nil {
+		return err
+	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -98,20 +130,21 @@ func Setup(c *fiber.Ctx) error {
 	}
 
 	// Encrypt TOTP secret for storage
-	cfg := config.GetConfig()
-	encryptedSecret, err := services.EncryptTOTPSecret(totpKey.Secret(), cfg.ServerSecret)
+	encryptedSecret, err := services.EncryptTOTPSecret(totpKey.Secret())
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to encrypt TOTP secret",
 		})
 	}
 
+	now := time.Now()
 	user := models.User{
-		Username:     req.Username,
-		PasswordHash: string(hashedPassword),
-		Role:         models.RoleAdmin,
-		TOTPSecret:   encryptedSecret,
-		TOTPEnabled:  false,
+		Username:          req.Username,
+		PasswordHash:      string(hashedPassword),
+		PasswordChangedAt: &now,
+		Role:              models.RoleAdmin,
+		TOTPSecret:        encryptedSecret,
+		TOTPEnabled:       false,
 	}
 
 	if result := database.DB.Create(&user); result.Error != nil {
@@ -119,9 +152,10 @@ func Setup(c *fiber.Ctx) error {
 			"error": "Failed to create user",
 		})
 	}
+	createDataKey(&user, req.Password)
 
 	// Generate temp token for TOTP enrollment
-	tempToken, err := generateToken(&user, true)
+	tempToken, err := generateTempToken(&user)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to generate token",
@@ -145,37 +179,169 @@ func Login(c *fiber.Ctx) error {
 		})
 	}
 
-	var user models.User
-	if result := database.DB.Where("username = ?", req.Username).First(&user); result.Error != nil {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": "Invalid credentials",
-		})
+	// Directory users signing in for the first time have no account yet, and
+	// so no failures to count
+	var account models.User
+	known := database.DB.Where("username = ?", req.Username).First(&account).Error == nil
+	if known {
+		if err := checkLoginThrottle(c, &account); err != nil {
+			return err
+		}
+	}
+
+	result, err := services.AuthenticatePassword(req.Username, req.Password)
+	if errors.Is(err, services.ErrInvalidCredentials) {
+		if known {
+			recordFailedLogin(c, &account, models.AuditActionLoginFailed, "Wrong password")
+		} else {
+			services.LogAudit(0, req.Username, models.AuditActionLoginFailed, nil, "", "Unknown user", c.IP())
+		}
+	}
+	if err != nil {
+		return passwordAuthError(c, err)
+	}
+	user := result.User
+
+	switch {
+	case result.Created:
+		services.LogAudit(user.ID, user.Username, models.AuditActionUserCreate, nil, "", "Provisioned from the directory as "+string(user.Role), c.IP())
+	case result.Reenabled:
+		services.LogAudit(user.ID, user.Username, models.AuditActionUserEnable, nil, "", "Back in the directory", c.IP())
+	}
+	if result.RoleChanged {
+		services.LogAudit(user.ID, user.Username, models.AuditActionUserUpdate, nil, "", "Role set to "+string(user.Role)+" from directory groups", c.IP())
 	}
 
-	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+	// The password is verified, so this is the moment to move credentials
+	// of users who predate envelope encryption under a data key. Directory
+	// users' keys do not depend on their password.
+	if user.AuthProvider == "" {
+		createDataKey(user, req.Password)
+	}
+
+	return beginSecondFactor(c, user)
+}
+
+// passwordAuthError answers a failed password check. Directory failures are
+// logged and shown generically.
+func passwordAuthError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, services.ErrInvalidCredentials):
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 			"error": "Invalid credentials",
 		})
+	case errors.Is(err, services.ErrUseSingleSignOn):
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "This account signs in with single sign-on",
+		})
+	case errors.Is(err, services.ErrAccountDisabled):
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "This account is disabled",
+		})
+	case errors.Is(err, services.ErrNotAllowed):
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Your account is not allowed to sign in to Farseer",
+		})
+	case errors.Is(err, services.ErrUsernameTaken):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "The username is taken by another account",
+		})
+	case errors.Is(err, services.ErrInvalidUsername):
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Your directory username cannot be used in Farseer",
+		})
+	case errors.Is(err, services.ErrLDAPUnavailable):
+		log.Printf("Directory sign-in failed: %v", err)
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": "The directory is unavailable, try again later",
+		})
+	default:
+		log.Printf("Sign-in failed: %v", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to check credentials",
+		})
 	}
+}
+
+// checkPasswordPolicy refuses a new password the policy does not allow
+func checkPasswordPolicy(password string) error {
+	err := services.CheckPasswordPolicy(password)
+	var policyErr *services.PasswordPolicyError
+	if errors.As(err, &policyErr) {
+		return fiber.NewError(fiber.StatusBadRequest, policyErr.Reason)
+	} else if err != nil {
+		log.Printf("Password policy: %v", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to check the breached password list")
+	}
+	return nil
+}
+
+// checkLoginThrottle refuses a sign-in step for an account that is locked or
+// has to wait after failed attempts
+func checkLoginThrottle(c *fiber.Ctx, user *models.User) error {
+	var throttled *services.LoginThrottledError
+	if err := services.CheckLoginThrottle(user); errors.As(err, &throttled) {
+		c.Set(fiber.HeaderRetryAfter, strconv.Itoa(throttled.RetryAfter()))
+		return fiber.NewError(fiber.StatusTooManyRequests, throttled.Error())
+	}
+	return nil
+}
+
+// recordFailedLogin audits a wrong password or second factor and counts it
+// towards the account's lockout
+func recordFailedLogin(c *fiber.Ctx, user *models.User, action models.AuditAction, details string) {
+	services.LogAudit(user.ID, user.Username, action, nil, "", details, c.IP())
 
-	// Generate temp token
-	tempToken, err := generateToken(&user, true)
+	lockedUntil, err := services.RecordFailedLogin(user)
+	if err != nil {
+		log.Printf("User %d: failed to count failed sign-in: %v", user.ID, err)
+		return
+	}
+	if lockedUntil != nil {
+		services.LogAudit(user.ID, user.Username, models.AuditActionUserLock, nil, "",
+			fmt.Sprintf("Locked until %s after %d failed sign-ins", lockedUntil.UTC().Format(time.RFC3339), user.FailedLogins), c.IP())
+	}
+}
+
+// verifyLoginSecondFactor is verifySecondFactor for the sign-in itself,
+// counting wrong answers towards the account's lockout
+func verifyLoginSecondFactor(c *fiber.Ctx, user *models.User, req *TOTPVerifyRequest) error {
+	return countSecondFactorFailure(c, user, verifySecondFactor(c, user, req))
+}
+
+// countSecondFactorFailure records a wrong second factor answer at sign-in,
+// whether verifying or enrolling, towards the account's lockout
+func countSecondFactorFailure(c *fiber.Ctx, user *models.User, err error) error {
+	var fe *fiber.Error
+	if errors.As(err, &fe) && fe.Code == fiber.StatusUnauthorized {
+		recordFailedLogin(c, user, models.AuditActionTOTPFailed, fe.Message)
+	}
+	return err
+}
+
+// beginSecondFactor answers a verified first factor with a temp token and
+// either the user's second factors or a new TOTP secret to enroll
+func beginSecondFactor(c *fiber.Ctx, user *models.User) error {
+	tempToken, err := generateTempToken(user)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to generate token",
 		})
 	}
 
-	if user.TOTPEnabled {
-		// User has TOTP set up — needs to verify code
+	keys := services.WebAuthnCredentialCount(user.ID)
+	if user.TOTPEnabled || keys > 0 {
+		// User has a second factor set up — needs to verify it
 		return c.JSON(LoginStepResponse{
-			RequiresTOTP: true,
-			TempToken:    tempToken,
+			RequiresTOTP:     user.TOTPEnabled,
+			RequiresWebAuthn: keys > 0,
+			PreferredFactor:  preferredFactor(user, keys),
+			TempToken:        tempToken,
 		})
 	}
 
-	// User doesn't have TOTP set up yet (admin-created user, first login)
-	// Generate a new TOTP secret for enrollment
+	// User doesn't have a second factor yet (admin-created user, first login)
+	// Generate a new TOTP secret for enrollment; a security key may be registered instead
 	totpKey, err := totp.Generate(totp.GenerateOpts{
 		Issuer:      "Farseer",
 		AccountName: user.Username,
@@ -186,8 +352,7 @@ func Login(c *fiber.Ctx) error {
 		})
 	}
 
-	cfg := config.GetConfig()
-	encryptedSecret, err := services.EncryptTOTPSecret(totpKey.Secret(), cfg.ServerSecret)
+	encryptedSecret, err := services.EncryptTOTPSecret(totpKey.Secret())
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to encrypt TOTP secret",
@@ -195,7 +360,7 @@ func Login(c *fiber.Ctx) error {
 	}
 
 	// Store the secret (but keep TOTPEnabled false until verified)
-	database.DB.Model(&user).Update("totp_secret", encryptedSecret)
+	database.DB.Model(user).Update("totp_secret", encryptedSecret)
 
 	return c.JSON(LoginStepResponse{
 		RequiresTOTPSetup: true,
@@ -216,7 +381,7 @@ func LoginTOTP(c *fiber.Ctx) error {
 		})
 	}
 
-	if req.Code == "" {
+	if req.Code == "" && req.RecoveryCode == "" {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "TOTP code is required",
 		})
@@ -229,44 +394,438 @@ func LoginTOTP(c *fiber.Ctx) error {
 		})
 	}
 
-	// Decrypt TOTP secret
-	cfg := config.GetConfig()
-	secret, err := services.DecryptTOTPSecret(user.TOTPSecret, cfg.ServerSecret)
+	if err := checkLoginThrottle(c, &user); err != nil {
+		return err
+	}
+
+	// Without a second factor this is TOTP enrollment: the code proves the
+	// authenticator app holds the secret handed out by Login
+	if !hasSecondFactor(&user) {
+		if req.Code == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Recovery codes cannot be used to complete TOTP enrollment",
+			})
+		}
+		if err := countSecondFactorFailure(c, &user, validateTOTPCode(&user, req.Code)); err != nil {
+			return err
+		}
+
+		database.DB.Model(&user).Update("totp_enabled", true)
+		user.TOTPEnabled = true
+		services.LogAudit(user.ID, user.Username, models.AuditActionTOTPSetup, nil, "", "TOTP enrolled", c.IP())
+		return completeLogin(c, &user, firstRecoveryCodes(&user), "")
+	}
+
+	if err := verifyLoginSecondFactor(c, &user, &req); err != nil {
+		return err
+	}
+	return completeLogin(c, &user, nil, "")
+}
+
+// completeLogin issues the full token once the second factor is verified.
+// recoveryCodes are shown to the user once, after their first enrollment.
+func completeLogin(c *fiber.Ctx, user *models.User, recoveryCodes []string, details string) error {
+	method := details
+	if method == "" {
+		method = "Password"
+	}
+	token, err := generateSessionToken(c, user, method)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to decrypt TOTP secret",
+			"error": "Failed to generate token",
+		})
+	}
+	if err := services.ClearFailedLogins(user); err != nil {
+		log.Printf("User %d: failed to reset failed sign-ins: %v", user.ID, err)
+	}
+
+	var encryptionKey string
+	if user.AuthProvider != "" {
+		if encryptionKey, err = services.SSOClientKey(user); err != nil {
+			log.Printf("User %d: failed to unlock SSO credential key: %v", user.ID, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to unlock credential key",
+			})
+		}
+	}
+
+	services.LogAudit(user.ID, user.Username, models.AuditActionLogin, nil, "", details, c.IP())
+
+	resp := userResponse(user)
+	return c.JSON(LoginStepResponse{
+		Token:         &token,
+		User:          &resp,
+		RecoveryCodes: recoveryCodes,
+		EncryptionKey: encryptionKey,
+	})
+}
+
+// firstRecoveryCodes hands out recovery codes when the first second factor is enrolled
+func firstRecoveryCodes(user *models.User) []string {
+	codes, err := services.GenerateRecoveryCodes(user.ID)
+	if err != nil {
+		log.Printf("User %d: failed to generate recovery codes: %v", user.ID, err)
+	}
+	return codes
+}
+
+// hasSecondFactor reports whether the user has enrolled TOTP or a security key
+func hasSecondFactor(user *models.User) bool {
+	return user.TOTPEnabled || services.WebAuthnCredentialCount(user.ID) > 0
+}
+
+// preferredFactor is the second factor offered first at login: the user's
+// choice while they still have it, otherwise TOTP
+func preferredFactor(user *models.User, keys int64) string {
+	switch {
+	case user.PreferredFactor == models.SecondFactorWebAuthn && keys > 0:
+		return models.SecondFactorWebAuthn
+	case user.TOTPEnabled:
+		return models.SecondFactorTOTP
+	case keys > 0:
+		return models.SecondFactorWebAuthn
+	}
+	return ""
+}
+
+// userResponse adds the user's second factor state to the safe response format
+func userResponse(user *models.User) models.UserResponse {
+	resp := user.ToResponse()
+	resp.RecoveryCodesLeft = services.RecoveryCodesLeft(user.ID)
+	resp.WebAuthnCredentials = services.WebAuthnCredentialCount(user.ID)
+	resp.PreferredFactor = preferredFactor(user, resp.WebAuthnCredentials)
+	resp.PasswordExpired = services.PasswordExpired(user)
+	return resp
+}
+
+// verifySecondFactor checks whichever of a TOTP code, a recovery code or a
+// security key assertion the request carries against the user's factors
+func verifySecondFactor(c *fiber.Ctx, user *models.User, req *TOTPVerifyRequest) error {
+	switch {
+	case len(req.Assertion) > 0:
+		if _, err := services.FinishWebAuthnLogin(user, c.Get("Origin"), services.WebAuthnVerify, req.Assertion); err != nil {
+			return webAuthnError(err)
+		}
+		return nil
+	case req.RecoveryCode != "":
+		remaining, err := services.UseRecoveryCode(user.ID, req.RecoveryCode)
+		if errors.Is(err, services.ErrInvalidRecoveryCode) {
+			return fiber.NewError(fiber.StatusUnauthorized, "Invalid recovery code")
+		} else if err != nil {
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to check recovery code")
+		}
+		services.LogAudit(user.ID, user.Username, models.AuditActionRecoveryCodeUse, nil, "", fmt.Sprintf("%d recovery codes left", remaining), c.IP())
+		return nil
+	case req.Code != "":
+		if !user.TOTPEnabled {
+			return fiber.NewError(fiber.StatusBadRequest, "TOTP is not enabled")
+		}
+		return validateTOTPCode(user, req.Code)
+	default:
+		return fiber.NewError(fiber.StatusBadRequest, "A TOTP code, recovery code or security key is required")
+	}
+}
+
+// reverifySecondFactor is verifySecondFactor for changes made from an active
+// session. A failed check answers 403, as 401 would end the session.
+func reverifySecondFactor(c *fiber.Ctx, user *models.User, req *TOTPVerifyRequest) error {
+	err := verifySecondFactor(c, user, req)
+	var fe *fiber.Error
+	if errors.As(err, &fe) && fe.Code == fiber.StatusUnauthorized {
+		return fiber.NewError(fiber.StatusForbidden, fe.Message)
+	}
+	return err
+}
+
+// validateTOTPCode checks a code against the user's TOTP secret
+func validateTOTPCode(user *models.User, code string) error {
+	secret, err := services.DecryptTOTPSecret(user.TOTPSecret)
+	if err != nil {
+		return fiber.NewError(fiber.StatusInternalServerError, "Failed to decrypt TOTP secret")
+	}
+	if !totp.Validate(code, secret) {
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid TOTP code")
+	}
+	return nil
+}
+
+// RegenerateRecoveryCodes replaces the current user's recovery codes. A
+// current second factor is required so a stolen session cannot mint new ones.
+func RegenerateRecoveryCodes(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	var req TOTPVerifyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
 		})
 	}
 
-	// Validate TOTP code
+	var user models.User
+	if result := database.DB.First(&user, userID); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if !hasSecondFactor(&user) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "No second factor enrolled",
+		})
+	}
+	if err := reverifySecondFactor(c, &user, &req); err != nil {
+		return err
+	}
+
+	codes, err := services.GenerateRecoveryCodes(user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate recovery codes",
+		})
+	}
+
+	services.LogAudit(user.ID, user.Username, models.AuditActionRecoveryCodesRegenerate, nil, "", "", c.IP())
+
+	return c.JSON(fiber.Map{
+		"recovery_codes": codes,
+	})
+}
+
+// StartTOTPReenrollment begins moving the current user's TOTP to a new
+// device, or adding TOTP for users who only have security keys. A current
+// second factor is required; the current secret stays in use until the new
+// one is confirmed.
+func StartTOTPReenrollment(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	var req TOTPVerifyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	var user models.User
+	if result := database.DB.First(&user, userID); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if !hasSecondFactor(&user) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "No second factor enrolled",
+		})
+	}
+	if err := reverifySecondFactor(c, &user, &req); err != nil {
+		return err
+	}
+
+	totpKey, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      "Farseer",
+		AccountName: user.Username,
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate TOTP secret",
+		})
+	}
+
+	encryptedSecret, err := services.EncryptTOTPSecret(totpKey.Secret())
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to encrypt TOTP secret",
+		})
+	}
+	if result := database.DB.Model(&user).Update("totp_pending_secret", encryptedSecret); result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to store TOTP secret",
+		})
+	}
+
+	return c.JSON(LoginStepResponse{
+		TOTPSecret: totpKey.Secret(),
+		TOTPQRURL:  totpKey.URL(),
+	})
+}
+
+// ConfirmTOTPReenrollment switches the current user to the new TOTP secret
+// once a code from the new device checks out
+func ConfirmTOTPReenrollment(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	var req TOTPVerifyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+	if req.Code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "TOTP code is required",
+		})
+	}
+
+	var user models.User
+	if result := database.DB.First(&user, userID); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if user.TOTPPendingSecret == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "No TOTP re-enrollment in progress",
+		})
+	}
+
+	secret, err := services.DecryptTOTPSecret(user.TOTPPendingSecret)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to decrypt TOTP secret",
+		})
+	}
 	if !totp.Validate(req.Code, secret) {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
 			"error": "Invalid TOTP code",
 		})
 	}
 
-	// If this is first-time enrollment, mark TOTP as enabled
+	details := "TOTP moved to a new device"
 	if !user.TOTPEnabled {
-		database.DB.Model(&user).Update("totp_enabled", true)
-		user.TOTPEnabled = true
-		services.LogAudit(user.ID, user.Username, models.AuditActionTOTPSetup, nil, "", "TOTP enrolled", c.IP())
+		details = "TOTP enrolled"
+	}
+	result := database.DB.Model(&user).Updates(map[string]interface{}{
+		"totp_secret":         user.TOTPPendingSecret,
+		"totp_pending_secret": "",
+		"totp_enabled":        true,
+	})
+	if result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update TOTP secret",
+		})
 	}
 
-	// Generate full JWT
-	token, err := generateToken(&user, false)
+	services.LogAudit(user.ID, user.Username, models.AuditActionTOTPSetup, nil, "", details, c.IP())
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ChangePassword sets a new password for the current user. The current
+// password and a second factor are required. The data key is re-wrapped
+// under the new password, so stored credentials stay readable, and the
+// user's other sessions are signed out.
+func ChangePassword(c *fiber.Ctx) error {
+	var req PasswordChangeRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	var user models.User
+	if result := database.DB.First(&user, middleware.GetUserID(c)); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if user.AuthProvider == models.AuthProviderLDAP {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Your password is managed in the directory",
+		})
+	}
+	if !services.HasLocalPassword(&user) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Your account has no Farseer password",
+		})
+	}
+
+	// Guesses count towards the lockout as they would at sign-in. Failures
+	// answer 403, as 401 would end the session.
+	if err := checkLoginThrottle(c, &user); err != nil {
+		return err
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.CurrentPassword)); err != nil {
+		recordFailedLogin(c, &user, models.AuditActionLoginFailed, "Wrong current password when changing password")
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "Current password is incorrect",
+		})
+	}
+
+	// Check the new password before the second factor, which may spend a
+	// single-use recovery code
+	if req.NewPassword == req.CurrentPassword {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The new password must differ from the current one",
+		})
+	}
+	if err := checkPasswordPolicy(req.NewPassword); err != nil {
+		return err
+	}
+	if err := reverifySecondFactor(c, &user, &req.TOTPVerifyRequest); err != nil {
+		var fe *fiber.Error
+		if errors.As(err, &fe) && fe.Code == fiber.StatusForbidden {
+			recordFailedLogin(c, &user, models.AuditActionTOTPFailed, fe.Message+" when changing password")
+		}
+		return err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to generate token",
+			"error": "Failed to hash password",
 		})
 	}
 
-	services.LogAudit(user.ID, user.Username, models.AuditActionLogin, nil, "", "", c.IP())
+	// SSO users' credential keys do not depend on their password
+	if user.AuthProvider == "" {
+		oldClientKey := services.DeriveClientKey(user.Username, req.CurrentPassword)
+		newClientKey := services.DeriveClientKey(user.Username, req.NewPassword)
+		if err := services.RewrapDataKey(&user, oldClientKey, newClientKey); err != nil {
+			log.Printf("User %d: failed to re-wrap credential key: %v", user.ID, err)
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to re-wrap credential key",
+			})
+		}
+	}
 
-	resp := user.ToResponse()
-	return c.JSON(LoginStepResponse{
-		Token: &token,
-		User:  &resp,
-	})
+	now := time.Now()
+	err = database.DB.Model(&models.User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+		"password_hash":       string(hashedPassword),
+		"password_changed_at": now,
+	}).Error
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update password",
+		})
+	}
+	user.PasswordHash = string(hashedPassword)
+	user.PasswordChangedAt = &now
+	if err := services.ClearFailedLogins(&user); err != nil {
+		log.Printf("User %d: failed to reset failed sign-ins: %v", user.ID, err)
+	}
+
+	sessionID := middleware.GetSessionID(c)
+	revoked, err := services.RevokeOtherSessions(user.ID, sessionID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+	services.LogAudit(user.ID, user.Username, models.AuditActionPasswordChange, nil, "",
+		fmt.Sprintf("Password changed, %d other sessions signed out", revoked), c.IP())
+
+	// The token this request came with may be marked as having an expired
+	// password, so hand out a fresh one for the same session
+	resp := fiber.Map{"sessions_revoked": revoked}
+	var session models.Session
+	if sessionID != "" && database.DB.Where("jti = ? AND user_id = ?", sessionID, user.ID).First(&session).Error == nil {
+		token, err := generateAccessToken(&user, &session)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to generate token",
+			})
+		}
+		resp["token"] = token
+	}
+	return c.JSON(resp)
 }
 
 // GetCurrentUser returns the currently authenticated user
@@ -280,7 +839,7 @@ func GetCurrentUser(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.JSON(user.ToResponse())
+	return c.JSON(userResponse(&user))
 }
 
 // ListUsers returns all users (admin only)
@@ -292,9 +851,15 @@ func ListUsers(c *fiber.Ctx) error {
 		})
 	}
 
+	recoveryCodes := services.RecoveryCodesLeftByUser()
+	keys := services.WebAuthnCredentialCountByUser()
 	responses := make([]models.UserResponse, len(users))
 	for i, u := range users {
 		responses[i] = u.ToResponse()
+		responses[i].RecoveryCodesLeft = recoveryCodes[u.ID]
+		responses[i].WebAuthnCredentials = keys[u.ID]
+		responses[i].PreferredFactor = preferredFactor(&u, keys[u.ID])
+		responses[i].PasswordExpired = services.PasswordExpired(&u)
 	}
 
 	return c.JSON(responses)
@@ -314,11 +879,23 @@ func CreateUser(c *fiber.Ctx) error {
 			"error": "Username must be at least 3 characters",
 		})
 	}
-	if len(input.Password) < 8 {
+	if !services.ValidUsername(input.Username) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Username may not contain '/'",
+		})
+	}
+	// Reverse proxy users have no password; the proxy vouches for them
+	proxyUser := input.AuthProvider == models.AuthProviderProxy
+	if input.AuthProvider != "" && !proxyUser {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Password must be at least 8 characters",
+			"error": "Only local and proxy accounts can be created",
 		})
 	}
+	if !proxyUser {
+		if err := checkPasswordPolicy(input.Password); err != nil {
+			return err
+		}
+	}
 	if input.Role != models.RoleAdmin && input.Role != models.RoleUser {
 		input.Role = models.RoleUser
 	}
@@ -330,18 +907,24 @@ func CreateUser(c *fiber.Ctx) error {
 		})
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to hash password",
-		})
-	}
-
 	user := models.User{
-		Username:     input.Username,
-		PasswordHash: string(hashedPassword),
-		Role:         input.Role,
-		TOTPEnabled:  false, // User will enroll on first login
+		Username:    input.Username,
+		Role:        input.Role,
+		TOTPEnabled: false, // User will enroll on first login
+	}
+	if proxyUser {
+		user.AuthProvider = models.AuthProviderProxy
+		user.ExternalID = input.Username
+	} else {
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to hash password",
+			})
+		}
+		now := time.Now()
+		user.PasswordHash = string(hashedPassword)
+		user.PasswordChangedAt = &now
 	}
 
 	if result := database.DB.Create(&user); result.Error != nil {
@@ -349,10 +932,17 @@ func CreateUser(c *fiber.Ctx) error {
 			"error": "Failed to create user",
 		})
 	}
+	if !proxyUser {
+		createDataKey(&user, input.Password)
+	}
 
 	currentUserID := middleware.GetUserID(c)
 	currentUsername := middleware.GetUsername(c)
-	services.LogAudit(currentUserID, currentUsername, models.AuditActionUserCreate, nil, "", "Created user: "+user.Username, c.IP())
+	details := "Created user: " + user.Username
+	if proxyUser {
+		details += " (signs in through the proxy)"
+	}
+	services.LogAudit(currentUserID, currentUsername, models.AuditActionUserCreate, nil, "", details, c.IP())
 
 	return c.Status(fiber.StatusCreated).JSON(user.ToResponse())
 }
@@ -380,12 +970,40 @@ func UpdateUser(c *fiber.Ctx) error {
 		})
 	}
 
+	// Directory users sign in with the name and password the directory knows
+	if user.AuthProvider == models.AuthProviderLDAP &&
+		(input.Password != "" || (input.Username != "" && input.Username != user.Username)) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "The username and password of directory users are managed in the directory",
+		})
+	}
+	// Proxy users are matched by the name the proxy sends
+	if user.AuthProvider == models.AuthProviderProxy && input.Username != "" && input.Username != user.Username {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Proxy users are named by the proxy and cannot be renamed",
+		})
+	}
+
+	// The client's encryption key is derived from both username and password,
+	// so a rename needs the password to re-derive it. SSO users' keys are
+	// independent of both.
+	if input.Username != "" && input.Username != user.Username && input.Password == "" && user.AuthProvider == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A new password is required when changing the username",
+		})
+	}
+
 	if input.Username != "" && input.Username != user.Username {
 		if len(input.Username) < 3 {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"error": "Username must be at least 3 characters",
 			})
 		}
+		if !services.ValidUsername(input.Username) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Username may not contain '/'",
+			})
+		}
 		var existing models.User
 		if result := database.DB.Where("username = ? AND id != ?", input.Username, userID).First(&existing); result.Error == nil {
 			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
@@ -396,10 +1014,8 @@ func UpdateUser(c *fiber.Ctx) error {
 	}
 
 	if input.Password != "" {
-		if len(input.Password) < 8 {
-			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "Password must be at least 8 characters",
-			})
+		if err := checkPasswordPolicy(input.Password); err != nil {
+			return err
 		}
 		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(input.Password), bcrypt.DefaultCost)
 		if err != nil {
@@ -407,11 +1023,54 @@ func UpdateUser(c *fiber.Ctx) error {
 				"error": "Failed to hash password",
 			})
 		}
+		now := time.Now()
 		user.PasswordHash = string(hashedPassword)
+		user.PasswordChangedAt = &now
 	}
 
-	if input.Role == models.RoleAdmin || input.Role == models.RoleUser {
+	// Tokens carry the role, so a role change has to sign the user out
+	revokeSessions := false
+	if (input.Role == models.RoleAdmin || input.Role == models.RoleUser) && input.Role != user.Role {
 		user.Role = input.Role
+		revokeSessions = true
+	}
+
+	currentUserID := middleware.GetUserID(c)
+	details := "Updated user: " + user.Username
+
+	// Re-wrap the data key under the new password. Only the user themselves
+	// holds the current key; an administrator reset has to start over.
+	if input.Password != "" && user.AuthProvider == "" {
+		newClientKey := services.DeriveClientKey(user.Username, input.Password)
+		if user.ID == currentUserID {
+			currentKey := c.Get("X-Encryption-Key")
+			if currentKey == "" {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Encryption key required to change your own password",
+				})
+			}
+			if err := services.RewrapDataKey(&user, currentKey, newClientKey); err != nil {
+				if errors.Is(err, services.ErrInvalidEncryptionKey) {
+					return encryptionKeyError(c, err)
+				}
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to re-wrap credential key",
+				})
+			}
+		} else {
+			cleared, err := services.ResetDataKey(&user, newClientKey)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to reset credential key",
+				})
+			}
+			details += fmt.Sprintf(" (password reset, %d stored secrets cleared)", cleared)
+			revokeSessions = true
+			if cleared > 0 {
+				services.Notify(user.ID, models.NotificationCredentialsReset, "Stored credentials cleared",
+					fmt.Sprintf("Your password was reset by an administrator. %d stored machine secrets could not be recovered and must be entered again.", cleared), nil)
+			}
+		}
 	}
 
 	if result := database.DB.Save(&user); result.Error != nil {
@@ -419,10 +1078,17 @@ func UpdateUser(c *fiber.Ctx) error {
 			"error": "Failed to update user",
 		})
 	}
+	if revokeSessions {
+		if err := services.RevokeUserSessions(&user); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to revoke sessions",
+			})
+		}
+		details += " (sessions revoked)"
+	}
 
-	currentUserID := middleware.GetUserID(c)
 	currentUsername := middleware.GetUsername(c)
-	services.LogAudit(currentUserID, currentUsername, models.AuditActionUserUpdate, nil, "", "Updated user: "+user.Username, c.IP())
+	services.LogAudit(currentUserID, currentUsername, models.AuditActionUserUpdate, nil, "", details, c.IP())
 
 	return c.JSON(user.ToResponse())
 }
@@ -450,10 +1116,8 @@ func DeleteUser(c *fiber.Ctx) error {
 		})
 	}
 
-	database.DB.Where("user_id = ?", userID).Delete(&models.Machine{})
-
 	deletedUsername := user.Username
-	if result := database.DB.Delete(&user); result.Error != nil {
+	if err := services.DeleteUser(&user); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to delete user",
 		})
@@ -465,27 +1129,183 @@ func DeleteUser(c *fiber.Ctx) error {
 	return c.SendStatus(fiber.StatusNoContent)
 }
 
-func generateToken(user *models.User, temp bool) (string, error) {
+// ResetUserTOTP clears a user's TOTP enrollment, security keys and recovery
+// codes and revokes their sessions, so they enroll again at next login (admin only)
+func ResetUserTOTP(c *fiber.Ctx) error {
+	currentUserID := middleware.GetUserID(c)
+	userID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	if uint(userID) == currentUserID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Cannot reset your own TOTP, move it to a new device from your account instead",
+		})
+	}
+
+	var user models.User
+	if result := database.DB.First(&user, userID); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		err := tx.Model(&user).Updates(map[string]interface{}{
+			"totp_secret":         "",
+			"totp_pending_secret": "",
+			"totp_enabled":        false,
+			"preferred_factor":    "",
+		}).Error
+		if err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.WebAuthnCredential{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("user_id = ?", user.ID).Delete(&models.RecoveryCode{}).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to reset TOTP",
+		})
+	}
+	if err := services.RevokeUserSessions(&user); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+
+	currentUsername := middleware.GetUsername(c)
+	services.LogAudit(currentUserID, currentUsername, models.AuditActionTOTPReset, nil, "", "Reset 2FA for user: "+user.Username+" (sessions revoked)", c.IP())
+
+	user.TOTPEnabled = false
+	return c.JSON(user.ToResponse())
+}
+
+// UnlockUser lifts a user's lockout and clears their failed sign-ins (admin only)
+func UnlockUser(c *fiber.Ctx) error {
+	userID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid user ID",
+		})
+	}
+
+	var user models.User
+	if result := database.DB.First(&user, userID); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	failures := user.FailedLogins
+	if err := services.ClearFailedLogins(&user); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to unlock user",
+		})
+	}
+
+	services.LogAudit(middleware.GetUserID(c), middleware.GetUsername(c), models.AuditActionUserUnlock, nil, "",
+		fmt.Sprintf("Unlocked user: %s (%d failed sign-ins cleared)", user.Username, failures), c.IP())
+	return c.JSON(userResponse(&user))
+}
+
+// createDataKey sets up the user's data key from a verified password and
+// moves any secrets still sealed with legacy keys under it. Failure is not
+// fatal: both steps are retried at the next login.
+func createDataKey(user *models.User, password string) {
+	clientKey := services.DeriveClientKey(user.Username, password)
+	if err := services.EnsureDataKey(user, clientKey); err != nil {
+		log.Printf("User %d: failed to set up data key: %v", user.ID, err)
+		return
+	}
+	migrated, err := services.MigrateLegacyCredentials(user, clientKey)
+	if err != nil {
+		log.Printf("User %d: failed to migrate legacy credentials: %v", user.ID, err)
+	} else if migrated > 0 {
+		log.Printf("User %d: re-sealed %d credentials encrypted with legacy keys", user.ID, migrated)
+	}
+}
+
+// generateTempToken issues the short-lived token that carries a sign-in
+// through its second factor
+func generateTempToken(user *models.User) (string, error) {
+	return signToken(tokenClaims(user, true))
+}
+
+// generateSessionToken starts a server-side session, sets its refresh
+// cookie and issues its first access token
+func generateSessionToken(c *fiber.Ctx, user *models.User, method string) (string, error) {
 	cfg := config.GetConfig()
+	expiresAt := time.Now().Add(time.Duration(cfg.SessionDurationHours) * time.Hour)
+	session, err := services.CreateSession(user.ID, method, c.IP(), c.Get(fiber.HeaderUserAgent), expiresAt)
+	if err != nil {
+		return "", err
+	}
+	refreshToken, err := services.IssueRefreshToken(session.ID)
+	if err != nil {
+		return "", err
+	}
+	setRefreshCookie(c, refreshToken, session.ExpiresAt)
+	return generateAccessToken(user, session)
+}
+
+// generateAccessToken issues a short-lived token for the session, which is
+// only valid while the session is and never outlives it
+func generateAccessToken(user *models.User, session *models.Session) (string, error) {
+	claims := tokenClaims(user, false)
+	if claims.ExpiresAt.After(session.ExpiresAt) {
+		claims.ExpiresAt = jwt.NewNumericDate(session.ExpiresAt)
+	}
+	claims.ID = session.JTI
+	return signToken(claims)
+}
+
+// generatePasswordStepToken issues the temp token for an SSO user who still
+// has to enter their local password
+func generatePasswordStepToken(user *models.User) (string, error) {
+	claims := tokenClaims(user, true)
+	claims.PasswordStep = true
+	claims.Audience = jwt.ClaimStrings{services.JWTAudiencePasswordStep}
+	return signToken(claims)
+}
 
-	var expiry time.Duration
+func tokenClaims(user *models.User, temp bool) *middleware.Claims {
+	cfg := config.GetConfig()
+
+	// Temp tokens only complete the second factor, so they get their own
+	// audience that nothing accepting access tokens will take
+	expiry, audience := time.Duration(cfg.AccessTokenMinutes)*time.Minute, services.JWTAudienceAccess
 	if temp {
-		expiry = 5 * time.Minute
-	} else {
-		expiry = time.Duration(cfg.SessionDurationHours) * time.Hour
+		expiry, audience = 5*time.Minute, services.JWTAudienceSecondFactor
 	}
 
-	claims := middleware.Claims{
-		UserID:   user.ID,
-		Username: user.Username,
-		Role:     string(user.Role),
-		TempAuth: temp,
+	return &middleware.Claims{
+		UserID:          user.ID,
+		Username:        user.Username,
+		Role:            string(user.Role),
+		TempAuth:        temp,
+		SessionVersion:  user.SessionVersion,
+		PasswordExpired: !temp && services.PasswordExpired(user),
 		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    cfg.JWTIssuer,
+			Audience:  jwt.ClaimStrings{audience},
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(expiry)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
+}
+
+func signToken(claims *middleware.Claims) (string, error) {
+	return services.SignJWT(claims)
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte(cfg.JWTSecret))
+// GetJWKS publishes the public keys that verify Farseer's tokens
+func GetJWKS(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderCacheControl, "public, max-age=300")
+	return c.JSON(fiber.Map{"keys": services.JWKS()})
 }
@@ -0,0 +1,302 @@
+package handlers
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"gorm.io/gorm"
+
+	"farseer/database"
+	"farseer/middleware"
+	"farseer/models"
+	"farseer/services"
+)
+
+// findCredential loads a shared credential owned by the user
+func findCredential(userID uint, credentialID uint) (*models.Credential, error) {
+	var credential models.Credential
+	if result := database.DB.Where("id = ? AND user_id = ?", credentialID, userID).First(&credential); result.Error != nil {
+		return nil, result.Error
+	}
+	return &credential, nil
+}
+
+// linkCredential points a machine at a shared credential, dropping any credential stored on the machine itself
+func linkCredential(machine *models.Machine, credential *models.Credential) {
+	machine.CredentialID = &credential.ID
+	machine.AuthType = credential.Type
+	machine.CredentialEncrypted = nil
+	machine.PublicKey = ""
+	machine.CredentialRotatedAt = credential.RotatedAt
+}
+
+// encryptCredentialInput packs a password or private key for storage
+func encryptCredentialInput(authType models.AuthType, secret, passphrase, encryptionKey string) ([]byte, error) {
+	credData := &services.CredentialData{}
+	if authType == models.AuthTypePassword {
+		credData.Password = secret
+	} else {
+		credData.PrivateKey = secret
+		credData.Passphrase = passphrase
+	}
+	return services.EncryptCredential(credData, encryptionKey)
+}
+
+// ListCredentials returns all shared credentials for the current user with their usage counts
+func ListCredentials(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	var credentials []models.Credential
+	if result := database.DB.Where("user_id = ?", userID).Order("name").Find(&credentials); result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch credentials",
+		})
+	}
+
+	var counts []struct {
+		CredentialID uint
+		Count        int64
+	}
+	database.DB.Model(&models.Machine{}).
+		Select("credential_id, count(*) as count").
+		Where("user_id = ? AND credential_id IS NOT NULL", userID).
+		Group("credential_id").
+		Scan(&counts)
+	usage := make(map[uint]int64, len(counts))
+	for _, row := range counts {
+		usage[row.CredentialID] = row.Count
+	}
+
+	responses := make([]models.CredentialResponse, len(credentials))
+	for i, cred := range credentials {
+		responses[i] = cred.ToResponse(usage[cred.ID])
+	}
+
+	return c.JSON(responses)
+}
+
+// GetCredentialMachines lists the machines that use a shared credential
+func GetCredentialMachines(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	credentialID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid credential ID",
+		})
+	}
+
+	if _, err := findCredential(userID, uint(credentialID)); err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Credential not found",
+		})
+	}
+
+	var machines []models.Machine
+	if result := database.DB.Where("user_id = ? AND credential_id = ?", userID, credentialID).Order("name").Find(&machines); result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch machines",
+		})
+	}
+
+	responses := make([]models.MachineResponse, len(machines))
+	for i, m := range machines {
+		responses[i] = m.ToResponse()
+	}
+
+	return c.JSON(responses)
+}
+
+// CreateCredential creates a new shared credential
+func CreateCredential(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	var input models.CredentialInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if input.Name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Name is required",
+		})
+	}
+
+	if input.Type != models.AuthTypePassword && input.Type != models.AuthTypeKey {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Type must be 'password' or 'key'",
+		})
+	}
+
+	if input.Secret == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Secret (password or private key) is required",
+		})
+	}
+
+	encryptionKey, err := getEncryptionKey(c)
+	if err != nil {
+		return encryptionKeyError(c, err)
+	}
+	encryptedSecret, err := encryptCredentialInput(input.Type, input.Secret, input.Passphrase, encryptionKey)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to encrypt credentials",
+		})
+	}
+
+	now := time.Now()
+	credential := models.Credential{
+		UserID:          userID,
+		Name:            input.Name,
+		Type:            input.Type,
+		SecretEncrypted: encryptedSecret,
+		RotatedAt:       &now,
+	}
+
+	if result := database.DB.Create(&credential); result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create credential",
+		})
+	}
+
+	username := middleware.GetUsername(c)
+	services.LogAudit(userID, username, models.AuditActionCredentialCreate, nil, "", "Created credential: "+credential.Name, c.IP())
+
+	return c.Status(fiber.StatusCreated).JSON(credential.ToResponse(0))
+}
+
+// UpdateCredential updates a shared credential; a new secret applies to every linked machine
+func UpdateCredential(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	credentialID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid credential ID",
+		})
+	}
+
+	credential, err := findCredential(userID, uint(credentialID))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Credential not found",
+		})
+	}
+
+	var input models.CredentialInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if input.Name != "" {
+		credential.Name = input.Name
+	}
+
+	// Changing the type only makes sense together with a new secret
+	if input.Type != "" && input.Type != credential.Type {
+		if input.Type != models.AuthTypePassword && input.Type != models.AuthTypeKey {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Type must be 'password' or 'key'",
+			})
+		}
+		if input.Secret == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "A new secret is required when changing the credential type",
+			})
+		}
+		credential.Type = input.Type
+	}
+
+	secretChanged := input.Secret != ""
+	if secretChanged {
+		encryptionKey, err := getEncryptionKey(c)
+		if err != nil {
+			return encryptionKeyError(c, err)
+		}
+		encryptedSecret, err := encryptCredentialInput(credential.Type, input.Secret, input.Passphrase, encryptionKey)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to encrypt credentials",
+			})
+		}
+		credential.SecretEncrypted = encryptedSecret
+		now := time.Now()
+		credential.RotatedAt = &now
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Save(credential).Error; err != nil {
+			return err
+		}
+		if !secretChanged {
+			return nil
+		}
+		// Keep the denormalised fields on linked machines in step
+		return tx.Model(&models.Machine{}).Where("user_id = ? AND credential_id = ?", userID, credential.ID).Updates(map[string]interface{}{
+			"auth_type":             credential.Type,
+			"public_key":            "",
+			"credential_rotated_at": credential.RotatedAt,
+		}).Error
+	})
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update credential",
+		})
+	}
+
+	var machineCount int64
+	database.DB.Model(&models.Machine{}).Where("user_id = ? AND credential_id = ?", userID, credential.ID).Count(&machineCount)
+
+	details := "Updated credential: " + credential.Name
+	if secretChanged {
+		details += " (secret replaced on " + strconv.FormatInt(machineCount, 10) + " machines)"
+	}
+	username := middleware.GetUsername(c)
+	services.LogAudit(userID, username, models.AuditActionCredentialUpdate, nil, "", details, c.IP())
+
+	return c.JSON(credential.ToResponse(machineCount))
+}
+
+// DeleteCredential deletes a shared credential that is no longer linked to any machine
+func DeleteCredential(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	credentialID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid credential ID",
+		})
+	}
+
+	credential, err := findCredential(userID, uint(credentialID))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Credential not found",
+		})
+	}
+
+	// Deleting a credential in use would leave its machines unable to connect
+	var machineCount int64
+	database.DB.Model(&models.Machine{}).Where("user_id = ? AND credential_id = ?", userID, credential.ID).Count(&machineCount)
+	if machineCount > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":         "Credential is still used by " + strconv.FormatInt(machineCount, 10) + " machine(s)",
+			"machine_count": machineCount,
+		})
+	}
+
+	deletedName := credential.Name
+	if result := database.DB.Delete(credential); result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to delete credential",
+		})
+	}
+
+	username := middleware.GetUsername(c)
+	services.LogAudit(userID, username, models.AuditActionCredentialDelete, nil, "", "Deleted credential: "+deletedName, c.IP())
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,145 @@
+package handlers
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"farseer/database"
+	"farseer/middleware"
+	"farseer/models"
+	"farseer/services"
+)
+
+type DeployKeyRequest struct {
+	KeyType  string `json:"key_type"` // "ed25519" (default) or "rsa"
+	Bits     int    `json:"bits,omitempty"`
+	Password string `json:"password"` // Temporary password, used once to install the key and then discarded
+}
+
+// DeployKey generates a key pair for a machine, installs the public key in the
+// remote authorized_keys using password authentication, verifies that the new
+// key works and switches the machine to key authentication
+func DeployKey(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	machineID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid machine ID",
+		})
+	}
+
+	var machine models.Machine
+	if result := database.DB.Where("id = ? AND user_id = ?", machineID, userID).First(&machine); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Machine not found",
+		})
+	}
+
+	var req DeployKeyRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if req.KeyType != "" && req.KeyType != services.KeyTypeEd25519 && req.KeyType != services.KeyTypeRSA {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Key type must be 'ed25519' or 'rsa'",
+		})
+	}
+
+	encryptionKey, err := getEncryptionKey(c)
+	if err != nil {
+		return encryptionKeyError(c, err)
+	}
+
+	// Fall back to the stored password for password-authenticated machines
+	password := req.Password
+	if password == "" && machine.AuthType == models.AuthTypePassword {
+		credData, err := services.MachineCredential(&machine, encryptionKey)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to decrypt credentials",
+			})
+		}
+		password = credData.Password
+	}
+	if password == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Password is required to install the key",
+		})
+	}
+
+	keyPair, err := services.GenerateKeyPair(req.KeyType, req.Bits, "farseer@"+machine.Name)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// Install the public key using the password
+	session, err := services.ConnectMachine(&machine, &services.CredentialData{Password: password})
+	if err != nil {
+		return machineConnectError(err)
+	}
+	err = session.InstallAuthorizedKey(keyPair.AuthorizedKey)
+	session.Close()
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	// Verify that the new key is accepted before switching over
+	keyCred := &services.CredentialData{PrivateKey: keyPair.PrivateKey}
+	session, err = services.ConnectMachine(&machine, keyCred)
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "Public key was installed but login with the new key failed: " + err.Error(),
+		})
+	}
+	session.Close()
+
+	encryptedCred, err := services.EncryptCredential(keyCred, encryptionKey)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to encrypt credentials",
+		})
+	}
+
+	// The generated key is specific to this machine, so any shared or external credential is unlinked
+	machine.AuthType = models.AuthTypeKey
+	machine.CredentialID = nil
+	machine.SecretPath = ""
+	machine.CredentialEncrypted = encryptedCred
+	machine.PublicKey = keyPair.AuthorizedKey
+	now := time.Now()
+	machine.CredentialRotatedAt = &now
+	if result := database.DB.Save(&machine); result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update machine",
+		})
+	}
+
+	username := middleware.GetUsername(c)
+	services.LogAudit(userID, username, models.AuditActionKeyDeploy, &machine.ID, machine.Name, "Deployed key "+keyPair.Fingerprint+" to "+machine.Username+"@"+machine.Hostname, c.IP())
+
+	return c.JSON(fiber.Map{
+		"machine":     machine.ToResponse(),
+		"public_key":  keyPair.AuthorizedKey,
+		"fingerprint": keyPair.Fingerprint,
+	})
+}
+
+// machineConnectError maps a failed non-interactive connection to an error,
+// passing host key errors through so the global error handler can report them
+func machineConnectError(err error) error {
+	var hostKeyErr *services.HostKeyError
+	if errors.As(err, &hostKeyErr) {
+		return hostKeyErr
+	}
+	return fiber.NewError(fiber.StatusInternalServerError, "Failed to connect: "+err.Error())
+}
@@ -1,10 +1,12 @@
 package handlers
 
 import (
+	"errors"
 	"net"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gofiber/fiber/v2"
 
@@ -42,6 +44,64 @@ func validatePort(port int) bool {
 	return port >= 1 && port <= 65535
 }
 
+// errEncryptionKeyRequired is returned when a request that touches stored credentials carries no key
+var errEncryptionKeyRequired = errors.New("encryption key required")
+
+// getEncryptionKey returns the user's data key, which seals their stored
+// credentials, unwrapped with the client key sent in X-Encryption-Key, or
+// without one, with the API token the request was made with
+func getEncryptionKey(c *fiber.Ctx) (string, error) {
+	clientKey := c.Get("X-Encryption-Key")
+	if clientKey == "" {
+		if record, token := middleware.GetAPIToken(c); record != nil {
+			return services.APITokenDataKey(record, token)
+		}
+		return "", errEncryptionKeyRequired
+	}
+	return services.UnlockDataKey(middleware.GetUserID(c), clientKey)
+}
+
+// encryptionKeyError responds to a failure to unlock the user's data key
+func encryptionKeyError(c *fiber.Ctx, err error) error {
+	if errors.Is(err, errEncryptionKeyRequired) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Encryption key required, please log in again",
+		})
+	}
+	if errors.Is(err, services.ErrAPITokenNoKey) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": err.Error() + ", create a new one",
+		})
+	}
+	if errors.Is(err, services.ErrInvalidEncryptionKey) {
+		// Typically a key derived from a password that has since changed
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid encryption key, please log in again",
+		})
+	}
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+		"error": "Failed to unlock credentials",
+	})
+}
+
+// secretPathError validates an external secret path and checks the current
+// user may read it, returning a message if it is unusable
+func secretPathError(c *fiber.Ctx, path string) string {
+	if !services.SecretStoreConfigured() {
+		return "No external secret store is configured"
+	}
+	user := &models.User{Username: middleware.GetUsername(c), Role: models.Role(middleware.GetRole(c))}
+	if err := services.CheckSecretPath(user, path); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+// validateRotationDays checks the scheduled password rotation interval (0 disables it)
+func validateRotationDays(days int) bool {
+	return days >= 0 && days <= 3650
+}
+
 // ListMachines returns all machines for the current user
 func ListMachines(c *fiber.Ctx) error {
 	userID := middleware.GetUserID(c)
@@ -114,58 +174,96 @@ func CreateMachine(c *fiber.Ctx) error {
 		})
 	}
 
+	// A linked shared credential determines the auth type
+	var linked *models.Credential
+	if input.CredentialID != nil {
+		credential, err := findCredential(userID, *input.CredentialID)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Credential not found",
+			})
+		}
+		linked = credential
+		input.AuthType = credential.Type
+	}
+
 	if input.AuthType != models.AuthTypePassword && input.AuthType != models.AuthTypeKey {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Auth type must be 'password' or 'key'",
 		})
 	}
 
-	if input.Credential == "" {
+	if input.SecretPath != "" {
+		if msg := secretPathError(c, input.SecretPath); msg != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": msg,
+			})
+		}
+	} else if input.Credential == "" && linked == nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Credential (password or private key) is required",
 		})
 	}
 
-	// Set default port
-	port := input.Port
-	if port == 0 {
-		port = 22
+	var hostKeyPolicy models.HostKeyPolicy
+	if input.HostKeyPolicy != nil {
+		hostKeyPolicy = *input.HostKeyPolicy
 	}
-
-	// Get user's password from token (we need to store encrypted password hash for this)
-	// For now, we'll use a session-based encryption key stored in memory
-	// In production, you might want to use a different approach
-	encryptionKey := c.Get("X-Encryption-Key")
-	if encryptionKey == "" {
-		// Fallback: use a derived key from the JWT (less secure but functional)
-		encryptionKey = middleware.GetUsername(c)
+	if hostKeyPolicy != "" && !hostKeyPolicy.IsValid() {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Host key policy must be 'strict', 'tofu' or 'accept-new'",
+		})
 	}
 
-	// Encrypt the credential
-	credData := &services.CredentialData{}
-	if input.AuthType == models.AuthTypePassword {
-		credData.Password = input.Credential
-	} else {
-		credData.PrivateKey = input.Credential
-		credData.Passphrase = input.Passphrase
+	var rotationDays int
+	if input.PasswordRotationDays != nil {
+		rotationDays = *input.PasswordRotationDays
 	}
-
-	encryptedCred, err := services.EncryptCredential(credData, encryptionKey)
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to encrypt credentials",
+	if !validateRotationDays(rotationDays) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Password rotation interval must be between 0 and 3650 days",
 		})
 	}
 
+	// Set default port
+	port := input.Port
+	if port == 0 {
+		port = 22
+	}
+
 	machine := models.Machine{
-		UserID:              userID,
-		GroupID:             input.GroupID,
-		Name:                input.Name,
-		Hostname:            input.Hostname,
-		Port:                port,
-		Username:            input.Username,
-		AuthType:            input.AuthType,
-		CredentialEncrypted: encryptedCred,
+		UserID:               userID,
+		GroupID:              input.GroupID,
+		Name:                 input.Name,
+		Hostname:             input.Hostname,
+		Port:                 port,
+		Username:             input.Username,
+		AuthType:             input.AuthType,
+		HostKey:              input.HostKey,
+		HostKeyPolicy:        hostKeyPolicy,
+		PasswordRotationDays: rotationDays,
+	}
+
+	switch {
+	case input.SecretPath != "":
+		machine.SecretPath = input.SecretPath
+	case linked != nil:
+		linkCredential(&machine, linked)
+	default:
+		encryptionKey, err := getEncryptionKey(c)
+		if err != nil {
+			return encryptionKeyError(c, err)
+		}
+		// Encrypt the credential
+		encryptedCred, err := encryptCredentialInput(input.AuthType, input.Credential, input.Passphrase, encryptionKey)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to encrypt credentials",
+			})
+		}
+		now := time.Now()
+		machine.CredentialEncrypted = encryptedCred
+		machine.CredentialRotatedAt = &now
 	}
 
 	if result := database.DB.Create(&machine); result.Error != nil {
@@ -181,6 +279,121 @@ func CreateMachine(c *fiber.Ctx) error {
 	return c.Status(fiber.StatusCreated).JSON(machine.ToResponse())
 }
 
+// TestMachineConnection attempts to connect and authenticate with the given
+// machine details without saving anything
+func TestMachineConnection(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	var input models.MachineInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if input.Hostname == "" || input.Username == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Hostname and username are required",
+		})
+	}
+
+	if !validateHostname(input.Hostname) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid hostname format. Must be a valid hostname or IP address",
+		})
+	}
+
+	if input.Port != 0 && !validatePort(input.Port) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Port must be between 1 and 65535",
+		})
+	}
+
+	// Test with an externally stored secret if a path is given
+	if input.SecretPath != "" && input.Credential == "" {
+		if msg := secretPathError(c, input.SecretPath); msg != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": msg,
+			})
+		}
+		provider, err := services.NewKVCredentialProvider()
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		credData, err := provider.Read(input.SecretPath)
+		if err != nil {
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+				"error": "Failed to fetch secret: " + err.Error(),
+			})
+		}
+		input.Credential = credData.Password
+		if input.AuthType == models.AuthTypeKey {
+			input.Credential = credData.PrivateKey
+			input.Passphrase = credData.Passphrase
+		}
+	}
+
+	// Test with a shared credential if one is selected
+	if input.CredentialID != nil && input.Credential == "" {
+		credential, err := findCredential(userID, *input.CredentialID)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Credential not found",
+			})
+		}
+		encryptionKey, err := getEncryptionKey(c)
+		if err != nil {
+			return encryptionKeyError(c, err)
+		}
+		credData, err := services.DecryptCredential(credential.SecretEncrypted, encryptionKey)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to decrypt credentials",
+			})
+		}
+		input.AuthType = credential.Type
+		input.Credential = credData.Password
+		if credential.Type == models.AuthTypeKey {
+			input.Credential = credData.PrivateKey
+			input.Passphrase = credData.Passphrase
+		}
+	}
+
+	if input.AuthType != models.AuthTypePassword && input.AuthType != models.AuthTypeKey {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Auth type must be 'password' or 'key'",
+		})
+	}
+
+	if input.Credential == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Credential (password or private key) is required",
+		})
+	}
+
+	port := input.Port
+	if port == 0 {
+		port = 22
+	}
+
+	sshConfig := &services.SSHConfig{
+		Hostname: input.Hostname,
+		Port:     port,
+		Username: input.Username,
+		HostKey:  input.HostKey,
+	}
+	if input.AuthType == models.AuthTypePassword {
+		sshConfig.Password = input.Credential
+	} else {
+		sshConfig.PrivateKey = input.Credential
+		sshConfig.Passphrase = input.Passphrase
+	}
+
+	return c.JSON(services.ProbeSSH(sshConfig))
+}
+
 // UpdateMachine updates an existing machine
 func UpdateMachine(c *fiber.Ctx) error {
 	userID := middleware.GetUserID(c)
@@ -233,29 +446,74 @@ func UpdateMachine(c *fiber.Ctx) error {
 	if input.AuthType != "" {
 		machine.AuthType = input.AuthType
 	}
-
-	// Update credential if provided
-	if input.Credential != "" {
-		encryptionKey := c.Get("X-Encryption-Key")
-		if encryptionKey == "" {
-			encryptionKey = middleware.GetUsername(c)
+	// Host key policy (empty means use the global policy)
+	if input.HostKeyPolicy != nil {
+		if *input.HostKeyPolicy != "" && !input.HostKeyPolicy.IsValid() {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Host key policy must be 'strict', 'tofu' or 'accept-new'",
+			})
 		}
-
-		credData := &services.CredentialData{}
-		if input.AuthType == models.AuthTypePassword {
-			credData.Password = input.Credential
-		} else {
-			credData.PrivateKey = input.Credential
-			credData.Passphrase = input.Passphrase
+		machine.HostKeyPolicy = *input.HostKeyPolicy
+	}
+	if input.PasswordRotationDays != nil {
+		if !validateRotationDays(*input.PasswordRotationDays) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Password rotation interval must be between 0 and 3650 days",
+			})
 		}
+		machine.PasswordRotationDays = *input.PasswordRotationDays
+	}
 
-		encryptedCred, err := services.EncryptCredential(credData, encryptionKey)
+	// Update credential: point at an external secret, link a shared credential,
+	// or store a new one on the machine
+	switch {
+	case input.SecretPath != "":
+		if msg := secretPathError(c, input.SecretPath); msg != "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": msg,
+			})
+		}
+		if machine.SecretPath != input.SecretPath {
+			machine.SecretPath = input.SecretPath
+			machine.CredentialID = nil
+			machine.CredentialEncrypted = nil
+			machine.PublicKey = ""
+			machine.CredentialRotatedAt = nil
+		}
+	case input.CredentialID != nil:
+		credential, err := findCredential(userID, *input.CredentialID)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Credential not found",
+			})
+		}
+		if machine.CredentialID == nil || *machine.CredentialID != credential.ID {
+			linkCredential(&machine, credential)
+		}
+		machine.SecretPath = ""
+		machine.AuthType = credential.Type
+	case input.Credential != "":
+		encryptionKey, err := getEncryptionKey(c)
+		if err != nil {
+			return encryptionKeyError(c, err)
+		}
+		encryptedCred, err := encryptCredentialInput(machine.AuthType, input.Credential, input.Passphrase, encryptionKey)
 		if err != nil {
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 				"error": "Failed to encrypt credentials",
 			})
 		}
+		machine.CredentialID = nil
+		machine.SecretPath = ""
 		machine.CredentialEncrypted = encryptedCred
+		machine.PublicKey = ""
+		now := time.Now()
+		machine.CredentialRotatedAt = &now
+	case machine.CredentialID != nil:
+		// Still linked, so the auth type keeps following the shared credential
+		if credential, err := findCredential(userID, *machine.CredentialID); err == nil {
+			machine.AuthType = credential.Type
+		}
 	}
 
 	if result := database.DB.Save(&machine); result.Error != nil {
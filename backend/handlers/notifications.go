@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"farseer/database"
+	"farseer/middleware"
+	"farseer/models"
+)
+
+// ListNotifications returns the current user's notifications, newest first
+func ListNotifications(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	query := database.DB.Where("user_id = ?", userID)
+	if c.Query("unread") == "true" {
+		query = query.Where("read_at IS NULL")
+	}
+
+	var notifications []models.Notification
+	if result := query.Order("created_at DESC").Limit(100).Find(&notifications); result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch notifications",
+		})
+	}
+
+	return c.JSON(notifications)
+}
+
+// MarkNotificationRead marks a single notification as read
+func MarkNotificationRead(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	notificationID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid notification ID",
+		})
+	}
+
+	var notification models.Notification
+	if result := database.DB.Where("id = ? AND user_id = ?", notificationID, userID).First(&notification); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Notification not found",
+		})
+	}
+
+	if notification.ReadAt == nil {
+		now := time.Now()
+		notification.ReadAt = &now
+		database.DB.Model(&notification).Update("read_at", now)
+	}
+
+	return c.JSON(notification)
+}
+
+// MarkAllNotificationsRead marks all of the current user's notifications as read
+func MarkAllNotificationsRead(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	if result := database.DB.Model(&models.Notification{}).Where("user_id = ? AND read_at IS NULL", userID).Update("read_at", time.Now()); result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update notifications",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"errors"
+	"farseer/config"
+	"farseer/database"
+	"farseer/middleware"
+	"farseer/models"
+	"farseer/services"
+	"log"
+	"net/url"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type SSOTicketRequest struct {
+	Ticket string `json:"ticket"`
+}
+
+type SSOPasswordRequest struct {
+	Password string `json:"password"`
+}
+
+// ssoRedirect sends the browser back to the login page. The result goes in
+// the fragment, which browsers never send to a server or proxy log.
+func ssoRedirect(c *fiber.Ctx, key, value string) error {
+	return c.Redirect("/login#"+key+"="+url.QueryEscape(value), fiber.StatusFound)
+}
+
+// ssoError reports a failed sign-in to the login page. Failures in talking to
+// the identity provider are logged and shown generically.
+func ssoError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, services.ErrOIDCNotConfigured), errors.Is(err, services.ErrSAMLNotConfigured), errors.Is(err, services.ErrOIDCInvalidState),
+		errors.Is(err, services.ErrOIDCNotAllowed), errors.Is(err, services.ErrOIDCUsernameTaken),
+		errors.Is(err, services.ErrInvalidUsername), errors.Is(err, services.ErrAccountDisabled):
+		return ssoRedirect(c, "sso_error", err.Error())
+	default:
+		log.Printf("Single sign-on failed: %v", err)
+		return ssoRedirect(c, "sso_error", services.ErrOIDCFailed.Error())
+	}
+}
+
+// OIDCLogin sends the browser to the identity provider
+func OIDCLogin(c *fiber.Ctx) error {
+	authURL, err := services.BeginOIDCLogin()
+	if err != nil {
+		return ssoError(c, err)
+	}
+	return c.Redirect(authURL, fiber.StatusFound)
+}
+
+// OIDCCallback completes the sign-in at the identity provider, provisioning
+// the user on their first visit, and hands the browser a one-time ticket
+func OIDCCallback(c *fiber.Ctx) error {
+	if idpError := c.Query("error"); idpError != "" {
+		log.Printf("Identity provider refused sign-in: %s: %s", idpError, c.Query("error_description"))
+		return ssoRedirect(c, "sso_error", "the identity provider refused the sign-in")
+	}
+
+	identity, err := services.FinishOIDCLogin(c.Query("state"), c.Query("code"))
+	if err != nil {
+		return ssoError(c, err)
+	}
+	result, err := services.ProvisionOIDCUser(identity)
+	if err != nil {
+		return ssoError(c, err)
+	}
+	return ssoTicket(c, result, "single sign-on")
+}
+
+// ssoTicket hands the browser a one-time ticket for a user an identity
+// provider has vouched for, auditing their provisioning or role change
+func ssoTicket(c *fiber.Ctx, result *services.AuthResult, source string) error {
+	user := result.User
+	if user.Disabled {
+		return ssoError(c, services.ErrAccountDisabled)
+	}
+	if result.Created {
+		services.LogAudit(user.ID, user.Username, models.AuditActionUserCreate, nil, "", "Provisioned from "+source+" as "+string(user.Role), c.IP())
+	} else if result.RoleChanged {
+		services.LogAudit(user.ID, user.Username, models.AuditActionUserUpdate, nil, "", "Role set to "+string(user.Role)+" from "+source+" groups", c.IP())
+	}
+
+	ticket, err := services.IssueLoginTicket(user.ID)
+	if err != nil {
+		return ssoError(c, err)
+	}
+	return ssoRedirect(c, "sso", ticket)
+}
+
+// OIDCExchange redeems the ticket from the OIDC callback or the SAML
+// assertion consumer service. Unless local authentication is also required,
+// it completes the login.
+func OIDCExchange(c *fiber.Ctx) error {
+	var req SSOTicketRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	userID, err := services.RedeemLoginTicket(req.Ticket)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	var user models.User
+	if result := database.DB.First(&user, userID); result.Error != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	if config.GetConfig().OIDCRequireLocalAuth {
+		tempToken, err := generatePasswordStepToken(&user)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to generate token",
+			})
+		}
+		return c.JSON(LoginStepResponse{
+			RequiresPassword: true,
+			PasswordSetup:    user.PasswordHash == "",
+			TempToken:        tempToken,
+		})
+	}
+	return completeLogin(c, &user, nil, "Single sign-on")
+}
+
+// OIDCPassword checks the local password of an SSO user, or sets it on their
+// first sign-in, then continues with the second factor
+func OIDCPassword(c *fiber.Ctx) error {
+	var req SSOPasswordRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	var user models.User
+	if result := database.DB.First(&user, middleware.GetUserID(c)); result.Error != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	if err := checkLoginThrottle(c, &user); err != nil {
+		return err
+	}
+
+	if user.PasswordHash == "" {
+		if err := checkPasswordPolicy(req.Password); err != nil {
+			return err
+		}
+		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to hash password",
+			})
+		}
+		// Conditional, so a concurrent first sign-in cannot replace it
+		result := database.DB.Model(&user).Where("password_hash = ''").Updates(map[string]interface{}{
+			"password_hash":       string(hashedPassword),
+			"password_changed_at": time.Now(),
+		})
+		if result.Error != nil || result.RowsAffected == 0 {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "Failed to set password, sign in again",
+			})
+		}
+		services.LogAudit(user.ID, user.Username, models.AuditActionUserUpdate, nil, "", "Local password set after single sign-on", c.IP())
+	} else if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(req.Password)); err != nil {
+		recordFailedLogin(c, &user, models.AuditActionLoginFailed, "Wrong password after single sign-on")
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Invalid credentials",
+		})
+	}
+
+	return beginSecondFactor(c, &user)
+}
@@ -0,0 +1,33 @@
+package handlers
+
+import (
+	"farseer/database"
+	"farseer/middleware"
+	"farseer/models"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ProxyLogin signs in the user the trusted proxy has authenticated, so the
+// browser gets a token and, like SSO users, its server-held credential key.
+// The proxy has done the authentication, including any second factor.
+func ProxyLogin(c *fiber.Ctx) error {
+	claims, err := middleware.ProxyClaims(c)
+	if err != nil {
+		e := err.(*fiber.Error)
+		return c.Status(e.Code).JSON(fiber.Map{"error": e.Message})
+	}
+	if claims == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "No user header from the proxy",
+		})
+	}
+
+	var user models.User
+	if result := database.DB.First(&user, claims.UserID); result.Error != nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	return completeLogin(c, &user, nil, "Reverse proxy")
+}
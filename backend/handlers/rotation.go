@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"strconv"
+
+	"github.com/gofiber/fiber/v2"
+
+	"farseer/database"
+	"farseer/middleware"
+	"farseer/models"
+	"farseer/services"
+)
+
+// selectRotationMachines returns the current user's machines selected by ID or group
+func selectRotationMachines(userID uint, input *models.RotationInput) ([]models.Machine, error) {
+	query := database.DB.Where("user_id = ?", userID)
+	switch {
+	case len(input.MachineIDs) > 0 && len(input.GroupIDs) > 0:
+		query = query.Where("id IN ? OR group_id IN ?", input.MachineIDs, input.GroupIDs)
+	case len(input.MachineIDs) > 0:
+		query = query.Where("id IN ?", input.MachineIDs)
+	default:
+		query = query.Where("group_id IN ?", input.GroupIDs)
+	}
+
+	var machines []models.Machine
+	err := query.Order("name").Find(&machines).Error
+	return machines, err
+}
+
+// StartKeyRotation starts a background job that rotates the keys of the selected machines
+func StartKeyRotation(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	var input models.RotationInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if len(input.MachineIDs) == 0 && len(input.GroupIDs) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Select at least one machine or group",
+		})
+	}
+
+	if input.KeyType != "" && input.KeyType != services.KeyTypeEd25519 && input.KeyType != services.KeyTypeRSA {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Key type must be 'ed25519' or 'rsa'",
+		})
+	}
+
+	machines, err := selectRotationMachines(userID, &input)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch machines",
+		})
+	}
+	if len(machines) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "No matching machines",
+		})
+	}
+
+	return startRotationJob(c, models.RotationKindKey, machines, services.RotationOptions{
+		KeyType: input.KeyType,
+		Bits:    input.Bits,
+	})
+}
+
+// StartPasswordRotation starts a background job that rotates the passwords of the selected machines
+func StartPasswordRotation(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	var input models.RotationInput
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	if len(input.MachineIDs) == 0 && len(input.GroupIDs) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Select at least one machine or group",
+		})
+	}
+
+	machines, err := selectRotationMachines(userID, &input)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch machines",
+		})
+	}
+	if len(machines) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "No matching machines",
+		})
+	}
+
+	return startRotationJob(c, models.RotationKindPassword, machines, services.RotationOptions{})
+}
+
+// StartDuePasswordRotation rotates the passwords of the current user's
+// machines whose scheduled rotation is overdue. The server rotates them on
+// its own only for users whose client key it holds, so the web client calls
+// this right after login, when a local user's encryption key is available.
+func StartDuePasswordRotation(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	machines, err := services.DuePasswordRotations(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch machines",
+		})
+	}
+	if len(machines) == 0 {
+		return c.SendStatus(fiber.StatusNoContent)
+	}
+
+	return startRotationJob(c, models.RotationKindPassword, machines, services.RotationOptions{})
+}
+
+// startRotationJob records a new job and runs it in the background
+func startRotationJob(c *fiber.Ctx, kind models.RotationKind, machines []models.Machine, opts services.RotationOptions) error {
+	encryptionKey, err := getEncryptionKey(c)
+	if err != nil {
+		return encryptionKeyError(c, err)
+	}
+
+	job := models.RotationJob{
+		UserID: middleware.GetUserID(c),
+		Kind:   kind,
+		Status: models.RotationStatusRunning,
+		Total:  len(machines),
+	}
+	if result := database.DB.Create(&job); result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to create rotation job",
+		})
+	}
+
+	username := middleware.GetUsername(c)
+	runningJob := job
+	go services.RunRotationJob(&runningJob, machines, encryptionKey, username, c.IP(), opts)
+
+	return c.Status(fiber.StatusAccepted).JSON(job)
+}
+
+// ListRotationJobs returns the current user's rotation jobs, newest first
+func ListRotationJobs(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+
+	var jobs []models.RotationJob
+	if result := database.DB.Where("user_id = ?", userID).Order("created_at DESC").Limit(50).Find(&jobs); result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch rotation jobs",
+		})
+	}
+
+	return c.JSON(jobs)
+}
+
+// GetRotationJob returns a rotation job with its per-machine results
+func GetRotationJob(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	jobID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid job ID",
+		})
+	}
+
+	var job models.RotationJob
+	if result := database.DB.Preload("Results").Where("id = ? AND user_id = ?", jobID, userID).First(&job); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Rotation job not found",
+		})
+	}
+
+	return c.JSON(job)
+}
@@ -0,0 +1,110 @@
+package handlers
+
+import (
+	"errors"
+	"farseer/middleware"
+	"farseer/models"
+	"farseer/services"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type SAMLMetadataImportRequest struct {
+	Metadata string `json:"metadata,omitempty"` // Identity provider metadata XML
+	URL      string `json:"url,omitempty"`      // Or where to fetch it from
+}
+
+// SAMLMetadata serves the service provider metadata to register with the
+// identity provider
+func SAMLMetadata(c *fiber.Ctx) error {
+	metadata, err := services.SAMLMetadata()
+	if errors.Is(err, services.ErrSAMLNotConfigured) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to build SAML metadata",
+		})
+	}
+	c.Set(fiber.HeaderContentType, "application/samlmetadata+xml")
+	return c.Send(metadata)
+}
+
+// SAMLLogin sends the browser to the identity provider with an
+// authentication request
+func SAMLLogin(c *fiber.Ctx) error {
+	authURL, err := services.BeginSAMLLogin()
+	if err != nil {
+		return ssoError(c, err)
+	}
+	return c.Redirect(authURL, fiber.StatusFound)
+}
+
+// SAMLACS is the assertion consumer service. It verifies the response the
+// identity provider has the browser post, provisioning the user on their
+// first visit, and hands the browser a one-time ticket.
+func SAMLACS(c *fiber.Ctx) error {
+	identity, err := services.FinishSAMLLogin(c.FormValue("RelayState"), c.FormValue("SAMLResponse"))
+	if err != nil {
+		return ssoError(c, err)
+	}
+	result, err := services.ProvisionSAMLUser(identity)
+	if err != nil {
+		return ssoError(c, err)
+	}
+	return ssoTicket(c, result, "SAML single sign-on")
+}
+
+// GetSAMLSettings reports the service provider's endpoints and the identity
+// provider it trusts (admin only)
+func GetSAMLSettings(c *fiber.Ctx) error {
+	status, err := services.GetSAMLStatus()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get SAML settings: " + err.Error(),
+		})
+	}
+	return c.JSON(status)
+}
+
+// ImportSAMLMetadata replaces the trusted identity provider with the one
+// described by the given metadata, or the metadata at a URL (admin only)
+func ImportSAMLMetadata(c *fiber.Ctx) error {
+	var req SAMLMetadataImportRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	metadata := []byte(req.Metadata)
+	if req.URL != "" {
+		fetched, err := services.FetchSAMLMetadata(req.URL)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		metadata = fetched
+	}
+	if len(metadata) == 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Metadata or a metadata URL is required",
+		})
+	}
+
+	entityID, err := services.ImportSAMLMetadata(metadata)
+	if errors.Is(err, services.ErrSAMLInvalidMetadata) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to import metadata: " + err.Error(),
+		})
+	}
+	services.LogAudit(middleware.GetUserID(c), middleware.GetUsername(c), models.AuditActionSAMLMetadataImport, nil, "", "Trusting SAML identity provider "+entityID, c.IP())
+
+	return GetSAMLSettings(c)
+}
@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"errors"
+	"farseer/config"
+	"farseer/database"
+	"farseer/middleware"
+	"farseer/models"
+	"farseer/services"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// refreshCookie holds the session's refresh token. It is only sent to the
+// refresh endpoint and never readable by scripts.
+const refreshCookie = "farseer_refresh"
+
+func setRefreshCookie(c *fiber.Ctx, token string, expires time.Time) {
+	c.Cookie(&fiber.Cookie{
+		Name:     refreshCookie,
+		Value:    token,
+		Path:     "/api/auth",
+		Expires:  expires,
+		Secure:   secureRequest(c),
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteStrictMode,
+	})
+}
+
+// secureRequest reports whether cookies should be marked Secure: always in
+// production, and otherwise when the request came over HTTPS, directly or
+// through a trusted proxy. X-Forwarded-Proto from anyone else is ignored, as
+// a client could send it to get a cookie that then travels in the clear.
+func secureRequest(c *fiber.Ctx) bool {
+	if config.GetConfig().Production || c.Context().IsTLS() {
+		return true
+	}
+	return services.TrustedProxy(c.Context().RemoteIP()) && strings.EqualFold(c.Get(fiber.HeaderXForwardedProto), "https")
+}
+
+func clearRefreshCookie(c *fiber.Ctx) {
+	setRefreshCookie(c, "", time.Unix(0, 0))
+}
+
+// RefreshToken issues a new access token for the session in the refresh
+// cookie and rotates the cookie. Sessions still end SessionDurationHours
+// after sign-in.
+func RefreshToken(c *fiber.Ctx) error {
+	token := c.Cookies(refreshCookie)
+	if token == "" {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Not signed in",
+		})
+	}
+
+	session, next, err := services.RefreshSession(token)
+	if errors.Is(err, services.ErrRefreshTokenReused) {
+		clearRefreshCookie(c)
+		var user models.User
+		database.DB.Select("username").First(&user, session.UserID)
+		services.LogAudit(session.UserID, user.Username, models.AuditActionSessionRevoke, nil, "",
+			fmt.Sprintf("Session %d revoked: a used refresh token was presented again", session.ID), c.IP())
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Session has been revoked",
+		})
+	} else if errors.Is(err, services.ErrSessionRevoked) {
+		clearRefreshCookie(c)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Session has ended",
+		})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to refresh session",
+		})
+	}
+
+	var user models.User
+	if result := database.DB.First(&user, session.UserID); result.Error != nil || user.Disabled {
+		clearRefreshCookie(c)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "Account is disabled",
+		})
+	}
+
+	accessToken, err := generateAccessToken(&user, session)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to generate token",
+		})
+	}
+	// Within the reuse grace period the browser already has the next token
+	if next != "" {
+		setRefreshCookie(c, next, session.ExpiresAt)
+	}
+	return c.JSON(fiber.Map{"token": accessToken})
+}
+
+// Logout ends the session the request was made with
+func Logout(c *fiber.Ctx) error {
+	clearRefreshCookie(c)
+	sessionID := middleware.GetSessionID(c)
+	if sessionID == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "This sign-in has no session to end",
+		})
+	}
+	if err := services.RevokeSessionByJTI(sessionID); err != nil && !errors.Is(err, services.ErrSessionNotFound) {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to end session",
+		})
+	}
+
+	services.LogAudit(middleware.GetUserID(c), middleware.GetUsername(c), models.AuditActionLogout, nil, "", "", c.IP())
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ListSessions returns the current user's active sessions
+func ListSessions(c *fiber.Ctx) error {
+	return sendSessions(c, middleware.GetUserID(c))
+}
+
+// RevokeSession ends one of the current user's sessions
+func RevokeSession(c *fiber.Ctx) error {
+	return revokeSession(c, middleware.GetUserID(c), c.Params("id"))
+}
+
+// RevokeOtherSessions ends every session of the current user but this one
+func RevokeOtherSessions(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	revoked, err := services.RevokeOtherSessions(userID, middleware.GetSessionID(c))
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+
+	if revoked > 0 {
+		services.LogAudit(userID, middleware.GetUsername(c), models.AuditActionSessionRevoke, nil, "",
+			fmt.Sprintf("Signed out %d other sessions", revoked), c.IP())
+	}
+	return c.JSON(fiber.Map{"revoked": revoked})
+}
+
+// ListUserSessions returns a user's active sessions (admin only)
+func ListUserSessions(c *fiber.Ctx) error {
+	user, err := sessionUser(c)
+	if err != nil {
+		return err
+	}
+	return sendSessions(c, user.ID)
+}
+
+// RevokeUserSession ends one of a user's sessions (admin only)
+func RevokeUserSession(c *fiber.Ctx) error {
+	user, err := sessionUser(c)
+	if err != nil {
+		return err
+	}
+	return revokeSession(c, user.ID, c.Params("sid"))
+}
+
+// RevokeAllUserSessions signs a user out everywhere, closing their open
+// terminals (admin only)
+func RevokeAllUserSessions(c *fiber.Ctx) error {
+	user, err := sessionUser(c)
+	if err != nil {
+		return err
+	}
+	if err := services.RevokeUserSessions(user); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke sessions",
+		})
+	}
+
+	services.LogAudit(middleware.GetUserID(c), middleware.GetUsername(c), models.AuditActionSessionRevoke, nil, "",
+		"Signed out "+user.Username+" everywhere", c.IP())
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// sessionUser loads the user named by the :id route parameter
+func sessionUser(c *fiber.Ctx) (*models.User, error) {
+	userID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Invalid user ID")
+	}
+
+	var user models.User
+	if result := database.DB.First(&user, userID); result.Error != nil {
+		return nil, fiber.NewError(fiber.StatusNotFound, "User not found")
+	}
+	return &user, nil
+}
+
+func sendSessions(c *fiber.Ctx, userID uint) error {
+	sessions, err := services.ListSessions(userID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch sessions",
+		})
+	}
+
+	current := middleware.GetSessionID(c)
+	responses := make([]models.SessionResponse, len(sessions))
+	for i := range sessions {
+		responses[i] = models.SessionResponse{Session: sessions[i], Current: current != "" && sessions[i].JTI == current}
+	}
+	return c.JSON(responses)
+}
+
+func revokeSession(c *fiber.Ctx, userID uint, id string) error {
+	sessionID, err := strconv.ParseUint(id, 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid session ID",
+		})
+	}
+
+	session, err := services.RevokeSession(userID, uint(sessionID))
+	if errors.Is(err, services.ErrSessionNotFound) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Session not found",
+		})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to revoke session",
+		})
+	}
+
+	details := fmt.Sprintf("Session %d (%s from %s) revoked", session.ID, session.Method, session.IPAddress)
+	if userID != middleware.GetUserID(c) {
+		var user models.User
+		database.DB.Select("username").First(&user, userID)
+		details = user.Username + ": " + details
+	}
+	services.LogAudit(middleware.GetUserID(c), middleware.GetUsername(c), models.AuditActionSessionRevoke, nil, "", details, c.IP())
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -1,21 +1,52 @@
 package handlers
 
 import (
+	"errors"
+	"fmt"
+
 	"farseer/config"
+	"farseer/middleware"
+	"farseer/models"
+	"farseer/services"
 
 	"github.com/gofiber/fiber/v2"
 )
 
 type AppSettings struct {
-	SessionDurationHours int `json:"session_duration_hours"`
+	SessionDurationHours       int                  `json:"session_duration_hours"`
+	HostKeyPolicy              models.HostKeyPolicy `json:"host_key_policy"`
+	HostKeyScanEnabled         *bool                `json:"host_key_scan_enabled"`
+	HostKeyScanIntervalMinutes int                  `json:"host_key_scan_interval_minutes"`
+	LockoutThreshold           int                  `json:"lockout_threshold"`
+	LockoutMinutes             int                  `json:"lockout_minutes"`
+	PasswordMinLength          int                  `json:"password_min_length"`
+	PasswordMinClasses         *int                 `json:"password_min_classes"`
+	PasswordMaxAgeDays         *int                 `json:"password_max_age_days"`
+	// Entries on the breached password list, which is set in the config file
+	BreachedPasswords int `json:"breached_passwords"`
+}
+
+func currentSettings(cfg *config.Config) AppSettings {
+	scanEnabled := !cfg.HostKeyScanDisabled
+	minClasses, maxAgeDays := cfg.PasswordMinClasses, cfg.PasswordMaxAgeDays
+	return AppSettings{
+		SessionDurationHours:       cfg.SessionDurationHours,
+		HostKeyPolicy:              models.HostKeyPolicy(cfg.HostKeyPolicy),
+		HostKeyScanEnabled:         &scanEnabled,
+		HostKeyScanIntervalMinutes: cfg.HostKeyScanIntervalMinutes,
+		LockoutThreshold:           cfg.LockoutThreshold,
+		LockoutMinutes:             cfg.LockoutMinutes,
+		PasswordMinLength:          cfg.PasswordMinLength,
+		PasswordMinClasses:         &minClasses,
+		PasswordMaxAgeDays:         &maxAgeDays,
+		BreachedPasswords:          services.BreachedPasswordCount(),
+	}
 }
 
 // GetSettings returns non-sensitive application settings (admin only)
 func GetSettings(c *fiber.Ctx) error {
 	cfg := config.GetConfig()
-	return c.JSON(AppSettings{
-		SessionDurationHours: cfg.SessionDurationHours,
-	})
+	return c.JSON(currentSettings(cfg))
 }
 
 // UpdateSettings updates application settings (admin only)
@@ -33,8 +64,75 @@ func UpdateSettings(c *fiber.Ctx) error {
 		})
 	}
 
+	if input.HostKeyPolicy != "" && !input.HostKeyPolicy.IsValid() {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Host key policy must be 'strict', 'tofu' or 'accept-new'",
+		})
+	}
+
+	if input.HostKeyScanIntervalMinutes != 0 && (input.HostKeyScanIntervalMinutes < 5 || input.HostKeyScanIntervalMinutes > 10080) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Host key scan interval must be between 5 minutes and 7 days",
+		})
+	}
+
+	if input.LockoutThreshold != 0 && (input.LockoutThreshold < 3 || input.LockoutThreshold > 100) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Lockout threshold must be between 3 and 100 failed sign-ins",
+		})
+	}
+
+	if input.LockoutMinutes != 0 && (input.LockoutMinutes < 1 || input.LockoutMinutes > 1440) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Lockout duration must be between 1 minute and 24 hours",
+		})
+	}
+
+	if input.PasswordMinLength != 0 && (input.PasswordMinLength < 8 || input.PasswordMinLength > 128) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Minimum password length must be between 8 and 128 characters",
+		})
+	}
+
+	if input.PasswordMinClasses != nil && (*input.PasswordMinClasses < 0 || *input.PasswordMinClasses > 4) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Required character classes must be between 0 and 4",
+		})
+	}
+
+	if input.PasswordMaxAgeDays != nil && (*input.PasswordMaxAgeDays < 0 || *input.PasswordMaxAgeDays > 3650) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Maximum password age must be between 0 (never) and 3650 days",
+		})
+	}
+
 	cfg := config.GetConfig()
 	cfg.SessionDurationHours = input.SessionDurationHours
+	if input.HostKeyPolicy != "" {
+		cfg.HostKeyPolicy = string(input.HostKeyPolicy)
+	}
+	if input.HostKeyScanEnabled != nil {
+		cfg.HostKeyScanDisabled = !*input.HostKeyScanEnabled
+	}
+	if input.HostKeyScanIntervalMinutes != 0 {
+		cfg.HostKeyScanIntervalMinutes = input.HostKeyScanIntervalMinutes
+	}
+	if input.LockoutThreshold != 0 {
+		cfg.LockoutThreshold = input.LockoutThreshold
+	}
+	if input.LockoutMinutes != 0 {
+		cfg.LockoutMinutes = input.LockoutMinutes
+	}
+	if input.PasswordMinLength != 0 {
+		cfg.PasswordMinLength = input.PasswordMinLength
+	}
+	// Zero is a valid choice for both, so only an omitted field keeps the setting
+	if input.PasswordMinClasses != nil {
+		cfg.PasswordMinClasses = *input.PasswordMinClasses
+	}
+	if input.PasswordMaxAgeDays != nil {
+		cfg.PasswordMaxAgeDays = *input.PasswordMaxAgeDays
+	}
 
 	if err := cfg.Save(); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -42,7 +140,70 @@ func UpdateSettings(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.JSON(AppSettings{
-		SessionDurationHours: cfg.SessionDurationHours,
-	})
+	return c.JSON(currentSettings(cfg))
+}
+
+// GetServerSecretStatus reports server secret versions and re-encryption progress (admin only)
+func GetServerSecretStatus(c *fiber.Ctx) error {
+	status, err := services.GetServerSecretStatus()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to get server secret status",
+		})
+	}
+	return c.JSON(status)
+}
+
+// RotateServerSecret replaces the server secret (admin only). TOTP secrets are
+// re-encrypted right away; stored credentials as each user next sends their key.
+func RotateServerSecret(c *fiber.Ctx) error {
+	result, err := services.RotateServerSecret()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to rotate server secret: " + err.Error(),
+		})
+	}
+
+	details := fmt.Sprintf("Rotated server secret to version %d, re-encrypted %d TOTP secrets", result.Version, result.TOTPReencrypted)
+	if result.TOTPFailed > 0 {
+		details += fmt.Sprintf(" (%d failed)", result.TOTPFailed)
+	}
+	services.LogAudit(middleware.GetUserID(c), middleware.GetUsername(c), models.AuditActionServerSecretRotate, nil, "", details, c.IP())
+
+	return c.JSON(result)
+}
+
+// GetJWTKeyStatus lists the JWT signing keys (admin only)
+func GetJWTKeyStatus(c *fiber.Ctx) error {
+	return c.JSON(services.GetJWTKeyStatus())
+}
+
+// RotateJWTKey switches to a new JWT signing key now rather than when the
+// current one is due (admin only). Tokens signed by the old key stay valid.
+func RotateJWTKey(c *fiber.Ctx) error {
+	key, err := services.RotateJWTKey()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to rotate JWT signing key: " + err.Error(),
+		})
+	}
+
+	services.LogAudit(middleware.GetUserID(c), middleware.GetUsername(c), models.AuditActionJWTKeyRotate, nil, "",
+		fmt.Sprintf("Now signing tokens with %s key %s", key.Algorithm, key.KID), c.IP())
+	return c.JSON(services.GetJWTKeyStatus())
+}
+
+// SyncLDAP runs the directory sync now rather than at the next interval (admin only)
+func SyncLDAP(c *fiber.Ctx) error {
+	result, err := services.SyncLDAPUsers()
+	if errors.Is(err, services.ErrLDAPNotConfigured) || errors.Is(err, services.ErrLDAPSyncUnavailable) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	} else if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Directory sync failed: " + err.Error(),
+		})
+	}
+	return c.JSON(result)
 }
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"errors"
 	"io"
 	"path/filepath"
 	"strconv"
@@ -36,30 +37,39 @@ func getSFTPClient(c *fiber.Ctx) (*sftpClientWithInfo, error) {
 		return nil, fiber.NewError(fiber.StatusNotFound, "Machine not found")
 	}
 
-	// Get encryption key
-	encryptionKey := c.Get("X-Encryption-Key")
-	if encryptionKey == "" {
-		encryptionKey = middleware.GetUsername(c)
+	encryptionKey, err := getEncryptionKey(c)
+	if errors.Is(err, errEncryptionKeyRequired) {
+		return nil, fiber.NewError(fiber.StatusBadRequest, "Encryption key required, please log in again")
+	} else if errors.Is(err, services.ErrInvalidEncryptionKey) {
+		return nil, fiber.NewError(fiber.StatusUnauthorized, "Invalid encryption key, please log in again")
+	} else if err != nil {
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to unlock credentials")
 	}
 
 	// Decrypt credentials
-	credData, err := services.DecryptCredential(machine.CredentialEncrypted, encryptionKey)
+	credData, err := services.MachineCredential(&machine, encryptionKey)
 	if err != nil {
-		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to decrypt credentials")
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to load credentials: "+err.Error())
 	}
 
-	// Create SFTP client
+	// Create SFTP client (non-interactive, so untrusted host keys fail closed)
 	sftpClient, err := services.NewSFTPClient(&services.SSHConfig{
-		Hostname:   machine.Hostname,
-		Port:       machine.Port,
-		Username:   machine.Username,
-		Password:   credData.Password,
-		PrivateKey: credData.PrivateKey,
-		Passphrase: credData.Passphrase,
-		HostKey:    machine.HostKey,
+		Hostname:      machine.Hostname,
+		Port:          machine.Port,
+		Username:      machine.Username,
+		Password:      credData.Password,
+		PrivateKey:    credData.PrivateKey,
+		Passphrase:    credData.Passphrase,
+		HostKey:       machine.HostKey,
+		HostKeyPolicy: services.ResolveHostKeyPolicy(machine.HostKeyPolicy),
 	})
 	if err != nil {
-		return nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to connect: "+err.Error())
+		return nil, machineConnectError(err)
+	}
+
+	// Remember keys trusted automatically under the accept-new policy
+	if sftpClient.HostKey != nil && sftpClient.HostKey.Status == "new" {
+		database.DB.Model(&machine).Update("host_key", sftpClient.HostKey.Fingerprint)
 	}
 
 	return &sftpClientWithInfo{
@@ -5,14 +5,12 @@ import (
 	"io"
 	"log"
 	"strconv"
-	"sync"
+	"strings"
 	"time"
 
 	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
-	"github.com/golang-jwt/jwt/v5"
 
-	"farseer/config"
 	"farseer/database"
 	"farseer/middleware"
 	"farseer/models"
@@ -60,28 +58,43 @@ type HostKeyConfirmData struct {
 	Accept bool `json:"accept"`
 }
 
-// Active sessions map
-var (
-	activeSessions = make(map[string]*services.SSHSession)
-	sessionsMu     sync.RWMutex
-)
-
 // SSHWebSocketUpgrade is middleware to upgrade HTTP to WebSocket
 func SSHWebSocketUpgrade(c *fiber.Ctx) error {
 	if websocket.IsWebSocketUpgrade(c) {
-		// Validate JWT token from query parameter
+		// Validate JWT token from query parameter, or an API token with the
+		// exec scope there or in the Authorization header, or without one,
+		// the trusted proxy's user header
 		tokenString := c.Query("token")
+		if header := strings.TrimPrefix(c.Get("Authorization"), "Bearer "); tokenString == "" && middleware.IsAPIToken(header) {
+			tokenString = header
+		}
+		if middleware.IsAPIToken(tokenString) {
+			claims, err := middleware.APITokenClaims(c, tokenString, models.ScopeExec)
+			if err != nil {
+				e := err.(*fiber.Error)
+				return c.Status(e.Code).JSON(fiber.Map{"error": e.Message})
+			}
+			c.Locals("userID", claims.UserID)
+			c.Locals("username", claims.Username)
+			return c.Next()
+		}
 		if tokenString == "" {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": "Token required",
-			})
+			claims, err := middleware.ProxyClaims(c)
+			if err != nil {
+				e := err.(*fiber.Error)
+				return c.Status(e.Code).JSON(fiber.Map{"error": e.Message})
+			}
+			if claims == nil {
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+					"error": "Token required",
+				})
+			}
+			c.Locals("userID", claims.UserID)
+			c.Locals("username", claims.Username)
+			return c.Next()
 		}
 
-		cfg := config.GetConfig()
-		token, err := jwt.ParseWithClaims(tokenString, &middleware.Claims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte(cfg.JWTSecret), nil
-		})
-
+		token, err := services.ParseJWT(tokenString, &middleware.Claims{}, services.JWTAudienceAccess)
 		if err != nil || !token.Valid {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
 				"error": "Invalid token",
@@ -94,10 +107,23 @@ func SSHWebSocketUpgrade(c *fiber.Ctx) error {
 				"error": "Invalid token claims",
 			})
 		}
+		if err := middleware.CheckSession(claims); err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid token",
+			})
+		}
+		// Temp tokens only prove part of the login, and an expired password
+		// has to be changed first
+		if claims.TempAuth || claims.PasswordExpired {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid token",
+			})
+		}
 
 		// Store user info in locals for WebSocket handler
 		c.Locals("userID", claims.UserID)
 		c.Locals("username", claims.Username)
+		c.Locals("sessionID", claims.ID)
 
 		return c.Next()
 	}
@@ -114,10 +140,11 @@ func SSHWebSocket(c *websocket.Conn) {
 		return
 	}
 
-	// Get user ID from query (validated in upgrade middleware)
+	// Get user ID from query; it must be the user the upgrade middleware
+	// authenticated
 	userIDStr := c.Query("user_id")
 	userID, err := strconv.ParseUint(userIDStr, 10, 32)
-	if err != nil {
+	if authenticated, ok := c.Locals("userID").(uint); err != nil || !ok || uint64(authenticated) != userID {
 		sendWSError(c, "Invalid user ID")
 		return
 	}
@@ -142,13 +169,25 @@ func SSHWebSocket(c *websocket.Conn) {
 		return
 	}
 
+	// API tokens carry the key themselves, so scripts may leave it empty
 	var authData AuthData
-	if err := json.Unmarshal(authMsg.Data, &authData); err != nil || authData.Key == "" {
+	apiToken, _ := c.Locals("apiToken").(*models.APIToken)
+	apiTokenSecret, _ := c.Locals("apiTokenSecret").(string)
+	if err := json.Unmarshal(authMsg.Data, &authData); err != nil || (authData.Key == "" && apiToken == nil) {
 		sendWSError(c, "Invalid auth data")
 		return
 	}
 
-	encryptionKey := authData.Key
+	var encryptionKey string
+	if authData.Key == "" {
+		encryptionKey, err = services.APITokenDataKey(apiToken, apiTokenSecret)
+	} else {
+		encryptionKey, err = services.UnlockDataKey(uint(userID), authData.Key)
+	}
+	if err != nil {
+		sendWSError(c, "Failed to unlock credentials: "+err.Error())
+		return
+	}
 
 	// Fetch machine from database
 	var machine models.Machine
@@ -158,13 +197,16 @@ func SSHWebSocket(c *websocket.Conn) {
 	}
 
 	// Decrypt credentials
-	credData, err := services.DecryptCredential(machine.CredentialEncrypted, encryptionKey)
+	credData, err := services.MachineCredential(&machine, encryptionKey)
 	if err != nil {
-		sendWSError(c, "Failed to decrypt credentials: "+err.Error())
+		sendWSError(c, "Failed to load credentials: "+err.Error())
 		return
 	}
 
-	// Prepare SSH config - first attempt with host key check to see what we get
+	// Prepare SSH config. Only the confirm policy lets an unknown or changed
+	// host key through to ask the user; the others refuse it in the handshake,
+	// before any credentials are sent.
+	hostKeyPolicy := services.ResolveHostKeyPolicy(machine.HostKeyPolicy)
 	sshConfig := &services.SSHConfig{
 		Hostname:         machine.Hostname,
 		Port:             machine.Port,
@@ -173,7 +215,8 @@ func SSHWebSocket(c *websocket.Conn) {
 		PrivateKey:       credData.PrivateKey,
 		Passphrase:       credData.Passphrase,
 		HostKey:          machine.HostKey,
-		SkipHostKeyCheck: true, // Skip check initially to get the key info
+		HostKeyPolicy:    hostKeyPolicy,
+		SkipHostKeyCheck: hostKeyPolicy == models.HostKeyPolicyConfirm,
 	}
 
 	// Connect to SSH server
@@ -183,6 +226,12 @@ func SSHWebSocket(c *websocket.Conn) {
 		return
 	}
 
+	// accept-new trusted an unknown key in the handshake, remember it
+	if hostKeyResult.Status == "new" && hostKeyPolicy == models.HostKeyPolicyAcceptNew {
+		database.DB.Model(&machine).Update("host_key", hostKeyResult.Fingerprint)
+		hostKeyResult.Status = "match"
+	}
+
 	// If this is a new key or mismatched key, ask user for confirmation
 	if hostKeyResult.Status == "new" || hostKeyResult.Status == "mismatch" {
 		// Send host key info to client for confirmation
@@ -242,15 +291,19 @@ func SSHWebSocket(c *websocket.Conn) {
 	userIDUint := uint(userID)
 	services.LogAudit(userIDUint, "", models.AuditActionSSHConnect, &machineIDUint, machine.Name, "Connected to "+machine.Hostname, "")
 
-	// Store session
-	sessionKey := machineIDStr + "-" + userIDStr
-	sessionsMu.Lock()
-	activeSessions[sessionKey] = session
-	sessionsMu.Unlock()
+	// Track the terminal so revoking the session closes it
+	sessionID, _ := c.Locals("sessionID").(string)
+	untrack := services.TrackTerminal(&services.Terminal{
+		UserID:    userIDUint,
+		SessionID: sessionID,
+		Close: func() {
+			session.Close()
+			// Closing a hijacked connection waits for the handler, so end the read loop
+			c.SetReadDeadline(time.Now())
+		},
+	})
 	defer func() {
-		sessionsMu.Lock()
-		delete(activeSessions, sessionKey)
-		sessionsMu.Unlock()
+		untrack()
 		// Log SSH disconnection
 		services.LogAudit(userIDUint, "", models.AuditActionSSHDisconnect, &machineIDUint, machine.Name, "Disconnected from "+machine.Hostname, "")
 	}()
@@ -419,3 +472,60 @@ func UpdateHostKey(c *fiber.Ctx) error {
 		"host_key": input.HostKey,
 	})
 }
+
+// ScanHostKey fetches the machine's current host key and records it in the history
+func ScanHostKey(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	machineID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid machine ID",
+		})
+	}
+
+	var machine models.Machine
+	if result := database.DB.Where("id = ? AND user_id = ?", machineID, userID).First(&machine); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Machine not found",
+		})
+	}
+
+	record, err := services.CheckMachineHostKey(&machine)
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"host_key": machine.HostKey,
+		"scanned":  record,
+	})
+}
+
+// GetHostKeyHistory returns every host key seen for a machine, newest first
+func GetHostKeyHistory(c *fiber.Ctx) error {
+	userID := middleware.GetUserID(c)
+	machineID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid machine ID",
+		})
+	}
+
+	var machine models.Machine
+	if result := database.DB.Where("id = ? AND user_id = ?", machineID, userID).First(&machine); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Machine not found",
+		})
+	}
+
+	var records []models.HostKeyRecord
+	if result := database.DB.Where("machine_id = ?", machine.ID).Order("id DESC").Find(&records); result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch host key history",
+		})
+	}
+
+	return c.JSON(records)
+}
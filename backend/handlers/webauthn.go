@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"errors"
+	"farseer/database"
+	"farseer/middleware"
+	"farseer/models"
+	"farseer/services"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+type WebAuthnRegisterRequest struct {
+	TOTPVerifyRequest
+	Name string `json:"name"`
+}
+
+type PreferredFactorRequest struct {
+	Factor string `json:"factor"`
+}
+
+// webAuthnError maps WebAuthn failures to the error response format
+func webAuthnError(err error) *fiber.Error {
+	switch {
+	case errors.Is(err, services.ErrWebAuthnFailed), errors.Is(err, services.ErrWebAuthnCloned):
+		return fiber.NewError(fiber.StatusUnauthorized, err.Error())
+	case errors.Is(err, services.ErrWebAuthnNoChallenge), errors.Is(err, services.ErrWebAuthnNoKeys),
+		errors.Is(err, services.ErrWebAuthnNotConfigured):
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	default:
+		return fiber.NewError(fiber.StatusInternalServerError, "Security key verification failed")
+	}
+}
+
+// keyName trims a user-supplied security key name, defaulting when empty
+func keyName(name string) string {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return "Security key"
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+// LoginWebAuthnBegin returns a challenge for signing in with a security key
+func LoginWebAuthnBegin(c *fiber.Ctx) error {
+	var user models.User
+	if result := database.DB.First(&user, middleware.GetUserID(c)); result.Error != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	if err := checkLoginThrottle(c, &user); err != nil {
+		return err
+	}
+
+	assertion, err := services.BeginWebAuthnLogin(&user, c.Get("Origin"), services.WebAuthnLogin)
+	if err != nil {
+		return webAuthnError(err)
+	}
+	return c.JSON(assertion)
+}
+
+// LoginWebAuthn verifies the security key's answer and returns a full JWT
+func LoginWebAuthn(c *fiber.Ctx) error {
+	var user models.User
+	if result := database.DB.First(&user, middleware.GetUserID(c)); result.Error != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	if err := checkLoginThrottle(c, &user); err != nil {
+		return err
+	}
+
+	key, err := services.FinishWebAuthnLogin(&user, c.Get("Origin"), services.WebAuthnLogin, c.Body())
+	if err != nil {
+		fe := webAuthnError(err)
+		if fe.Code == fiber.StatusUnauthorized {
+			recordFailedLogin(c, &user, models.AuditActionTOTPFailed, "Security key: "+fe.Message)
+		}
+		return fe
+	}
+	return completeLogin(c, &user, nil, "Security key: "+key.Name)
+}
+
+// LoginWebAuthnRegisterBegin starts enrolling a security key as the first
+// second factor, instead of TOTP, during a user's first login
+func LoginWebAuthnRegisterBegin(c *fiber.Ctx) error {
+	var req WebAuthnRegisterRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	var user models.User
+	if result := database.DB.First(&user, middleware.GetUserID(c)); result.Error != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if hasSecondFactor(&user) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A second factor is already enrolled, verify it to sign in",
+		})
+	}
+
+	creation, err := services.BeginWebAuthnRegistration(&user, c.Get("Origin"), keyName(req.Name))
+	if err != nil {
+		return webAuthnError(err)
+	}
+	return c.JSON(creation)
+}
+
+// LoginWebAuthnRegister stores the first security key and returns a full JWT
+func LoginWebAuthnRegister(c *fiber.Ctx) error {
+	var user models.User
+	if result := database.DB.First(&user, middleware.GetUserID(c)); result.Error != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if hasSecondFactor(&user) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "A second factor is already enrolled, verify it to sign in",
+		})
+	}
+
+	key, err := services.FinishWebAuthnRegistration(&user, c.Get("Origin"), c.Body())
+	if err != nil {
+		return webAuthnError(err)
+	}
+
+	database.DB.Model(&user).Update("preferred_factor", models.SecondFactorWebAuthn)
+	user.PreferredFactor = models.SecondFactorWebAuthn
+	services.LogAudit(user.ID, user.Username, models.AuditActionWebAuthnRegister, nil, "", "Security key enrolled: "+key.Name, c.IP())
+	return completeLogin(c, &user, firstRecoveryCodes(&user), "Security key: "+key.Name)
+}
+
+// ListWebAuthnCredentials lists the current user's security keys
+func ListWebAuthnCredentials(c *fiber.Ctx) error {
+	var keys []models.WebAuthnCredential
+	if result := database.DB.Where("user_id = ?", middleware.GetUserID(c)).Order("created_at").Find(&keys); result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to fetch security keys",
+		})
+	}
+	return c.JSON(keys)
+}
+
+// WebAuthnChallenge returns a challenge for confirming a sensitive change
+// with a security key; the answer goes in the change's "assertion" field
+func WebAuthnChallenge(c *fiber.Ctx) error {
+	var user models.User
+	if result := database.DB.First(&user, middleware.GetUserID(c)); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	assertion, err := services.BeginWebAuthnLogin(&user, c.Get("Origin"), services.WebAuthnVerify)
+	if err != nil {
+		return webAuthnError(err)
+	}
+	return c.JSON(assertion)
+}
+
+// RegisterWebAuthnBegin starts adding a security key to the current user.
+// A current second factor is required so a stolen session cannot add one.
+func RegisterWebAuthnBegin(c *fiber.Ctx) error {
+	var req WebAuthnRegisterRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	var user models.User
+	if result := database.DB.First(&user, middleware.GetUserID(c)); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+	if err := reverifySecondFactor(c, &user, &req.TOTPVerifyRequest); err != nil {
+		return err
+	}
+
+	creation, err := services.BeginWebAuthnRegistration(&user, c.Get("Origin"), keyName(req.Name))
+	if err != nil {
+		return webAuthnError(err)
+	}
+	return c.JSON(creation)
+}
+
+// RegisterWebAuthn stores a new security key for the current user
+func RegisterWebAuthn(c *fiber.Ctx) error {
+	var user models.User
+	if result := database.DB.First(&user, middleware.GetUserID(c)); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	key, err := services.FinishWebAuthnRegistration(&user, c.Get("Origin"), c.Body())
+	if err != nil {
+		// A key that fails to register does not mean the session is invalid
+		e := webAuthnError(err)
+		if e.Code == fiber.StatusUnauthorized {
+			e.Code = fiber.StatusBadRequest
+		}
+		return e
+	}
+
+	services.LogAudit(user.ID, user.Username, models.AuditActionWebAuthnRegister, nil, "", "Security key added: "+key.Name, c.IP())
+	return c.Status(fiber.StatusCreated).JSON(key)
+}
+
+// DeleteWebAuthnCredential removes one of the current user's security keys.
+// The last second factor cannot be removed.
+func DeleteWebAuthnCredential(c *fiber.Ctx) error {
+	keyID, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid security key ID",
+		})
+	}
+
+	var user models.User
+	if result := database.DB.First(&user, middleware.GetUserID(c)); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	var key models.WebAuthnCredential
+	if result := database.DB.Where("id = ? AND user_id = ?", keyID, user.ID).First(&key); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "Security key not found",
+		})
+	}
+	if !user.TOTPEnabled && services.WebAuthnCredentialCount(user.ID) <= 1 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Cannot remove your only second factor, set up TOTP first",
+		})
+	}
+
+	if result := database.DB.Delete(&key); result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to remove security key",
+		})
+	}
+
+	services.LogAudit(user.ID, user.Username, models.AuditActionWebAuthnDelete, nil, "", "Security key removed: "+key.Name, c.IP())
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// UpdatePreferredFactor sets which second factor is offered first at login
+func UpdatePreferredFactor(c *fiber.Ctx) error {
+	var req PreferredFactorRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid request body",
+		})
+	}
+
+	var user models.User
+	if result := database.DB.First(&user, middleware.GetUserID(c)); result.Error != nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "User not found",
+		})
+	}
+
+	switch req.Factor {
+	case models.SecondFactorTOTP:
+		if !user.TOTPEnabled {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "TOTP is not enabled",
+			})
+		}
+	case models.SecondFactorWebAuthn:
+		if services.WebAuthnCredentialCount(user.ID) == 0 {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "No security keys registered",
+			})
+		}
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Factor must be totp or webauthn",
+		})
+	}
+
+	if result := database.DB.Model(&user).Update("preferred_factor", req.Factor); result.Error != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to update preferred factor",
+		})
+	}
+	return c.JSON(userResponse(&user))
+}
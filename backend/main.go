@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -19,17 +20,33 @@ import (
 	"farseer/database"
 	"farseer/handlers"
 	"farseer/middleware"
+	"farseer/services"
 )
 
 func main() {
 	// Load configuration
 	cfg := config.GetConfig()
 
+	// Unlock the server secrets that protect stored data
+	if err := services.InitServerKeys(); err != nil {
+		log.Fatalf("Failed to load server secrets: %v", err)
+	}
+	if err := services.InitJWTKeys(); err != nil {
+		log.Fatalf("Failed to load JWT signing keys: %v", err)
+	}
+
 	// Connect to database
 	if err := database.Connect(); err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
 	}
 
+	// Start background jobs
+	services.AbortInterruptedRotationJobs()
+	services.StartHostKeyScanner()
+	services.StartLDAPSync()
+	services.StartPasswordRotationScheduler()
+	services.StartJWTKeyRotation()
+
 	// Create Fiber app
 	app := fiber.New(fiber.Config{
 		AppName:      "Farseer",
@@ -48,10 +65,16 @@ func main() {
 		AllowCredentials: true,
 	}))
 
+	// Only trusted proxies may vouch for users
+	app.Use(middleware.RejectUntrustedProxyHeader())
+
 	// WebSocket route for SSH (must be before other routes to avoid middleware conflicts)
 	app.Use("/api/ssh/:id/ws", handlers.SSHWebSocketUpgrade)
 	app.Get("/api/ssh/:id/ws", websocket.New(handlers.SSHWebSocket))
 
+	// Public keys for other services verifying Farseer's tokens
+	app.Get("/.well-known/jwks.json", handlers.GetJWKS)
+
 	// API routes
 	api := app.Group("/api")
 
@@ -74,12 +97,49 @@ func main() {
 	api.Post("/setup", authLimiter, handlers.Setup)
 	api.Post("/login", authLimiter, handlers.Login)
 
+	// Single sign-on (OpenID Connect)
+	api.Get("/auth/oidc/login", authLimiter, handlers.OIDCLogin)
+	api.Get("/auth/oidc/callback", handlers.OIDCCallback)
+	api.Post("/auth/oidc/exchange", authLimiter, handlers.OIDCExchange)
+	api.Post("/auth/oidc/password", authLimiter, middleware.PasswordStepRequired(), handlers.OIDCPassword)
+
+	// Single sign-on (SAML 2.0); tickets are redeemed at /auth/oidc/exchange
+	api.Get("/auth/saml/metadata", handlers.SAMLMetadata)
+	api.Get("/auth/saml/login", authLimiter, handlers.SAMLLogin)
+	api.Post("/auth/saml/acs", handlers.SAMLACS)
+
+	// Reverse proxy authentication
+	api.Post("/auth/proxy", authLimiter, handlers.ProxyLogin)
+	api.Post("/auth/refresh", handlers.RefreshToken)
+
 	// TOTP verification (uses temp token, rate-limited)
 	api.Post("/login/totp", authLimiter, middleware.TempAuthRequired(), handlers.LoginTOTP)
+	api.Post("/login/webauthn/begin", authLimiter, middleware.TempAuthRequired(), handlers.LoginWebAuthnBegin)
+	api.Post("/login/webauthn", authLimiter, middleware.TempAuthRequired(), handlers.LoginWebAuthn)
+	api.Post("/login/webauthn/register/begin", authLimiter, middleware.TempAuthRequired(), handlers.LoginWebAuthnRegisterBegin)
+	api.Post("/login/webauthn/register", authLimiter, middleware.TempAuthRequired(), handlers.LoginWebAuthnRegister)
 
 	// Protected routes
 	protected := api.Group("", middleware.AuthRequired())
 	protected.Get("/user", handlers.GetCurrentUser)
+	protected.Post("/user/recovery-codes", authLimiter, handlers.RegenerateRecoveryCodes)
+	protected.Post("/user/totp/reenroll", authLimiter, handlers.StartTOTPReenrollment)
+	protected.Post("/user/totp/confirm", authLimiter, handlers.ConfirmTOTPReenrollment)
+	protected.Post("/user/password", authLimiter, handlers.ChangePassword)
+	protected.Put("/user/preferred-factor", handlers.UpdatePreferredFactor)
+	protected.Get("/user/webauthn", handlers.ListWebAuthnCredentials)
+	protected.Post("/user/webauthn/challenge", authLimiter, handlers.WebAuthnChallenge)
+	protected.Post("/user/webauthn/register/begin", authLimiter, handlers.RegisterWebAuthnBegin)
+	protected.Post("/user/webauthn/register", authLimiter, handlers.RegisterWebAuthn)
+	protected.Delete("/user/webauthn/:id", handlers.DeleteWebAuthnCredential)
+	protected.Get("/user/api-tokens", handlers.ListAPITokens)
+	protected.Get("/user/api-tokens/scopes", handlers.GetAPITokenScopes)
+	protected.Post("/user/api-tokens", authLimiter, handlers.CreateAPIToken)
+	protected.Delete("/user/api-tokens/:id", handlers.DeleteAPIToken)
+	protected.Get("/user/sessions", handlers.ListSessions)
+	protected.Delete("/user/sessions", handlers.RevokeOtherSessions)
+	protected.Delete("/user/sessions/:id", handlers.RevokeSession)
+	protected.Post("/logout", handlers.Logout)
 
 	// Admin-only routes
 	admin := protected.Group("", middleware.AdminRequired())
@@ -90,10 +150,22 @@ func main() {
 	users.Post("/", handlers.CreateUser)
 	users.Put("/:id", handlers.UpdateUser)
 	users.Delete("/:id", handlers.DeleteUser)
+	users.Post("/:id/totp/reset", handlers.ResetUserTOTP)
+	users.Post("/:id/unlock", handlers.UnlockUser)
+	users.Get("/:id/sessions", handlers.ListUserSessions)
+	users.Delete("/:id/sessions", handlers.RevokeAllUserSessions)
+	users.Delete("/:id/sessions/:sid", handlers.RevokeUserSession)
 
 	// Settings routes (admin only)
 	admin.Get("/settings", handlers.GetSettings)
 	admin.Put("/settings", handlers.UpdateSettings)
+	admin.Get("/settings/server-secret", handlers.GetServerSecretStatus)
+	admin.Post("/settings/server-secret/rotate", handlers.RotateServerSecret)
+	admin.Get("/settings/jwt-keys", handlers.GetJWTKeyStatus)
+	admin.Post("/settings/jwt-keys/rotate", handlers.RotateJWTKey)
+	admin.Post("/settings/ldap/sync", handlers.SyncLDAP)
+	admin.Get("/settings/saml", handlers.GetSAMLSettings)
+	admin.Put("/settings/saml/idp-metadata", handlers.ImportSAMLMetadata)
 
 	// Audit log routes (admin only)
 	audit := admin.Group("/audit")
@@ -104,9 +176,34 @@ func main() {
 	machines := protected.Group("/machines")
 	machines.Get("/", handlers.ListMachines)
 	machines.Post("/", handlers.CreateMachine)
+	// Rate-limited: probes open connections to any host the caller names
+	machines.Post("/test", authLimiter, handlers.TestMachineConnection)
 	machines.Get("/:id", handlers.GetMachine)
 	machines.Put("/:id", handlers.UpdateMachine)
 	machines.Delete("/:id", handlers.DeleteMachine)
+	machines.Post("/:id/deploy-key", handlers.DeployKey)
+
+	// Credential rotation routes
+	rotations := protected.Group("/rotations")
+	rotations.Get("/", handlers.ListRotationJobs)
+	rotations.Post("/keys", handlers.StartKeyRotation)
+	rotations.Post("/passwords", handlers.StartPasswordRotation)
+	rotations.Post("/passwords/due", handlers.StartDuePasswordRotation)
+	rotations.Get("/:id", handlers.GetRotationJob)
+
+	// Notification routes
+	notifications := protected.Group("/notifications")
+	notifications.Get("/", handlers.ListNotifications)
+	notifications.Post("/read", handlers.MarkAllNotificationsRead)
+	notifications.Post("/:id/read", handlers.MarkNotificationRead)
+
+	// Shared credential routes
+	credentials := protected.Group("/credentials")
+	credentials.Get("/", handlers.ListCredentials)
+	credentials.Post("/", handlers.CreateCredential)
+	credentials.Put("/:id", handlers.UpdateCredential)
+	credentials.Delete("/:id", handlers.DeleteCredential)
+	credentials.Get("/:id/machines", handlers.GetCredentialMachines)
 
 	// Group routes
 	groups := protected.Group("/groups")
@@ -119,6 +216,8 @@ func main() {
 	ssh := protected.Group("/ssh")
 	ssh.Get("/:id/hostkey", handlers.GetHostKey)
 	ssh.Put("/:id/hostkey", handlers.UpdateHostKey)
+	ssh.Post("/:id/hostkey/scan", handlers.ScanHostKey)
+	ssh.Get("/:id/hostkey/history", handlers.GetHostKeyHistory)
 
 	// SFTP routes
 	sftp := protected.Group("/sftp/:id")
@@ -161,6 +260,18 @@ func main() {
 func customErrorHandler(c *fiber.Ctx, err error) error {
 	code := fiber.StatusInternalServerError
 
+	// Untrusted host keys are reported with enough detail for a trust prompt
+	var hostKeyErr *services.HostKeyError
+	if errors.As(err, &hostKeyErr) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":           err.Error(),
+			"host_key_status": hostKeyErr.Status,
+			"fingerprint":     hostKeyErr.Fingerprint,
+			"stored_key":      hostKeyErr.Expected,
+			"policy":          hostKeyErr.Policy,
+		})
+	}
+
 	if e, ok := err.(*fiber.Error); ok {
 		code = e.Code
 	}
@@ -0,0 +1,84 @@
+package middleware
+
+import (
+	"errors"
+	"farseer/models"
+	"farseer/services"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// tokenRoutes lists the routes API tokens may use, by path prefix, with the
+// scope reading (GET) and changing (anything else) needs. An empty scope, and
+// every route not listed, such as account and user management, refuse tokens.
+var tokenRoutes = []struct {
+	prefix      string
+	read, write string
+}{
+	{"/api/machines", models.ScopeMachinesRead, models.ScopeMachinesWrite},
+	{"/api/groups", models.ScopeMachinesRead, models.ScopeMachinesWrite},
+	{"/api/rotations", models.ScopeMachinesRead, models.ScopeMachinesWrite},
+	{"/api/ssh", models.ScopeMachinesRead, models.ScopeMachinesWrite}, // Host keys; sessions need exec
+	{"/api/credentials", models.ScopeCredentialsRead, models.ScopeCredentialsWrite},
+	{"/api/sftp", models.ScopeSFTPRead, models.ScopeSFTPWrite},
+	{"/api/audit", models.ScopeAuditRead, ""},
+}
+
+// routeScope returns the scope an API token needs for the request, or "" if
+// tokens cannot be used for it
+func routeScope(c *fiber.Ctx) string {
+	path := strings.ToLower(c.Path())
+	for _, route := range tokenRoutes {
+		if path != route.prefix && !strings.HasPrefix(path, route.prefix+"/") {
+			continue
+		}
+		if c.Method() == http.MethodGet || c.Method() == http.MethodHead {
+			return route.read
+		}
+		return route.write
+	}
+	return ""
+}
+
+// IsAPIToken reports whether a bearer token is an API token rather than a JWT
+func IsAPIToken(token string) bool {
+	return strings.HasPrefix(token, services.APITokenPrefix)
+}
+
+// APITokenClaims authenticates a request by an API token, which must have
+// been granted scope. The token is kept in the request locals for GetAPIToken.
+func APITokenClaims(c *fiber.Ctx, token, scope string) (*Claims, error) {
+	record, user, err := services.AuthenticateAPIToken(token, c.IP())
+	if err != nil {
+		if errors.Is(err, services.ErrInvalidAPIToken) || errors.Is(err, services.ErrAccountDisabled) {
+			return nil, fiber.NewError(fiber.StatusUnauthorized, err.Error())
+		}
+		log.Printf("API token authentication failed: %v", err)
+		return nil, fiber.NewError(fiber.StatusInternalServerError, "API token authentication failed")
+	}
+	if scope == "" {
+		return nil, fiber.NewError(fiber.StatusForbidden, "API tokens cannot be used here")
+	}
+	if !record.HasScope(scope) {
+		return nil, fiber.NewError(fiber.StatusForbidden, "API token lacks the "+scope+" scope")
+	}
+
+	c.Locals("apiToken", record)
+	c.Locals("apiTokenSecret", token)
+	return &Claims{
+		UserID:   user.ID,
+		Username: user.Username,
+		Role:     string(user.Role),
+	}, nil
+}
+
+// GetAPIToken returns the API token the request was authenticated with, and
+// the token itself, or nil for other requests
+func GetAPIToken(c *fiber.Ctx) (*models.APIToken, string) {
+	record, _ := c.Locals("apiToken").(*models.APIToken)
+	token, _ := c.Locals("apiTokenSecret").(string)
+	return record, token
+}
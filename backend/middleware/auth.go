@@ -1,7 +1,11 @@
 package middleware
 
 import (
-	"farseer/config"
+	"errors"
+	"farseer/database"
+	"farseer/models"
+	"farseer/services"
+	"log"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
@@ -9,17 +13,21 @@ import (
 )
 
 type Claims struct {
-	UserID   uint   `json:"user_id"`
-	Username string `json:"username"`
-	Role     string `json:"role"`
-	TempAuth bool   `json:"temp_auth,omitempty"`
+	UserID         uint   `json:"user_id"`
+	Username       string `json:"username"`
+	Role           string `json:"role"`
+	TempAuth       bool   `json:"temp_auth,omitempty"`
+	PasswordStep   bool   `json:"pw_step,omitempty"` // SSO sign-in still needs the local password
+	SessionVersion int    `json:"sv,omitempty"`      // Must match the user's, so bumping it revokes the token
+	// The password is past its maximum age; until it is changed the token
+	// only reaches passwordChangeRoutes
+	PasswordExpired bool `json:"pw_expired,omitempty"`
 	jwt.RegisteredClaims
 }
 
-// parseClaims extracts and validates JWT claims from the Authorization header
-func parseClaims(c *fiber.Ctx) (*Claims, error) {
-	cfg := config.GetConfig()
-
+// parseClaims extracts and validates JWT claims from the Authorization header,
+// accepting only tokens meant for the audience
+func parseClaims(c *fiber.Ctx, audience string) (*Claims, error) {
 	authHeader := c.Get("Authorization")
 	if authHeader == "" {
 		return nil, fiber.NewError(fiber.StatusUnauthorized, "Missing authorization header")
@@ -30,10 +38,7 @@ func parseClaims(c *fiber.Ctx) (*Claims, error) {
 		return nil, fiber.NewError(fiber.StatusUnauthorized, "Invalid authorization header format")
 	}
 
-	token, err := jwt.ParseWithClaims(parts[1], &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte(cfg.JWTSecret), nil
-	})
-
+	token, err := services.ParseJWT(parts[1], &Claims{}, audience)
 	if err != nil || !token.Valid {
 		return nil, fiber.NewError(fiber.StatusUnauthorized, "Invalid or expired token")
 	}
@@ -43,13 +48,60 @@ func parseClaims(c *fiber.Ctx) (*Claims, error) {
 		return nil, fiber.NewError(fiber.StatusUnauthorized, "Invalid token claims")
 	}
 
+	if err := CheckSession(claims); err != nil {
+		return nil, err
+	}
+
 	return claims, nil
 }
 
-// AuthRequired validates a full (non-temp) JWT token
+// CheckSession rejects tokens of deleted or disabled users, tokens issued
+// before the user's sessions were revoked, and full tokens whose server-side
+// session has ended
+func CheckSession(claims *Claims) error {
+	var user models.User
+	if err := database.DB.Select("id", "session_version", "disabled").First(&user, claims.UserID).Error; err != nil {
+		return fiber.NewError(fiber.StatusUnauthorized, "Invalid or expired token")
+	}
+	if user.SessionVersion != claims.SessionVersion {
+		return fiber.NewError(fiber.StatusUnauthorized, "Session has been revoked")
+	}
+	if user.Disabled {
+		return fiber.NewError(fiber.StatusUnauthorized, "Account is disabled")
+	}
+	if !claims.TempAuth {
+		if err := services.ValidateSession(claims.ID, claims.UserID); errors.Is(err, services.ErrSessionRevoked) {
+			return fiber.NewError(fiber.StatusUnauthorized, "Session has been revoked")
+		} else if err != nil {
+			log.Printf("Failed to check session of user %d: %v", claims.UserID, err)
+			return fiber.NewError(fiber.StatusInternalServerError, "Failed to check session")
+		}
+	}
+	return nil
+}
+
+// passwordChangeRoutes are the routes open to a session whose password has expired
+var passwordChangeRoutes = map[string]bool{
+	fiber.MethodGet + " /api/user":           true,
+	fiber.MethodPost + " /api/user/password": true,
+	fiber.MethodPost + " /api/logout":        true,
+}
+
+// AuthRequired validates a full (non-temp) JWT token, or an API token with
+// the scope the route needs. Requests without either are authenticated by the
+// trusted proxy's user header, when enabled.
 func AuthRequired() fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		claims, err := parseClaims(c)
+		var claims *Claims
+		var err error
+		if authHeader := c.Get("Authorization"); authHeader == "" {
+			claims, err = ProxyClaims(c)
+		} else if token := strings.TrimPrefix(authHeader, "Bearer "); IsAPIToken(token) {
+			claims, err = APITokenClaims(c, token, routeScope(c))
+		}
+		if claims == nil && err == nil {
+			claims, err = parseClaims(c, services.JWTAudienceAccess)
+		}
 		if err != nil {
 			e := err.(*fiber.Error)
 			return c.Status(e.Code).JSON(fiber.Map{"error": e.Message})
@@ -62,9 +114,17 @@ func AuthRequired() fiber.Handler {
 			})
 		}
 
+		if claims.PasswordExpired && !passwordChangeRoutes[c.Method()+" "+c.Path()] {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error":            "Your password has expired, change it to continue",
+				"password_expired": true,
+			})
+		}
+
 		c.Locals("userID", claims.UserID)
 		c.Locals("username", claims.Username)
 		c.Locals("role", claims.Role)
+		c.Locals("sessionID", claims.ID)
 
 		return c.Next()
 	}
@@ -73,7 +133,7 @@ func AuthRequired() fiber.Handler {
 // TempAuthRequired validates a temp JWT token (used only for TOTP verification)
 func TempAuthRequired() fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		claims, err := parseClaims(c)
+		claims, err := parseClaims(c, services.JWTAudienceSecondFactor)
 		if err != nil {
 			e := err.(*fiber.Error)
 			return c.Status(e.Code).JSON(fiber.Map{"error": e.Message})
@@ -84,6 +144,35 @@ func TempAuthRequired() fiber.Handler {
 				"error": "Temporary token required",
 			})
 		}
+		if claims.PasswordStep {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Password required",
+			})
+		}
+
+		c.Locals("userID", claims.UserID)
+		c.Locals("username", claims.Username)
+		c.Locals("role", claims.Role)
+
+		return c.Next()
+	}
+}
+
+// PasswordStepRequired validates the temp token issued after single sign-on
+// when the local password is still required
+func PasswordStepRequired() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		claims, err := parseClaims(c, services.JWTAudiencePasswordStep)
+		if err != nil {
+			e := err.(*fiber.Error)
+			return c.Status(e.Code).JSON(fiber.Map{"error": e.Message})
+		}
+
+		if !claims.TempAuth || !claims.PasswordStep {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Password step token required",
+			})
+		}
 
 		c.Locals("userID", claims.UserID)
 		c.Locals("username", claims.Username)
@@ -113,6 +202,15 @@ func GetUserID(c *fiber.Ctx) uint {
 	return 0
 }
 
+// GetSessionID returns the jti of the session the request was made with, or
+// "" for requests authenticated by an API token or the proxy header
+func GetSessionID(c *fiber.Ctx) string {
+	if sessionID, ok := c.Locals("sessionID").(string); ok {
+		return sessionID
+	}
+	return ""
+}
+
 func GetUsername(c *fiber.Ctx) string {
 	if username, ok := c.Locals("username").(string); ok {
 		return username
@@ -0,0 +1,81 @@
+package middleware
+
+import (
+	"errors"
+	"farseer/config"
+	"farseer/models"
+	"farseer/services"
+	"log"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// ProxyUser returns the username the trusted proxy sent, or "" when reverse
+// proxy authentication is off or the request has no user header
+func ProxyUser(c *fiber.Ctx) string {
+	if !services.ProxyAuthEnabled() {
+		return ""
+	}
+	return strings.TrimSpace(c.Get(config.GetConfig().ProxyAuthUserHeader))
+}
+
+// RejectUntrustedProxyHeader refuses requests carrying the proxy user header
+// that do not come from a trusted proxy, so a client reaching Farseer around
+// the proxy cannot claim to be anyone. The peer address is used, never a
+// forwarded-for header.
+func RejectUntrustedProxyHeader() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if ProxyUser(c) != "" && !services.TrustedProxy(c.Context().RemoteIP()) {
+			log.Printf("Refused %s header from untrusted address %s", config.GetConfig().ProxyAuthUserHeader, c.Context().RemoteIP())
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": services.ErrUntrustedProxy.Error(),
+			})
+		}
+		return c.Next()
+	}
+}
+
+// ProxyClaims authenticates a request by the trusted proxy's user header,
+// provisioning the account if enabled. It returns nil claims for requests
+// without the header.
+func ProxyClaims(c *fiber.Ctx) (*Claims, error) {
+	username := ProxyUser(c)
+	if username == "" {
+		return nil, nil
+	}
+	if !services.TrustedProxy(c.Context().RemoteIP()) {
+		return nil, fiber.NewError(fiber.StatusForbidden, services.ErrUntrustedProxy.Error())
+	}
+
+	cfg := config.GetConfig()
+	var groups []string
+	if cfg.ProxyAuthGroupsHeader != "" {
+		groups = services.ProxyGroups(c.Get(cfg.ProxyAuthGroupsHeader))
+	}
+	result, err := services.AuthenticateProxyUser(username, groups)
+	if err != nil {
+		switch {
+		case errors.Is(err, services.ErrNotProxyAccount), errors.Is(err, services.ErrUnknownProxyUser),
+			errors.Is(err, services.ErrNotAllowed), errors.Is(err, services.ErrUsernameTaken),
+			errors.Is(err, services.ErrInvalidUsername), errors.Is(err, services.ErrAccountDisabled):
+			return nil, fiber.NewError(fiber.StatusForbidden, err.Error())
+		default:
+			log.Printf("Proxy authentication of %q failed: %v", username, err)
+			return nil, fiber.NewError(fiber.StatusInternalServerError, "Proxy authentication failed")
+		}
+	}
+
+	user := result.User
+	if result.Created {
+		services.LogAudit(user.ID, user.Username, models.AuditActionUserCreate, nil, "", "Provisioned from the proxy as "+string(user.Role), c.IP())
+	} else if result.RoleChanged {
+		services.LogAudit(user.ID, user.Username, models.AuditActionUserUpdate, nil, "", "Role set to "+string(user.Role)+" from proxy groups", c.IP())
+	}
+	return &Claims{
+		UserID:         user.ID,
+		Username:       user.Username,
+		Role:           string(user.Role),
+		SessionVersion: user.SessionVersion,
+	}, nil
+}
@@ -0,0 +1,102 @@
+package models
+
+import (
+	"strings"
+	"time"
+)
+
+// Scopes an API token can be granted. Each allows reading or changing one
+// area of the API; routes outside every scope cannot be used with a token.
+const (
+	ScopeMachinesRead     = "machines:read"     // Machines, groups, host keys and rotation jobs
+	ScopeMachinesWrite    = "machines:write"    // Change them, deploy keys and start rotations
+	ScopeCredentialsRead  = "credentials:read"  // Shared credentials, without their secrets
+	ScopeCredentialsWrite = "credentials:write" // Create, change and delete shared credentials
+	ScopeExec             = "exec"              // SSH sessions
+	ScopeSFTPRead         = "sftp:read"         // List and download files
+	ScopeSFTPWrite        = "sftp:write"        // Upload, rename and delete files
+	ScopeAuditRead        = "audit:read"        // The audit log (admins only)
+)
+
+// APITokenScopes lists every scope, in the order they are shown
+var APITokenScopes = []string{
+	ScopeMachinesRead,
+	ScopeMachinesWrite,
+	ScopeCredentialsRead,
+	ScopeCredentialsWrite,
+	ScopeExec,
+	ScopeSFTPRead,
+	ScopeSFTPWrite,
+	ScopeAuditRead,
+}
+
+// APIToken is a long-lived personal access token for scripts. Only a SHA-256
+// hash of it is stored; the token itself is shown once, when created.
+type APIToken struct {
+	ID            uint   `gorm:"primaryKey"`
+	UserID        uint   `gorm:"not null;index"`
+	Name          string `gorm:"not null"`
+	Prefix        string `gorm:"not null"`             // Start of the token, to tell tokens apart
+	TokenHash     string `gorm:"uniqueIndex;not null"` // Hex SHA-256 of the token
+	Scopes        string `gorm:"not null"`             // Comma-separated
+	DataKeySealed []byte `gorm:"type:blob"`            // The owner's data key, sealed with the token, so scripts can use stored credentials
+	ExpiresAt     *time.Time
+	LastUsedAt    *time.Time
+	LastUsedIP    string
+	CreatedAt     time.Time
+}
+
+// APITokenResponse is the safe response format for API tokens
+type APITokenResponse struct {
+	ID         uint       `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	LastUsedIP string     `json:"last_used_ip,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+func (t *APIToken) ToResponse() APITokenResponse {
+	return APITokenResponse{
+		ID:         t.ID,
+		Name:       t.Name,
+		Prefix:     t.Prefix,
+		Scopes:     t.ScopeList(),
+		ExpiresAt:  t.ExpiresAt,
+		LastUsedAt: t.LastUsedAt,
+		LastUsedIP: t.LastUsedIP,
+		CreatedAt:  t.CreatedAt,
+	}
+}
+
+// ScopeList returns the token's scopes
+func (t *APIToken) ScopeList() []string {
+	if t.Scopes == "" {
+		return []string{}
+	}
+	return strings.Split(t.Scopes, ",")
+}
+
+// HasScope reports whether the token was granted scope
+func (t *APIToken) HasScope(scope string) bool {
+	for _, s := range t.ScopeList() {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Expired reports whether the token is past its expiry
+func (t *APIToken) Expired() bool {
+	return t.ExpiresAt != nil && time.Now().After(*t.ExpiresAt)
+}
+
+// APITokenInput is used for creating API tokens
+type APITokenInput struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires_in_days"` // 0 for a token that does not expire
+}
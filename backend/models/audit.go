@@ -7,23 +7,48 @@ import (
 type AuditAction string
 
 const (
-	AuditActionLogin         AuditAction = "login"
-	AuditActionLogout        AuditAction = "logout"
-	AuditActionSSHConnect    AuditAction = "ssh_connect"
-	AuditActionSSHDisconnect AuditAction = "ssh_disconnect"
-	AuditActionSFTPList      AuditAction = "sftp_list"
-	AuditActionSFTPDownload  AuditAction = "sftp_download"
-	AuditActionSFTPUpload    AuditAction = "sftp_upload"
-	AuditActionSFTPDelete    AuditAction = "sftp_delete"
-	AuditActionSFTPMkdir     AuditAction = "sftp_mkdir"
-	AuditActionSFTPRename    AuditAction = "sftp_rename"
-	AuditActionMachineCreate AuditAction = "machine_create"
-	AuditActionMachineUpdate AuditAction = "machine_update"
-	AuditActionMachineDelete AuditAction = "machine_delete"
-	AuditActionUserCreate    AuditAction = "user_create"
-	AuditActionUserUpdate    AuditAction = "user_update"
-	AuditActionUserDelete    AuditAction = "user_delete"
-	AuditActionTOTPSetup     AuditAction = "totp_setup"
+	AuditActionLogin                   AuditAction = "login"
+	AuditActionLogout                  AuditAction = "logout"
+	AuditActionSSHConnect              AuditAction = "ssh_connect"
+	AuditActionSSHDisconnect           AuditAction = "ssh_disconnect"
+	AuditActionSFTPList                AuditAction = "sftp_list"
+	AuditActionSFTPDownload            AuditAction = "sftp_download"
+	AuditActionSFTPUpload              AuditAction = "sftp_upload"
+	AuditActionSFTPDelete              AuditAction = "sftp_delete"
+	AuditActionSFTPMkdir               AuditAction = "sftp_mkdir"
+	AuditActionSFTPRename              AuditAction = "sftp_rename"
+	AuditActionMachineCreate           AuditAction = "machine_create"
+	AuditActionMachineUpdate           AuditAction = "machine_update"
+	AuditActionMachineDelete           AuditAction = "machine_delete"
+	AuditActionUserCreate              AuditAction = "user_create"
+	AuditActionUserUpdate              AuditAction = "user_update"
+	AuditActionUserDelete              AuditAction = "user_delete"
+	AuditActionTOTPSetup               AuditAction = "totp_setup"
+	AuditActionHostKeyMismatch         AuditAction = "host_key_mismatch"
+	AuditActionKeyDeploy               AuditAction = "key_deploy"
+	AuditActionKeyRotate               AuditAction = "key_rotate"
+	AuditActionPasswordRotate          AuditAction = "password_rotate"
+	AuditActionCredentialCreate        AuditAction = "credential_create"
+	AuditActionCredentialUpdate        AuditAction = "credential_update"
+	AuditActionCredentialDelete        AuditAction = "credential_delete"
+	AuditActionServerSecretRotate      AuditAction = "server_secret_rotate"
+	AuditActionRecoveryCodeUse         AuditAction = "recovery_code_use"
+	AuditActionRecoveryCodesRegenerate AuditAction = "recovery_codes_regenerate"
+	AuditActionTOTPReset               AuditAction = "totp_reset"
+	AuditActionWebAuthnRegister        AuditAction = "webauthn_register"
+	AuditActionWebAuthnDelete          AuditAction = "webauthn_delete"
+	AuditActionUserDisable             AuditAction = "user_disable"
+	AuditActionUserEnable              AuditAction = "user_enable"
+	AuditActionSAMLMetadataImport      AuditAction = "saml_metadata_import"
+	AuditActionAPITokenCreate          AuditAction = "api_token_create"
+	AuditActionAPITokenRevoke          AuditAction = "api_token_revoke"
+	AuditActionSessionRevoke           AuditAction = "session_revoke"
+	AuditActionJWTKeyRotate            AuditAction = "jwt_key_rotate"
+	AuditActionLoginFailed             AuditAction = "login_failed"
+	AuditActionTOTPFailed              AuditAction = "totp_failed"
+	AuditActionUserLock                AuditAction = "user_lock"
+	AuditActionUserUnlock              AuditAction = "user_unlock"
+	AuditActionPasswordChange          AuditAction = "password_change"
 )
 
 type AuditLog struct {
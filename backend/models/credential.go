@@ -0,0 +1,54 @@
+package models
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Credential is a reusable identity (password or private key) that several
+// machines can reference instead of each storing its own copy
+type Credential struct {
+	ID              uint           `gorm:"primaryKey" json:"id"`
+	UserID          uint           `gorm:"not null;index" json:"user_id"`
+	Name            string         `gorm:"not null" json:"name"`
+	Type            AuthType       `gorm:"not null" json:"type"`
+	SecretEncrypted []byte         `gorm:"type:blob" json:"-"`
+	RotatedAt       *time.Time     `json:"rotated_at,omitempty"`
+	CreatedAt       time.Time      `json:"created_at"`
+	UpdatedAt       time.Time      `json:"updated_at"`
+	DeletedAt       gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// CredentialInput is used for creating/updating credentials
+type CredentialInput struct {
+	Name       string   `json:"name"`
+	Type       AuthType `json:"type"`
+	Secret     string   `json:"secret"`               // Password or private key (will be encrypted)
+	Passphrase string   `json:"passphrase,omitempty"` // For encrypted private keys
+}
+
+// CredentialResponse is the safe response without the secret
+type CredentialResponse struct {
+	ID            uint       `json:"id"`
+	Name          string     `json:"name"`
+	Type          AuthType   `json:"type"`
+	RotatedAt     *time.Time `json:"rotated_at,omitempty"`
+	SecretMissing bool       `json:"secret_missing,omitempty"` // Secret was cleared by a password reset
+	MachineCount  int64      `json:"machine_count"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+}
+
+func (c *Credential) ToResponse(machineCount int64) CredentialResponse {
+	return CredentialResponse{
+		ID:            c.ID,
+		Name:          c.Name,
+		Type:          c.Type,
+		RotatedAt:     c.RotatedAt,
+		SecretMissing: len(c.SecretEncrypted) == 0,
+		MachineCount:  machineCount,
+		CreatedAt:     c.CreatedAt,
+		UpdatedAt:     c.UpdatedAt,
+	}
+}
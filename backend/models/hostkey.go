@@ -0,0 +1,17 @@
+package models
+
+import (
+	"time"
+)
+
+// HostKeyRecord is an entry in a machine's host key history. Consecutive scans
+// that see the same key extend the existing record instead of adding a new one.
+type HostKeyRecord struct {
+	ID          uint      `gorm:"primaryKey" json:"id"`
+	MachineID   uint      `gorm:"not null;index" json:"machine_id"`
+	Fingerprint string    `gorm:"not null" json:"fingerprint"`
+	KeyType     string    `json:"key_type"`
+	Status      string    `json:"status"` // "new", "match", "mismatch" relative to the trusted key when first seen
+	FirstSeenAt time.Time `json:"first_seen_at"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+}
@@ -13,59 +13,110 @@ const (
 	AuthTypeKey      AuthType = "key"
 )
 
+// HostKeyPolicy controls how unknown or changed host keys are handled
+type HostKeyPolicy string
+
+const (
+	// HostKeyPolicyStrict only accepts host keys that were trusted beforehand
+	HostKeyPolicyStrict HostKeyPolicy = "strict"
+	// HostKeyPolicyConfirm asks the user to confirm new or changed keys (trust on first use)
+	HostKeyPolicyConfirm HostKeyPolicy = "tofu"
+	// HostKeyPolicyAcceptNew trusts new keys automatically but rejects changed keys
+	HostKeyPolicyAcceptNew HostKeyPolicy = "accept-new"
+)
+
+// IsValid reports whether p is a known host key policy
+func (p HostKeyPolicy) IsValid() bool {
+	return p == HostKeyPolicyStrict || p == HostKeyPolicyConfirm || p == HostKeyPolicyAcceptNew
+}
+
 type Machine struct {
-	ID                  uint           `gorm:"primaryKey" json:"id"`
-	UserID              uint           `gorm:"not null;index" json:"user_id"`
-	GroupID             *uint          `gorm:"index" json:"group_id"`
-	Name                string         `gorm:"not null" json:"name"`
-	Hostname            string         `gorm:"not null" json:"hostname"`
-	Port                int            `gorm:"default:22" json:"port"`
-	Username            string         `gorm:"not null" json:"username"`
-	AuthType            AuthType       `gorm:"not null" json:"auth_type"`
-	CredentialEncrypted []byte         `gorm:"type:blob" json:"-"`
-	HostKey             string         `json:"host_key,omitempty"`
-	CreatedAt           time.Time      `json:"created_at"`
-	UpdatedAt           time.Time      `json:"updated_at"`
-	DeletedAt           gorm.DeletedAt `gorm:"index" json:"-"`
+	ID                   uint           `gorm:"primaryKey" json:"id"`
+	UserID               uint           `gorm:"not null;index" json:"user_id"`
+	GroupID              *uint          `gorm:"index" json:"group_id"`
+	Name                 string         `gorm:"not null" json:"name"`
+	Hostname             string         `gorm:"not null" json:"hostname"`
+	Port                 int            `gorm:"default:22" json:"port"`
+	Username             string         `gorm:"not null" json:"username"`
+	AuthType             AuthType       `gorm:"not null" json:"auth_type"`
+	CredentialID         *uint          `gorm:"index" json:"credential_id"` // Shared credential; overrides CredentialEncrypted
+	CredentialEncrypted  []byte         `gorm:"type:blob" json:"-"`
+	SecretPath           string         `json:"secret_path,omitempty"` // Path in the external secret store; overrides both of the above
+	PublicKey            string         `json:"public_key,omitempty"`  // authorized_keys line of a key generated by Farseer
+	CredentialRotatedAt  *time.Time     `json:"credential_rotated_at,omitempty"`
+	PasswordRotationDays int            `json:"password_rotation_days"` // 0 disables password rotation reminders
+	HostKey              string         `json:"host_key,omitempty"`
+	HostKeyPolicy        HostKeyPolicy  `json:"host_key_policy,omitempty"` // Empty means use the global policy
+	HostKeyScannedAt     *time.Time     `json:"host_key_scanned_at,omitempty"`
+	CreatedAt            time.Time      `json:"created_at"`
+	UpdatedAt            time.Time      `json:"updated_at"`
+	DeletedAt            gorm.DeletedAt `gorm:"index" json:"-"`
+}
+
+// HasOwnCredential reports whether the machine's credential is stored on the
+// machine itself, rather than shared or held in an external secret store
+func (m *Machine) HasOwnCredential() bool {
+	return m.CredentialID == nil && m.SecretPath == ""
 }
 
 // MachineInput is used for creating/updating machines
 type MachineInput struct {
-	Name       string   `json:"name" validate:"required"`
-	GroupID    *uint    `json:"group_id"`
-	Hostname   string   `json:"hostname" validate:"required"`
-	Port       int      `json:"port"`
-	Username   string   `json:"username" validate:"required"`
-	AuthType   AuthType `json:"auth_type" validate:"required,oneof=password key"`
-	Credential string   `json:"credential"` // Password or private key (will be encrypted)
-	Passphrase string   `json:"passphrase,omitempty"` // For encrypted private keys
+	Name                 string         `json:"name" validate:"required"`
+	GroupID              *uint          `json:"group_id"`
+	Hostname             string         `json:"hostname" validate:"required"`
+	Port                 int            `json:"port"`
+	Username             string         `json:"username" validate:"required"`
+	AuthType             AuthType       `json:"auth_type" validate:"required,oneof=password key"`
+	CredentialID         *uint          `json:"credential_id"`             // Link to a shared credential instead of storing one
+	SecretPath           string         `json:"secret_path"`               // Fetch the credential from the external secret store
+	Credential           string         `json:"credential"`                // Password or private key (will be encrypted)
+	Passphrase           string         `json:"passphrase,omitempty"`      // For encrypted private keys
+	HostKey              string         `json:"host_key,omitempty"`        // Fingerprint confirmed via the connection test
+	HostKeyPolicy        *HostKeyPolicy `json:"host_key_policy,omitempty"` // Empty means the global policy; nil on update keeps the current one
+	PasswordRotationDays *int           `json:"password_rotation_days"`    // Nil on update keeps the current interval
 }
 
 // MachineResponse is the safe response without sensitive data
 type MachineResponse struct {
-	ID        uint      `json:"id"`
-	GroupID   *uint     `json:"group_id"`
-	Name      string    `json:"name"`
-	Hostname  string    `json:"hostname"`
-	Port      int       `json:"port"`
-	Username  string    `json:"username"`
-	AuthType  AuthType  `json:"auth_type"`
-	HostKey   string    `json:"host_key,omitempty"`
-	CreatedAt time.Time `json:"created_at"`
-	UpdatedAt time.Time `json:"updated_at"`
+	ID                   uint          `json:"id"`
+	GroupID              *uint         `json:"group_id"`
+	Name                 string        `json:"name"`
+	Hostname             string        `json:"hostname"`
+	Port                 int           `json:"port"`
+	Username             string        `json:"username"`
+	AuthType             AuthType      `json:"auth_type"`
+	CredentialID         *uint         `json:"credential_id"`
+	SecretPath           string        `json:"secret_path,omitempty"`
+	CredentialMissing    bool          `json:"credential_missing,omitempty"` // Secret was cleared by a password reset
+	PublicKey            string        `json:"public_key,omitempty"`
+	CredentialRotatedAt  *time.Time    `json:"credential_rotated_at,omitempty"`
+	PasswordRotationDays int           `json:"password_rotation_days"`
+	HostKey              string        `json:"host_key,omitempty"`
+	HostKeyPolicy        HostKeyPolicy `json:"host_key_policy,omitempty"`
+	HostKeyScannedAt     *time.Time    `json:"host_key_scanned_at,omitempty"`
+	CreatedAt            time.Time     `json:"created_at"`
+	UpdatedAt            time.Time     `json:"updated_at"`
 }
 
 func (m *Machine) ToResponse() MachineResponse {
 	return MachineResponse{
-		ID:        m.ID,
-		GroupID:   m.GroupID,
-		Name:      m.Name,
-		Hostname:  m.Hostname,
-		Port:      m.Port,
-		Username:  m.Username,
-		AuthType:  m.AuthType,
-		HostKey:   m.HostKey,
-		CreatedAt: m.CreatedAt,
-		UpdatedAt: m.UpdatedAt,
+		ID:                   m.ID,
+		GroupID:              m.GroupID,
+		Name:                 m.Name,
+		Hostname:             m.Hostname,
+		Port:                 m.Port,
+		Username:             m.Username,
+		AuthType:             m.AuthType,
+		CredentialID:         m.CredentialID,
+		SecretPath:           m.SecretPath,
+		CredentialMissing:    m.HasOwnCredential() && len(m.CredentialEncrypted) == 0,
+		PublicKey:            m.PublicKey,
+		CredentialRotatedAt:  m.CredentialRotatedAt,
+		PasswordRotationDays: m.PasswordRotationDays,
+		HostKey:              m.HostKey,
+		HostKeyPolicy:        m.HostKeyPolicy,
+		HostKeyScannedAt:     m.HostKeyScannedAt,
+		CreatedAt:            m.CreatedAt,
+		UpdatedAt:            m.UpdatedAt,
 	}
 }
@@ -0,0 +1,24 @@
+package models
+
+import (
+	"time"
+)
+
+type NotificationType string
+
+const (
+	NotificationHostKeyMismatch     NotificationType = "host_key_mismatch"
+	NotificationPasswordRotationDue NotificationType = "password_rotation_due"
+	NotificationCredentialsReset    NotificationType = "credentials_reset"
+)
+
+type Notification struct {
+	ID        uint             `gorm:"primaryKey" json:"id"`
+	UserID    uint             `gorm:"not null;index" json:"user_id"`
+	Type      NotificationType `gorm:"index" json:"type"`
+	Title     string           `json:"title"`
+	Message   string           `json:"message"`
+	MachineID *uint            `json:"machine_id,omitempty"`
+	ReadAt    *time.Time       `json:"read_at,omitempty"`
+	CreatedAt time.Time        `gorm:"index" json:"created_at"`
+}
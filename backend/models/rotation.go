@@ -0,0 +1,64 @@
+package models
+
+import (
+	"time"
+)
+
+type RotationKind string
+
+const (
+	RotationKindKey      RotationKind = "key"
+	RotationKindPassword RotationKind = "password"
+)
+
+type RotationStatus string
+
+const (
+	RotationStatusRunning   RotationStatus = "running"
+	RotationStatusCompleted RotationStatus = "completed"
+	RotationStatusFailed    RotationStatus = "failed" // Finished with at least one failed machine
+)
+
+type RotationResultStatus string
+
+const (
+	RotationResultSuccess    RotationResultStatus = "success"
+	RotationResultFailed     RotationResultStatus = "failed"      // Nothing changed on the machine
+	RotationResultRolledBack RotationResultStatus = "rolled_back" // Partial changes were undone
+	RotationResultSkipped    RotationResultStatus = "skipped"
+)
+
+// RotationJob is a credential rotation campaign over one or more machines
+type RotationJob struct {
+	ID         uint             `gorm:"primaryKey" json:"id"`
+	UserID     uint             `gorm:"not null;index" json:"user_id"`
+	Kind       RotationKind     `gorm:"not null" json:"kind"`
+	Status     RotationStatus   `gorm:"not null" json:"status"`
+	Total      int              `json:"total"`
+	Succeeded  int              `json:"succeeded"`
+	Failed     int              `json:"failed"`
+	Skipped    int              `json:"skipped"`
+	Results    []RotationResult `gorm:"foreignKey:JobID" json:"results,omitempty"`
+	CreatedAt  time.Time        `json:"created_at"`
+	FinishedAt *time.Time       `json:"finished_at,omitempty"`
+}
+
+// RotationResult is the outcome of a rotation job for a single machine
+type RotationResult struct {
+	ID          uint                 `gorm:"primaryKey" json:"id"`
+	JobID       uint                 `gorm:"not null;index" json:"job_id"`
+	MachineID   uint                 `gorm:"not null;index" json:"machine_id"`
+	MachineName string               `json:"machine_name"`
+	Status      RotationResultStatus `json:"status"`
+	Message     string               `json:"message,omitempty"`
+	Fingerprint string               `json:"fingerprint,omitempty"`
+	CreatedAt   time.Time            `json:"created_at"`
+}
+
+// RotationInput selects the machines for a rotation job
+type RotationInput struct {
+	MachineIDs []uint `json:"machine_ids"`
+	GroupIDs   []uint `json:"group_ids"`
+	KeyType    string `json:"key_type,omitempty"` // For key rotation: "ed25519" (default) or "rsa"
+	Bits       int    `json:"bits,omitempty"`
+}
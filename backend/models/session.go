@@ -0,0 +1,33 @@
+package models
+
+import "time"
+
+// Session is a sign-in, referenced by the jti claim of the JWT it was issued
+// with. Deleting it revokes the token.
+type Session struct {
+	ID         uint      `gorm:"primaryKey" json:"id"`
+	UserID     uint      `gorm:"not null;index" json:"user_id"`
+	JTI        string    `gorm:"uniqueIndex;not null" json:"-"`
+	Method     string    `json:"method"` // How the user signed in, e.g. "Password" or "Single sign-on"
+	IPAddress  string    `json:"ip_address"`
+	UserAgent  string    `json:"user_agent"`
+	ExpiresAt  time.Time `gorm:"index" json:"expires_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// SessionResponse marks the session the request was made with
+type SessionResponse struct {
+	Session
+	Current bool `json:"current"`
+}
+
+// RefreshToken is one link in a session's chain of refresh tokens. Each is
+// used once and replaced; a used one coming back means it was stolen.
+type RefreshToken struct {
+	ID        uint       `gorm:"primaryKey"`
+	SessionID uint       `gorm:"not null;index"`
+	TokenHash string     `gorm:"uniqueIndex;not null"` // SHA-256 hex of the token
+	UsedAt    *time.Time // When it was exchanged for the next one
+	CreatedAt time.Time
+}
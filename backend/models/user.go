@@ -13,40 +13,80 @@ const (
 	RoleUser  Role = "user"
 )
 
+// External providers a user can be provisioned from
+const (
+	AuthProviderOIDC  = "oidc"
+	AuthProviderLDAP  = "ldap"
+	AuthProviderSAML  = "saml"
+	AuthProviderProxy = "proxy"
+)
+
 type User struct {
-	ID           uint           `gorm:"primaryKey" json:"id"`
-	Username     string         `gorm:"uniqueIndex;not null" json:"username"`
-	PasswordHash string         `gorm:"not null" json:"-"`
-	Role         Role           `gorm:"not null;default:user" json:"role"`
-	TOTPSecret   string         `gorm:"" json:"-"`
-	TOTPEnabled  bool           `gorm:"default:false" json:"-"`
-	CreatedAt    time.Time      `json:"created_at"`
-	UpdatedAt    time.Time      `json:"updated_at"`
-	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
+	ID                 uint           `gorm:"primaryKey" json:"id"`
+	Username           string         `gorm:"uniqueIndex;not null" json:"username"`
+	PasswordHash       string         `gorm:"not null" json:"-"`
+	Role               Role           `gorm:"not null;default:user" json:"role"`
+	TOTPSecret         string         `gorm:"" json:"-"`
+	TOTPEnabled        bool           `gorm:"default:false" json:"-"`
+	TOTPPendingSecret  string         `gorm:"" json:"-"`              // New secret awaiting confirmation while moving TOTP to another device
+	SessionVersion     int            `gorm:"default:0" json:"-"`     // Bumped to invalidate every token issued so far
+	PreferredFactor    string         `gorm:"" json:"-"`              // "totp" or "webauthn", offered first at login
+	DataKeyEncrypted   []byte         `gorm:"type:blob" json:"-"`     // Per-user key sealing stored credentials, wrapped with the password-derived key
+	LegacyKeysMigrated bool           `gorm:"default:false" json:"-"` // Secrets sealed with pre-envelope keys have been moved under the data key
+	AuthProvider       string         `gorm:"" json:"-"`              // Empty for local accounts, otherwise the external provider ("oidc", "ldap", "saml" or "proxy")
+	ExternalID         string         `gorm:"index" json:"-"`         // The user's subject at the single sign-on provider, or their directory DN
+	ClientKeySealed    string         `gorm:"" json:"-"`              // Stands in for the password-derived client key of external users, sealed with the server secret
+	Disabled           bool           `gorm:"default:false" json:"-"` // Removed from the directory; signing in is refused
+	FailedLogins       int            `gorm:"default:0" json:"-"`     // Failed passwords and second factors since the last sign-in
+	LastFailedLoginAt  *time.Time     `json:"-"`
+	LockedUntil        *time.Time     `json:"-"`
+	PasswordChangedAt  *time.Time     `json:"-"` // Unset for passwords older than the record, which count from CreatedAt
+	CreatedAt          time.Time      `json:"created_at"`
+	UpdatedAt          time.Time      `json:"updated_at"`
+	DeletedAt          gorm.DeletedAt `gorm:"index" json:"-"`
 }
 
 // UserResponse is the safe response format for users
 type UserResponse struct {
-	ID          uint      `json:"id"`
-	Username    string    `json:"username"`
-	Role        Role      `json:"role"`
-	TOTPEnabled bool      `json:"totp_enabled"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID                  uint       `json:"id"`
+	Username            string     `json:"username"`
+	Role                Role       `json:"role"`
+	TOTPEnabled         bool       `json:"totp_enabled"`
+	RecoveryCodesLeft   int64      `json:"recovery_codes_left"`
+	WebAuthnCredentials int64      `json:"webauthn_credentials"`
+	PreferredFactor     string     `json:"preferred_factor,omitempty"`
+	AuthProvider        string     `json:"auth_provider,omitempty"`
+	Disabled            bool       `json:"disabled,omitempty"`
+	LockedUntil         *time.Time `json:"locked_until,omitempty"`
+	PasswordExpired     bool       `json:"password_expired,omitempty"`
+	CreatedAt           time.Time  `json:"created_at"`
 }
 
 func (u *User) ToResponse() UserResponse {
 	return UserResponse{
-		ID:          u.ID,
-		Username:    u.Username,
-		Role:        u.Role,
-		TOTPEnabled: u.TOTPEnabled,
-		CreatedAt:   u.CreatedAt,
+		ID:           u.ID,
+		Username:     u.Username,
+		Role:         u.Role,
+		TOTPEnabled:  u.TOTPEnabled,
+		AuthProvider: u.AuthProvider,
+		Disabled:     u.Disabled,
+		LockedUntil:  u.lockedUntil(),
+		CreatedAt:    u.CreatedAt,
+	}
+}
+
+// lockedUntil is when the account's lockout ends, or nil if it is not locked
+func (u *User) lockedUntil() *time.Time {
+	if u.LockedUntil == nil || !u.LockedUntil.After(time.Now()) {
+		return nil
 	}
+	return u.LockedUntil
 }
 
 // UserInput is used for creating/updating users
 type UserInput struct {
-	Username string `json:"username"`
-	Password string `json:"password"`
-	Role     Role   `json:"role"`
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	Role         Role   `json:"role"`
+	AuthProvider string `json:"auth_provider,omitempty"` // "proxy" creates an account for a reverse proxy user, without a password
 }
@@ -0,0 +1,25 @@
+package models
+
+import "time"
+
+// Second factors a user can sign in with
+const (
+	SecondFactorTOTP     = "totp"
+	SecondFactorWebAuthn = "webauthn"
+)
+
+// WebAuthnCredential is a security key or passkey registered as a second factor
+type WebAuthnCredential struct {
+	ID              uint       `gorm:"primaryKey" json:"id"`
+	UserID          uint       `gorm:"index;not null" json:"-"`
+	Name            string     `gorm:"not null" json:"name"`
+	CredentialID    []byte     `gorm:"type:blob;uniqueIndex;not null" json:"-"`
+	PublicKey       []byte     `gorm:"type:blob;not null" json:"-"` // COSE encoded
+	AttestationType string     `json:"-"`
+	AAGUID          []byte     `gorm:"type:blob" json:"-"`
+	Transports      string     `json:"-"` // Comma-separated, passed back to the browser as hints
+	SignCount       uint32     `json:"sign_count"`
+	BackupEligible  bool       `json:"backup_eligible"` // Synced passkey rather than a device-bound key
+	LastUsedAt      *time.Time `json:"last_used_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
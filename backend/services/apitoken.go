@@ -0,0 +1,175 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+
+	"farseer/database"
+	"farseer/models"
+)
+
+const (
+	// APITokenPrefix starts every API token, so they are told apart from JWTs
+	// and recognised by secret scanners
+	APITokenPrefix = "fst_"
+	apiTokenBytes  = 32
+	// apiTokenShown is how much of a token is kept to tell it apart in lists
+	apiTokenShown = len(APITokenPrefix) + 8
+	// maxAPITokenDays bounds the expiry that can be chosen
+	maxAPITokenDays = 3650
+	// apiTokenUseInterval is how often a token's last use is recorded
+	apiTokenUseInterval = time.Minute
+)
+
+var (
+	// ErrInvalidAPIToken is returned for unknown, revoked and expired API tokens
+	ErrInvalidAPIToken = errors.New("invalid or expired API token")
+	// ErrAPITokenNoKey is returned when a token cannot unlock its owner's credentials
+	ErrAPITokenNoKey = errors.New("this API token cannot unlock stored credentials")
+	// ErrInvalidAPITokenInput is returned when a token is requested with an unusable name, scope or expiry
+	ErrInvalidAPITokenInput = errors.New("invalid API token")
+)
+
+// hashToken returns the hex SHA-256 of an API or refresh token. Tokens are
+// random, so unlike passwords they need no slow hash.
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// validateAPITokenScopes checks the requested scopes and returns them
+// deduplicated, in the order of models.APITokenScopes
+func validateAPITokenScopes(scopes []string, role models.Role) ([]string, error) {
+	known := make(map[string]bool, len(models.APITokenScopes))
+	for _, scope := range models.APITokenScopes {
+		known[scope] = true
+	}
+	requested := make(map[string]bool, len(scopes))
+	for _, scope := range scopes {
+		if !known[scope] {
+			return nil, fmt.Errorf("%w: unknown scope %q", ErrInvalidAPITokenInput, scope)
+		}
+		requested[scope] = true
+	}
+	if len(requested) == 0 {
+		return nil, fmt.Errorf("%w: at least one scope is required", ErrInvalidAPITokenInput)
+	}
+	if requested[models.ScopeAuditRead] && role != models.RoleAdmin {
+		return nil, fmt.Errorf("%w: scope %q is only for admins", ErrInvalidAPITokenInput, models.ScopeAuditRead)
+	}
+
+	var valid []string
+	for _, scope := range models.APITokenScopes {
+		if requested[scope] {
+			valid = append(valid, scope)
+		}
+	}
+	return valid, nil
+}
+
+// CreateAPIToken creates an API token for user and returns it in plain text.
+// This is the only time it can be shown. dataKey, the key sealing the user's
+// stored credentials, is sealed with the token so scripts can use them.
+func CreateAPIToken(user *models.User, input *models.APITokenInput, dataKey string) (string, *models.APIToken, error) {
+	name := strings.TrimSpace(input.Name)
+	if name == "" || len(name) > 64 {
+		return "", nil, fmt.Errorf("%w: a name of up to 64 characters is required", ErrInvalidAPITokenInput)
+	}
+	scopes, err := validateAPITokenScopes(input.Scopes, user.Role)
+	if err != nil {
+		return "", nil, err
+	}
+	if input.ExpiresInDays < 0 || input.ExpiresInDays > maxAPITokenDays {
+		return "", nil, fmt.Errorf("%w: expiry must be between 0 (never) and %d days", ErrInvalidAPITokenInput, maxAPITokenDays)
+	}
+
+	buf := make([]byte, apiTokenBytes)
+	if _, err := rand.Read(buf); err != nil {
+		return "", nil, err
+	}
+	token := APITokenPrefix + hex.EncodeToString(buf)
+
+	record := &models.APIToken{
+		UserID:    user.ID,
+		Name:      name,
+		Prefix:    token[:apiTokenShown],
+		TokenHash: hashToken(token),
+		Scopes:    strings.Join(scopes, ","),
+	}
+	if input.ExpiresInDays > 0 {
+		expires := time.Now().AddDate(0, 0, input.ExpiresInDays)
+		record.ExpiresAt = &expires
+	}
+	if dataKey != "" {
+		if record.DataKeySealed, err = sealBytes([]byte(dataKey), token); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if err := database.DB.Create(record).Error; err != nil {
+		return "", nil, err
+	}
+	return token, record, nil
+}
+
+// AuthenticateAPIToken looks up the token and its owner, recording its use
+func AuthenticateAPIToken(token, ip string) (*models.APIToken, *models.User, error) {
+	var record models.APIToken
+	if err := database.DB.Where("token_hash = ?", hashToken(token)).First(&record).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, nil, ErrInvalidAPIToken
+		}
+		return nil, nil, err
+	}
+	if record.Expired() {
+		return nil, nil, ErrInvalidAPIToken
+	}
+
+	var user models.User
+	if err := database.DB.Select("id", "username", "role", "disabled").First(&user, record.UserID).Error; err != nil {
+		return nil, nil, ErrInvalidAPIToken
+	}
+	if user.Disabled {
+		return nil, nil, ErrAccountDisabled
+	}
+
+	// Recorded at most once a minute, so busy scripts do not write on every request
+	now := time.Now()
+	if record.LastUsedAt == nil || now.Sub(*record.LastUsedAt) > apiTokenUseInterval || record.LastUsedIP != ip {
+		database.DB.Model(&record).Updates(map[string]interface{}{"last_used_at": now, "last_used_ip": ip})
+	}
+	return &record, &user, nil
+}
+
+// APITokenDataKey unseals the owner's data key with the token, moving it to
+// the current server secret if it was sealed with a retired one
+func APITokenDataKey(record *models.APIToken, token string) (string, error) {
+	if len(record.DataKeySealed) == 0 {
+		return "", ErrAPITokenNoKey
+	}
+	dataKey, err := openBytes(record.DataKeySealed, token)
+	if err != nil {
+		return "", ErrAPITokenNoKey
+	}
+
+	if version, _ := serverKeys.Current(); KeyVersion(record.DataKeySealed) != version {
+		sealed, err := sealBytes(dataKey, token)
+		if err == nil {
+			err = database.DB.Model(record).Update("data_key_sealed", sealed).Error
+		}
+		if err != nil {
+			log.Printf("API token %d: failed to re-seal data key with the current server secret: %v", record.ID, err)
+		} else {
+			schedulePrune()
+		}
+	}
+	return string(dataKey), nil
+}
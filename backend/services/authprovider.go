@@ -0,0 +1,186 @@
+package services
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"farseer/database"
+	"farseer/models"
+)
+
+var (
+	// ErrInvalidCredentials is returned when the username or password is wrong
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrUseSingleSignOn is returned for the password of an account that signs in with single sign-on
+	ErrUseSingleSignOn = errors.New("this account signs in with single sign-on")
+	// ErrAccountDisabled is returned when the account has been disabled
+	ErrAccountDisabled = errors.New("this account is disabled")
+	// ErrNotAllowed is returned when the user is in none of the allowed groups
+	ErrNotAllowed = errors.New("your account is not allowed to sign in to Farseer")
+	// ErrUsernameTaken is returned when a new external user's name belongs to another account
+	ErrUsernameTaken = errors.New("the username is taken by another account")
+)
+
+// PasswordAuthenticator checks passwords for the accounts of one provider
+type PasswordAuthenticator interface {
+	// Enabled reports whether the provider is configured
+	Enabled() bool
+	// Authenticate verifies the password of user, or for a nil user, of a
+	// username no account has yet, provisioning one if the provider can
+	Authenticate(user *models.User, username, password string) (*AuthResult, error)
+}
+
+// AuthResult is the account a password was verified for
+type AuthResult struct {
+	User        *models.User
+	Created     bool // Provisioned by this sign-in
+	RoleChanged bool // Role updated from the provider's groups
+	Reenabled   bool // Disabled account the provider vouches for again
+}
+
+// passwordAuthenticators maps User.AuthProvider to the provider checking
+// those accounts' passwords. Providers missing here have no passwords.
+var passwordAuthenticators = map[string]PasswordAuthenticator{
+	"":                      localAuthenticator{},
+	models.AuthProviderLDAP: ldapAuthenticator{},
+}
+
+// AuthenticatePassword verifies a username and password with the provider
+// the account belongs to. Unknown usernames are tried against the directory,
+// which provisions the account on first sign-in.
+func AuthenticatePassword(username, password string) (*AuthResult, error) {
+	var user models.User
+	err := database.DB.Where("username = ?", username).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if ldap := passwordAuthenticators[models.AuthProviderLDAP]; ldap.Enabled() {
+			return checkEnabled(ldap.Authenticate(nil, username, password))
+		}
+		return nil, ErrInvalidCredentials
+	} else if err != nil {
+		return nil, err
+	}
+
+	authenticator, ok := passwordAuthenticators[user.AuthProvider]
+	if !ok {
+		// Only tell who holds the local password that the account uses SSO
+		if _, err := (localAuthenticator{}).Authenticate(&user, username, password); err != nil {
+			return nil, err
+		}
+		return nil, ErrUseSingleSignOn
+	}
+	if !authenticator.Enabled() {
+		return nil, ErrInvalidCredentials
+	}
+	return checkEnabled(authenticator.Authenticate(&user, username, password))
+}
+
+func checkEnabled(result *AuthResult, err error) (*AuthResult, error) {
+	if err != nil {
+		return nil, err
+	}
+	if result.User.Disabled {
+		return nil, ErrAccountDisabled
+	}
+	return result, nil
+}
+
+// localAuthenticator checks the bcrypt hash stored with the account
+type localAuthenticator struct{}
+
+func (localAuthenticator) Enabled() bool { return true }
+
+func (localAuthenticator) Authenticate(user *models.User, username, password string) (*AuthResult, error) {
+	if user == nil || user.PasswordHash == "" {
+		return nil, ErrInvalidCredentials
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)); err != nil {
+		return nil, ErrInvalidCredentials
+	}
+	return &AuthResult{User: user}, nil
+}
+
+// groupRole maps an external provider's groups to a role. Without any group
+// mapping configured it returns an empty role, leaving the role to admins.
+// Groups are compared case-insensitively, as directories do.
+func groupRole(groups, adminGroups, userGroups []string) (models.Role, error) {
+	if len(adminGroups) == 0 && len(userGroups) == 0 {
+		return "", nil
+	}
+	if containsAny(groups, adminGroups) {
+		return models.RoleAdmin, nil
+	}
+	if len(userGroups) == 0 || containsAny(groups, userGroups) {
+		return models.RoleUser, nil
+	}
+	return "", ErrNotAllowed
+}
+
+// provisionExternalUser finds the user with the given ID at an external
+// provider, creating them on their first sign-in, and applies role if set
+func provisionExternalUser(provider, externalID, username string, role models.Role) (*AuthResult, error) {
+	user := &models.User{}
+	err := database.DB.Where("auth_provider = ? AND external_id = ?", provider, externalID).First(user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		// Never attach to an existing account by name: whoever controls that
+		// name at the provider would take over the local account
+		if !ValidUsername(username) {
+			return nil, ErrInvalidUsername
+		}
+		var count int64
+		database.DB.Unscoped().Model(&models.User{}).Where("username = ?", username).Count(&count)
+		if count > 0 || username == "" {
+			return nil, ErrUsernameTaken
+		}
+		if role == "" {
+			role = models.RoleUser
+		}
+		user = &models.User{
+			Username:     username,
+			Role:         role,
+			AuthProvider: provider,
+			ExternalID:   externalID,
+		}
+		if err := database.DB.Create(user).Error; err != nil {
+			return nil, err
+		}
+		return &AuthResult{User: user, Created: true}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	changed, err := applyExternalRole(user, role)
+	if err != nil {
+		return nil, err
+	}
+	return &AuthResult{User: user, RoleChanged: changed}, nil
+}
+
+// applyExternalRole sets the role an external provider's groups map to,
+// reporting whether it changed
+func applyExternalRole(user *models.User, role models.Role) (bool, error) {
+	if role == "" || role == user.Role {
+		return false, nil
+	}
+	if err := database.DB.Model(user).Update("role", role).Error; err != nil {
+		return false, err
+	}
+	// Tokens issued before carry the old role
+	if err := RevokeUserSessions(user); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func containsAny(values, wanted []string) bool {
+	for _, v := range values {
+		for _, w := range wanted {
+			if strings.EqualFold(v, w) {
+				return true
+			}
+		}
+	}
+	return false
+}
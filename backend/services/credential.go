@@ -0,0 +1,51 @@
+package services
+
+import (
+	"errors"
+
+	"farseer/database"
+	"farseer/models"
+)
+
+// ErrCredentialNotFound is returned when a machine links to a shared credential that no longer exists
+var ErrCredentialNotFound = errors.New("linked credential not found")
+
+// CredentialProvider loads the credential a machine authenticates with from
+// wherever it is kept
+type CredentialProvider interface {
+	GetCredential(machine *models.Machine, encryptionKey string) (*CredentialData, error)
+}
+
+// LocalCredentialProvider decrypts credentials stored in the database,
+// either on the machine itself or on the shared credential it links to
+type LocalCredentialProvider struct{}
+
+func (LocalCredentialProvider) GetCredential(machine *models.Machine, encryptionKey string) (*CredentialData, error) {
+	if machine.CredentialID == nil {
+		return DecryptCredential(machine.CredentialEncrypted, encryptionKey)
+	}
+
+	var credential models.Credential
+	if err := database.DB.Where("id = ? AND user_id = ?", *machine.CredentialID, machine.UserID).First(&credential).Error; err != nil {
+		return nil, ErrCredentialNotFound
+	}
+	return DecryptCredential(credential.SecretEncrypted, encryptionKey)
+}
+
+// CredentialProviderFor returns the provider holding a machine's credential
+func CredentialProviderFor(machine *models.Machine) (CredentialProvider, error) {
+	if machine.SecretPath != "" {
+		return NewKVCredentialProvider()
+	}
+	return LocalCredentialProvider{}, nil
+}
+
+// MachineCredential returns the credential a machine authenticates with,
+// decrypting it locally or fetching it from the external secret store
+func MachineCredential(machine *models.Machine, encryptionKey string) (*CredentialData, error) {
+	provider, err := CredentialProviderFor(machine)
+	if err != nil {
+		return nil, err
+	}
+	return provider.GetCredential(machine, encryptionKey)
+}
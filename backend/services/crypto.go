@@ -10,8 +10,6 @@ import (
 	"io"
 
 	"golang.org/x/crypto/pbkdf2"
-
-	"farseer/config"
 )
 
 const (
@@ -27,17 +25,21 @@ type CredentialData struct {
 	Passphrase string `json:"passphrase,omitempty"`
 }
 
-// EncryptedData holds the encrypted data with its salt
+// EncryptedData holds the encrypted data with its salt and the version of
+// the server secret it was sealed with (absent on data sealed before versioning)
 type EncryptedData struct {
+	Version    int    `json:"version,omitempty"`
 	Salt       []byte `json:"salt"`
 	Nonce      []byte `json:"nonce"`
 	Ciphertext []byte `json:"ciphertext"`
 }
 
-func deriveKey(password string, salt []byte) []byte {
-	cfg := config.GetConfig()
+// ErrUnknownKeyVersion is returned for data sealed with a server secret that is no longer known
+var ErrUnknownKeyVersion = errors.New("data sealed with an unknown server secret version")
+
+func deriveKey(password, serverSecret string, salt []byte) []byte {
 	// Combine user password with server secret for extra security
-	combined := password + cfg.ServerSecret
+	combined := password + serverSecret
 	return pbkdf2.Key([]byte(combined), salt, iterations, keyLength, sha256.New)
 }
 
@@ -48,15 +50,36 @@ func EncryptCredential(data *CredentialData, userPassword string) ([]byte, error
 	if err != nil {
 		return nil, err
 	}
+	return sealBytes(plaintext, userPassword)
+}
+
+// DecryptCredential decrypts credential data
+func DecryptCredential(encryptedBytes []byte, userPassword string) (*CredentialData, error) {
+	plaintext, err := openBytes(encryptedBytes, userPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unmarshal credential data
+	var data CredentialData
+	if err := json.Unmarshal(plaintext, &data); err != nil {
+		return nil, err
+	}
 
+	return &data, nil
+}
+
+// sealBytes encrypts plaintext with AES-256-GCM under a key derived from password and the server secret
+func sealBytes(plaintext []byte, password string) ([]byte, error) {
 	// Generate random salt
 	salt := make([]byte, saltLength)
 	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
 		return nil, err
 	}
 
-	// Derive key
-	key := deriveKey(userPassword, salt)
+	// Derive key from the current server secret
+	version, serverSecret := serverKeys.Current()
+	key := deriveKey(password, serverSecret, salt)
 
 	// Create cipher
 	block, err := aes.NewCipher(key)
@@ -80,6 +103,7 @@ func EncryptCredential(data *CredentialData, userPassword string) ([]byte, error
 
 	// Package everything together
 	encData := EncryptedData{
+		Version:    version,
 		Salt:       salt,
 		Nonce:      nonce,
 		Ciphertext: ciphertext,
@@ -88,16 +112,20 @@ func EncryptCredential(data *CredentialData, userPassword string) ([]byte, error
 	return json.Marshal(encData)
 }
 
-// DecryptCredential decrypts credential data
-func DecryptCredential(encryptedBytes []byte, userPassword string) (*CredentialData, error) {
+// openBytes reverses sealBytes
+func openBytes(encryptedBytes []byte, password string) ([]byte, error) {
 	// Unmarshal encrypted data
 	var encData EncryptedData
 	if err := json.Unmarshal(encryptedBytes, &encData); err != nil {
 		return nil, err
 	}
 
-	// Derive key
-	key := deriveKey(userPassword, encData.Salt)
+	// Derive key from the server secret the data was sealed with
+	serverSecret, ok := serverKeys.Secret(encData.Version)
+	if !ok {
+		return nil, ErrUnknownKeyVersion
+	}
+	key := deriveKey(password, serverSecret, encData.Salt)
 
 	// Create cipher
 	block, err := aes.NewCipher(key)
@@ -121,81 +149,34 @@ func DecryptCredential(encryptedBytes []byte, userPassword string) (*CredentialD
 		return nil, errors.New("decryption failed - invalid password or corrupted data")
 	}
 
-	// Unmarshal credential data
-	var data CredentialData
-	if err := json.Unmarshal(plaintext, &data); err != nil {
-		return nil, err
-	}
-
-	return &data, nil
+	return plaintext, nil
 }
 
-// EncryptTOTPSecret encrypts a TOTP secret using AES-256-GCM with the server secret
-func EncryptTOTPSecret(secret string, serverSecret string) (string, error) {
-	salt := make([]byte, saltLength)
-	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
-		return "", err
-	}
-
-	key := pbkdf2.Key([]byte(serverSecret), salt, iterations, keyLength, sha256.New)
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return "", err
-	}
-
-	gcm, err := cipher.NewGCM(block)
-	if err != nil {
-		return "", err
-	}
-
-	nonce := make([]byte, gcm.NonceSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
-		return "", err
-	}
-
-	ciphertext := gcm.Seal(nil, nonce, []byte(secret), nil)
-
-	encData := EncryptedData{
-		Salt:       salt,
-		Nonce:      nonce,
-		Ciphertext: ciphertext,
-	}
-
-	result, err := json.Marshal(encData)
+// EncryptTOTPSecret encrypts a TOTP secret using AES-256-GCM with the current server secret
+func EncryptTOTPSecret(secret string) (string, error) {
+	// No user key: the server secret alone is the key material
+	result, err := sealBytes([]byte(secret), "")
 	if err != nil {
 		return "", err
 	}
 	return string(result), nil
 }
 
-// DecryptTOTPSecret decrypts a TOTP secret
-func DecryptTOTPSecret(encrypted string, serverSecret string) (string, error) {
-	var encData EncryptedData
-	if err := json.Unmarshal([]byte(encrypted), &encData); err != nil {
-		return "", err
-	}
-
-	key := pbkdf2.Key([]byte(serverSecret), encData.Salt, iterations, keyLength, sha256.New)
-
-	block, err := aes.NewCipher(key)
-	if err != nil {
-		return "", err
-	}
-
-	gcm, err := cipher.NewGCM(block)
+// DecryptTOTPSecret decrypts a TOTP secret sealed with any known server secret
+func DecryptTOTPSecret(encrypted string) (string, error) {
+	plaintext, err := openBytes([]byte(encrypted), "")
 	if err != nil {
 		return "", err
 	}
+	return string(plaintext), nil
+}
 
-	if len(encData.Nonce) != gcm.NonceSize() {
-		return "", errors.New("invalid nonce size")
-	}
-
-	plaintext, err := gcm.Open(nil, encData.Nonce, encData.Ciphertext, nil)
-	if err != nil {
-		return "", errors.New("decryption failed")
+// KeyVersion returns the server secret version a sealed blob was encrypted
+// with, without decrypting it. Blobs sealed before versioning report 1.
+func KeyVersion(encryptedBytes []byte) int {
+	var encData EncryptedData
+	if err := json.Unmarshal(encryptedBytes, &encData); err != nil || encData.Version == 0 {
+		return 1
 	}
-
-	return string(plaintext), nil
+	return encData.Version
 }
@@ -0,0 +1,274 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"log"
+
+	"golang.org/x/crypto/pbkdf2"
+	"gorm.io/gorm"
+
+	"farseer/database"
+	"farseer/models"
+)
+
+// Stored credentials are protected by envelope encryption: each user has a
+// random data key that seals their machine credentials, and only the data key
+// is sealed with the key the client derives from the user's password (plus
+// the server secret). Changing the password re-wraps that single key.
+
+const (
+	dataKeyLength   = 32
+	clientKeySalt   = "farseer-credential-key-"
+	clientKeyLength = 32
+)
+
+// ErrInvalidEncryptionKey is returned when the supplied key cannot unwrap the user's data key
+var ErrInvalidEncryptionKey = errors.New("invalid encryption key")
+
+// DeriveClientKey reproduces the key the web client derives from the user's
+// password (see frontend/src/utils/crypto.ts)
+func DeriveClientKey(username, password string) string {
+	key := pbkdf2.Key([]byte(password), []byte(clientKeySalt+username), iterations, clientKeyLength, sha256.New)
+	return hex.EncodeToString(key)
+}
+
+func generateDataKey() (string, error) {
+	key := make([]byte, dataKeyLength)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
+}
+
+// UnlockDataKey returns the key that seals the user's stored credentials.
+// Users without a data key (not logged in since envelope encryption was
+// introduced) still have credentials sealed with the client key itself.
+func UnlockDataKey(userID uint, clientKey string) (string, error) {
+	var user models.User
+	if err := database.DB.Select("id", "data_key_encrypted").First(&user, userID).Error; err != nil {
+		return "", err
+	}
+
+	key := clientKey
+	if len(user.DataKeyEncrypted) > 0 {
+		dataKey, err := openBytes(user.DataKeyEncrypted, clientKey)
+		if err != nil {
+			return "", ErrInvalidEncryptionKey
+		}
+		key = string(dataKey)
+	}
+
+	// Having the key is the chance to move anything sealed with a retired server secret
+	if err := upgradeKeyVersion(&user, clientKey, key); err != nil {
+		log.Printf("User %d: failed to re-seal credentials with the current server secret: %v", user.ID, err)
+	}
+	return key, nil
+}
+
+// EnsureDataKey gives the user a data key if they have none, moving any
+// credentials sealed directly with the client key under it. It must only be
+// called with a client key derived from a verified password.
+func EnsureDataKey(user *models.User, clientKey string) error {
+	if len(user.DataKeyEncrypted) > 0 {
+		return nil
+	}
+
+	dataKey, err := generateDataKey()
+	if err != nil {
+		return err
+	}
+	wrapped, err := sealBytes([]byte(dataKey), clientKey)
+	if err != nil {
+		return err
+	}
+
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		_, err := resealUserCredentials(tx, user.ID, func(blob []byte) ([]byte, error) {
+			return reseal(blob, clientKey, dataKey)
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Model(user).Update("data_key_encrypted", wrapped).Error
+	})
+	if err != nil {
+		return err
+	}
+
+	user.DataKeyEncrypted = wrapped
+	return nil
+}
+
+// RewrapDataKey seals the user's data key under a new client key after a
+// password change. The old client key must be the one in use before the change.
+func RewrapDataKey(user *models.User, oldClientKey, newClientKey string) error {
+	if err := EnsureDataKey(user, oldClientKey); err != nil {
+		return err
+	}
+
+	dataKey, err := openBytes(user.DataKeyEncrypted, oldClientKey)
+	if err != nil {
+		return ErrInvalidEncryptionKey
+	}
+	wrapped, err := sealBytes(dataKey, newClientKey)
+	if err != nil {
+		return err
+	}
+	if err := database.DB.Model(user).Update("data_key_encrypted", wrapped).Error; err != nil {
+		return err
+	}
+
+	user.DataKeyEncrypted = wrapped
+	return nil
+}
+
+// ResetDataKey is the recovery path for a password reset by an administrator.
+// Without the previous password the old data key cannot be unwrapped, so the
+// user's stored secrets are cleared (machines, groups and settings are kept)
+// and a fresh data key is sealed under the new password. It returns the
+// number of machines and shared credentials whose secret was cleared.
+func ResetDataKey(user *models.User, newClientKey string) (int64, error) {
+	dataKey, err := generateDataKey()
+	if err != nil {
+		return 0, err
+	}
+	wrapped, err := sealBytes([]byte(dataKey), newClientKey)
+	if err != nil {
+		return 0, err
+	}
+
+	var cleared int64
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		result := tx.Model(&models.Machine{}).
+			Where("user_id = ? AND credential_encrypted IS NOT NULL", user.ID).
+			Updates(map[string]interface{}{"credential_encrypted": nil, "public_key": ""})
+		if result.Error != nil {
+			return result.Error
+		}
+		cleared += result.RowsAffected
+
+		result = tx.Model(&models.Credential{}).
+			Where("user_id = ? AND secret_encrypted IS NOT NULL", user.ID).
+			Update("secret_encrypted", nil)
+		if result.Error != nil {
+			return result.Error
+		}
+		cleared += result.RowsAffected
+
+		// API tokens carry the old data key, which now unlocks nothing
+		if err := tx.Model(&models.APIToken{}).Where("user_id = ?", user.ID).Update("data_key_sealed", nil).Error; err != nil {
+			return err
+		}
+
+		return tx.Model(user).Update("data_key_encrypted", wrapped).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	user.DataKeyEncrypted = wrapped
+	return cleared, nil
+}
+
+// MigrateLegacyCredentials moves secrets still sealed with a pre-envelope key
+// under the user's data key: those written with the username fallback key
+// used when requests carried no X-Encryption-Key, and any sealed directly with
+// the client key that EnsureDataKey could not move. Secrets encrypted under a
+// username the account no longer has cannot be recovered this way. It runs
+// once per user and returns the number of secrets re-sealed.
+func MigrateLegacyCredentials(user *models.User, clientKey string) (int, error) {
+	if user.LegacyKeysMigrated || len(user.DataKeyEncrypted) == 0 {
+		return 0, nil
+	}
+
+	dataKey, err := openBytes(user.DataKeyEncrypted, clientKey)
+	if err != nil {
+		return 0, ErrInvalidEncryptionKey
+	}
+	legacyKeys := []string{user.Username, clientKey}
+
+	var migrated int
+	err = database.DB.Transaction(func(tx *gorm.DB) error {
+		var err error
+		migrated, err = resealUserCredentials(tx, user.ID, func(blob []byte) ([]byte, error) {
+			if _, err := openBytes(blob, string(dataKey)); err == nil {
+				return nil, nil
+			}
+			for _, key := range legacyKeys {
+				if resealed, err := reseal(blob, key, string(dataKey)); err == nil {
+					return resealed, nil
+				}
+			}
+			return nil, errors.New("no known key opens it")
+		})
+		if err != nil {
+			return err
+		}
+		return tx.Model(user).Update("legacy_keys_migrated", true).Error
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	user.LegacyKeysMigrated = true
+	return migrated, nil
+}
+
+// resealUserCredentials passes every stored secret of a user through fn and
+// saves the result. Secrets fn fails on are logged and left untouched, as are
+// those for which it returns nil. It returns the number of secrets re-sealed.
+func resealUserCredentials(tx *gorm.DB, userID uint, fn func(blob []byte) ([]byte, error)) (int, error) {
+	var resealedCount int
+
+	var machines []models.Machine
+	if err := tx.Where("user_id = ? AND credential_encrypted IS NOT NULL", userID).Find(&machines).Error; err != nil {
+		return 0, err
+	}
+	for _, machine := range machines {
+		resealed, err := fn(machine.CredentialEncrypted)
+		if err != nil {
+			log.Printf("Machine %d: leaving credential sealed with its previous key: %v", machine.ID, err)
+			continue
+		}
+		if resealed == nil {
+			continue
+		}
+		// Only if unchanged since it was read, so a concurrent update is not overwritten
+		if err := tx.Model(&machine).Where("credential_encrypted = ?", machine.CredentialEncrypted).Update("credential_encrypted", resealed).Error; err != nil {
+			return 0, err
+		}
+		resealedCount++
+	}
+
+	var credentials []models.Credential
+	if err := tx.Where("user_id = ? AND secret_encrypted IS NOT NULL", userID).Find(&credentials).Error; err != nil {
+		return 0, err
+	}
+	for _, credential := range credentials {
+		resealed, err := fn(credential.SecretEncrypted)
+		if err != nil {
+			log.Printf("Credential %d: leaving secret sealed with its previous key: %v", credential.ID, err)
+			continue
+		}
+		if resealed == nil {
+			continue
+		}
+		if err := tx.Model(&credential).Where("secret_encrypted = ?", credential.SecretEncrypted).Update("secret_encrypted", resealed).Error; err != nil {
+			return 0, err
+		}
+		resealedCount++
+	}
+
+	return resealedCount, nil
+}
+
+func reseal(blob []byte, fromKey, toKey string) ([]byte, error) {
+	data, err := DecryptCredential(blob, fromKey)
+	if err != nil {
+		return nil, err
+	}
+	return EncryptCredential(data, toKey)
+}
@@ -0,0 +1,149 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"farseer/config"
+	"farseer/database"
+	"farseer/models"
+)
+
+// errHostKeyCaptured aborts the handshake once the host key has been received
+var errHostKeyCaptured = errors.New("host key captured")
+
+// ScanHostKey fetches a server's host key without authenticating, like
+// ssh-keyscan. Only the key exchange is performed.
+func ScanHostKey(hostname string, port int) (ssh.PublicKey, error) {
+	var hostKey ssh.PublicKey
+
+	sshConfig := &ssh.ClientConfig{
+		User: "farseer",
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKey = key
+			return errHostKeyCaptured
+		},
+		Timeout: 15 * time.Second,
+	}
+
+	addr := net.JoinHostPort(hostname, strconv.Itoa(port))
+	client, err := ssh.Dial("tcp", addr, sshConfig)
+	if client != nil {
+		client.Close()
+	}
+	if hostKey == nil {
+		return nil, fmt.Errorf("failed to fetch host key: %w", err)
+	}
+
+	return hostKey, nil
+}
+
+// CheckMachineHostKey scans a machine's host key, compares it with the
+// trusted key and records it in the machine's history. A newly seen
+// mismatching key raises an audit event and notifies the machine's owner
+// and the admins.
+func CheckMachineHostKey(machine *models.Machine) (*models.HostKeyRecord, error) {
+	key, err := ScanHostKey(machine.Hostname, machine.Port)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	fingerprint := ssh.FingerprintSHA256(key)
+
+	status := "match"
+	if machine.HostKey == "" {
+		status = "new"
+	} else if machine.HostKey != fingerprint {
+		status = "mismatch"
+	}
+
+	database.DB.Model(machine).Update("host_key_scanned_at", now)
+
+	// Extend the latest record if the key hasn't changed since the last scan
+	var latest models.HostKeyRecord
+	result := database.DB.Where("machine_id = ?", machine.ID).Order("id DESC").First(&latest)
+	if result.Error == nil && latest.Fingerprint == fingerprint {
+		latest.LastSeenAt = now
+		if err := database.DB.Model(&latest).Update("last_seen_at", now).Error; err != nil {
+			return nil, err
+		}
+		return &latest, nil
+	}
+
+	record := models.HostKeyRecord{
+		MachineID:   machine.ID,
+		Fingerprint: fingerprint,
+		KeyType:     key.Type(),
+		Status:      status,
+		FirstSeenAt: now,
+		LastSeenAt:  now,
+	}
+	if err := database.DB.Create(&record).Error; err != nil {
+		return nil, err
+	}
+
+	if status == "mismatch" {
+		reportHostKeyMismatch(machine, fingerprint)
+	}
+
+	return &record, nil
+}
+
+// reportHostKeyMismatch audits a changed host key and alerts the machine's
+// owner and every admin
+func reportHostKeyMismatch(machine *models.Machine, fingerprint string) {
+	details := fmt.Sprintf("Host key for %s changed: expected %s, got %s", machine.Hostname, machine.HostKey, fingerprint)
+	title := "Host key changed: " + machine.Name
+
+	var owner models.User
+	database.DB.Select("username").First(&owner, machine.UserID)
+
+	LogAudit(machine.UserID, owner.Username, models.AuditActionHostKeyMismatch, &machine.ID, machine.Name, details, "")
+
+	Notify(machine.UserID, models.NotificationHostKeyMismatch, title, details, &machine.ID)
+
+	// Admins don't own the machine, so their alert names the owner instead
+	// of linking to it
+	var adminIDs []uint
+	if err := database.DB.Model(&models.User{}).Where("role = ? AND id <> ?", models.RoleAdmin, machine.UserID).Pluck("id", &adminIDs).Error; err != nil {
+		log.Printf("Host key scan: failed to load admins to alert: %v", err)
+		return
+	}
+	for _, adminID := range adminIDs {
+		Notify(adminID, models.NotificationHostKeyMismatch, title, details+" (machine owned by "+owner.Username+")", nil)
+	}
+}
+
+// StartHostKeyScanner periodically checks the host key of every machine that
+// has a trusted key. The interval is re-read from the config before each run.
+func StartHostKeyScanner() {
+	go func() {
+		for {
+			cfg := config.GetConfig()
+			time.Sleep(time.Duration(cfg.HostKeyScanIntervalMinutes) * time.Minute)
+
+			if cfg.HostKeyScanDisabled {
+				continue
+			}
+
+			var machines []models.Machine
+			if err := database.DB.Where("host_key != ''").Find(&machines).Error; err != nil {
+				log.Printf("Host key scan: failed to load machines: %v", err)
+				continue
+			}
+
+			for i := range machines {
+				if _, err := CheckMachineHostKey(&machines[i]); err != nil {
+					log.Printf("Host key scan: machine %d (%s): %v", machines[i].ID, machines[i].Hostname, err)
+				}
+			}
+		}
+	}()
+}
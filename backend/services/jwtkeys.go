@@ -0,0 +1,442 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"farseer/config"
+)
+
+// JWTAlgorithms are the algorithms JWT keys can sign with
+var JWTAlgorithms = []string{"EdDSA", "ES256"}
+
+// ErrUnknownJWTKey is returned for tokens signed by a key Farseer does not
+// have, or no longer accepts
+var ErrUnknownJWTKey = errors.New("unknown JWT signing key")
+
+// Audiences of the tokens Farseer signs. Only access tokens grant access to
+// the API; the others carry a sign-in through its next step, and other
+// services verifying tokens against the JWKS should accept JWTAudienceAccess
+// alone.
+const (
+	JWTAudienceAccess       = "farseer"
+	JWTAudienceSecondFactor = "farseer-second-factor"
+	JWTAudiencePasswordStep = "farseer-password-step"
+)
+
+// jwtKeyring holds the JWT signing keys in memory, the current one first
+type jwtKeyring struct {
+	mu   sync.RWMutex
+	keys []*jwtKey
+}
+
+type jwtKey struct {
+	config.JWTKey
+	signer crypto.Signer
+}
+
+var jwtKeys = &jwtKeyring{}
+
+// JSONWebKey is the public half of a signing key, as published in the JWKS
+type JSONWebKey struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+	Y         string `json:"y,omitempty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	Use       string `json:"use"`
+}
+
+// JWTKeyInfo describes a signing key for the settings page
+type JWTKeyInfo struct {
+	KID       string     `json:"kid"`
+	Algorithm string     `json:"alg"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"` // When a retired key stops verifying tokens
+	Current   bool       `json:"current"`
+}
+
+// JWTKeyStatus lists the signing keys and when the next rotation is due
+type JWTKeyStatus struct {
+	Keys         []JWTKeyInfo `json:"keys"`
+	Algorithm    string       `json:"algorithm"` // For the next key
+	RotationDays int          `json:"rotation_days"`
+	NextRotation time.Time    `json:"next_rotation"`
+}
+
+// InitJWTKeys loads the JWT signing keys, generating the first one on a new
+// install
+func InitJWTKeys() error {
+	cfg := config.GetConfig()
+	if !validJWTAlgorithm(cfg.JWTAlgorithm) {
+		return fmt.Errorf("unknown jwt_algorithm %q, use EdDSA or ES256", cfg.JWTAlgorithm)
+	}
+
+	var keys []*jwtKey
+	if len(cfg.JWTKeys) == 0 {
+		key, err := generateJWTKey(cfg.JWTAlgorithm)
+		if err != nil {
+			return err
+		}
+		keys = []*jwtKey{key}
+		if err := saveJWTKeys(cfg, keys); err != nil {
+			return err
+		}
+	} else {
+		for _, stored := range cfg.JWTKeys {
+			key, err := parseJWTKey(stored)
+			if err != nil {
+				return fmt.Errorf("JWT key %s: %w", stored.KID, err)
+			}
+			keys = append(keys, key)
+		}
+		if err := wrapConfigJWTKeys(cfg, keys); err != nil {
+			return err
+		}
+	}
+
+	jwtKeys.mu.Lock()
+	jwtKeys.keys = keys
+	jwtKeys.mu.Unlock()
+	return nil
+}
+
+// SignJWT signs claims with the current key, naming it in the kid header
+func SignJWT(claims jwt.Claims) (string, error) {
+	jwtKeys.mu.RLock()
+	key := jwtKeys.keys[0]
+	jwtKeys.mu.RUnlock()
+
+	token := jwt.NewWithClaims(jwt.GetSigningMethod(key.Algorithm), claims)
+	token.Header["kid"] = key.KID
+	return token.SignedString(key.signer)
+}
+
+// ParseJWT verifies a token against the key its kid header names. Each key
+// only verifies its own algorithm. The token must come from this issuer, be
+// meant for the audience and expire.
+func ParseJWT(tokenString string, claims jwt.Claims, audience string) (*jwt.Token, error) {
+	return jwt.ParseWithClaims(tokenString, claims, jwtVerificationKey,
+		jwt.WithValidMethods(JWTAlgorithms),
+		jwt.WithIssuer(config.GetConfig().JWTIssuer),
+		jwt.WithAudience(audience),
+		jwt.WithExpirationRequired())
+}
+
+func jwtVerificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	now := time.Now()
+
+	jwtKeys.mu.RLock()
+	defer jwtKeys.mu.RUnlock()
+	for _, key := range jwtKeys.keys {
+		if key.KID != kid || !key.verifies(now) {
+			continue
+		}
+		if token.Method.Alg() != key.Algorithm {
+			return nil, fmt.Errorf("key %s does not sign with %s", kid, token.Method.Alg())
+		}
+		return key.signer.Public(), nil
+	}
+	return nil, ErrUnknownJWTKey
+}
+
+// verifies reports whether the key still verifies tokens: it is current, or
+// was retired less than the overlap ago
+func (k *jwtKey) verifies(now time.Time) bool {
+	return k.RetiredAt == nil || now.Before(k.RetiredAt.Add(jwtKeyOverlap()))
+}
+
+// jwtKeyOverlap is how long a retired key keeps verifying tokens. It is never
+// shorter than the tokens it signed live.
+func jwtKeyOverlap() time.Duration {
+	cfg := config.GetConfig()
+	overlap := time.Duration(cfg.JWTKeyOverlapHours) * time.Hour
+	if lifetime := time.Duration(cfg.AccessTokenMinutes) * time.Minute; overlap < lifetime {
+		return lifetime
+	}
+	return overlap
+}
+
+// RotateJWTKey makes a new key current. Tokens signed by the previous one
+// stay valid for the overlap, after which the key is removed.
+func RotateJWTKey() (*JWTKeyInfo, error) {
+	cfg := config.GetConfig()
+	key, err := generateJWTKey(cfg.JWTAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	jwtKeys.mu.Lock()
+	defer jwtKeys.mu.Unlock()
+
+	now := time.Now()
+	keys := []*jwtKey{key}
+	for _, old := range jwtKeys.keys {
+		retired := *old
+		if retired.RetiredAt == nil {
+			retired.RetiredAt = &now
+		}
+		if retired.verifies(now) {
+			keys = append(keys, &retired)
+		}
+	}
+	if err := saveJWTKeys(cfg, keys); err != nil {
+		return nil, err
+	}
+	jwtKeys.keys = keys
+
+	info := key.info(true)
+	return &info, nil
+}
+
+// pruneJWTKeys removes retired keys whose overlap has passed
+func pruneJWTKeys() error {
+	jwtKeys.mu.Lock()
+	defer jwtKeys.mu.Unlock()
+
+	now := time.Now()
+	keys := make([]*jwtKey, 0, len(jwtKeys.keys))
+	for _, key := range jwtKeys.keys {
+		if key.verifies(now) {
+			keys = append(keys, key)
+		}
+	}
+	if len(keys) == len(jwtKeys.keys) {
+		return nil
+	}
+	if err := saveJWTKeys(config.GetConfig(), keys); err != nil {
+		return err
+	}
+	jwtKeys.keys = keys
+	return nil
+}
+
+func saveJWTKeys(cfg *config.Config, keys []*jwtKey) error {
+	stored := make([]config.JWTKey, len(keys))
+	for i, key := range keys {
+		stored[i] = key.JWTKey
+	}
+	return cfg.UpdateJWTKeys(stored)
+}
+
+// JWKS returns the public keys that verify Farseer's tokens, for other
+// services to check them without a shared secret
+func JWKS() []JSONWebKey {
+	now := time.Now()
+	jwtKeys.mu.RLock()
+	defer jwtKeys.mu.RUnlock()
+
+	set := make([]JSONWebKey, 0, len(jwtKeys.keys))
+	for _, key := range jwtKeys.keys {
+		if !key.verifies(now) {
+			continue
+		}
+		jwk := JSONWebKey{KeyID: key.KID, Algorithm: key.Algorithm, Use: "sig"}
+		switch public := key.signer.Public().(type) {
+		case ed25519.PublicKey:
+			jwk.KeyType, jwk.Curve = "OKP", "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public)
+		case *ecdsa.PublicKey:
+			jwk.KeyType, jwk.Curve = "EC", "P-256"
+			jwk.X = base64.RawURLEncoding.EncodeToString(public.X.FillBytes(make([]byte, 32)))
+			jwk.Y = base64.RawURLEncoding.EncodeToString(public.Y.FillBytes(make([]byte, 32)))
+		}
+		set = append(set, jwk)
+	}
+	return set
+}
+
+// GetJWTKeyStatus lists the signing keys
+func GetJWTKeyStatus() *JWTKeyStatus {
+	cfg := config.GetConfig()
+	jwtKeys.mu.RLock()
+	defer jwtKeys.mu.RUnlock()
+
+	status := &JWTKeyStatus{
+		Keys:         make([]JWTKeyInfo, len(jwtKeys.keys)),
+		Algorithm:    cfg.JWTAlgorithm,
+		RotationDays: cfg.JWTKeyRotationDays,
+		NextRotation: jwtKeys.keys[0].CreatedAt.AddDate(0, 0, cfg.JWTKeyRotationDays),
+	}
+	for i, key := range jwtKeys.keys {
+		status.Keys[i] = key.info(i == 0)
+	}
+	return status
+}
+
+func (k *jwtKey) info(current bool) JWTKeyInfo {
+	info := JWTKeyInfo{
+		KID:       k.KID,
+		Algorithm: k.Algorithm,
+		CreatedAt: k.CreatedAt,
+		RetiredAt: k.RetiredAt,
+		Current:   current,
+	}
+	if k.RetiredAt != nil {
+		expires := k.RetiredAt.Add(jwtKeyOverlap())
+		info.ExpiresAt = &expires
+	}
+	return info
+}
+
+// StartJWTKeyRotation rotates the signing key once it is older than
+// JWTKeyRotationDays and removes retired keys after the overlap, checking
+// hourly
+func StartJWTKeyRotation() {
+	go func() {
+		for {
+			cfg := config.GetConfig()
+			jwtKeys.mu.RLock()
+			due := time.Now().After(jwtKeys.keys[0].CreatedAt.AddDate(0, 0, cfg.JWTKeyRotationDays))
+			jwtKeys.mu.RUnlock()
+
+			if due {
+				if key, err := RotateJWTKey(); err != nil {
+					log.Printf("JWT key rotation: %v", err)
+				} else {
+					log.Printf("JWT key rotation: now signing with %s (%s)", key.KID, key.Algorithm)
+				}
+			}
+			if err := pruneJWTKeys(); err != nil {
+				log.Printf("JWT key rotation: failed to remove retired keys: %v", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func validJWTAlgorithm(alg string) bool {
+	for _, valid := range JWTAlgorithms {
+		if alg == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// wrapConfigJWTKeys moves JWT keys kept in the config file as is under the key
+// provider, once one is configured
+func wrapConfigJWTKeys(cfg *config.Config, keys []*jwtKey) error {
+	provider := serverKeys.Provider()
+	if provider == nil {
+		return nil
+	}
+	wrapped := 0
+	for _, key := range keys {
+		if key.PrivateKey == "" {
+			continue
+		}
+		if err := sealJWTKey(&key.JWTKey, key.PrivateKey); err != nil {
+			return err
+		}
+		wrapped++
+	}
+	if wrapped == 0 {
+		return nil
+	}
+	if err := saveJWTKeys(cfg, keys); err != nil {
+		return err
+	}
+	log.Printf("Moved %d JWT keys from the config file under the %s key provider", wrapped, provider.Name())
+	return nil
+}
+
+// sealJWTKey stores a private key wrapped by the key provider protecting the
+// server secrets, or as is when there is none
+func sealJWTKey(stored *config.JWTKey, privateKey string) error {
+	provider := serverKeys.Provider()
+	if provider == nil {
+		stored.PrivateKey, stored.WrappedPrivateKey = privateKey, ""
+		return nil
+	}
+	wrapped, err := provider.Wrap(privateKey)
+	if err != nil {
+		return fmt.Errorf("failed to wrap JWT key: %w", err)
+	}
+	stored.PrivateKey, stored.WrappedPrivateKey = "", wrapped
+	return nil
+}
+
+func generateJWTKey(alg string) (*jwtKey, error) {
+	var private crypto.Signer
+	var err error
+	switch alg {
+	case "EdDSA":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	case "ES256":
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("unknown JWT algorithm %q", alg)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	kid := make([]byte, 8)
+	if _, err := rand.Read(kid); err != nil {
+		return nil, err
+	}
+	key := &jwtKey{
+		JWTKey: config.JWTKey{KID: hex.EncodeToString(kid), Algorithm: alg, CreatedAt: time.Now()},
+		signer: private,
+	}
+	if err := sealJWTKey(&key.JWTKey, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func parseJWTKey(stored config.JWTKey) (*jwtKey, error) {
+	privateKey := stored.PrivateKey
+	if stored.WrappedPrivateKey != "" {
+		provider := serverKeys.Provider()
+		if provider == nil {
+			return nil, errors.New("private key is wrapped by a key provider, configure it to start")
+		}
+		var err error
+		if privateKey, err = provider.Unwrap(stored.WrappedPrivateKey); err != nil {
+			return nil, fmt.Errorf("failed to unwrap private key: %w", err)
+		}
+	}
+	block, _ := pem.Decode([]byte(privateKey))
+	if block == nil {
+		return nil, errors.New("private key is not PEM")
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	switch key := private.(type) {
+	case ed25519.PrivateKey:
+		if stored.Algorithm == "EdDSA" {
+			return &jwtKey{JWTKey: stored, signer: key}, nil
+		}
+	case *ecdsa.PrivateKey:
+		if stored.Algorithm == "ES256" && key.Curve == elliptic.P256() {
+			return &jwtKey{JWTKey: stored, signer: key}, nil
+		}
+	}
+	return nil, fmt.Errorf("private key does not match algorithm %s", stored.Algorithm)
+}
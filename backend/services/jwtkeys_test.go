@@ -0,0 +1,123 @@
+package services
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+
+	"farseer/config"
+)
+
+// useJWTKeys starts the test from a fresh set of signing keys under the key
+// provider, restoring the config and keys afterwards
+func useJWTKeys(t *testing.T, provider KeyProvider) *config.Config {
+	t.Helper()
+	cfg := config.GetConfig()
+	saved := *cfg
+	savedProvider := serverKeys.Provider()
+	jwtKeys.mu.RLock()
+	savedKeys := jwtKeys.keys
+	jwtKeys.mu.RUnlock()
+	t.Cleanup(func() {
+		*cfg = saved
+		setKeyProvider(savedProvider)
+		jwtKeys.mu.Lock()
+		jwtKeys.keys = savedKeys
+		jwtKeys.mu.Unlock()
+	})
+
+	cfg.JWTKeys = nil
+	setKeyProvider(provider)
+	if err := InitJWTKeys(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func setKeyProvider(provider KeyProvider) {
+	serverKeys.mu.Lock()
+	defer serverKeys.mu.Unlock()
+	serverKeys.provider = provider
+}
+
+func TestJWTKeysWrapped(t *testing.T) {
+	t.Setenv(masterKeyEnv, "env-master-key-0123456789abcdef01234")
+	provider, err := NewEnvKeyProvider()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := useJWTKeys(t, nil)
+	plain := cfg.JWTKeys[0]
+	if plain.PrivateKey == "" || plain.WrappedPrivateKey != "" {
+		t.Fatalf("without a key provider the key should be kept as is: %+v", plain)
+	}
+	token, err := SignJWT(jwt.RegisteredClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A key provider configured later wraps the existing key on start
+	setKeyProvider(provider)
+	if err := InitJWTKeys(); err != nil {
+		t.Fatal(err)
+	}
+	moved := cfg.JWTKeys[0]
+	if moved.KID != plain.KID || moved.PrivateKey != "" || moved.WrappedPrivateKey == "" {
+		t.Fatalf("key not moved under the key provider: %+v", moved)
+	}
+	if _, err := jwt.Parse(token, jwtVerificationKey); err != nil {
+		t.Errorf("token signed before the move: %v", err)
+	}
+
+	if _, err := RotateJWTKey(); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range cfg.JWTKeys {
+		if key.PrivateKey != "" || key.WrappedPrivateKey == "" {
+			t.Errorf("key %s stored unwrapped", key.KID)
+		}
+	}
+
+	setKeyProvider(nil)
+	if err := InitJWTKeys(); err == nil {
+		t.Error("wrapped keys loaded without the key provider")
+	}
+}
+
+func TestParseJWTAudience(t *testing.T) {
+	cfg := useJWTKeys(t, nil)
+	expires := jwt.NewNumericDate(time.Now().Add(time.Minute))
+	claims := func(issuer, audience string, expiresAt *jwt.NumericDate) jwt.RegisteredClaims {
+		return jwt.RegisteredClaims{Issuer: issuer, Audience: jwt.ClaimStrings{audience}, ExpiresAt: expiresAt}
+	}
+
+	tests := []struct {
+		name     string
+		claims   jwt.RegisteredClaims
+		audience string
+		valid    bool
+	}{
+		{"access token", claims(cfg.JWTIssuer, JWTAudienceAccess, expires), JWTAudienceAccess, true},
+		{"second factor token", claims(cfg.JWTIssuer, JWTAudienceSecondFactor, expires), JWTAudienceSecondFactor, true},
+		{"second factor token as access", claims(cfg.JWTIssuer, JWTAudienceSecondFactor, expires), JWTAudienceAccess, false},
+		{"password step token as access", claims(cfg.JWTIssuer, JWTAudiencePasswordStep, expires), JWTAudienceAccess, false},
+		{"access token as second factor", claims(cfg.JWTIssuer, JWTAudienceAccess, expires), JWTAudienceSecondFactor, false},
+		{"other issuer", claims("elsewhere", JWTAudienceAccess, expires), JWTAudienceAccess, false},
+		{"no expiry", claims(cfg.JWTIssuer, JWTAudienceAccess, nil), JWTAudienceAccess, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := SignJWT(tt.claims)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = ParseJWT(token, &jwt.RegisteredClaims{}, tt.audience)
+			if tt.valid && err != nil {
+				t.Errorf("rejected: %v", err)
+			} else if !tt.valid && err == nil {
+				t.Error("accepted")
+			}
+		})
+	}
+}
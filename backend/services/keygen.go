@@ -0,0 +1,100 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Supported key types for generated key pairs
+const (
+	KeyTypeEd25519 = "ed25519"
+	KeyTypeRSA     = "rsa"
+)
+
+const defaultRSABits = 4096
+
+// KeyPair is a generated SSH key pair
+type KeyPair struct {
+	PrivateKey    string // OpenSSH PEM encoded private key
+	AuthorizedKey string // Public key in authorized_keys format, without trailing newline
+	Fingerprint   string
+}
+
+// GenerateKeyPair creates a new Ed25519 or RSA key pair. bits is only used
+// for RSA keys and defaults to 4096.
+func GenerateKeyPair(keyType string, bits int, comment string) (*KeyPair, error) {
+	var privateKey crypto.PrivateKey
+	var publicKey crypto.PublicKey
+
+	switch keyType {
+	case KeyTypeEd25519, "":
+		pub, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate key: %w", err)
+		}
+		privateKey, publicKey = priv, pub
+	case KeyTypeRSA:
+		if bits == 0 {
+			bits = defaultRSABits
+		}
+		if bits < 2048 || bits > 8192 {
+			return nil, fmt.Errorf("RSA key size must be between 2048 and 8192 bits")
+		}
+		priv, err := rsa.GenerateKey(rand.Reader, bits)
+		if err != nil {
+			return nil, fmt.Errorf("failed to generate key: %w", err)
+		}
+		privateKey, publicKey = priv, &priv.PublicKey
+	default:
+		return nil, fmt.Errorf("unsupported key type: %s", keyType)
+	}
+
+	block, err := ssh.MarshalPrivateKey(privateKey, comment)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode private key: %w", err)
+	}
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode public key: %w", err)
+	}
+
+	authorizedKey := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sshPublicKey)))
+	if comment != "" {
+		authorizedKey += " " + comment
+	}
+
+	return &KeyPair{
+		PrivateKey:    string(pem.EncodeToMemory(block)),
+		AuthorizedKey: authorizedKey,
+		Fingerprint:   ssh.FingerprintSHA256(sshPublicKey),
+	}, nil
+}
+
+// installAuthorizedKeyScript appends the key read from stdin to
+// ~/.ssh/authorized_keys unless an identical line is already present
+const installAuthorizedKeyScript = `umask 077
+IFS= read -r key || exit 1
+mkdir -p ~/.ssh && chmod 700 ~/.ssh || exit 1
+touch ~/.ssh/authorized_keys && chmod 600 ~/.ssh/authorized_keys || exit 1
+grep -qxF "$key" ~/.ssh/authorized_keys && exit 0
+if [ -s ~/.ssh/authorized_keys ] && [ -n "$(tail -c 1 ~/.ssh/authorized_keys)" ]; then
+	echo >> ~/.ssh/authorized_keys
+fi
+printf '%s\n' "$key" >> ~/.ssh/authorized_keys`
+
+// InstallAuthorizedKey idempotently adds a public key to the remote user's
+// authorized_keys file, like ssh-copy-id
+func (s *SSHSession) InstallAuthorizedKey(authorizedKey string) error {
+	if _, err := s.Run(installAuthorizedKeyScript, authorizedKey+"\n"); err != nil {
+		return fmt.Errorf("failed to install public key: %w", err)
+	}
+	return nil
+}
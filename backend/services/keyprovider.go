@@ -0,0 +1,228 @@
+package services
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	keyProviderTimeout = 10 * time.Second
+	// masterKeyEnv holds the master key for the "env" key provider
+	masterKeyEnv = "FARSEER_MASTER_KEY"
+	// minMasterKeyLength rejects master keys too short to be random
+	minMasterKeyLength = 32
+)
+
+// KeyProvider protects the server secrets at rest. Secrets are stored wrapped
+// and only ever held unwrapped in memory.
+type KeyProvider interface {
+	Name() string
+	Wrap(secret string) (string, error)
+	Unwrap(wrapped string) (string, error)
+}
+
+// masterKeyProvider wraps secrets locally with AES-256-GCM under a master key
+// obtained from a file, the environment or a key management service
+type masterKeyProvider struct {
+	name string
+	gcm  cipher.AEAD
+}
+
+func newMasterKeyProvider(name string, material []byte) (*masterKeyProvider, error) {
+	if len(material) < minMasterKeyLength {
+		return nil, fmt.Errorf("%s master key must be at least %d bytes", name, minMasterKeyLength)
+	}
+	key := sha256.Sum256(material)
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &masterKeyProvider{name: name, gcm: gcm}, nil
+}
+
+// NewFileKeyProvider reads the master key from a file
+func NewFileKeyProvider(path string) (KeyProvider, error) {
+	if path == "" {
+		return nil, errors.New("key provider file is not set")
+	}
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0077 != 0 {
+		log.Printf("Warning: master key file %s is accessible by other users", path)
+	}
+	material, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read master key: %w", err)
+	}
+	return newMasterKeyProvider("file", bytes.TrimSpace(material))
+}
+
+// NewEnvKeyProvider reads the master key from FARSEER_MASTER_KEY
+func NewEnvKeyProvider() (KeyProvider, error) {
+	material := os.Getenv(masterKeyEnv)
+	if material == "" {
+		return nil, fmt.Errorf("%s is not set", masterKeyEnv)
+	}
+	return newMasterKeyProvider("env", []byte(material))
+}
+
+// NewKMSKeyProvider fetches the master key from a key management service:
+// GET {address}/v1/keys/{name} answering {"key": "<base64>"}
+func NewKMSKeyProvider(address, keyName, token string) (KeyProvider, error) {
+	var resp struct {
+		Key string `json:"key"`
+	}
+	endpoint := "/v1/keys/" + url.PathEscape(keyName)
+	headers := map[string]string{}
+	if token != "" {
+		headers["Authorization"] = "Bearer " + token
+	}
+	if err := keyServiceRequest(http.MethodGet, address, endpoint, headers, nil, &resp); err != nil {
+		return nil, err
+	}
+	material, err := base64.StdEncoding.DecodeString(resp.Key)
+	if err != nil {
+		return nil, errors.New("key service returned an invalid key")
+	}
+	return newMasterKeyProvider("kms", material)
+}
+
+func (p *masterKeyProvider) Name() string { return p.name }
+
+func (p *masterKeyProvider) Wrap(secret string) (string, error) {
+	nonce := make([]byte, p.gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := p.gcm.Seal(nonce, nonce, []byte(secret), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func (p *masterKeyProvider) Unwrap(wrapped string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil || len(sealed) < p.gcm.NonceSize() {
+		return "", errors.New("malformed wrapped secret")
+	}
+	nonce, ciphertext := sealed[:p.gcm.NonceSize()], sealed[p.gcm.NonceSize():]
+	plaintext, err := p.gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", errors.New("failed to unwrap secret - wrong master key?")
+	}
+	return string(plaintext), nil
+}
+
+// TransitKeyProvider has a key-wrapping service encrypt and decrypt the
+// secrets, so the master key never leaves it. It speaks the Vault transit
+// API: POST /v1/transit/encrypt/{name} and /v1/transit/decrypt/{name}.
+type TransitKeyProvider struct {
+	Address string
+	KeyName string
+	Token   string
+}
+
+func (p *TransitKeyProvider) Name() string { return "transit" }
+
+func (p *TransitKeyProvider) Wrap(secret string) (string, error) {
+	var resp struct {
+		Data struct {
+			Ciphertext string `json:"ciphertext"`
+		} `json:"data"`
+	}
+	body := map[string]string{"plaintext": base64.StdEncoding.EncodeToString([]byte(secret))}
+	if err := p.request("encrypt", body, &resp); err != nil {
+		return "", err
+	}
+	if resp.Data.Ciphertext == "" {
+		return "", errors.New("key service returned no ciphertext")
+	}
+	return resp.Data.Ciphertext, nil
+}
+
+func (p *TransitKeyProvider) Unwrap(wrapped string) (string, error) {
+	var resp struct {
+		Data struct {
+			Plaintext string `json:"plaintext"`
+		} `json:"data"`
+	}
+	if err := p.request("decrypt", map[string]string{"ciphertext": wrapped}, &resp); err != nil {
+		return "", err
+	}
+	plaintext, err := base64.StdEncoding.DecodeString(resp.Data.Plaintext)
+	if err != nil || len(plaintext) == 0 {
+		return "", errors.New("key service returned an invalid plaintext")
+	}
+	return string(plaintext), nil
+}
+
+func (p *TransitKeyProvider) request(operation string, body interface{}, out interface{}) error {
+	headers := map[string]string{}
+	if p.Token != "" {
+		headers["X-Vault-Token"] = p.Token
+	}
+	endpoint := "/v1/transit/" + operation + "/" + url.PathEscape(p.KeyName)
+	return keyServiceRequest(http.MethodPost, p.Address, endpoint, headers, body, out)
+}
+
+// keyServiceRequest sends a JSON request to a key service and decodes the response into out
+func keyServiceRequest(method, address, endpoint string, headers map[string]string, body interface{}, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(address, "/")+endpoint, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	client := &http.Client{Timeout: keyProviderTimeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("key service request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("failed to read key service response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var failure struct {
+			Errors []string `json:"errors"`
+		}
+		if json.Unmarshal(data, &failure) == nil && len(failure.Errors) > 0 {
+			return fmt.Errorf("key service returned %d: %s", resp.StatusCode, strings.Join(failure.Errors, "; "))
+		}
+		return fmt.Errorf("key service returned %d", resp.StatusCode)
+	}
+	if err := json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("invalid key service response: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,230 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"farseer/config"
+)
+
+const transitCiphertextPrefix = "vault:v1:"
+
+// keyServiceStandIn serves the "kms" key API and the Vault transit API from
+// in-memory keys, created on first use
+type keyServiceStandIn struct {
+	token string
+
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+func newKeyServiceStandIn(t *testing.T, token string) string {
+	t.Helper()
+	standIn := &keyServiceStandIn{token: token, keys: make(map[string][]byte)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/keys/", standIn.handleKey)
+	mux.HandleFunc("/v1/transit/", standIn.handleTransit)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server.URL
+}
+
+func (s *keyServiceStandIn) key(name string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[name]; !ok {
+		key := make([]byte, 32)
+		rand.Read(key)
+		s.keys[name] = key
+	}
+	return s.keys[name]
+}
+
+func (s *keyServiceStandIn) handleKey(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+s.token {
+		writeStandInError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	key := s.key(strings.TrimPrefix(r.URL.Path, "/v1/keys/"))
+	json.NewEncoder(w).Encode(map[string]string{"key": base64.StdEncoding.EncodeToString(key)})
+}
+
+func (s *keyServiceStandIn) handleTransit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.Header.Get("X-Vault-Token") != s.token {
+		writeStandInError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	operation, name, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v1/transit/"), "/")
+	var body struct {
+		Plaintext  string `json:"plaintext"`
+		Ciphertext string `json:"ciphertext"`
+	}
+	json.NewDecoder(r.Body).Decode(&body)
+
+	block, _ := aes.NewCipher(s.key(name))
+	gcm, _ := cipher.NewGCM(block)
+
+	switch operation {
+	case "encrypt":
+		plaintext, err := base64.StdEncoding.DecodeString(body.Plaintext)
+		if err != nil {
+			writeStandInError(w, http.StatusBadRequest, "plaintext must be base64")
+			return
+		}
+		nonce := make([]byte, gcm.NonceSize())
+		rand.Read(nonce)
+		sealed := gcm.Seal(nonce, nonce, plaintext, nil)
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{
+			"ciphertext": transitCiphertextPrefix + base64.StdEncoding.EncodeToString(sealed),
+		}})
+	case "decrypt":
+		sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(body.Ciphertext, transitCiphertextPrefix))
+		if err != nil || len(sealed) < gcm.NonceSize() {
+			writeStandInError(w, http.StatusBadRequest, "invalid ciphertext")
+			return
+		}
+		plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+		if err != nil {
+			writeStandInError(w, http.StatusBadRequest, "cipher: message authentication failed")
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": map[string]string{
+			"plaintext": base64.StdEncoding.EncodeToString(plaintext),
+		}})
+	default:
+		writeStandInError(w, http.StatusNotFound, "unsupported path")
+	}
+}
+
+func writeStandInError(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string][]string{"errors": {message}})
+}
+
+// roundTrip wraps a secret and checks it unwraps, with the same provider
+// and with other, equally configured ones
+func roundTrip(t *testing.T, wrapper KeyProvider, unwrappers ...KeyProvider) string {
+	t.Helper()
+	secret := "0123456789abcdef0123456789abcdef"
+	wrapped, err := wrapper.Wrap(secret)
+	if err != nil {
+		t.Fatalf("%s: wrap: %v", wrapper.Name(), err)
+	}
+	if strings.Contains(wrapped, secret) {
+		t.Fatalf("%s: wrapped secret contains the plaintext", wrapper.Name())
+	}
+	for _, provider := range append([]KeyProvider{wrapper}, unwrappers...) {
+		if got, err := provider.Unwrap(wrapped); err != nil || got != secret {
+			t.Fatalf("%s: unwrap = %q, %v", provider.Name(), got, err)
+		}
+	}
+	return wrapped
+}
+
+func TestKMSKeyProvider(t *testing.T) {
+	address := newKeyServiceStandIn(t, "kms-token")
+
+	provider, err := NewKeyProvider(&config.Config{KeyProvider: "kms", KeyProviderAddress: address, KeyProviderKeyName: "farseer", KeyProviderToken: "kms-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A restarted server fetches the same master key again
+	restarted, err := NewKMSKeyProvider(address, "farseer", "kms-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped := roundTrip(t, provider, restarted)
+
+	other, err := NewKMSKeyProvider(address, "other", "kms-token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Unwrap(wrapped); err == nil {
+		t.Error("a different master key unwrapped the secret")
+	}
+
+	if _, err := NewKMSKeyProvider(address, "farseer", "wrong"); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("wrong token: %v", err)
+	}
+	if _, err := NewKeyProvider(&config.Config{KeyProvider: "kms", KeyProviderAddress: address}); err == nil {
+		t.Error("kms provider without a key name was accepted")
+	}
+}
+
+func TestTransitKeyProvider(t *testing.T) {
+	address := newKeyServiceStandIn(t, "transit-token")
+
+	provider, err := NewKeyProvider(&config.Config{KeyProvider: "transit", KeyProviderAddress: address, KeyProviderKeyName: "farseer", KeyProviderToken: "transit-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped := roundTrip(t, provider)
+	if !strings.HasPrefix(wrapped, transitCiphertextPrefix) {
+		t.Errorf("wrapped secret %q is not transit ciphertext", wrapped)
+	}
+
+	sealed, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(wrapped, transitCiphertextPrefix))
+	sealed[len(sealed)-1] ^= 1
+	tampered := transitCiphertextPrefix + base64.StdEncoding.EncodeToString(sealed)
+	if _, err := provider.Unwrap(tampered); err == nil {
+		t.Error("tampered ciphertext was unwrapped")
+	}
+
+	other := &TransitKeyProvider{Address: address, KeyName: "other", Token: "transit-token"}
+	if _, err := other.Unwrap(wrapped); err == nil {
+		t.Error("a different transit key unwrapped the secret")
+	}
+	wrongToken := &TransitKeyProvider{Address: address, KeyName: "farseer", Token: "wrong"}
+	if _, err := wrongToken.Unwrap(wrapped); err == nil || !strings.Contains(err.Error(), "permission denied") {
+		t.Errorf("wrong token: %v", err)
+	}
+}
+
+func TestFileAndEnvKeyProviders(t *testing.T) {
+	dir := t.TempDir()
+	keyFile := filepath.Join(dir, "master.key")
+	if err := os.WriteFile(keyFile, []byte("file-master-key-0123456789abcdef0123\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fileProvider, err := NewKeyProvider(&config.Config{KeyProvider: "file", KeyProviderFile: keyFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reread, err := NewFileKeyProvider(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrapped := roundTrip(t, fileProvider, reread)
+
+	t.Setenv(masterKeyEnv, "env-master-key-0123456789abcdef01234")
+	envProvider, err := NewKeyProvider(&config.Config{KeyProvider: "env"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roundTrip(t, envProvider)
+	if _, err := envProvider.Unwrap(wrapped); err == nil {
+		t.Error("the env master key unwrapped a secret wrapped with the file key")
+	}
+
+	shortFile := filepath.Join(dir, "short.key")
+	os.WriteFile(shortFile, []byte("too short"), 0600)
+	if _, err := NewFileKeyProvider(shortFile); err == nil {
+		t.Error("a short master key was accepted")
+	}
+	if _, err := NewKeyProvider(&config.Config{KeyProvider: "nope"}); err == nil {
+		t.Error("an unknown key provider was accepted")
+	}
+	if provider, err := NewKeyProvider(&config.Config{}); provider != nil || err != nil {
+		t.Errorf("default provider = %v, %v; want none", provider, err)
+	}
+}
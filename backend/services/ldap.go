@@ -0,0 +1,389 @@
+package services
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+
+	"farseer/config"
+	"farseer/database"
+	"farseer/models"
+)
+
+const ldapTimeout = 10 * time.Second
+
+var (
+	// ErrLDAPNotConfigured is returned when directory sign-in is not set up
+	ErrLDAPNotConfigured = errors.New("LDAP is not configured")
+	// ErrLDAPUnavailable is returned when the directory cannot be reached or
+	// refuses the service account
+	ErrLDAPUnavailable = errors.New("the directory is unavailable")
+	// ErrLDAPSyncUnavailable is returned when users cannot be looked up
+	// without their password, which the sync needs
+	ErrLDAPSyncUnavailable = errors.New("directory sync needs ldap_base_dn to search for users")
+)
+
+// ldapEntry is a user found in the directory
+type ldapEntry struct {
+	DN     string
+	Groups []string
+}
+
+// ldapSyncMu keeps scheduled and manual syncs from overlapping
+var ldapSyncMu sync.Mutex
+
+// LDAPEnabled reports whether directory sign-in is configured
+func LDAPEnabled() bool {
+	return config.GetConfig().LDAPURL != ""
+}
+
+// ldapAuthenticator binds to the directory as the user
+type ldapAuthenticator struct{}
+
+func (ldapAuthenticator) Enabled() bool { return LDAPEnabled() }
+
+func (ldapAuthenticator) Authenticate(user *models.User, username, password string) (*AuthResult, error) {
+	// An empty password makes an unauthenticated bind, which succeeds for any DN
+	if username == "" || password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	entry, err := ldapBindUser(username, password)
+	if err != nil {
+		return nil, err
+	}
+	cfg := config.GetConfig()
+	role, err := groupRole(entry.Groups, cfg.LDAPAdminGroups, cfg.LDAPUserGroups)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return provisionExternalUser(models.AuthProviderLDAP, entry.DN, username, role)
+	}
+
+	// The directory just vouched for the user, so a sync that disabled them
+	// is out of date; their DN may also have moved since
+	result := &AuthResult{User: user}
+	updates := map[string]interface{}{}
+	if user.ExternalID != entry.DN {
+		updates["external_id"] = entry.DN
+	}
+	if user.Disabled {
+		updates["disabled"] = false
+		result.Reenabled = true
+	}
+	if len(updates) > 0 {
+		if err := database.DB.Model(user).Updates(updates).Error; err != nil {
+			return nil, err
+		}
+	}
+	if result.RoleChanged, err = applyExternalRole(user, role); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// ldapConnect opens a connection to the directory, upgraded with StartTLS
+// when configured
+func ldapConnect() (*ldap.Conn, error) {
+	cfg := config.GetConfig()
+	if cfg.LDAPURL == "" {
+		return nil, ErrLDAPNotConfigured
+	}
+	u, err := url.Parse(cfg.LDAPURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid ldap_url: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		ServerName:         u.Hostname(),
+		InsecureSkipVerify: cfg.LDAPInsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+
+	conn, err := ldap.DialURL(cfg.LDAPURL, ldap.DialWithDialer(&net.Dialer{Timeout: ldapTimeout}), ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrLDAPUnavailable, err)
+	}
+	conn.SetTimeout(ldapTimeout)
+	if cfg.LDAPStartTLS {
+		if err := conn.StartTLS(tlsConfig); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%w: StartTLS: %v", ErrLDAPUnavailable, err)
+		}
+	}
+	return conn, nil
+}
+
+// ldapServiceBind binds as the configured service account. Without one the
+// connection stays anonymous.
+func ldapServiceBind(conn *ldap.Conn) error {
+	cfg := config.GetConfig()
+	if cfg.LDAPBindDN == "" {
+		return nil
+	}
+	password := cfg.LDAPBindPassword
+	if envPassword := os.Getenv("FARSEER_LDAP_BIND_PASSWORD"); envPassword != "" {
+		password = envPassword
+	}
+	if err := conn.Bind(cfg.LDAPBindDN, password); err != nil {
+		return fmt.Errorf("%w: service account bind: %v", ErrLDAPUnavailable, err)
+	}
+	return nil
+}
+
+// ldapBindUser verifies the password by binding as the user. Their DN comes
+// from the DN template, or else from searching the base DN for the username.
+func ldapBindUser(username, password string) (*ldapEntry, error) {
+	conn, err := ldapConnect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	cfg := config.GetConfig()
+
+	if cfg.LDAPUserDNTemplate != "" {
+		dn := fmt.Sprintf(cfg.LDAPUserDNTemplate, ldap.EscapeDN(username))
+		if err := conn.Bind(dn, password); err != nil {
+			return nil, ldapBindError(err)
+		}
+		// The groups are read as the user, who can usually see their own entry
+		return ldapReadEntry(conn, dn)
+	}
+
+	if cfg.LDAPBaseDN == "" {
+		return nil, fmt.Errorf("%w: set ldap_user_dn_template or ldap_base_dn", ErrLDAPNotConfigured)
+	}
+	if err := ldapServiceBind(conn); err != nil {
+		return nil, err
+	}
+	entry, err := ldapFindUser(conn, username)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		return nil, ErrInvalidCredentials
+	}
+	if err := conn.Bind(entry.DN, password); err != nil {
+		return nil, ldapBindError(err)
+	}
+	return entry, nil
+}
+
+func ldapBindError(err error) error {
+	if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		return ErrInvalidCredentials
+	}
+	return fmt.Errorf("%w: %v", ErrLDAPUnavailable, err)
+}
+
+// ldapFindUser searches the base DN for the user with the given name. It
+// returns nil if there is none; more than one match is an error, as binding
+// to either could let one user sign in as the other.
+func ldapFindUser(conn *ldap.Conn, username string) (*ldapEntry, error) {
+	cfg := config.GetConfig()
+	req := ldap.NewSearchRequest(
+		cfg.LDAPBaseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(ldapTimeout.Seconds()), false,
+		fmt.Sprintf(cfg.LDAPUserFilter, ldap.EscapeFilter(username)),
+		[]string{cfg.LDAPGroupAttribute}, nil,
+	)
+	result, err := conn.Search(req)
+	switch {
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchObject):
+		return nil, nil
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded):
+		return nil, fmt.Errorf("%w: more than one entry matches %q", ErrLDAPUnavailable, username)
+	case err != nil:
+		return nil, fmt.Errorf("%w: search: %v", ErrLDAPUnavailable, err)
+	}
+
+	switch len(result.Entries) {
+	case 0:
+		return nil, nil
+	case 1:
+		return newLDAPEntry(result.Entries[0]), nil
+	default:
+		return nil, fmt.Errorf("%w: more than one entry matches %q", ErrLDAPUnavailable, username)
+	}
+}
+
+// ldapReadEntry reads the groups of the entry with the given DN
+func ldapReadEntry(conn *ldap.Conn, dn string) (*ldapEntry, error) {
+	cfg := config.GetConfig()
+	req := ldap.NewSearchRequest(
+		dn, ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, int(ldapTimeout.Seconds()), false,
+		"(objectClass=*)", []string{cfg.LDAPGroupAttribute}, nil,
+	)
+	result, err := conn.Search(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: reading %s: %v", ErrLDAPUnavailable, dn, err)
+	}
+	if len(result.Entries) != 1 {
+		return nil, fmt.Errorf("%w: %s not found after binding", ErrLDAPUnavailable, dn)
+	}
+	return newLDAPEntry(result.Entries[0]), nil
+}
+
+// newLDAPEntry collects the user's groups. The CN of each group DN is added
+// alongside, so admin and user groups can be configured by either.
+func newLDAPEntry(entry *ldap.Entry) *ldapEntry {
+	groups := entry.GetAttributeValues(config.GetConfig().LDAPGroupAttribute)
+	for _, group := range groups {
+		dn, err := ldap.ParseDN(group)
+		if err != nil || len(dn.RDNs) == 0 {
+			continue
+		}
+		for _, attr := range dn.RDNs[0].Attributes {
+			if strings.EqualFold(attr.Type, "cn") {
+				groups = append(groups, attr.Value)
+			}
+		}
+	}
+	return &ldapEntry{DN: entry.DN, Groups: groups}
+}
+
+// LDAPSyncResult counts what a directory sync changed
+type LDAPSyncResult struct {
+	Checked     int `json:"checked"`
+	Disabled    int `json:"disabled"`
+	Enabled     int `json:"enabled"`
+	RoleChanged int `json:"role_changed"`
+}
+
+// SyncLDAPUsers looks up every directory user with the service account.
+// Users who were removed from the directory or from every allowed group are
+// disabled and signed out; users who are back are enabled again, and roles
+// follow group changes. Nothing changes unless every lookup succeeds.
+func SyncLDAPUsers() (*LDAPSyncResult, error) {
+	cfg := config.GetConfig()
+	if !LDAPEnabled() {
+		return nil, ErrLDAPNotConfigured
+	}
+	if cfg.LDAPBaseDN == "" {
+		return nil, ErrLDAPSyncUnavailable
+	}
+
+	ldapSyncMu.Lock()
+	defer ldapSyncMu.Unlock()
+
+	var users []models.User
+	if err := database.DB.Where("auth_provider = ?", models.AuthProviderLDAP).Find(&users).Error; err != nil {
+		return nil, err
+	}
+	result := &LDAPSyncResult{Checked: len(users)}
+	if len(users) == 0 {
+		return result, nil
+	}
+
+	conn, err := ldapConnect()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := ldapServiceBind(conn); err != nil {
+		return nil, err
+	}
+
+	entries := make([]*ldapEntry, len(users))
+	found := 0
+	for i := range users {
+		if entries[i], err = ldapFindUser(conn, users[i].Username); err != nil {
+			return nil, err
+		}
+		if entries[i] != nil {
+			found++
+		}
+	}
+	// A wrong base DN or filter finds nobody; that must not lock everyone out
+	if found == 0 {
+		return nil, fmt.Errorf("none of the %d directory users were found, check ldap_base_dn and ldap_user_filter; nobody was disabled", len(users))
+	}
+
+	for i := range users {
+		user, entry := &users[i], entries[i]
+		reason := "Removed from the directory"
+		var role models.Role
+		if entry != nil {
+			var roleErr error
+			if role, roleErr = groupRole(entry.Groups, cfg.LDAPAdminGroups, cfg.LDAPUserGroups); roleErr != nil {
+				reason, entry = "No longer in an allowed directory group", nil
+			}
+		}
+
+		if entry == nil {
+			if user.Disabled {
+				continue
+			}
+			if err := database.DB.Model(user).Update("disabled", true).Error; err != nil {
+				return result, err
+			}
+			if err := RevokeUserSessions(user); err != nil {
+				return result, err
+			}
+			result.Disabled++
+			LogAudit(user.ID, user.Username, models.AuditActionUserDisable, nil, "", reason, "")
+			continue
+		}
+
+		updates := map[string]interface{}{}
+		if user.ExternalID != entry.DN {
+			updates["external_id"] = entry.DN
+		}
+		if user.Disabled {
+			updates["disabled"] = false
+		}
+		if role != "" && role != user.Role {
+			updates["role"] = role
+		}
+		if len(updates) == 0 {
+			continue
+		}
+		if err := database.DB.Model(user).Updates(updates).Error; err != nil {
+			return result, err
+		}
+		if _, ok := updates["disabled"]; ok {
+			result.Enabled++
+			LogAudit(user.ID, user.Username, models.AuditActionUserEnable, nil, "", "Back in the directory", "")
+		}
+		if _, ok := updates["role"]; ok {
+			// The role is part of the token, so signing out is what applies it
+			if err := RevokeUserSessions(user); err != nil {
+				return result, err
+			}
+			result.RoleChanged++
+			LogAudit(user.ID, user.Username, models.AuditActionUserUpdate, nil, "", "Role set to "+string(role)+" from directory groups", "")
+		}
+	}
+	return result, nil
+}
+
+// StartLDAPSync periodically runs the directory sync while LDAP with a base
+// DN is configured. The interval is re-read from the config before each run.
+func StartLDAPSync() {
+	go func() {
+		for {
+			cfg := config.GetConfig()
+			time.Sleep(time.Duration(cfg.LDAPSyncIntervalMinutes) * time.Minute)
+
+			if !LDAPEnabled() || cfg.LDAPBaseDN == "" {
+				continue
+			}
+			result, err := SyncLDAPUsers()
+			if err != nil {
+				log.Printf("Directory sync: %v", err)
+				continue
+			}
+			if result.Disabled > 0 || result.Enabled > 0 || result.RoleChanged > 0 {
+				log.Printf("Directory sync: %d users checked, %d disabled, %d enabled, %d role changes",
+					result.Checked, result.Disabled, result.Enabled, result.RoleChanged)
+			}
+		}
+	}()
+}
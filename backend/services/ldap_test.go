@@ -0,0 +1,400 @@
+package services
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+	"github.com/jimlambrt/gldap"
+
+	"farseer/config"
+	"farseer/database"
+	"farseer/models"
+)
+
+const (
+	ldapStandInBase     = "dc=farseer,dc=test"
+	ldapStandInBindDN   = "cn=farseer," + ldapStandInBase
+	ldapStandInPassword = "service-password"
+)
+
+// ldapStandInUser is a person in the stand-in directory
+type ldapStandInUser struct {
+	password string
+	groups   []string
+}
+
+// ldapStandIn is a directory with people under ou=people and groups under
+// ou=groups. People bind with their DN and password and carry memberOf;
+// searching needs a bind. Users can be changed while it runs.
+type ldapStandIn struct {
+	mu    sync.Mutex
+	users map[string]ldapStandInUser
+	bound map[int]string // DN each connection is bound as
+}
+
+// newLDAPStandIn starts a directory and points the LDAP settings at it,
+// finding users by searching with the service account
+func newLDAPStandIn(t *testing.T) *ldapStandIn {
+	t.Helper()
+	d := &ldapStandIn{users: make(map[string]ldapStandInUser), bound: make(map[int]string)}
+
+	mux, err := gldap.NewMux()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mux.Bind(d.handleBind)
+	mux.Unbind(d.handleUnbind)
+	mux.Search(d.handleSearch)
+	mux.DefaultRoute(func(w *gldap.ResponseWriter, r *gldap.Request) {
+		w.Write(r.NewResponse(gldap.WithResponseCode(gldap.ResultUnwillingToPerform)))
+	})
+	server, err := gldap.NewServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.Router(mux)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	go server.Run(addr)
+	for deadline := time.Now().Add(5 * time.Second); !server.Ready(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("directory did not start")
+		}
+	}
+
+	cfg := config.GetConfig()
+	saved := *cfg
+	cfg.LDAPURL = "ldap://" + addr
+	cfg.LDAPBindDN = ldapStandInBindDN
+	cfg.LDAPBindPassword = ldapStandInPassword
+	cfg.LDAPBaseDN = ldapStandInBase
+	cfg.LDAPUserDNTemplate = ""
+	cfg.LDAPAdminGroups = []string{"farseer-admins"}
+	cfg.LDAPUserGroups = []string{"cn=farseer-users,ou=groups," + ldapStandInBase}
+	t.Cleanup(func() {
+		server.Stop()
+		*cfg = saved
+		// Directory users of one test would be missing from the next one's directory
+		database.DB.Unscoped().Where("auth_provider = ?", models.AuthProviderLDAP).Delete(&models.User{})
+	})
+	return d
+}
+
+func (d *ldapStandIn) setUser(uid, password string, groups ...string) {
+	d.mu.Lock()
+	d.users[uid] = ldapStandInUser{password: password, groups: groups}
+	d.mu.Unlock()
+}
+
+func (d *ldapStandIn) removeUser(uid string) {
+	d.mu.Lock()
+	delete(d.users, uid)
+	d.mu.Unlock()
+}
+
+func ldapStandInUserDN(uid string) string {
+	return "uid=" + ldap.EscapeDN(uid) + ",ou=people," + ldapStandInBase
+}
+
+func ldapStandInGroupDN(name string) string {
+	return "cn=" + ldap.EscapeDN(name) + ",ou=groups," + ldapStandInBase
+}
+
+// entries builds the directory tree from the users
+func (d *ldapStandIn) entries() []*ldap.Entry {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	entries := []*ldap.Entry{
+		ldap.NewEntry(ldapStandInBase, map[string][]string{"objectClass": {"top", "domain"}}),
+		ldap.NewEntry("ou=people,"+ldapStandInBase, map[string][]string{"objectClass": {"top", "organizationalUnit"}}),
+		ldap.NewEntry("ou=groups,"+ldapStandInBase, map[string][]string{"objectClass": {"top", "organizationalUnit"}}),
+	}
+	members := map[string][]string{}
+	for uid, u := range d.users {
+		var memberOf []string
+		for _, g := range u.groups {
+			members[g] = append(members[g], ldapStandInUserDN(uid))
+			memberOf = append(memberOf, ldapStandInGroupDN(g))
+		}
+		entries = append(entries, ldap.NewEntry(ldapStandInUserDN(uid), map[string][]string{
+			"objectClass": {"top", "person", "inetOrgPerson"},
+			"uid":         {uid},
+			"cn":          {uid},
+			"memberOf":    memberOf,
+		}))
+	}
+	for g, dns := range members {
+		entries = append(entries, ldap.NewEntry(ldapStandInGroupDN(g), map[string][]string{
+			"objectClass": {"top", "groupOfNames"},
+			"cn":          {g},
+			"member":      dns,
+		}))
+	}
+	return entries
+}
+
+func (d *ldapStandIn) handleBind(w *gldap.ResponseWriter, r *gldap.Request) {
+	resp := r.NewBindResponse(gldap.WithResponseCode(gldap.ResultInvalidCredentials))
+	defer w.Write(resp)
+
+	m, err := r.GetSimpleBindMessage()
+	if err != nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.bound, r.ConnectionID())
+
+	// An empty password is an unauthenticated bind: it succeeds, but the
+	// connection stays anonymous (RFC 4513, section 5.1.2)
+	if m.Password == "" {
+		resp.SetResultCode(gldap.ResultSuccess)
+		return
+	}
+	ok := strings.EqualFold(m.UserName, ldapStandInBindDN) && string(m.Password) == ldapStandInPassword
+	for uid, u := range d.users {
+		if strings.EqualFold(m.UserName, ldapStandInUserDN(uid)) && string(m.Password) == u.password {
+			ok = true
+		}
+	}
+	if ok {
+		d.bound[r.ConnectionID()] = m.UserName
+		resp.SetResultCode(gldap.ResultSuccess)
+	}
+}
+
+func (d *ldapStandIn) handleUnbind(w *gldap.ResponseWriter, r *gldap.Request) {
+	d.mu.Lock()
+	delete(d.bound, r.ConnectionID())
+	d.mu.Unlock()
+}
+
+func (d *ldapStandIn) handleSearch(w *gldap.ResponseWriter, r *gldap.Request) {
+	resp := r.NewSearchDoneResponse(gldap.WithResponseCode(gldap.ResultSuccess))
+	defer w.Write(resp)
+
+	m, err := r.GetSearchMessage()
+	if err != nil {
+		resp.SetResultCode(gldap.ResultProtocolError)
+		return
+	}
+	d.mu.Lock()
+	boundDN := d.bound[r.ConnectionID()]
+	d.mu.Unlock()
+	if boundDN == "" {
+		resp.SetResultCode(gldap.ResultInsufficientAccessRights)
+		return
+	}
+	filter, err := ldap.CompileFilter(m.Filter)
+	if err != nil {
+		resp.SetResultCode(gldap.ResultProtocolError)
+		return
+	}
+
+	entries := d.entries()
+	baseExists := false
+	for _, e := range entries {
+		if strings.EqualFold(e.DN, m.BaseDN) {
+			baseExists = true
+		}
+	}
+	if !baseExists {
+		resp.SetResultCode(gldap.ResultNoSuchObject)
+		return
+	}
+	for _, e := range entries {
+		if !ldapInScope(e.DN, m.BaseDN, m.Scope) || !ldapMatches(filter, e) {
+			continue
+		}
+		entry := r.NewSearchResponseEntry(e.DN)
+		for _, attr := range e.Attributes {
+			if ldapWanted(attr.Name, m.Attributes) && len(attr.Values) > 0 {
+				entry.AddAttribute(attr.Name, attr.Values)
+			}
+		}
+		w.Write(entry)
+	}
+}
+
+func ldapInScope(dn, base string, scope gldap.Scope) bool {
+	dn, base = strings.ToLower(dn), strings.ToLower(base)
+	switch scope {
+	case gldap.BaseObject:
+		return dn == base
+	case gldap.SingleLevel:
+		i := strings.Index(dn, ",")
+		return i >= 0 && dn[i+1:] == base
+	default:
+		return dn == base || strings.HasSuffix(dn, ","+base)
+	}
+}
+
+func ldapWanted(name string, attributes []string) bool {
+	if len(attributes) == 0 {
+		return true
+	}
+	for _, a := range attributes {
+		if a == "*" || strings.EqualFold(a, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// ldapMatches evaluates the presence, equality and boolean filters Farseer
+// sends. Values compare case-insensitively.
+func ldapMatches(f *ber.Packet, e *ldap.Entry) bool {
+	switch f.Tag {
+	case ldap.FilterAnd:
+		for _, child := range f.Children {
+			if !ldapMatches(child, e) {
+				return false
+			}
+		}
+		return true
+	case ldap.FilterOr:
+		for _, child := range f.Children {
+			if ldapMatches(child, e) {
+				return true
+			}
+		}
+		return false
+	case ldap.FilterNot:
+		return len(f.Children) == 1 && !ldapMatches(f.Children[0], e)
+	case ldap.FilterPresent:
+		return len(e.GetEqualFoldAttributeValues(f.Data.String())) > 0
+	case ldap.FilterEqualityMatch:
+		if len(f.Children) != 2 {
+			return false
+		}
+		for _, v := range e.GetEqualFoldAttributeValues(f.Children[0].Value.(string)) {
+			if strings.EqualFold(v, f.Children[1].Value.(string)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func TestLDAPAuthenticate(t *testing.T) {
+	d := newLDAPStandIn(t)
+	d.setUser("ldap-alice", "alice-pw", "farseer-admins")
+	d.setUser("ldap-bob", "bob-pw", "farseer-users")
+	d.setUser("ldap-carol", "carol-pw", "contractors")
+
+	result, err := ldapAuthenticator{}.Authenticate(nil, "ldap-alice", "alice-pw")
+	if err != nil || !result.Created || result.User.Role != models.RoleAdmin ||
+		result.User.ExternalID != ldapStandInUserDN("ldap-alice") {
+		t.Fatalf("admin sign-in: %+v, %v", result, err)
+	}
+	// The user group is configured by DN, the admin group by CN
+	result, err = ldapAuthenticator{}.Authenticate(nil, "ldap-bob", "bob-pw")
+	if err != nil || result.User.Role != models.RoleUser {
+		t.Fatalf("user sign-in: %+v, %v", result, err)
+	}
+	if _, err := (ldapAuthenticator{}).Authenticate(nil, "ldap-carol", "carol-pw"); !errors.Is(err, ErrNotAllowed) {
+		t.Errorf("user outside the allowed groups: %v, want ErrNotAllowed", err)
+	}
+
+	for _, tt := range []struct{ username, password string }{
+		{"ldap-alice", "wrong"},
+		{"ldap-alice", ""},
+		{"ldap-nobody", "whatever"},
+		{"ldap-*", "alice-pw"},
+	} {
+		if _, err := (ldapAuthenticator{}).Authenticate(nil, tt.username, tt.password); !errors.Is(err, ErrInvalidCredentials) {
+			t.Errorf("Authenticate(%q, %q) = %v, want ErrInvalidCredentials", tt.username, tt.password, err)
+		}
+	}
+
+	config.GetConfig().LDAPBindPassword = "wrong"
+	if _, err := (ldapAuthenticator{}).Authenticate(nil, "ldap-alice", "alice-pw"); !errors.Is(err, ErrLDAPUnavailable) {
+		t.Errorf("wrong service password: %v, want ErrLDAPUnavailable", err)
+	}
+}
+
+func TestLDAPAuthenticateWithDNTemplate(t *testing.T) {
+	d := newLDAPStandIn(t)
+	d.setUser("ldap-dave", "dave-pw", "farseer-users")
+	cfg := config.GetConfig()
+	cfg.LDAPUserDNTemplate = "uid=%s,ou=people," + ldapStandInBase
+	// Binding as the user needs no service account
+	cfg.LDAPBindDN, cfg.LDAPBindPassword = "", ""
+
+	result, err := ldapAuthenticator{}.Authenticate(nil, "ldap-dave", "dave-pw")
+	if err != nil || result.User.Role != models.RoleUser {
+		t.Fatalf("sign-in: %+v, %v", result, err)
+	}
+	if _, err := (ldapAuthenticator{}).Authenticate(result.User, "ldap-dave", "wrong"); !errors.Is(err, ErrInvalidCredentials) {
+		t.Errorf("wrong password: %v, want ErrInvalidCredentials", err)
+	}
+}
+
+func TestSyncLDAPUsers(t *testing.T) {
+	d := newLDAPStandIn(t)
+	for _, uid := range []string{"ldap-erin", "ldap-frank", "ldap-grace"} {
+		d.setUser(uid, "pw", "farseer-users")
+		if _, err := (ldapAuthenticator{}).Authenticate(nil, uid, "pw"); err != nil {
+			t.Fatalf("sign-in as %s: %v", uid, err)
+		}
+	}
+	states := func() string {
+		var users []models.User
+		database.DB.Where("auth_provider = ?", models.AuthProviderLDAP).Find(&users)
+		var list []string
+		for _, u := range users {
+			state := string(u.Role)
+			if u.Disabled {
+				state = "disabled"
+			}
+			list = append(list, u.Username+"="+state)
+		}
+		sort.Strings(list)
+		return strings.Join(list, " ")
+	}
+	runSync := func(want LDAPSyncResult) {
+		t.Helper()
+		got, err := SyncLDAPUsers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if *got != want {
+			t.Errorf("sync = %+v, want %+v", *got, want)
+		}
+	}
+
+	d.removeUser("ldap-erin")
+	d.setUser("ldap-frank", "pw", "contractors")
+	d.setUser("ldap-grace", "pw", "farseer-admins")
+	runSync(LDAPSyncResult{Checked: 3, Disabled: 2, RoleChanged: 1})
+	if got := states(); got != "ldap-erin=disabled ldap-frank=disabled ldap-grace=admin" {
+		t.Errorf("after sync: %s", got)
+	}
+
+	d.setUser("ldap-erin", "pw", "farseer-users")
+	runSync(LDAPSyncResult{Checked: 3, Enabled: 1})
+	if got := states(); got != "ldap-erin=user ldap-frank=disabled ldap-grace=admin" {
+		t.Errorf("after returning: %s", got)
+	}
+
+	// A base DN that finds nobody must not disable everyone
+	config.GetConfig().LDAPBaseDN = "ou=people,dc=elsewhere,dc=test"
+	if _, err := SyncLDAPUsers(); err == nil {
+		t.Error("sync that found nobody succeeded")
+	}
+	if got := states(); got != "ldap-erin=user ldap-frank=disabled ldap-grace=admin" {
+		t.Errorf("after a failed sync: %s", got)
+	}
+}
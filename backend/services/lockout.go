@@ -0,0 +1,151 @@
+package services
+
+import (
+	"fmt"
+	"time"
+
+	"gorm.io/gorm"
+
+	"farseer/config"
+	"farseer/database"
+	"farseer/models"
+)
+
+const (
+	// Failed sign-ins in a row after which each further attempt has to wait,
+	// one second at first and doubling up to maxLoginDelay
+	loginDelayAfter = 3
+	maxLoginDelay   = time.Minute
+	// Failures are forgotten after a day without another one
+	failedLoginWindow = 24 * time.Hour
+)
+
+// LoginThrottledError is returned for sign-ins to an account that is locked
+// or still waiting out the delay after its last failure
+type LoginThrottledError struct {
+	Until  time.Time
+	Locked bool
+}
+
+func (e *LoginThrottledError) Error() string {
+	if e.Locked {
+		return "Account is locked after too many failed sign-ins, try again in " + waitText(e.RetryAfter())
+	}
+	return "Too many failed sign-ins, try again in " + waitText(e.RetryAfter())
+}
+
+// RetryAfter is the wait in whole seconds, for the Retry-After header
+func (e *LoginThrottledError) RetryAfter() int {
+	seconds := int((time.Until(e.Until) + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		return 1
+	}
+	return seconds
+}
+
+// CheckLoginThrottle returns a *LoginThrottledError if the user may not try
+// a password or second factor yet
+func CheckLoginThrottle(user *models.User) error {
+	now := time.Now()
+	if user.LockedUntil != nil && now.Before(*user.LockedUntil) {
+		return &LoginThrottledError{Until: *user.LockedUntil, Locked: true}
+	}
+	failures := recentFailedLogins(user, now)
+	if failures == 0 {
+		return nil
+	}
+	if until := user.LastFailedLoginAt.Add(loginDelay(failures)); now.Before(until) {
+		return &LoginThrottledError{Until: until}
+	}
+	return nil
+}
+
+// RecordFailedLogin counts a wrong password or second factor against the
+// user. Once LockoutThreshold failures are reached the account is locked for
+// LockoutMinutes, and each failure after the lockout ends locks it again
+// until a sign-in succeeds. It returns the end of the lockout when this
+// failure caused one.
+func RecordFailedLogin(user *models.User) (*time.Time, error) {
+	cfg := config.GetConfig()
+	now := time.Now()
+
+	var lockedUntil *time.Time
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		// Counted in SQL so concurrent failures are not lost
+		result := tx.Model(&models.User{}).Where("id = ?", user.ID).Updates(map[string]interface{}{
+			"failed_logins":        gorm.Expr("CASE WHEN last_failed_login_at > ? THEN failed_logins + 1 ELSE 1 END", now.Add(-failedLoginWindow)),
+			"last_failed_login_at": now,
+		})
+		if result.Error != nil {
+			return result.Error
+		}
+
+		var counted models.User
+		if err := tx.Select("failed_logins").First(&counted, user.ID).Error; err != nil {
+			return err
+		}
+		user.FailedLogins = counted.FailedLogins
+		user.LastFailedLoginAt = &now
+
+		if counted.FailedLogins < cfg.LockoutThreshold {
+			return nil
+		}
+		until := now.Add(time.Duration(cfg.LockoutMinutes) * time.Minute)
+		if err := tx.Model(&models.User{}).Where("id = ?", user.ID).Update("locked_until", until).Error; err != nil {
+			return err
+		}
+		user.LockedUntil = &until
+		lockedUntil = &until
+		return nil
+	})
+	return lockedUntil, err
+}
+
+// ClearFailedLogins resets the user's failure count and lifts any lockout,
+// after a successful sign-in or when an admin unlocks the account
+func ClearFailedLogins(user *models.User) error {
+	err := database.DB.Model(&models.User{}).
+		Where("id = ? AND (failed_logins > 0 OR locked_until IS NOT NULL)", user.ID).
+		Updates(map[string]interface{}{
+			"failed_logins":        0,
+			"last_failed_login_at": nil,
+			"locked_until":         nil,
+		}).Error
+	if err != nil {
+		return err
+	}
+	user.FailedLogins = 0
+	user.LastFailedLoginAt = nil
+	user.LockedUntil = nil
+	return nil
+}
+
+// waitText spells out a wait in seconds, rounded up to minutes past one
+func waitText(seconds int) string {
+	unit, n := "second", seconds
+	if seconds > 60 {
+		unit, n = "minute", (seconds+59)/60
+	}
+	if n != 1 {
+		unit += "s"
+	}
+	return fmt.Sprintf("%d %s", n, unit)
+}
+
+func recentFailedLogins(user *models.User, now time.Time) int {
+	if user.LastFailedLoginAt == nil || now.Sub(*user.LastFailedLoginAt) > failedLoginWindow {
+		return 0
+	}
+	return user.FailedLogins
+}
+
+// loginDelay is how long to wait after the last of failures in a row
+func loginDelay(failures int) time.Duration {
+	if failures < loginDelayAfter {
+		return 0
+	}
+	if shift := failures - loginDelayAfter; shift < 6 {
+		return time.Second << shift
+	}
+	return maxLoginDelay
+}
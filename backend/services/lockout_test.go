@@ -0,0 +1,118 @@
+package services
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"farseer/config"
+	"farseer/database"
+	"farseer/models"
+)
+
+func TestLoginDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{2, 0},
+		{3, time.Second},
+		{4, 2 * time.Second},
+		{8, 32 * time.Second},
+		{9, time.Minute},
+		{50, time.Minute},
+	}
+	for _, tt := range tests {
+		if got := loginDelay(tt.failures); got != tt.want {
+			t.Errorf("loginDelay(%d) = %v, want %v", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestCheckLoginThrottle(t *testing.T) {
+	ago := func(d time.Duration) *time.Time {
+		at := time.Now().Add(-d)
+		return &at
+	}
+
+	tests := []struct {
+		name   string
+		user   models.User
+		wait   bool
+		locked bool
+	}{
+		{"no failures", models.User{}, false, false},
+		{"below the delay", models.User{FailedLogins: 2, LastFailedLoginAt: ago(0)}, false, false},
+		{"within the delay", models.User{FailedLogins: 3, LastFailedLoginAt: ago(0)}, true, false},
+		{"delay passed", models.User{FailedLogins: 3, LastFailedLoginAt: ago(2 * time.Second)}, false, false},
+		{"doubled delay", models.User{FailedLogins: 5, LastFailedLoginAt: ago(2 * time.Second)}, true, false},
+		{"failures forgotten", models.User{FailedLogins: 9, LastFailedLoginAt: ago(25 * time.Hour)}, false, false},
+		{"locked", models.User{LockedUntil: ago(-time.Minute)}, true, true},
+		{"lockout ended", models.User{LockedUntil: ago(time.Second)}, false, false},
+	}
+	for _, tt := range tests {
+		err := CheckLoginThrottle(&tt.user)
+		var throttled *LoginThrottledError
+		if !errors.As(err, &throttled) {
+			if tt.wait {
+				t.Errorf("%s: %v, want a wait", tt.name, err)
+			}
+			continue
+		}
+		if !tt.wait || throttled.Locked != tt.locked {
+			t.Errorf("%s: %+v, want wait=%v locked=%v", tt.name, throttled, tt.wait, tt.locked)
+		}
+	}
+}
+
+func TestRecordFailedLogin(t *testing.T) {
+	cfg := config.GetConfig()
+	saved := *cfg
+	t.Cleanup(func() { *cfg = saved })
+	cfg.LockoutThreshold = 3
+	cfg.LockoutMinutes = 15
+
+	user := createTestUser(t, "lockout-user", models.RoleUser)
+	for i := 1; i <= 3; i++ {
+		lockedUntil, err := RecordFailedLogin(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.FailedLogins != i {
+			t.Errorf("failure %d counted as %d", i, user.FailedLogins)
+		}
+		if (lockedUntil != nil) != (i == 3) {
+			t.Errorf("failure %d: locked until %v", i, lockedUntil)
+		}
+	}
+
+	var stored models.User
+	database.DB.First(&stored, user.ID)
+	if stored.FailedLogins != 3 || stored.LockedUntil == nil || time.Until(*stored.LockedUntil) < 14*time.Minute {
+		t.Fatalf("stored after the lockout: %d failures, locked until %v", stored.FailedLogins, stored.LockedUntil)
+	}
+	var throttled *LoginThrottledError
+	if err := CheckLoginThrottle(&stored); !errors.As(err, &throttled) || !throttled.Locked {
+		t.Errorf("locked account: %v, want locked", err)
+	}
+
+	if err := ClearFailedLogins(user); err != nil {
+		t.Fatal(err)
+	}
+	var cleared models.User
+	database.DB.First(&cleared, user.ID)
+	if cleared.FailedLogins != 0 || cleared.LastFailedLoginAt != nil || cleared.LockedUntil != nil {
+		t.Errorf("after clearing: %d failures, last at %v, locked until %v", cleared.FailedLogins, cleared.LastFailedLoginAt, cleared.LockedUntil)
+	}
+
+	// The count starts over once the last failure is older than the window
+	old := time.Now().Add(-failedLoginWindow - time.Hour)
+	database.DB.Model(user).Updates(map[string]interface{}{"failed_logins": 2, "last_failed_login_at": old})
+	if _, err := RecordFailedLogin(user); err != nil {
+		t.Fatal(err)
+	}
+	if user.FailedLogins != 1 {
+		t.Errorf("failure after the window counted as %d, want 1", user.FailedLogins)
+	}
+}
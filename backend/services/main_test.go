@@ -0,0 +1,46 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"farseer/database"
+	"farseer/models"
+)
+
+// TestMain points the config and database at a scratch directory, so tests
+// run against a fresh server secret and an empty database
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "farseer-services-test")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Setenv("FARSEER_CONFIG_DIR", dir)
+	os.Setenv("FARSEER_DB_PATH", filepath.Join(dir, "farseer.db"))
+
+	if err := InitServerKeys(); err != nil {
+		fmt.Fprintln(os.Stderr, "server keys:", err)
+		os.Exit(1)
+	}
+	if err := database.Connect(); err != nil {
+		fmt.Fprintln(os.Stderr, "database:", err)
+		os.Exit(1)
+	}
+
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// createTestUser stores a user with the given role
+func createTestUser(t *testing.T, username string, role models.Role) *models.User {
+	t.Helper()
+	user := &models.User{Username: username, PasswordHash: "-", Role: role}
+	if err := database.DB.Create(user).Error; err != nil {
+		t.Fatalf("create user %s: %v", username, err)
+	}
+	return user
+}
@@ -0,0 +1,22 @@
+package services
+
+import (
+	"farseer/database"
+	"farseer/models"
+)
+
+// Notify creates a notification for a user
+func Notify(userID uint, notificationType models.NotificationType, title string, message string, machineID *uint) {
+	notification := models.Notification{
+		UserID:    userID,
+		Type:      notificationType,
+		Title:     title,
+		Message:   message,
+		MachineID: machineID,
+	}
+
+	// Fire and forget - same as audit logging
+	go func() {
+		database.DB.Create(&notification)
+	}()
+}
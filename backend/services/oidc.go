@@ -0,0 +1,322 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+
+	"farseer/config"
+	"farseer/database"
+	"farseer/models"
+)
+
+const (
+	// oidcLoginTimeout is how long the user has to sign in at the identity provider
+	oidcLoginTimeout = 10 * time.Minute
+	// oidcTicketTimeout is how long the browser has to redeem the ticket it is
+	// redirected back with
+	oidcTicketTimeout = time.Minute
+	oidcHTTPTimeout   = 15 * time.Second
+)
+
+var (
+	// ErrOIDCNotConfigured is returned when single sign-on is not set up
+	ErrOIDCNotConfigured = errors.New("single sign-on is not configured")
+	// ErrOIDCInvalidState is returned when the callback does not match a pending sign-in
+	ErrOIDCInvalidState = errors.New("single sign-on session expired or is invalid, start again")
+	// ErrOIDCFailed is returned when the identity provider's answer does not verify
+	ErrOIDCFailed = errors.New("single sign-on failed")
+	// ErrOIDCNotAllowed is returned when the user is in none of the allowed groups
+	ErrOIDCNotAllowed = ErrNotAllowed
+	// ErrOIDCUsernameTaken is returned when a new SSO user's name belongs to another account
+	ErrOIDCUsernameTaken = ErrUsernameTaken
+	// ErrOIDCInvalidTicket is returned when a login ticket is unknown, used or expired
+	ErrOIDCInvalidTicket = errors.New("single sign-on ticket expired or is invalid, start again")
+)
+
+// OIDCIdentity is what the identity provider asserted about a user
+type OIDCIdentity struct {
+	Subject  string
+	Username string
+	Groups   []string
+}
+
+// pendingOIDCLogin is a sign-in sent to the identity provider and not returned yet
+type pendingOIDCLogin struct {
+	nonce    string
+	verifier string // PKCE code verifier
+	expires  time.Time
+}
+
+// loginTicket lets the browser collect the result of a completed sign-in
+type loginTicket struct {
+	userID  uint
+	expires time.Time
+}
+
+var (
+	// pendingOIDCLogins holds outstanding sign-ins, keyed by their state parameter
+	pendingOIDCLogins sync.Map
+	// loginTickets holds completed sign-ins awaiting redemption, keyed by ticket
+	loginTickets sync.Map
+
+	oidcMu       sync.Mutex
+	oidcProvider *oidc.Provider
+)
+
+// OIDCEnabled reports whether single sign-on is configured
+func OIDCEnabled() bool {
+	cfg := config.GetConfig()
+	return cfg.OIDCIssuer != "" && cfg.OIDCClientID != ""
+}
+
+// oidcContext carries the HTTP client used to talk to the identity provider
+func oidcContext() context.Context {
+	return oidc.ClientContext(context.Background(), &http.Client{Timeout: oidcHTTPTimeout})
+}
+
+// oidcClient discovers the identity provider on first use. A failed discovery
+// is retried on the next sign-in rather than cached.
+func oidcClient() (*oidc.Provider, *oauth2.Config, error) {
+	if !OIDCEnabled() {
+		return nil, nil, ErrOIDCNotConfigured
+	}
+	cfg := config.GetConfig()
+
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if oidcProvider == nil {
+		provider, err := oidc.NewProvider(oidcContext(), cfg.OIDCIssuer)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to discover identity provider: %w", err)
+		}
+		oidcProvider = provider
+	}
+
+	secret := cfg.OIDCClientSecret
+	if envSecret := os.Getenv("FARSEER_OIDC_CLIENT_SECRET"); envSecret != "" {
+		secret = envSecret
+	}
+	return oidcProvider, &oauth2.Config{
+		ClientID:     cfg.OIDCClientID,
+		ClientSecret: secret,
+		RedirectURL:  cfg.OIDCRedirectURL,
+		Endpoint:     oidcProvider.Endpoint(),
+		Scopes:       cfg.OIDCScopes,
+	}, nil
+}
+
+// BeginOIDCLogin returns the identity provider URL to send the browser to.
+// The authorization code flow is protected with PKCE, a state and a nonce.
+func BeginOIDCLogin() (string, error) {
+	_, oauth, err := oidcClient()
+	if err != nil {
+		return "", err
+	}
+
+	state, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	nonce, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	verifier := oauth2.GenerateVerifier()
+
+	pruneExpired(&pendingOIDCLogins, func(v interface{}) time.Time { return v.(*pendingOIDCLogin).expires })
+	pendingOIDCLogins.Store(state, &pendingOIDCLogin{
+		nonce:    nonce,
+		verifier: verifier,
+		expires:  time.Now().Add(oidcLoginTimeout),
+	})
+	return oauth.AuthCodeURL(state, oidc.Nonce(nonce), oauth2.S256ChallengeOption(verifier)), nil
+}
+
+// FinishOIDCLogin exchanges the authorization code from the callback and
+// verifies the ID token it yields
+func FinishOIDCLogin(state, code string) (*OIDCIdentity, error) {
+	value, ok := pendingOIDCLogins.LoadAndDelete(state)
+	if !ok || state == "" {
+		return nil, ErrOIDCInvalidState
+	}
+	pending := value.(*pendingOIDCLogin)
+	if time.Now().After(pending.expires) {
+		return nil, ErrOIDCInvalidState
+	}
+
+	provider, oauth, err := oidcClient()
+	if err != nil {
+		return nil, err
+	}
+	ctx := oidcContext()
+	token, err := oauth.Exchange(ctx, code, oauth2.VerifierOption(pending.verifier))
+	if err != nil {
+		return nil, fmt.Errorf("%w: code exchange: %v", ErrOIDCFailed, err)
+	}
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, fmt.Errorf("%w: no ID token in the response", ErrOIDCFailed)
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: oauth.ClientID}).Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOIDCFailed, err)
+	}
+	if idToken.Nonce != pending.nonce {
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrOIDCFailed)
+	}
+
+	var claims map[string]interface{}
+	if err := idToken.Claims(&claims); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrOIDCFailed, err)
+	}
+	cfg := config.GetConfig()
+	identity := &OIDCIdentity{
+		Subject: idToken.Subject,
+		Groups:  stringList(claims[cfg.OIDCGroupsClaim]),
+	}
+	for _, claim := range []string{cfg.OIDCUsernameClaim, "email", "sub"} {
+		if name, ok := claims[claim].(string); ok && name != "" {
+			identity.Username = name
+			break
+		}
+	}
+	return identity, nil
+}
+
+// OIDCRole maps the identity provider's groups to a role. Without any group
+// mapping configured it returns an empty role, leaving the role to admins.
+func OIDCRole(groups []string) (models.Role, error) {
+	cfg := config.GetConfig()
+	return groupRole(groups, cfg.OIDCAdminGroups, cfg.OIDCUserGroups)
+}
+
+// ProvisionOIDCUser finds the user the identity belongs to, creating them on
+// their first sign-in, and applies the role from their groups
+func ProvisionOIDCUser(identity *OIDCIdentity) (*AuthResult, error) {
+	role, err := OIDCRole(identity.Groups)
+	if err != nil {
+		return nil, err
+	}
+	return provisionExternalUser(models.AuthProviderOIDC, identity.Subject, identity.Username, role)
+}
+
+// IssueLoginTicket records a completed sign-in for the browser to redeem once
+func IssueLoginTicket(userID uint) (string, error) {
+	ticket, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	pruneExpired(&loginTickets, func(v interface{}) time.Time { return v.(*loginTicket).expires })
+	loginTickets.Store(ticket, &loginTicket{userID: userID, expires: time.Now().Add(oidcTicketTimeout)})
+	return ticket, nil
+}
+
+// RedeemLoginTicket returns the user a login ticket was issued for and
+// invalidates it
+func RedeemLoginTicket(ticket string) (uint, error) {
+	value, ok := loginTickets.LoadAndDelete(ticket)
+	if !ok {
+		return 0, ErrOIDCInvalidTicket
+	}
+	t := value.(*loginTicket)
+	if time.Now().After(t.expires) {
+		return 0, ErrOIDCInvalidTicket
+	}
+	return t.userID, nil
+}
+
+// SSOClientKey returns the key that stands in for the password-derived client
+// key of an SSO or directory user, creating it and their data key on first
+// use. It is sealed with the server secret alone, so unlike a local user's
+// credentials, an external user's can be decrypted by whoever holds the
+// database and the server secret.
+func SSOClientKey(user *models.User) (string, error) {
+	key, err := ssoClientKey(user)
+	if err != nil {
+		return "", err
+	}
+	if err := EnsureDataKey(user, key); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+func ssoClientKey(user *models.User) (string, error) {
+	if user.ClientKeySealed != "" {
+		key, err := openBytes([]byte(user.ClientKeySealed), "")
+		if err != nil {
+			return "", err
+		}
+		return string(key), nil
+	}
+
+	key, err := generateDataKey()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := sealBytes([]byte(key), "")
+	if err != nil {
+		return "", err
+	}
+	// Only set when still empty, so two concurrent first logins agree on one key
+	result := database.DB.Model(user).Where("client_key_sealed = '' OR client_key_sealed IS NULL").Update("client_key_sealed", string(sealed))
+	if result.Error != nil {
+		return "", result.Error
+	}
+	if result.RowsAffected == 0 {
+		var current models.User
+		if err := database.DB.Select("id", "client_key_sealed", "data_key_encrypted").First(&current, user.ID).Error; err != nil {
+			return "", err
+		}
+		user.ClientKeySealed, user.DataKeyEncrypted = current.ClientKeySealed, current.DataKeyEncrypted
+		return ssoClientKey(user)
+	}
+	user.ClientKeySealed = string(sealed)
+	return key, nil
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// pruneExpired drops entries past their expiry, so abandoned sign-ins do not accumulate
+func pruneExpired(m *sync.Map, expires func(interface{}) time.Time) {
+	now := time.Now()
+	m.Range(func(key, value interface{}) bool {
+		if now.After(expires(value)) {
+			m.Delete(key)
+		}
+		return true
+	})
+}
+
+// stringList reads a claim that is either a list of strings or a single string
+func stringList(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
@@ -0,0 +1,401 @@
+package services
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"farseer/config"
+	"farseer/models"
+)
+
+const oidcStandInKeyID = "farseer-test"
+
+// oidcGrant is an authorization code issued by the stand-in provider
+type oidcGrant struct {
+	redirectURI string
+	challenge   string
+	nonce       string
+	subject     string
+	username    string
+	groups      []string
+}
+
+// oidcStandIn is an OpenID Connect provider serving discovery, JWKS, an
+// authorization endpoint that signs in whoever the login_* parameters name,
+// and a token endpoint requiring PKCE (S256)
+type oidcStandIn struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	key          *rsa.PrivateKey
+	// tamper, when set, edits the ID token claims before signing
+	tamper func(claims map[string]interface{})
+	// signWith, when set, signs ID tokens with a key missing from the JWKS
+	signWith *rsa.PrivateKey
+
+	mu     sync.Mutex
+	grants map[string]*oidcGrant
+}
+
+// newOIDCStandIn starts a provider and points the single sign-on settings at it
+func newOIDCStandIn(t *testing.T) *oidcStandIn {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &oidcStandIn{clientID: "farseer", clientSecret: "client-secret", key: key, grants: make(map[string]*oidcGrant)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", p.handleDiscovery)
+	mux.HandleFunc("/jwks", p.handleJWKS)
+	mux.HandleFunc("/authorize", p.handleAuthorize)
+	mux.HandleFunc("/token", p.handleToken)
+	server := httptest.NewServer(mux)
+	p.issuer = server.URL
+
+	cfg := config.GetConfig()
+	saved := *cfg
+	cfg.OIDCIssuer = p.issuer
+	cfg.OIDCClientID = p.clientID
+	cfg.OIDCClientSecret = p.clientSecret
+	cfg.OIDCRedirectURL = "https://farseer.test/api/auth/oidc/callback"
+	resetOIDCProvider()
+	t.Cleanup(func() {
+		server.Close()
+		*cfg = saved
+		resetOIDCProvider()
+	})
+	return p
+}
+
+func resetOIDCProvider() {
+	oidcMu.Lock()
+	oidcProvider = nil
+	oidcMu.Unlock()
+}
+
+func (p *oidcStandIn) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"issuer":                                p.issuer,
+		"authorization_endpoint":                p.issuer + "/authorize",
+		"token_endpoint":                        p.issuer + "/token",
+		"jwks_uri":                              p.issuer + "/jwks",
+		"response_types_supported":              []string{"code"},
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"code_challenge_methods_supported":      []string{"S256"},
+	})
+}
+
+func (p *oidcStandIn) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": oidcStandInKeyID,
+			"alg": "RS256",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(p.key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(p.key.E)).Bytes()),
+		}},
+	})
+}
+
+func (p *oidcStandIn) handleAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != p.clientID || q.Get("response_type") != "code" {
+		http.Error(w, "invalid request", http.StatusBadRequest)
+		return
+	}
+	if q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "PKCE with S256 is required", http.StatusBadRequest)
+		return
+	}
+	redirectURI, err := url.Parse(q.Get("redirect_uri"))
+	if err != nil || redirectURI.Host == "" {
+		http.Error(w, "invalid redirect_uri", http.StatusBadRequest)
+		return
+	}
+	subject := q.Get("login_sub")
+	if subject == "" {
+		subject = q.Get("login_user")
+	}
+	var groups []string
+	if q.Get("login_groups") != "" {
+		groups = strings.Split(q.Get("login_groups"), ",")
+	}
+
+	code, _ := randomToken()
+	p.mu.Lock()
+	p.grants[code] = &oidcGrant{
+		redirectURI: redirectURI.String(),
+		challenge:   q.Get("code_challenge"),
+		nonce:       q.Get("nonce"),
+		subject:     subject,
+		username:    q.Get("login_user"),
+		groups:      groups,
+	}
+	p.mu.Unlock()
+
+	back := redirectURI.Query()
+	back.Set("code", code)
+	back.Set("state", q.Get("state"))
+	redirectURI.RawQuery = back.Encode()
+	http.Redirect(w, r, redirectURI.String(), http.StatusFound)
+}
+
+func (p *oidcStandIn) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ParseForm() != nil {
+		writeOIDCError(w, http.StatusBadRequest, "invalid_request")
+		return
+	}
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID, secret = r.Form.Get("client_id"), r.Form.Get("client_secret")
+	}
+	if clientID != p.clientID || secret != p.clientSecret {
+		writeOIDCError(w, http.StatusUnauthorized, "invalid_client")
+		return
+	}
+
+	p.mu.Lock()
+	g := p.grants[r.Form.Get("code")]
+	delete(p.grants, r.Form.Get("code"))
+	p.mu.Unlock()
+
+	sum := sha256.Sum256([]byte(r.Form.Get("code_verifier")))
+	if g == nil || r.Form.Get("redirect_uri") != g.redirectURI ||
+		base64.RawURLEncoding.EncodeToString(sum[:]) != g.challenge {
+		writeOIDCError(w, http.StatusBadRequest, "invalid_grant")
+		return
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":                p.issuer,
+		"sub":                g.subject,
+		"aud":                p.clientID,
+		"iat":                now.Unix(),
+		"exp":                now.Add(5 * time.Minute).Unix(),
+		"nonce":              g.nonce,
+		"preferred_username": g.username,
+		"groups":             g.groups,
+	}
+	if p.tamper != nil {
+		p.tamper(claims)
+	}
+	accessToken, _ := randomToken()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   "Bearer",
+		"expires_in":   300,
+		"id_token":     p.sign(claims),
+	})
+}
+
+// sign returns claims as an RS256 signed JWT
+func (p *oidcStandIn) sign(claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": oidcStandInKeyID, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	key := p.key
+	if p.signWith != nil {
+		key = p.signWith
+	}
+	signature, _ := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func writeOIDCError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": code})
+}
+
+// authorize starts a sign-in and follows it through the provider's
+// authorization endpoint as the given user, returning the state and code the
+// browser would be redirected back with
+func (p *oidcStandIn) authorize(t *testing.T, username, groups string) (state, code string) {
+	t.Helper()
+	authURL, err := BeginOIDCLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(authURL, p.issuer+"/authorize?") {
+		t.Fatalf("auth URL %q does not point at the provider", authURL)
+	}
+	authURL += "&" + url.Values{"login_user": {username}, "login_groups": {groups}}.Encode()
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, err := url.Parse(resp.Header.Get("Location"))
+	if resp.StatusCode != http.StatusFound || err != nil {
+		t.Fatalf("authorize: %s, location %q", resp.Status, resp.Header.Get("Location"))
+	}
+	return location.Query().Get("state"), location.Query().Get("code")
+}
+
+func TestOIDCLogin(t *testing.T) {
+	p := newOIDCStandIn(t)
+
+	state, code := p.authorize(t, "oidc-alice", "staff,ops")
+	identity, err := FinishOIDCLogin(state, code)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.Subject != "oidc-alice" || identity.Username != "oidc-alice" ||
+		strings.Join(identity.Groups, ",") != "staff,ops" {
+		t.Errorf("identity = %+v", identity)
+	}
+
+	// The state is single-use
+	if _, err := FinishOIDCLogin(state, code); !errors.Is(err, ErrOIDCInvalidState) {
+		t.Errorf("replayed state: %v, want ErrOIDCInvalidState", err)
+	}
+}
+
+func TestOIDCLoginRejects(t *testing.T) {
+	p := newOIDCStandIn(t)
+
+	t.Run("unknown state", func(t *testing.T) {
+		_, code := p.authorize(t, "oidc-bob", "")
+		for _, state := range []string{"", "bogus"} {
+			if _, err := FinishOIDCLogin(state, code); !errors.Is(err, ErrOIDCInvalidState) {
+				t.Errorf("state %q: %v, want ErrOIDCInvalidState", state, err)
+			}
+		}
+	})
+
+	t.Run("expired sign-in", func(t *testing.T) {
+		state, code := p.authorize(t, "oidc-bob", "")
+		value, _ := pendingOIDCLogins.Load(state)
+		value.(*pendingOIDCLogin).expires = time.Now().Add(-time.Second)
+		if _, err := FinishOIDCLogin(state, code); !errors.Is(err, ErrOIDCInvalidState) {
+			t.Errorf("expired: %v, want ErrOIDCInvalidState", err)
+		}
+	})
+
+	t.Run("PKCE verifier mismatch", func(t *testing.T) {
+		// A code redeemed by a sign-in other than the one it was issued to
+		// comes with the wrong verifier
+		state, code := p.authorize(t, "oidc-bob", "")
+		value, _ := pendingOIDCLogins.Load(state)
+		value.(*pendingOIDCLogin).verifier = "not-the-verifier-the-challenge-was-made-from"
+		if _, err := FinishOIDCLogin(state, code); !errors.Is(err, ErrOIDCFailed) || !strings.Contains(err.Error(), "code exchange") {
+			t.Errorf("wrong verifier: %v, want a failed code exchange", err)
+		}
+	})
+
+	tampered := []struct {
+		name   string
+		tamper func(map[string]interface{})
+	}{
+		{"nonce mismatch", func(c map[string]interface{}) { c["nonce"] = "another-nonce" }},
+		{"wrong audience", func(c map[string]interface{}) { c["aud"] = "another-client" }},
+		{"wrong issuer", func(c map[string]interface{}) { c["iss"] = "https://evil.test" }},
+		{"expired token", func(c map[string]interface{}) { c["exp"] = time.Now().Add(-time.Hour).Unix() }},
+	}
+	for _, tt := range tampered {
+		t.Run(tt.name, func(t *testing.T) {
+			p.tamper = tt.tamper
+			defer func() { p.tamper = nil }()
+			state, code := p.authorize(t, "oidc-bob", "")
+			if _, err := FinishOIDCLogin(state, code); !errors.Is(err, ErrOIDCFailed) {
+				t.Errorf("%s: %v, want ErrOIDCFailed", tt.name, err)
+			}
+		})
+	}
+
+	t.Run("bad signature", func(t *testing.T) {
+		p.signWith, _ = rsa.GenerateKey(rand.Reader, 2048)
+		defer func() { p.signWith = nil }()
+		state, code := p.authorize(t, "oidc-bob", "")
+		if _, err := FinishOIDCLogin(state, code); !errors.Is(err, ErrOIDCFailed) {
+			t.Errorf("signed with an unknown key: %v, want ErrOIDCFailed", err)
+		}
+	})
+}
+
+func TestOIDCLoginTickets(t *testing.T) {
+	ticket, err := IssueLoginTicket(42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if userID, err := RedeemLoginTicket(ticket); err != nil || userID != 42 {
+		t.Fatalf("redeem = %d, %v", userID, err)
+	}
+	if _, err := RedeemLoginTicket(ticket); !errors.Is(err, ErrOIDCInvalidTicket) {
+		t.Errorf("second redemption: %v, want ErrOIDCInvalidTicket", err)
+	}
+
+	ticket, _ = IssueLoginTicket(42)
+	value, _ := loginTickets.Load(ticket)
+	value.(*loginTicket).expires = time.Now().Add(-time.Second)
+	if _, err := RedeemLoginTicket(ticket); !errors.Is(err, ErrOIDCInvalidTicket) {
+		t.Errorf("expired ticket: %v, want ErrOIDCInvalidTicket", err)
+	}
+}
+
+func TestProvisionOIDCUserRoles(t *testing.T) {
+	p := newOIDCStandIn(t)
+	cfg := config.GetConfig()
+	cfg.OIDCAdminGroups = []string{"farseer-admins"}
+	cfg.OIDCUserGroups = []string{"farseer-users"}
+
+	signInAs := func(username, groups string) (*AuthResult, error) {
+		t.Helper()
+		state, code := p.authorize(t, username, groups)
+		identity, err := FinishOIDCLogin(state, code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ProvisionOIDCUser(identity)
+	}
+	signIn := func(groups string) (*AuthResult, error) {
+		t.Helper()
+		return signInAs("oidc-carol", groups)
+	}
+
+	if _, err := signIn("contractors"); !errors.Is(err, ErrOIDCNotAllowed) {
+		t.Fatalf("user outside the allowed groups: %v, want ErrOIDCNotAllowed", err)
+	}
+	result, err := signIn("farseer-users")
+	if err != nil || !result.Created || result.User.Role != models.RoleUser ||
+		result.User.AuthProvider != models.AuthProviderOIDC {
+		t.Fatalf("first sign-in: %+v, %v", result, err)
+	}
+	result, err = signIn("Farseer-Admins")
+	if err != nil || result.Created || !result.RoleChanged || result.User.Role != models.RoleAdmin {
+		t.Fatalf("promoted sign-in: %+v, %v", result, err)
+	}
+
+	// A name with a slash would reach into another user's secret paths
+	if _, err := signInAs("oidc-carol/prod", "farseer-users"); !errors.Is(err, ErrInvalidUsername) {
+		t.Errorf("username with a slash: %v, want ErrInvalidUsername", err)
+	}
+
+	// A different subject claiming the same username is not attached to the account
+	p.tamper = func(c map[string]interface{}) { c["sub"] = "someone-else" }
+	defer func() { p.tamper = nil }()
+	if _, err := signIn("farseer-users"); !errors.Is(err, ErrOIDCUsernameTaken) {
+		t.Errorf("username takeover: %v, want ErrOIDCUsernameTaken", err)
+	}
+}
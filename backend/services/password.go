@@ -0,0 +1,384 @@
+package services
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"farseer/database"
+	"farseer/models"
+)
+
+const (
+	rotatedPasswordLength = 24
+	passwdTimeout         = 30 * time.Second
+)
+
+// Character classes for generated passwords. Symbols exclude characters that
+// need quoting in shells or that chpasswd treats specially (":").
+var passwordClasses = []string{
+	"abcdefghijkmnopqrstuvwxyz",
+	"ABCDEFGHJKLMNPQRSTUVWXYZ",
+	"23456789",
+	"!#%+,-./=?@^_~",
+}
+
+// GeneratePassword returns a random password containing at least one
+// character from every class
+func GeneratePassword(length int) (string, error) {
+	if length < len(passwordClasses) {
+		return "", errors.New("password length too short")
+	}
+
+	all := strings.Join(passwordClasses, "")
+	password := make([]byte, length)
+	for i := range password {
+		charset := all
+		if i < len(passwordClasses) {
+			charset = passwordClasses[i]
+		}
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(charset))))
+		if err != nil {
+			return "", err
+		}
+		password[i] = charset[n.Int64()]
+	}
+
+	// Shuffle so the guaranteed characters aren't always first
+	for i := len(password) - 1; i > 0; i-- {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(i+1)))
+		if err != nil {
+			return "", err
+		}
+		j := n.Int64()
+		password[i], password[j] = password[j], password[i]
+	}
+
+	return string(password), nil
+}
+
+// ChangePassword changes the remote account password. root uses chpasswd;
+// other users go through passwd on a PTY, answering its prompts.
+func (s *SSHSession) ChangePassword(username, currentPassword, newPassword string) error {
+	uid, err := s.Run("id -u", "")
+	if err != nil {
+		return fmt.Errorf("failed to determine remote user: %w", err)
+	}
+
+	if strings.TrimSpace(uid) == "0" {
+		if _, err := s.Run("chpasswd", username+":"+newPassword+"\n"); err != nil {
+			return fmt.Errorf("chpasswd failed: %w", err)
+		}
+		return nil
+	}
+
+	return s.runPasswd(currentPassword, newPassword)
+}
+
+func (s *SSHSession) runPasswd(currentPassword, newPassword string) error {
+	session, err := s.Client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create session: %w", err)
+	}
+	defer session.Close()
+
+	if err := session.RequestPty("xterm", 24, 80, ssh.TerminalModes{ssh.ECHO: 0}); err != nil {
+		return fmt.Errorf("failed to request PTY: %w", err)
+	}
+
+	stdin, err := session.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stdin pipe: %w", err)
+	}
+	stdout, err := session.StdoutPipe()
+	if err != nil {
+		return fmt.Errorf("failed to get stdout pipe: %w", err)
+	}
+
+	if err := session.Start("LC_ALL=C passwd"); err != nil {
+		return fmt.Errorf("failed to start passwd: %w", err)
+	}
+
+	// Answer each prompt (output ending in ":") with the next response
+	answers := []string{currentPassword, newPassword, newPassword}
+	var transcript strings.Builder
+	readDone := make(chan struct{})
+	go func() {
+		defer close(readDone)
+		buf := make([]byte, 1024)
+		var pending strings.Builder
+		for {
+			n, err := stdout.Read(buf)
+			if n > 0 {
+				transcript.Write(buf[:n])
+				pending.Write(buf[:n])
+				if strings.HasSuffix(strings.TrimSpace(pending.String()), ":") && len(answers) > 0 {
+					io.WriteString(stdin, answers[0]+"\n")
+					answers = answers[1:]
+					pending.Reset()
+				}
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		<-readDone
+		if err != nil {
+			return fmt.Errorf("passwd failed: %w: %s", err, strings.TrimSpace(transcript.String()))
+		}
+		return nil
+	case <-time.After(passwdTimeout):
+		session.Signal(ssh.SIGKILL)
+		return errors.New("passwd timed out")
+	}
+}
+
+// RotateMachinePassword sets a new random password on the machine and
+// verifies that it can be used to log in. If the new password does not work
+// the previous one is restored. The caller is responsible for storing the
+// returned password.
+func RotateMachinePassword(machine *models.Machine, oldCred *CredentialData) (string, error) {
+	if oldCred.Password == "" {
+		return "", errors.New("machine does not use password authentication")
+	}
+
+	newPassword, err := GeneratePassword(rotatedPasswordLength)
+	if err != nil {
+		return "", err
+	}
+
+	session, err := ConnectMachine(machine, oldCred)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect with current password: %w", err)
+	}
+	defer session.Close()
+
+	if err := session.ChangePassword(machine.Username, oldCred.Password, newPassword); err != nil {
+		return "", err
+	}
+
+	verify, err := ConnectMachine(machine, &CredentialData{Password: newPassword})
+	if err != nil {
+		cause := fmt.Errorf("login with new password failed: %w", err)
+		if err := session.ChangePassword(machine.Username, newPassword, oldCred.Password); err != nil {
+			return "", &RotationError{Err: fmt.Errorf("%v; rollback failed: %v", cause, err)}
+		}
+		return "", &RotationError{Err: cause, RolledBack: true}
+	}
+	verify.Close()
+
+	return newPassword, nil
+}
+
+func rotateOnePassword(machine *models.Machine, encryptionKey string) *models.RotationResult {
+	result := &models.RotationResult{
+		MachineID:   machine.ID,
+		MachineName: machine.Name,
+	}
+
+	if reason := rotationSkipReason(machine, models.AuthTypePassword); reason != "" {
+		result.Status = models.RotationResultSkipped
+		result.Message = reason
+		return result
+	}
+
+	oldCred, err := DecryptCredential(machine.CredentialEncrypted, encryptionKey)
+	if err != nil {
+		result.Status = models.RotationResultFailed
+		result.Message = "Failed to decrypt credentials"
+		return result
+	}
+
+	newPassword, err := RotateMachinePassword(machine, oldCred)
+	if err != nil {
+		result.Status = models.RotationResultFailed
+		var rotationErr *RotationError
+		if errors.As(err, &rotationErr) && rotationErr.RolledBack {
+			result.Status = models.RotationResultRolledBack
+		}
+		result.Message = err.Error()
+		return result
+	}
+
+	// Only now that the new password is verified is the stored credential replaced
+	encryptedCred, err := EncryptCredential(&CredentialData{Password: newPassword}, encryptionKey)
+	if err == nil {
+		err = database.DB.Model(machine).Updates(map[string]interface{}{
+			"credential_encrypted":  encryptedCred,
+			"credential_rotated_at": time.Now(),
+		}).Error
+	}
+	if err != nil {
+		result.Status = models.RotationResultFailed
+		result.Message = "Failed to save new password: " + err.Error()
+		if restoreErr := restorePassword(machine, newPassword, oldCred.Password); restoreErr != nil {
+			result.Message += "; failed to restore previous password: " + restoreErr.Error()
+		} else {
+			result.Status = models.RotationResultRolledBack
+		}
+		return result
+	}
+
+	result.Status = models.RotationResultSuccess
+	return result
+}
+
+func restorePassword(machine *models.Machine, currentPassword, previousPassword string) error {
+	session, err := ConnectMachine(machine, &CredentialData{Password: currentPassword})
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	return session.ChangePassword(machine.Username, currentPassword, previousPassword)
+}
+
+// PasswordRotationDue reports whether a machine's scheduled password rotation is overdue
+func PasswordRotationDue(machine *models.Machine) bool {
+	if machine.AuthType != models.AuthTypePassword || !machine.HasOwnCredential() || machine.PasswordRotationDays <= 0 {
+		return false
+	}
+	if machine.CredentialRotatedAt == nil {
+		return true
+	}
+	return time.Since(*machine.CredentialRotatedAt) >= time.Duration(machine.PasswordRotationDays)*24*time.Hour
+}
+
+// DuePasswordRotations returns the user's machines whose scheduled password rotation is overdue
+func DuePasswordRotations(userID uint) ([]models.Machine, error) {
+	var machines []models.Machine
+	err := database.DB.Where("user_id = ? AND auth_type = ? AND credential_id IS NULL AND (secret_path IS NULL OR secret_path = '') AND password_rotation_days > 0", userID, models.AuthTypePassword).
+		Order("name").Find(&machines).Error
+	if err != nil {
+		return nil, err
+	}
+
+	due := machines[:0]
+	for _, machine := range machines {
+		if PasswordRotationDue(&machine) {
+			due = append(due, machine)
+		}
+	}
+	return due, nil
+}
+
+// StartPasswordRotationScheduler rotates overdue machine passwords every
+// hour. The server can only unlock the credentials of SSO, directory and
+// proxy users, whose client key it holds. A local user's data key is wrapped
+// with their password-derived key alone, so their machines get a reminder
+// instead and are rotated when the web client signs in (see
+// StartDuePasswordRotation) or the owner starts a rotation.
+func StartPasswordRotationScheduler() {
+	go func() {
+		for {
+			time.Sleep(1 * time.Hour)
+
+			var machines []models.Machine
+			if err := database.DB.Where("auth_type = ? AND credential_id IS NULL AND (secret_path IS NULL OR secret_path = '') AND password_rotation_days > 0", models.AuthTypePassword).
+				Order("user_id, name").Find(&machines).Error; err != nil {
+				log.Printf("Password rotation: failed to load machines: %v", err)
+				continue
+			}
+
+			due := make(map[uint][]models.Machine)
+			var owners []uint
+			for _, machine := range machines {
+				if !PasswordRotationDue(&machine) || recentlyFailedRotation(machine.ID) {
+					continue
+				}
+				if _, seen := due[machine.UserID]; !seen {
+					owners = append(owners, machine.UserID)
+				}
+				due[machine.UserID] = append(due[machine.UserID], machine)
+			}
+
+			for _, userID := range owners {
+				if err := runScheduledPasswordRotation(userID, due[userID]); err != nil {
+					log.Printf("Password rotation: user %d: %v", userID, err)
+					remindPasswordRotation(due[userID])
+				}
+			}
+		}
+	}()
+}
+
+// recentlyFailedRotation reports whether the machine's last rotation failed
+// within the past day, so a host that keeps refusing is retried daily rather
+// than every hour
+func recentlyFailedRotation(machineID uint) bool {
+	var last models.RotationResult
+	err := database.DB.Where("machine_id = ?", machineID).Order("id DESC").First(&last).Error
+	return err == nil && last.Status != models.RotationResultSuccess && last.Status != models.RotationResultSkipped &&
+		time.Since(last.CreatedAt) < 24*time.Hour
+}
+
+// errNoServerHeldKey means the server cannot unlock a user's credentials
+// without them signing in
+var errNoServerHeldKey = errors.New("credential key is derived from the user's password")
+
+// runScheduledPasswordRotation rotates a user's overdue passwords with their
+// server-held client key, as a rotation job of their own
+func runScheduledPasswordRotation(userID uint, machines []models.Machine) error {
+	var user models.User
+	if err := database.DB.First(&user, userID).Error; err != nil {
+		return err
+	}
+	if user.ClientKeySealed == "" || user.Disabled {
+		return errNoServerHeldKey
+	}
+
+	clientKey, err := SSOClientKey(&user)
+	if err != nil {
+		return err
+	}
+	dataKey, err := UnlockDataKey(user.ID, clientKey)
+	if err != nil {
+		return err
+	}
+
+	job := models.RotationJob{
+		UserID: user.ID,
+		Kind:   models.RotationKindPassword,
+		Status: models.RotationStatusRunning,
+		Total:  len(machines),
+	}
+	if err := database.DB.Create(&job).Error; err != nil {
+		return err
+	}
+	RunRotationJob(&job, machines, dataKey, user.Username, "", RotationOptions{})
+	return nil
+}
+
+// remindPasswordRotation notifies the owners of machines whose rotation is
+// due and could not run on the server, once per unread reminder
+func remindPasswordRotation(machines []models.Machine) {
+	for i := range machines {
+		machine := &machines[i]
+
+		var count int64
+		database.DB.Model(&models.Notification{}).
+			Where("machine_id = ? AND type = ? AND read_at IS NULL", machine.ID, models.NotificationPasswordRotationDue).
+			Count(&count)
+		if count > 0 {
+			continue
+		}
+
+		Notify(machine.UserID, models.NotificationPasswordRotationDue, "Password rotation due: "+machine.Name,
+			fmt.Sprintf("The password for %s@%s is due for rotation (every %d days). It is rotated the next time you sign in to the web UI, or you can start a rotation through the API.", machine.Username, machine.Hostname, machine.PasswordRotationDays), &machine.ID)
+	}
+}
@@ -0,0 +1,181 @@
+package services
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"farseer/config"
+	"farseer/models"
+)
+
+// ErrBreachedListUnavailable is returned when the breached password list is
+// configured but cannot be read. Passwords are refused rather than let
+// through unchecked.
+var ErrBreachedListUnavailable = errors.New("breached password list unavailable")
+
+// PasswordPolicyError explains why a password does not meet the policy. Its
+// message is meant for the user.
+type PasswordPolicyError struct {
+	Reason string
+}
+
+func (e *PasswordPolicyError) Error() string {
+	return e.Reason
+}
+
+// breachedList holds the SHA-1 digests from the breached password file,
+// reloaded when the file changes
+type breachedList struct {
+	mu      sync.Mutex
+	path    string
+	modTime time.Time
+	digests map[[sha1.Size]byte]struct{}
+}
+
+var breached = &breachedList{}
+
+// CheckPasswordPolicy returns a *PasswordPolicyError if password is too
+// short, mixes too few character classes or is on the breached password list
+func CheckPasswordPolicy(password string) error {
+	cfg := config.GetConfig()
+
+	if len([]rune(password)) < cfg.PasswordMinLength {
+		return &PasswordPolicyError{fmt.Sprintf("Password must be at least %d characters", cfg.PasswordMinLength)}
+	}
+	if cfg.PasswordMinClasses > 1 && passwordClassCount(password) < cfg.PasswordMinClasses {
+		return &PasswordPolicyError{fmt.Sprintf("Password must mix at least %d of lowercase letters, uppercase letters, digits and symbols", cfg.PasswordMinClasses)}
+	}
+
+	if cfg.PasswordBreachedListFile == "" {
+		return nil
+	}
+	digests, err := breached.load(cfg.PasswordBreachedListFile)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBreachedListUnavailable, err)
+	}
+	if _, found := digests[sha1.Sum([]byte(password))]; found {
+		return &PasswordPolicyError{"This password appears in a list of breached passwords, choose another"}
+	}
+	return nil
+}
+
+// BreachedPasswordCount is the number of entries on the breached password
+// list, or 0 when none is configured or it cannot be read
+func BreachedPasswordCount() int {
+	path := config.GetConfig().PasswordBreachedListFile
+	if path == "" {
+		return 0
+	}
+	digests, err := breached.load(path)
+	if err != nil {
+		return 0
+	}
+	return len(digests)
+}
+
+// PasswordExpired reports whether the user's local password is older than
+// PasswordMaxAgeDays. Passwords set before changes were recorded count from
+// the account's creation.
+func PasswordExpired(user *models.User) bool {
+	days := config.GetConfig().PasswordMaxAgeDays
+	if days <= 0 || !HasLocalPassword(user) {
+		return false
+	}
+	changed := user.CreatedAt
+	if user.PasswordChangedAt != nil {
+		changed = *user.PasswordChangedAt
+	}
+	return time.Now().After(changed.AddDate(0, 0, days))
+}
+
+// HasLocalPassword reports whether the user signs in with a password Farseer
+// stores. Directory passwords are managed in the directory, and proxy users
+// have none.
+func HasLocalPassword(user *models.User) bool {
+	return user.PasswordHash != "" && user.AuthProvider != models.AuthProviderLDAP && user.AuthProvider != models.AuthProviderProxy
+}
+
+// passwordClassCount counts the character classes a password mixes:
+// lowercase, uppercase, digits and everything else
+func passwordClassCount(password string) int {
+	var lower, upper, digit, other bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			other = true
+		}
+	}
+	count := 0
+	for _, has := range []bool{lower, upper, digit, other} {
+		if has {
+			count++
+		}
+	}
+	return count
+}
+
+// load returns the digests of the breached password file. Each line is a
+// password, or the SHA-1 of one in hex as in the Have I Been Pwned downloads
+// ("HASH" or "HASH:count").
+func (b *breachedList) load(path string) (map[[sha1.Size]byte]struct{}, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.digests != nil && b.path == path && b.modTime.Equal(info.ModTime()) {
+		return b.digests, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	digests := make(map[[sha1.Size]byte]struct{})
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		digests[breachedDigest(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	b.path, b.modTime, b.digests = path, info.ModTime(), digests
+	return digests, nil
+}
+
+func breachedDigest(line string) [sha1.Size]byte {
+	hash := line
+	if i := strings.IndexByte(line, ':'); i == 2*sha1.Size {
+		hash = line[:i]
+	}
+	var digest [sha1.Size]byte
+	if len(hash) == 2*sha1.Size {
+		if _, err := hex.Decode(digest[:], []byte(hash)); err == nil {
+			return digest
+		}
+	}
+	return sha1.Sum([]byte(line))
+}
@@ -0,0 +1,140 @@
+package services
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"farseer/config"
+	"farseer/models"
+)
+
+func TestPasswordClassCount(t *testing.T) {
+	tests := []struct {
+		password string
+		want     int
+	}{
+		{"", 0},
+		{"password", 1},
+		{"PASSWORD", 1},
+		{"12345678", 1},
+		{"Password", 2},
+		{"Password1", 3},
+		{"Password1!", 4},
+		{"pass word", 2},
+		{"Ünïcödé1", 3},
+	}
+	for _, tt := range tests {
+		if got := passwordClassCount(tt.password); got != tt.want {
+			t.Errorf("passwordClassCount(%q) = %d, want %d", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestBreachedDigest(t *testing.T) {
+	digest := sha1.Sum([]byte("letmein"))
+	upper := strings.ToUpper(hex.EncodeToString(digest[:]))
+
+	tests := []struct {
+		name string
+		line string
+		want [sha1.Size]byte
+	}{
+		{"password", "letmein", digest},
+		{"hash", upper, digest},
+		{"lowercase hash", strings.ToLower(upper), digest},
+		{"hash with count", upper + ":1234", digest},
+		{"short hash with count", "abc:12", sha1.Sum([]byte("abc:12"))},
+		{"not hex", strings.Repeat("z", 2*sha1.Size), sha1.Sum([]byte(strings.Repeat("z", 2*sha1.Size)))},
+	}
+	for _, tt := range tests {
+		if got := breachedDigest(tt.line); got != tt.want {
+			t.Errorf("%s: breachedDigest(%q) is not the expected digest", tt.name, tt.line)
+		}
+	}
+}
+
+func TestCheckPasswordPolicy(t *testing.T) {
+	cfg := config.GetConfig()
+	saved := *cfg
+	t.Cleanup(func() { *cfg = saved })
+
+	digest := sha1.Sum([]byte("Correct-Horse-1"))
+	list := filepath.Join(t.TempDir(), "breached.txt")
+	contents := "password123\r\n\n" + strings.ToUpper(hex.EncodeToString(digest[:])) + ":42\n"
+	if err := os.WriteFile(list, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg.PasswordMinLength = 10
+	cfg.PasswordMinClasses = 3
+	cfg.PasswordBreachedListFile = list
+
+	tests := []struct {
+		password string
+		ok       bool
+	}{
+		{"Short-1", false},
+		{"longenough", false},
+		{"Longenough1", true},
+		{"password123", false},
+		{"Correct-Horse-1", false},
+		{"Correct-Horse-2", true},
+	}
+	for _, tt := range tests {
+		err := CheckPasswordPolicy(tt.password)
+		var policyErr *PasswordPolicyError
+		if tt.ok && err != nil || !tt.ok && !errors.As(err, &policyErr) {
+			t.Errorf("CheckPasswordPolicy(%q) = %v, want ok=%v", tt.password, err, tt.ok)
+		}
+	}
+	if n := BreachedPasswordCount(); n != 2 {
+		t.Errorf("BreachedPasswordCount() = %d, want 2", n)
+	}
+
+	cfg.PasswordBreachedListFile = filepath.Join(t.TempDir(), "missing.txt")
+	if err := CheckPasswordPolicy("Longenough1"); !errors.Is(err, ErrBreachedListUnavailable) {
+		t.Errorf("missing list: %v, want ErrBreachedListUnavailable", err)
+	}
+}
+
+func TestPasswordExpired(t *testing.T) {
+	cfg := config.GetConfig()
+	saved := *cfg
+	t.Cleanup(func() { *cfg = saved })
+
+	daysAgo := func(days int) *time.Time {
+		at := time.Now().AddDate(0, 0, -days)
+		return &at
+	}
+	local := func(changed *time.Time, created int) *models.User {
+		return &models.User{PasswordHash: "-", PasswordChangedAt: changed, CreatedAt: *daysAgo(created)}
+	}
+	directory := local(daysAgo(100), 100)
+	directory.AuthProvider = models.AuthProviderLDAP
+
+	tests := []struct {
+		name   string
+		maxAge int
+		user   *models.User
+		want   bool
+	}{
+		{"recent change", 90, local(daysAgo(10), 200), false},
+		{"old change", 90, local(daysAgo(91), 200), true},
+		{"never changed, new account", 90, local(nil, 10), false},
+		{"never changed, old account", 90, local(nil, 100), true},
+		{"no maximum age", 0, local(daysAgo(1000), 1000), false},
+		{"directory password", 90, directory, false},
+		{"no password", 90, &models.User{CreatedAt: *daysAgo(100)}, false},
+	}
+	for _, tt := range tests {
+		cfg.PasswordMaxAgeDays = tt.maxAge
+		if got := PasswordExpired(tt.user); got != tt.want {
+			t.Errorf("%s: PasswordExpired = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const probeTimeout = 10 * time.Second
+
+// Probe step names, in the order they are attempted
+const (
+	ProbeStepDNS       = "dns"
+	ProbeStepTCP       = "tcp"
+	ProbeStepHandshake = "handshake"
+	ProbeStepHostKey   = "host_key"
+	ProbeStepAuth      = "auth"
+)
+
+// Probe step statuses
+const (
+	ProbeStatusOK      = "ok"
+	ProbeStatusFailed  = "failed"
+	ProbeStatusSkipped = "skipped"
+)
+
+// ProbeStep is the outcome of a single stage of a connection test
+type ProbeStep struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Message    string `json:"message,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+}
+
+// ProbeResult is the full report of a connection test
+type ProbeResult struct {
+	Success       bool        `json:"success"`
+	Steps         []ProbeStep `json:"steps"`
+	Fingerprint   string      `json:"fingerprint,omitempty"`
+	HostKeyStatus string      `json:"host_key_status,omitempty"` // "new", "match", "mismatch"
+	Banner        string      `json:"banner,omitempty"`
+}
+
+func (r *ProbeResult) addStep(name, status, message string, started time.Time) {
+	r.Steps = append(r.Steps, ProbeStep{
+		Name:       name,
+		Status:     status,
+		Message:    message,
+		DurationMs: time.Since(started).Milliseconds(),
+	})
+}
+
+// skipRemaining marks every step after the failed one as skipped
+func (r *ProbeResult) skipRemaining(after string) {
+	steps := []string{ProbeStepDNS, ProbeStepTCP, ProbeStepHandshake, ProbeStepHostKey, ProbeStepAuth}
+	skipping := false
+	for _, name := range steps {
+		if skipping {
+			r.Steps = append(r.Steps, ProbeStep{Name: name, Status: ProbeStatusSkipped})
+		}
+		if name == after {
+			skipping = true
+		}
+	}
+}
+
+// ProbeSSH attempts to connect and authenticate without opening a session,
+// reporting the result of each stage. The connection is always closed.
+func ProbeSSH(cfg *SSHConfig) *ProbeResult {
+	result := &ProbeResult{}
+
+	// DNS resolution
+	started := time.Now()
+	var addrs []string
+	if ip := net.ParseIP(cfg.Hostname); ip != nil {
+		addrs = []string{ip.String()}
+		result.addStep(ProbeStepDNS, ProbeStatusOK, "Hostname is an IP address", started)
+	} else {
+		resolved, err := net.LookupHost(cfg.Hostname)
+		if err != nil || len(resolved) == 0 {
+			result.addStep(ProbeStepDNS, ProbeStatusFailed, fmt.Sprintf("Failed to resolve %s: %v", cfg.Hostname, err), started)
+			result.skipRemaining(ProbeStepDNS)
+			return result
+		}
+		addrs = resolved
+		result.addStep(ProbeStepDNS, ProbeStatusOK, "Resolved to "+resolved[0], started)
+	}
+
+	// TCP connection
+	started = time.Now()
+	addr := net.JoinHostPort(addrs[0], strconv.Itoa(cfg.Port))
+	conn, err := net.DialTimeout("tcp", addr, probeTimeout)
+	if err != nil {
+		result.addStep(ProbeStepTCP, ProbeStatusFailed, fmt.Sprintf("Failed to connect to %s: %v", addr, err), started)
+		result.skipRemaining(ProbeStepTCP)
+		return result
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(probeTimeout * 3))
+	result.addStep(ProbeStepTCP, ProbeStatusOK, "Connected to "+addr, started)
+
+	// Auth methods are parsed up front so a bad key is reported as an auth failure
+	authMethods, authErr := buildAuthMethods(cfg)
+	if authErr != nil {
+		// Still run the handshake so the host key can be reported
+		authMethods = nil
+	}
+
+	// SSH handshake, host key and authentication all happen inside NewClientConn
+	started = time.Now()
+	hostKeySeen := false
+	var hostKeyErr error
+	sshConfig := &ssh.ClientConfig{
+		User: cfg.Username,
+		Auth: authMethods,
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			hostKeySeen = true
+			result.Fingerprint = ssh.FingerprintSHA256(key)
+			result.addStep(ProbeStepHandshake, ProbeStatusOK, "Key exchange completed ("+key.Type()+")", started)
+
+			switch {
+			case cfg.HostKey == "":
+				result.HostKeyStatus = "new"
+				result.addStep(ProbeStepHostKey, ProbeStatusOK, "New host key "+result.Fingerprint, time.Now())
+			case cfg.HostKey == result.Fingerprint:
+				result.HostKeyStatus = "match"
+				result.addStep(ProbeStepHostKey, ProbeStatusOK, "Host key matches", time.Now())
+			default:
+				result.HostKeyStatus = "mismatch"
+				hostKeyErr = fmt.Errorf("host key mismatch: expected %s, got %s", cfg.HostKey, result.Fingerprint)
+				result.addStep(ProbeStepHostKey, ProbeStatusFailed, hostKeyErr.Error(), time.Now())
+				return hostKeyErr
+			}
+
+			// No usable credentials: stop here rather than attempting "none" auth
+			if authErr != nil {
+				return authErr
+			}
+
+			started = time.Now()
+			return nil
+		},
+		BannerCallback: func(message string) error {
+			result.Banner = message
+			return nil
+		},
+	}
+
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
+	if err != nil {
+		switch {
+		case !hostKeySeen:
+			result.addStep(ProbeStepHandshake, ProbeStatusFailed, "SSH handshake failed: "+err.Error(), started)
+			result.skipRemaining(ProbeStepHandshake)
+		case hostKeyErr != nil:
+			result.skipRemaining(ProbeStepHostKey)
+		case authErr != nil:
+			result.addStep(ProbeStepAuth, ProbeStatusFailed, authErr.Error(), started)
+		default:
+			result.addStep(ProbeStepAuth, ProbeStatusFailed, "Authentication failed: "+err.Error(), started)
+		}
+		return result
+	}
+	client := ssh.NewClient(sshConn, chans, reqs)
+	defer client.Close()
+
+	result.addStep(ProbeStepAuth, ProbeStatusOK, "Authenticated as "+cfg.Username, started)
+	result.Success = true
+
+	return result
+}
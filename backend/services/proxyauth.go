@@ -0,0 +1,103 @@
+package services
+
+import (
+	"errors"
+	"log"
+	"net"
+	"strings"
+
+	"gorm.io/gorm"
+
+	"farseer/config"
+	"farseer/database"
+	"farseer/models"
+)
+
+var (
+	// ErrUntrustedProxy is returned when the proxy user header comes from an address not trusted to set it
+	ErrUntrustedProxy = errors.New("the proxy user header is only accepted from trusted proxies")
+	// ErrNotProxyAccount is returned when the proxy names an account that signs in another way
+	ErrNotProxyAccount = errors.New("this account does not sign in through the proxy")
+	// ErrUnknownProxyUser is returned for a proxy user with no account when auto-provisioning is off
+	ErrUnknownProxyUser = errors.New("no account for the proxy user, ask an admin to create one")
+)
+
+// ProxyAuthEnabled reports whether reverse-proxy authentication is configured
+func ProxyAuthEnabled() bool {
+	cfg := config.GetConfig()
+	return cfg.ProxyAuthUserHeader != "" && len(cfg.ProxyAuthTrustedCIDRs) > 0
+}
+
+// TrustedProxy reports whether ip is in one of the trusted proxy networks.
+// Single addresses are accepted as well as CIDRs.
+func TrustedProxy(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, entry := range config.GetConfig().ProxyAuthTrustedCIDRs {
+		entry = strings.TrimSpace(entry)
+		if !strings.Contains(entry, "/") {
+			if trusted := net.ParseIP(entry); trusted != nil && trusted.Equal(ip) {
+				return true
+			}
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid trusted proxy CIDR %q: %v", entry, err)
+			continue
+		}
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ProxyGroups splits the groups header the proxy sent
+func ProxyGroups(header string) []string {
+	var groups []string
+	for _, g := range strings.Split(header, ",") {
+		if g = strings.TrimSpace(g); g != "" {
+			groups = append(groups, g)
+		}
+	}
+	return groups
+}
+
+// AuthenticateProxyUser finds the account of a user the trusted proxy has
+// authenticated, creating it when auto-provisioning is on. Accounts are
+// matched by the proxy's username, and only accounts belonging to the proxy
+// are; a local or SSO account with the same name is never signed in.
+func AuthenticateProxyUser(username string, groups []string) (*AuthResult, error) {
+	cfg := config.GetConfig()
+	var role models.Role
+	if cfg.ProxyAuthGroupsHeader != "" {
+		var err error
+		if role, err = groupRole(groups, cfg.ProxyAuthAdminGroups, cfg.ProxyAuthUserGroups); err != nil {
+			return nil, err
+		}
+	}
+
+	var user models.User
+	err := database.DB.Where("auth_provider = ? AND external_id = ?", models.AuthProviderProxy, username).First(&user).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		if !cfg.ProxyAuthAutoProvision {
+			var count int64
+			database.DB.Model(&models.User{}).Where("username = ?", username).Count(&count)
+			if count > 0 {
+				return nil, ErrNotProxyAccount
+			}
+			return nil, ErrUnknownProxyUser
+		}
+		return checkEnabled(provisionExternalUser(models.AuthProviderProxy, username, username, role))
+	} else if err != nil {
+		return nil, err
+	}
+
+	changed, err := applyExternalRole(&user, role)
+	if err != nil {
+		return nil, err
+	}
+	return checkEnabled(&AuthResult{User: &user, RoleChanged: changed}, nil)
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"crypto/rand"
+	"errors"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"gorm.io/gorm"
+
+	"farseer/database"
+	"farseer/models"
+)
+
+const (
+	recoveryCodeCount = 10
+	// Ten characters from a 32-letter alphabet give 50 bits per code
+	recoveryCodeLength   = 10
+	recoveryCodeAlphabet = "abcdefghjkmnpqrstuvwxyz023456789"
+)
+
+// ErrInvalidRecoveryCode is returned when a recovery code does not match any unused code of the user
+var ErrInvalidRecoveryCode = errors.New("invalid recovery code")
+
+// GenerateRecoveryCodes replaces a user's recovery codes with a fresh set and
+// returns them in plain text. This is the only time they can be shown.
+func GenerateRecoveryCodes(userID uint) ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	records := make([]models.RecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		code, err := randomRecoveryCode()
+		if err != nil {
+			return nil, err
+		}
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		codes[i] = code[:recoveryCodeLength/2] + "-" + code[recoveryCodeLength/2:]
+		records[i] = models.RecoveryCode{UserID: userID, CodeHash: string(hash)}
+	}
+
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("user_id = ?", userID).Delete(&models.RecoveryCode{}).Error; err != nil {
+			return err
+		}
+		return tx.Create(&records).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// UseRecoveryCode consumes one of the user's unused recovery codes and
+// returns how many are left
+func UseRecoveryCode(userID uint, code string) (int64, error) {
+	code = normalizeRecoveryCode(code)
+	if len(code) != recoveryCodeLength {
+		return 0, ErrInvalidRecoveryCode
+	}
+
+	var records []models.RecoveryCode
+	if err := database.DB.Where("user_id = ? AND used_at IS NULL", userID).Find(&records).Error; err != nil {
+		return 0, err
+	}
+	for _, record := range records {
+		if bcrypt.CompareHashAndPassword([]byte(record.CodeHash), []byte(code)) != nil {
+			continue
+		}
+		// Conditional on still being unused, so a code cannot be spent twice concurrently
+		result := database.DB.Model(&record).Where("used_at IS NULL").Update("used_at", time.Now())
+		if result.Error != nil {
+			return 0, result.Error
+		}
+		if result.RowsAffected == 0 {
+			return 0, ErrInvalidRecoveryCode
+		}
+		return RecoveryCodesLeft(userID), nil
+	}
+	return 0, ErrInvalidRecoveryCode
+}
+
+// RecoveryCodesLeft counts a user's unused recovery codes
+func RecoveryCodesLeft(userID uint) int64 {
+	var count int64
+	database.DB.Model(&models.RecoveryCode{}).Where("user_id = ? AND used_at IS NULL", userID).Count(&count)
+	return count
+}
+
+// RecoveryCodesLeftByUser counts unused recovery codes for every user that has any
+func RecoveryCodesLeftByUser() map[uint]int64 {
+	var rows []struct {
+		UserID uint
+		Count  int64
+	}
+	database.DB.Model(&models.RecoveryCode{}).
+		Select("user_id, COUNT(*) AS count").
+		Where("used_at IS NULL").
+		Group("user_id").
+		Scan(&rows)
+
+	counts := make(map[uint]int64, len(rows))
+	for _, row := range rows {
+		counts[row.UserID] = row.Count
+	}
+	return counts
+}
+
+func randomRecoveryCode() (string, error) {
+	buf := make([]byte, recoveryCodeLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	code := make([]byte, recoveryCodeLength)
+	for i, b := range buf {
+		// 256 is a multiple of 32, so this is unbiased
+		code[i] = recoveryCodeAlphabet[int(b)%len(recoveryCodeAlphabet)]
+	}
+	return string(code), nil
+}
+
+// normalizeRecoveryCode accepts codes typed with spaces, dashes or capitals
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, code)
+}
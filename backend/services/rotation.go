@@ -0,0 +1,289 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"farseer/database"
+	"farseer/models"
+)
+
+// removeAuthorizedKeyScript removes every authorized_keys line containing the
+// base64 key blob read from stdin, preserving the file's inode and mode
+const removeAuthorizedKeyScript = `umask 077
+IFS= read -r blob || exit 1
+f=~/.ssh/authorized_keys
+[ -f "$f" ] || exit 0
+tmp=$(mktemp "$f.XXXXXX") || exit 1
+awk -v k="$blob" '{ for (i = 1; i <= NF; i++) if ($i == k) next } { print }' "$f" > "$tmp" && cat "$tmp" > "$f"
+status=$?
+rm -f "$tmp"
+exit $status`
+
+// RemoveAuthorizedKey removes a public key from the remote user's
+// authorized_keys file. Options and comments on the line are ignored.
+func (s *SSHSession) RemoveAuthorizedKey(authorizedKey string) error {
+	pub, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+	if err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+
+	blob := strings.Fields(string(ssh.MarshalAuthorizedKey(pub)))[1]
+	if _, err := s.Run(removeAuthorizedKeyScript, blob+"\n"); err != nil {
+		return fmt.Errorf("failed to remove public key: %w", err)
+	}
+	return nil
+}
+
+// authorizedKeyFromPrivate derives the authorized_keys line for a private key
+func authorizedKeyFromPrivate(cred *CredentialData) (string, error) {
+	var signer ssh.Signer
+	var err error
+	if cred.Passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase([]byte(cred.PrivateKey), []byte(cred.Passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey([]byte(cred.PrivateKey))
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to parse private key: %w", err)
+	}
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(signer.PublicKey()))), nil
+}
+
+// RotationError describes a failed rotation and whether partial changes were undone
+type RotationError struct {
+	Err        error
+	RolledBack bool
+}
+
+func (e *RotationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RotationError) Unwrap() error {
+	return e.Err
+}
+
+// RotateMachineKey replaces a machine's key: the new key is installed and
+// verified, then the old key is removed from authorized_keys. On failure any
+// change made to authorized_keys is undone. The caller is responsible for
+// storing the returned credential.
+func RotateMachineKey(machine *models.Machine, oldCred *CredentialData, keyType string, bits int) (*KeyPair, error) {
+	if oldCred.PrivateKey == "" {
+		return nil, errors.New("machine does not use key authentication")
+	}
+
+	oldAuthorizedKey, err := authorizedKeyFromPrivate(oldCred)
+	if err != nil {
+		return nil, err
+	}
+
+	keyPair, err := GenerateKeyPair(keyType, bits, "farseer@"+machine.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	oldSession, err := ConnectMachine(machine, oldCred)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect with current key: %w", err)
+	}
+	defer oldSession.Close()
+
+	if err := oldSession.InstallAuthorizedKey(keyPair.AuthorizedKey); err != nil {
+		return nil, err
+	}
+
+	// From here on, failures must remove the new key again
+	rollback := func(cause error) error {
+		if err := oldSession.RemoveAuthorizedKey(keyPair.AuthorizedKey); err != nil {
+			return &RotationError{Err: fmt.Errorf("%v; rollback failed: %v", cause, err)}
+		}
+		return &RotationError{Err: cause, RolledBack: true}
+	}
+
+	newCred := &CredentialData{PrivateKey: keyPair.PrivateKey}
+	newSession, err := ConnectMachine(machine, newCred)
+	if err != nil {
+		return nil, rollback(fmt.Errorf("login with new key failed: %w", err))
+	}
+	defer newSession.Close()
+
+	if err := newSession.RemoveAuthorizedKey(oldAuthorizedKey); err != nil {
+		return nil, rollback(err)
+	}
+
+	return keyPair, nil
+}
+
+// RestoreAuthorizedKey re-installs a machine's previous key after a rotation
+// succeeded remotely but could not be saved
+func RestoreAuthorizedKey(machine *models.Machine, oldCred *CredentialData, newKey *KeyPair) error {
+	oldAuthorizedKey, err := authorizedKeyFromPrivate(oldCred)
+	if err != nil {
+		return err
+	}
+
+	session, err := ConnectMachine(machine, &CredentialData{PrivateKey: newKey.PrivateKey})
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	if err := session.InstallAuthorizedKey(oldAuthorizedKey); err != nil {
+		return err
+	}
+	return session.RemoveAuthorizedKey(newKey.AuthorizedKey)
+}
+
+// RotationOptions holds the kind-specific settings of a rotation job
+type RotationOptions struct {
+	KeyType string
+	Bits    int
+}
+
+// RunRotationJob rotates the credential of every machine in the job, one
+// machine at a time, and records a result for each. encryptionKey is the
+// owner's credential encryption key and is only held for the duration of the job.
+func RunRotationJob(job *models.RotationJob, machines []models.Machine, encryptionKey string, username string, ipAddress string, opts RotationOptions) {
+	action := models.AuditActionKeyRotate
+	if job.Kind == models.RotationKindPassword {
+		action = models.AuditActionPasswordRotate
+	}
+
+	for i := range machines {
+		machine := &machines[i]
+
+		var result *models.RotationResult
+		if job.Kind == models.RotationKindPassword {
+			result = rotateOnePassword(machine, encryptionKey)
+		} else {
+			result = rotateOneKey(machine, encryptionKey, opts.KeyType, opts.Bits)
+		}
+		result.JobID = job.ID
+
+		switch result.Status {
+		case models.RotationResultSuccess:
+			job.Succeeded++
+			details := "Rotated password"
+			if result.Fingerprint != "" {
+				details = "Rotated key to " + result.Fingerprint
+			}
+			LogAudit(job.UserID, username, action, &machine.ID, machine.Name, details, ipAddress)
+		case models.RotationResultSkipped:
+			job.Skipped++
+		default:
+			job.Failed++
+			LogAudit(job.UserID, username, action, &machine.ID, machine.Name, "Rotation failed: "+result.Message, ipAddress)
+		}
+
+		database.DB.Create(result)
+		database.DB.Model(job).Updates(map[string]interface{}{
+			"succeeded": job.Succeeded,
+			"failed":    job.Failed,
+			"skipped":   job.Skipped,
+		})
+	}
+
+	finishRotationJob(job)
+}
+
+// AbortInterruptedRotationJobs marks jobs that were still running when the
+// server stopped as failed
+func AbortInterruptedRotationJobs() {
+	database.DB.Model(&models.RotationJob{}).
+		Where("status = ?", models.RotationStatusRunning).
+		Updates(map[string]interface{}{
+			"status":      models.RotationStatusFailed,
+			"finished_at": time.Now(),
+		})
+}
+
+func finishRotationJob(job *models.RotationJob) {
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Status = models.RotationStatusCompleted
+	if job.Failed > 0 {
+		job.Status = models.RotationStatusFailed
+	}
+	if err := database.DB.Model(job).Updates(map[string]interface{}{
+		"status":      job.Status,
+		"finished_at": now,
+	}).Error; err != nil {
+		log.Printf("Rotation job %d: failed to save status: %v", job.ID, err)
+	}
+}
+
+// rotationSkipReason explains why a machine's credential can't be rotated as
+// authType, or returns "" if it can
+func rotationSkipReason(machine *models.Machine, authType models.AuthType) string {
+	if machine.AuthType != authType {
+		return fmt.Sprintf("Machine does not use %s authentication", authType)
+	}
+	// Rotating a shared credential on one host would lock out every other host
+	// using it, and externally stored secrets are managed by their store
+	if !machine.HasOwnCredential() {
+		return "Machine uses a shared or externally stored credential"
+	}
+	return ""
+}
+
+func rotateOneKey(machine *models.Machine, encryptionKey string, keyType string, bits int) *models.RotationResult {
+	result := &models.RotationResult{
+		MachineID:   machine.ID,
+		MachineName: machine.Name,
+	}
+
+	if reason := rotationSkipReason(machine, models.AuthTypeKey); reason != "" {
+		result.Status = models.RotationResultSkipped
+		result.Message = reason
+		return result
+	}
+
+	oldCred, err := DecryptCredential(machine.CredentialEncrypted, encryptionKey)
+	if err != nil {
+		result.Status = models.RotationResultFailed
+		result.Message = "Failed to decrypt credentials"
+		return result
+	}
+
+	keyPair, err := RotateMachineKey(machine, oldCred, keyType, bits)
+	if err != nil {
+		result.Status = models.RotationResultFailed
+		var rotationErr *RotationError
+		if errors.As(err, &rotationErr) && rotationErr.RolledBack {
+			result.Status = models.RotationResultRolledBack
+		}
+		result.Message = err.Error()
+		return result
+	}
+
+	// Only now that the remote side is done is the stored credential replaced
+	encryptedCred, err := EncryptCredential(&CredentialData{PrivateKey: keyPair.PrivateKey}, encryptionKey)
+	if err == nil {
+		now := time.Now()
+		err = database.DB.Model(machine).Updates(map[string]interface{}{
+			"credential_encrypted":  encryptedCred,
+			"public_key":            keyPair.AuthorizedKey,
+			"credential_rotated_at": now,
+		}).Error
+	}
+	if err != nil {
+		result.Status = models.RotationResultFailed
+		result.Message = "Failed to save new key: " + err.Error()
+		if restoreErr := RestoreAuthorizedKey(machine, oldCred, keyPair); restoreErr != nil {
+			result.Message += "; failed to restore previous key: " + restoreErr.Error()
+		} else {
+			result.Status = models.RotationResultRolledBack
+		}
+		return result
+	}
+
+	result.Status = models.RotationResultSuccess
+	result.Fingerprint = keyPair.Fingerprint
+	return result
+}
@@ -0,0 +1,453 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/crewjam/saml"
+	xrv "github.com/mattermost/xml-roundtrip-validator"
+
+	"farseer/config"
+	"farseer/models"
+)
+
+const (
+	// samlLoginTimeout is how long the user has to sign in at the identity provider
+	samlLoginTimeout = 10 * time.Minute
+	samlHTTPTimeout  = 15 * time.Second
+	// samlMetadataMaxSize bounds identity provider metadata fetched from a URL
+	samlMetadataMaxSize = 1 << 20
+
+	samlNameIDTransient = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+)
+
+var (
+	// ErrSAMLNotConfigured is returned when SAML single sign-on is not set up
+	ErrSAMLNotConfigured = errors.New("SAML single sign-on is not configured")
+	// ErrSAMLInvalidState is returned when a response does not match a pending sign-in
+	ErrSAMLInvalidState = ErrOIDCInvalidState
+	// ErrSAMLFailed is returned when the identity provider's response does not verify
+	ErrSAMLFailed = ErrOIDCFailed
+	// ErrSAMLInvalidMetadata is returned when imported identity provider metadata is unusable
+	ErrSAMLInvalidMetadata = errors.New("invalid identity provider metadata")
+)
+
+// SAMLIdentity is what the identity provider asserted about a user
+type SAMLIdentity struct {
+	ExternalID string
+	Username   string
+	Groups     []string
+}
+
+// SAMLStatus describes the service provider and the identity provider it trusts
+type SAMLStatus struct {
+	Enabled     bool   `json:"enabled"`
+	EntityID    string `json:"entity_id,omitempty"`
+	MetadataURL string `json:"metadata_url,omitempty"`
+	ACSURL      string `json:"acs_url,omitempty"`
+	IDPEntityID string `json:"idp_entity_id,omitempty"`
+	IDPSSOURL   string `json:"idp_sso_url,omitempty"`
+}
+
+// pendingSAMLLogin is an authentication request sent to the identity provider
+type pendingSAMLLogin struct {
+	requestID string
+	expires   time.Time
+}
+
+var (
+	// pendingSAMLLogins holds outstanding sign-ins, keyed by their RelayState
+	pendingSAMLLogins sync.Map
+
+	// samlMu guards generating the service provider key
+	samlMu sync.Mutex
+)
+
+// SAMLEnabled reports whether SAML single sign-on is configured
+func SAMLEnabled() bool {
+	cfg := config.GetConfig()
+	return cfg.SAMLRootURL != "" && cfg.SAMLIDPMetadata != ""
+}
+
+// samlURLs returns the service provider's entity ID and endpoint URLs
+func samlURLs() (entityID string, metadataURL, acsURL *url.URL, err error) {
+	cfg := config.GetConfig()
+	root := strings.TrimSuffix(cfg.SAMLRootURL, "/")
+	if u, err := url.Parse(root); err != nil || u.Scheme == "" || u.Host == "" {
+		return "", nil, nil, fmt.Errorf("invalid SAML root URL %q", cfg.SAMLRootURL)
+	}
+	if metadataURL, err = url.Parse(root + "/api/auth/saml/metadata"); err != nil {
+		return "", nil, nil, err
+	}
+	if acsURL, err = url.Parse(root + "/api/auth/saml/acs"); err != nil {
+		return "", nil, nil, err
+	}
+	entityID = cfg.SAMLEntityID
+	if entityID == "" {
+		entityID = metadataURL.String()
+	}
+	return entityID, metadataURL, acsURL, nil
+}
+
+// samlServiceProvider builds the service provider from the config. Without
+// imported identity provider metadata it can still describe itself.
+func samlServiceProvider() (*saml.ServiceProvider, error) {
+	cfg := config.GetConfig()
+	if cfg.SAMLRootURL == "" {
+		return nil, ErrSAMLNotConfigured
+	}
+	entityID, metadataURL, acsURL, err := samlURLs()
+	if err != nil {
+		return nil, err
+	}
+	key, cert, err := samlKeyPair()
+	if err != nil {
+		return nil, err
+	}
+
+	sp := &saml.ServiceProvider{
+		EntityID:          entityID,
+		Key:               key,
+		Certificate:       cert,
+		MetadataURL:       *metadataURL,
+		AcsURL:            *acsURL,
+		AuthnNameIDFormat: saml.UnspecifiedNameIDFormat,
+		IDPMetadata:       &saml.EntityDescriptor{},
+	}
+	if cfg.SAMLIDPMetadata != "" {
+		sp.IDPMetadata, err = parseIDPMetadata([]byte(cfg.SAMLIDPMetadata))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return sp, nil
+}
+
+// samlKeyPair returns the service provider's signing and decryption key,
+// generating a key and self-signed certificate on first use
+func samlKeyPair() (*rsa.PrivateKey, *x509.Certificate, error) {
+	samlMu.Lock()
+	defer samlMu.Unlock()
+
+	cfg := config.GetConfig()
+	if cfg.SAMLSPKey == "" || cfg.SAMLSPCertificate == "" {
+		keyPEM, certPEM, err := generateSAMLKeyPair()
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg.SAMLSPKey, cfg.SAMLSPCertificate = keyPEM, certPEM
+		if err := cfg.Save(); err != nil {
+			cfg.SAMLSPKey, cfg.SAMLSPCertificate = "", ""
+			return nil, nil, fmt.Errorf("failed to save SAML key: %w", err)
+		}
+	}
+
+	pair, err := tls.X509KeyPair([]byte(cfg.SAMLSPCertificate), []byte(cfg.SAMLSPKey))
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid SAML key pair: %w", err)
+	}
+	key, ok := pair.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("the SAML key must be an RSA key")
+	}
+	cert, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	return key, cert, nil
+}
+
+func generateSAMLKeyPair() (keyPEM, certPEM string, err error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return "", "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", "", err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "Farseer SAML service provider"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(10, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return "", "", err
+	}
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	return keyPEM, certPEM, nil
+}
+
+// parseIDPMetadata reads identity provider metadata, which may be wrapped in
+// an EntitiesDescriptor, and checks it can be signed in with
+func parseIDPMetadata(data []byte) (*saml.EntityDescriptor, error) {
+	if err := xrv.Validate(bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSAMLInvalidMetadata, err)
+	}
+
+	var entity *saml.EntityDescriptor
+	var entities saml.EntitiesDescriptor
+	if err := xml.Unmarshal(data, &entities); err == nil {
+		for i := range entities.EntityDescriptors {
+			if len(entities.EntityDescriptors[i].IDPSSODescriptors) > 0 {
+				entity = &entities.EntityDescriptors[i]
+				break
+			}
+		}
+	} else {
+		entity = &saml.EntityDescriptor{}
+		if err := xml.Unmarshal(data, entity); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrSAMLInvalidMetadata, err)
+		}
+	}
+	if entity == nil || entity.EntityID == "" || len(entity.IDPSSODescriptors) == 0 {
+		return nil, fmt.Errorf("%w: no identity provider found", ErrSAMLInvalidMetadata)
+	}
+
+	sp := &saml.ServiceProvider{IDPMetadata: entity}
+	if sp.GetSSOBindingLocation(saml.HTTPRedirectBinding) == "" {
+		return nil, fmt.Errorf("%w: no single sign-on service with the HTTP-Redirect binding", ErrSAMLInvalidMetadata)
+	}
+	hasSigningKey := false
+	for _, descriptor := range entity.IDPSSODescriptors {
+		for _, keyDescriptor := range descriptor.KeyDescriptors {
+			if (keyDescriptor.Use == "" || keyDescriptor.Use == "signing") && len(keyDescriptor.KeyInfo.X509Data.X509Certificates) > 0 {
+				hasSigningKey = true
+			}
+		}
+	}
+	if !hasSigningKey {
+		return nil, fmt.Errorf("%w: no signing certificate", ErrSAMLInvalidMetadata)
+	}
+	return entity, nil
+}
+
+// FetchSAMLMetadata downloads identity provider metadata to import
+func FetchSAMLMetadata(metadataURL string) ([]byte, error) {
+	u, err := url.Parse(metadataURL)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return nil, fmt.Errorf("%w: the URL must be http or https", ErrSAMLInvalidMetadata)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), samlHTTPTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch identity provider metadata: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch identity provider metadata: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, samlMetadataMaxSize))
+}
+
+// ImportSAMLMetadata validates identity provider metadata and saves it as
+// the identity provider to trust, returning its entity ID
+func ImportSAMLMetadata(data []byte) (string, error) {
+	entity, err := parseIDPMetadata(data)
+	if err != nil {
+		return "", err
+	}
+	cfg := config.GetConfig()
+	previous := cfg.SAMLIDPMetadata
+	cfg.SAMLIDPMetadata = string(data)
+	if err := cfg.Save(); err != nil {
+		cfg.SAMLIDPMetadata = previous
+		return "", fmt.Errorf("failed to save config: %w", err)
+	}
+	return entity.EntityID, nil
+}
+
+// GetSAMLStatus reports the service provider's endpoints and the identity
+// provider it trusts
+func GetSAMLStatus() (*SAMLStatus, error) {
+	if config.GetConfig().SAMLRootURL == "" {
+		return &SAMLStatus{}, nil
+	}
+	sp, err := samlServiceProvider()
+	if err != nil {
+		return nil, err
+	}
+	return &SAMLStatus{
+		Enabled:     SAMLEnabled(),
+		EntityID:    sp.EntityID,
+		MetadataURL: sp.MetadataURL.String(),
+		ACSURL:      sp.AcsURL.String(),
+		IDPEntityID: sp.IDPMetadata.EntityID,
+		IDPSSOURL:   sp.GetSSOBindingLocation(saml.HTTPRedirectBinding),
+	}, nil
+}
+
+// SAMLMetadata returns the service provider metadata to register with the
+// identity provider
+func SAMLMetadata() ([]byte, error) {
+	sp, err := samlServiceProvider()
+	if err != nil {
+		return nil, err
+	}
+	return xml.MarshalIndent(sp.Metadata(), "", "  ")
+}
+
+// BeginSAMLLogin returns the identity provider URL to send the browser to,
+// carrying a new authentication request
+func BeginSAMLLogin() (string, error) {
+	if !SAMLEnabled() {
+		return "", ErrSAMLNotConfigured
+	}
+	sp, err := samlServiceProvider()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := sp.MakeAuthenticationRequest(sp.GetSSOBindingLocation(saml.HTTPRedirectBinding), saml.HTTPRedirectBinding, saml.HTTPPostBinding)
+	if err != nil {
+		return "", err
+	}
+	relayState, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	redirect, err := req.Redirect(relayState, sp)
+	if err != nil {
+		return "", err
+	}
+
+	pruneExpired(&pendingSAMLLogins, func(v interface{}) time.Time { return v.(*pendingSAMLLogin).expires })
+	pendingSAMLLogins.Store(relayState, &pendingSAMLLogin{
+		requestID: req.ID,
+		expires:   time.Now().Add(samlLoginTimeout),
+	})
+	return redirect.String(), nil
+}
+
+// FinishSAMLLogin verifies the response posted to the assertion consumer
+// service. It must be signed by the imported identity provider, answer the
+// pending request the RelayState names, and be addressed to this service
+// provider; the request is used up so a response cannot be replayed.
+func FinishSAMLLogin(relayState, samlResponse string) (*SAMLIdentity, error) {
+	value, ok := pendingSAMLLogins.LoadAndDelete(relayState)
+	if !ok || relayState == "" {
+		return nil, ErrSAMLInvalidState
+	}
+	pending := value.(*pendingSAMLLogin)
+	if time.Now().After(pending.expires) {
+		return nil, ErrSAMLInvalidState
+	}
+	if !SAMLEnabled() {
+		return nil, ErrSAMLNotConfigured
+	}
+	sp, err := samlServiceProvider()
+	if err != nil {
+		return nil, err
+	}
+
+	responseXML, err := base64.StdEncoding.DecodeString(samlResponse)
+	if err != nil {
+		return nil, fmt.Errorf("%w: response is not base64", ErrSAMLFailed)
+	}
+	assertion, err := sp.ParseXMLResponse(responseXML, []string{pending.requestID})
+	if err != nil {
+		var invalid *saml.InvalidResponseError
+		if errors.As(err, &invalid) {
+			err = invalid.PrivateErr
+		}
+		return nil, fmt.Errorf("%w: %v", ErrSAMLFailed, err)
+	}
+	// The library only checks the audience when one is given; an assertion
+	// for nobody in particular could have been issued to another service
+	if assertion.Conditions == nil || len(assertion.Conditions.AudienceRestrictions) == 0 {
+		return nil, fmt.Errorf("%w: assertion has no audience restriction", ErrSAMLFailed)
+	}
+	if assertion.Subject == nil || assertion.Subject.NameID == nil || assertion.Subject.NameID.Value == "" {
+		return nil, fmt.Errorf("%w: assertion has no subject", ErrSAMLFailed)
+	}
+
+	cfg := config.GetConfig()
+	nameID := assertion.Subject.NameID
+	identity := &SAMLIdentity{
+		Username: samlAttribute(assertion, cfg.SAMLUsernameAttribute),
+		Groups:   samlAttributeValues(assertion, cfg.SAMLGroupsAttribute),
+	}
+	// A transient name ID changes on every sign-in, so it cannot recognise a
+	// returning user; the username stands in for it then
+	if nameID.Format != samlNameIDTransient {
+		identity.ExternalID = nameID.Value
+		if identity.Username == "" {
+			identity.Username = nameID.Value
+		}
+	} else {
+		identity.ExternalID = identity.Username
+	}
+	if identity.ExternalID == "" {
+		return nil, fmt.Errorf("%w: no %s attribute for the transient name ID", ErrSAMLFailed, cfg.SAMLUsernameAttribute)
+	}
+	return identity, nil
+}
+
+// samlAttributeValues returns the values of the attribute with the given
+// name or friendly name
+func samlAttributeValues(assertion *saml.Assertion, name string) []string {
+	var values []string
+	for _, statement := range assertion.AttributeStatements {
+		for _, attr := range statement.Attributes {
+			if attr.Name != name && attr.FriendlyName != name {
+				continue
+			}
+			for _, v := range attr.Values {
+				if v.Value != "" {
+					values = append(values, v.Value)
+				}
+			}
+		}
+	}
+	return values
+}
+
+func samlAttribute(assertion *saml.Assertion, name string) string {
+	if values := samlAttributeValues(assertion, name); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// SAMLRole maps the identity provider's groups to a role. Without any group
+// mapping configured it returns an empty role, leaving the role to admins.
+func SAMLRole(groups []string) (models.Role, error) {
+	cfg := config.GetConfig()
+	return groupRole(groups, cfg.SAMLAdminGroups, cfg.SAMLUserGroups)
+}
+
+// ProvisionSAMLUser finds the user the identity belongs to, creating them on
+// their first sign-in, and applies the role from their groups
+func ProvisionSAMLUser(identity *SAMLIdentity) (*AuthResult, error) {
+	role, err := SAMLRole(identity.Groups)
+	if err != nil {
+		return nil, err
+	}
+	return provisionExternalUser(models.AuthProviderSAML, identity.ExternalID, identity.Username, role)
+}
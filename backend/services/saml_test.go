@@ -0,0 +1,329 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/beevik/etree"
+	"github.com/crewjam/saml"
+
+	"farseer/config"
+	"farseer/models"
+)
+
+const samlNameIDPersistent = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+
+// samlStandIn is an identity provider with a self-signed key, serving its
+// metadata over HTTP. Responses are made directly from the authentication
+// request URLs Farseer redirects to.
+type samlStandIn struct {
+	idp *saml.IdentityProvider
+	// audience replaces the audience asserted; "none" leaves it out
+	audience string
+}
+
+// newSAMLStandIn starts an identity provider and imports its metadata
+func newSAMLStandIn(t *testing.T) *samlStandIn {
+	t.Helper()
+	p := &samlStandIn{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.idp.Handler().ServeHTTP(w, r)
+	}))
+	key, cert := newSAMLStandInKeyPair(t)
+	metadataURL, _ := url.Parse(server.URL + "/metadata")
+	ssoURL, _ := url.Parse(server.URL + "/sso")
+	p.idp = &saml.IdentityProvider{
+		Key:                     key,
+		Certificate:             cert,
+		MetadataURL:             *metadataURL,
+		SSOURL:                  *ssoURL,
+		ServiceProviderProvider: p,
+	}
+
+	cfg := config.GetConfig()
+	saved := *cfg
+	cfg.SAMLRootURL = "https://farseer.test"
+	cfg.SAMLAdminGroups = []string{"farseer-admins"}
+	cfg.SAMLUserGroups = []string{"farseer-users"}
+	t.Cleanup(func() {
+		server.Close()
+		*cfg = saved
+	})
+
+	metadata, err := FetchSAMLMetadata(metadataURL.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	entityID, err := ImportSAMLMetadata(metadata)
+	if err != nil || entityID != metadataURL.String() {
+		t.Fatalf("import metadata: %q, %v", entityID, err)
+	}
+	return p
+}
+
+func newSAMLStandInKeyPair(t *testing.T) (*rsa.PrivateKey, *x509.Certificate) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "farseer-test-idp"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, cert
+}
+
+// GetServiceProvider returns Farseer's own metadata, as registered with a
+// real identity provider
+func (p *samlStandIn) GetServiceProvider(r *http.Request, serviceProviderID string) (*saml.EntityDescriptor, error) {
+	data, err := SAMLMetadata()
+	if err != nil {
+		return nil, err
+	}
+	var metadata saml.EntityDescriptor
+	if err := xml.Unmarshal(data, &metadata); err != nil {
+		return nil, err
+	}
+	if metadata.EntityID != serviceProviderID {
+		return nil, errors.New("unknown service provider " + serviceProviderID)
+	}
+	return &metadata, nil
+}
+
+// respond answers the authentication request in authURL, signing in as
+// username with the given name ID format. It returns the RelayState and
+// SAMLResponse the browser would post back.
+func (p *samlStandIn) respond(t *testing.T, authURL, username, nameIDFormat string, groups ...string) (relayState, samlResponse string) {
+	t.Helper()
+	req := p.assert(t, authURL, username, nameIDFormat, groups...)
+	form, err := req.PostBinding()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return form.RelayState, form.SAMLResponse
+}
+
+// respondUnsigned answers like respond, but with neither the response nor the
+// assertion signed
+func (p *samlStandIn) respondUnsigned(t *testing.T, authURL, username string) (relayState, samlResponse string) {
+	t.Helper()
+	req := p.assert(t, authURL, username, samlNameIDPersistent)
+	response := &saml.Response{
+		Destination:  req.ACSEndpoint.Location,
+		ID:           "id-unsigned",
+		InResponseTo: req.Request.ID,
+		IssueInstant: req.Now,
+		Version:      "2.0",
+		Issuer:       &saml.Issuer{Value: p.idp.MetadataURL.String()},
+		Status:       saml.Status{StatusCode: saml.StatusCode{Value: saml.StatusSuccess}},
+	}
+	responseEl := response.Element()
+	responseEl.AddChild(req.Assertion.Element())
+	doc := etree.NewDocument()
+	doc.SetRoot(responseEl)
+	data, err := doc.WriteToBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req.RelayState, base64.StdEncoding.EncodeToString(data)
+}
+
+func (p *samlStandIn) assert(t *testing.T, authURL, username, nameIDFormat string, groups ...string) *saml.IdpAuthnRequest {
+	t.Helper()
+	if !strings.HasPrefix(authURL, p.idp.SSOURL.String()+"?") {
+		t.Fatalf("auth URL %q does not point at the identity provider", authURL)
+	}
+	req, err := saml.NewIdpAuthnRequest(p.idp, httptest.NewRequest(http.MethodGet, authURL, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := req.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	var groupValues []saml.AttributeValue
+	for _, g := range groups {
+		groupValues = append(groupValues, saml.AttributeValue{Type: "xs:string", Value: g})
+	}
+	session := &saml.Session{
+		ID:           "session-" + username,
+		CreateTime:   time.Now(),
+		ExpireTime:   time.Now().Add(time.Hour),
+		Index:        "1",
+		NameID:       "id-" + username,
+		NameIDFormat: nameIDFormat,
+		UserName:     username,
+		CustomAttributes: []saml.Attribute{{
+			FriendlyName: "groups",
+			Name:         "groups",
+			NameFormat:   "urn:oasis:names:tc:SAML:2.0:attrname-format:basic",
+			Values:       groupValues,
+		}},
+	}
+	if err := (saml.DefaultAssertionMaker{}).MakeAssertion(req, session); err != nil {
+		t.Fatal(err)
+	}
+	switch p.audience {
+	case "":
+	case "none":
+		req.Assertion.Conditions.AudienceRestrictions = nil
+	default:
+		req.Assertion.Conditions.AudienceRestrictions = []saml.AudienceRestriction{{Audience: saml.Audience{Value: p.audience}}}
+	}
+	return req
+}
+
+func beginSAMLLogin(t *testing.T) string {
+	t.Helper()
+	authURL, err := BeginSAMLLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return authURL
+}
+
+func TestSAMLLogin(t *testing.T) {
+	p := newSAMLStandIn(t)
+
+	relayState, response := p.respond(t, beginSAMLLogin(t), "saml-alice", samlNameIDPersistent, "farseer-users", "ops")
+	identity, err := FinishSAMLLogin(relayState, response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if identity.ExternalID != "id-saml-alice" || identity.Username != "saml-alice" ||
+		strings.Join(identity.Groups, ",") != "farseer-users,ops" {
+		t.Errorf("identity = %+v", identity)
+	}
+
+	// A transient name ID changes on every sign-in, so the username identifies the user
+	relayState, response = p.respond(t, beginSAMLLogin(t), "saml-alice", samlNameIDTransient)
+	identity, err = FinishSAMLLogin(relayState, response)
+	if err != nil || identity.ExternalID != "saml-alice" {
+		t.Errorf("transient name ID: %+v, %v", identity, err)
+	}
+}
+
+func TestSAMLLoginRejects(t *testing.T) {
+	p := newSAMLStandIn(t)
+
+	t.Run("unsigned response", func(t *testing.T) {
+		relayState, response := p.respondUnsigned(t, beginSAMLLogin(t), "saml-bob")
+		if _, err := FinishSAMLLogin(relayState, response); !errors.Is(err, ErrSAMLFailed) {
+			t.Errorf("unsigned: %v, want ErrSAMLFailed", err)
+		}
+	})
+
+	t.Run("signed by another key", func(t *testing.T) {
+		key, cert := p.idp.Key, p.idp.Certificate
+		p.idp.Key, p.idp.Certificate = newSAMLStandInKeyPair(t)
+		defer func() { p.idp.Key, p.idp.Certificate = key, cert }()
+		relayState, response := p.respond(t, beginSAMLLogin(t), "saml-bob", samlNameIDPersistent)
+		if _, err := FinishSAMLLogin(relayState, response); !errors.Is(err, ErrSAMLFailed) {
+			t.Errorf("unknown key: %v, want ErrSAMLFailed", err)
+		}
+	})
+
+	t.Run("wrong audience", func(t *testing.T) {
+		p.audience = "https://other-service.test/metadata"
+		defer func() { p.audience = "" }()
+		relayState, response := p.respond(t, beginSAMLLogin(t), "saml-bob", samlNameIDPersistent)
+		if _, err := FinishSAMLLogin(relayState, response); !errors.Is(err, ErrSAMLFailed) {
+			t.Errorf("wrong audience: %v, want ErrSAMLFailed", err)
+		}
+	})
+
+	t.Run("missing audience restriction", func(t *testing.T) {
+		p.audience = "none"
+		defer func() { p.audience = "" }()
+		relayState, response := p.respond(t, beginSAMLLogin(t), "saml-bob", samlNameIDPersistent)
+		if _, err := FinishSAMLLogin(relayState, response); !errors.Is(err, ErrSAMLFailed) || !strings.Contains(err.Error(), "audience") {
+			t.Errorf("no audience: %v, want ErrSAMLFailed for the audience", err)
+		}
+	})
+
+	t.Run("replayed RelayState", func(t *testing.T) {
+		relayState, response := p.respond(t, beginSAMLLogin(t), "saml-bob", samlNameIDPersistent)
+		if _, err := FinishSAMLLogin(relayState, response); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := FinishSAMLLogin(relayState, response); !errors.Is(err, ErrSAMLInvalidState) {
+			t.Errorf("replayed: %v, want ErrSAMLInvalidState", err)
+		}
+	})
+
+	t.Run("response to another request", func(t *testing.T) {
+		_, response := p.respond(t, beginSAMLLogin(t), "saml-bob", samlNameIDPersistent)
+		otherRelayState, _ := url.Parse(beginSAMLLogin(t))
+		if _, err := FinishSAMLLogin(otherRelayState.Query().Get("RelayState"), response); !errors.Is(err, ErrSAMLFailed) {
+			t.Errorf("mismatched request: %v, want ErrSAMLFailed", err)
+		}
+	})
+
+	t.Run("expired pending login", func(t *testing.T) {
+		relayState, response := p.respond(t, beginSAMLLogin(t), "saml-bob", samlNameIDPersistent)
+		value, _ := pendingSAMLLogins.Load(relayState)
+		value.(*pendingSAMLLogin).expires = time.Now().Add(-time.Second)
+		if _, err := FinishSAMLLogin(relayState, response); !errors.Is(err, ErrSAMLInvalidState) {
+			t.Errorf("expired: %v, want ErrSAMLInvalidState", err)
+		}
+	})
+
+	t.Run("unknown RelayState", func(t *testing.T) {
+		_, response := p.respond(t, beginSAMLLogin(t), "saml-bob", samlNameIDPersistent)
+		for _, relayState := range []string{"", "bogus"} {
+			if _, err := FinishSAMLLogin(relayState, response); !errors.Is(err, ErrSAMLInvalidState) {
+				t.Errorf("RelayState %q: %v, want ErrSAMLInvalidState", relayState, err)
+			}
+		}
+	})
+}
+
+func TestProvisionSAMLUserRoles(t *testing.T) {
+	p := newSAMLStandIn(t)
+	signIn := func(groups ...string) (*AuthResult, error) {
+		t.Helper()
+		relayState, response := p.respond(t, beginSAMLLogin(t), "saml-carol", samlNameIDPersistent, groups...)
+		identity, err := FinishSAMLLogin(relayState, response)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ProvisionSAMLUser(identity)
+	}
+
+	if _, err := signIn("contractors"); !errors.Is(err, ErrNotAllowed) {
+		t.Fatalf("user outside the allowed groups: %v, want ErrNotAllowed", err)
+	}
+	result, err := signIn("farseer-users")
+	if err != nil || !result.Created || result.User.Role != models.RoleUser ||
+		result.User.AuthProvider != models.AuthProviderSAML {
+		t.Fatalf("first sign-in: %+v, %v", result, err)
+	}
+	result, err = signIn("farseer-admins")
+	if err != nil || result.Created || !result.RoleChanged || result.User.Role != models.RoleAdmin {
+		t.Errorf("promoted sign-in: %+v, %v", result, err)
+	}
+}
@@ -0,0 +1,207 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"farseer/config"
+	"farseer/database"
+	"farseer/models"
+)
+
+const secretStoreTimeout = 10 * time.Second
+
+var (
+	// ErrSecretStoreNotConfigured is returned when a machine references a secret path but no store is set up
+	ErrSecretStoreNotConfigured = errors.New("external secret store is not configured")
+	// ErrSecretNotFound is returned when the secret path does not exist in the store
+	ErrSecretNotFound = errors.New("secret not found in external store")
+	// ErrSecretPathNotAllowed is returned when a machine's owner may not read its secret path
+	ErrSecretPathNotAllowed = errors.New("secret path is outside the owner's allowed prefix")
+	// ErrInvalidUsername is returned for a username that could reach into
+	// another user's secret store paths
+	ErrInvalidUsername = errors.New("usernames may not contain '/' or be '.' or '..'")
+)
+
+// KVCredentialProvider reads machine credentials from an HTTP key/value
+// secret store speaking the Vault KV version 2 API. The secret at a machine's
+// path holds "password" or "private_key" (plus an optional "passphrase").
+type KVCredentialProvider struct {
+	Address   string
+	Token     string
+	Mount     string
+	Namespace string
+	Client    *http.Client
+}
+
+// SecretStoreConfigured reports whether an external secret store address is set
+func SecretStoreConfigured() bool {
+	return config.GetConfig().SecretStoreAddress != ""
+}
+
+// NewKVCredentialProvider creates a provider from the server configuration
+func NewKVCredentialProvider() (*KVCredentialProvider, error) {
+	cfg := config.GetConfig()
+	if cfg.SecretStoreAddress == "" {
+		return nil, ErrSecretStoreNotConfigured
+	}
+
+	token := cfg.SecretStoreToken
+	if envToken := os.Getenv("FARSEER_SECRET_STORE_TOKEN"); envToken != "" {
+		token = envToken
+	}
+	mount := cfg.SecretStoreMount
+	if mount == "" {
+		mount = "secret"
+	}
+
+	return &KVCredentialProvider{
+		Address:   strings.TrimRight(cfg.SecretStoreAddress, "/"),
+		Token:     token,
+		Mount:     strings.Trim(mount, "/"),
+		Namespace: cfg.SecretStoreNamespace,
+		Client:    &http.Client{Timeout: secretStoreTimeout},
+	}, nil
+}
+
+// ValidateSecretPath checks that a secret path is relative and free of traversal segments
+func ValidateSecretPath(path string) error {
+	if path == "" || strings.HasPrefix(path, "/") || strings.HasSuffix(path, "/") {
+		return errors.New("secret path must be a relative path such as 'ssh/web-01'")
+	}
+	for _, segment := range strings.Split(path, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return errors.New("secret path contains an invalid segment")
+		}
+	}
+	return nil
+}
+
+// SecretPathPrefix is the prefix the user's secret paths must start with, or
+// "" for admins, who may read any path
+func SecretPathPrefix(user *models.User) string {
+	if user.Role == models.RoleAdmin {
+		return ""
+	}
+	prefix := strings.ReplaceAll(config.GetConfig().SecretStoreUserPrefix, "{username}", user.Username)
+	return strings.Trim(prefix, "/") + "/"
+}
+
+// CheckSecretPath checks that path is valid and that the user may read it.
+// Every read uses the server's token, so without the prefix a user could
+// fetch any secret the server can.
+func CheckSecretPath(user *models.User, path string) error {
+	if err := ValidateSecretPath(path); err != nil {
+		return err
+	}
+	// A username with a slash would make the prefix cover another user's
+	// paths: alice/prod would read under users/alice/
+	if user.Role != models.RoleAdmin && !ValidUsername(user.Username) {
+		return ErrInvalidUsername
+	}
+	if prefix := SecretPathPrefix(user); !strings.HasPrefix(path, prefix) {
+		return fmt.Errorf("secret path must start with '%s'", prefix)
+	}
+	return nil
+}
+
+// ValidUsername reports whether username is a single path segment, as the
+// secret store prefix users/{username} needs. Empty names are left to the
+// callers, which report them on their own.
+func ValidUsername(username string) bool {
+	return username != "." && username != ".." && !strings.Contains(username, "/")
+}
+
+// GetCredential reads the machine's secret, provided its owner may still
+// read that path
+func (p *KVCredentialProvider) GetCredential(machine *models.Machine, _ string) (*CredentialData, error) {
+	var owner models.User
+	if err := database.DB.Select("id", "username", "role").First(&owner, machine.UserID).Error; err != nil {
+		return nil, err
+	}
+	if err := CheckSecretPath(&owner, machine.SecretPath); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSecretPathNotAllowed, err)
+	}
+	return p.Read(machine.SecretPath)
+}
+
+// Read fetches the latest version of the secret at path
+func (p *KVCredentialProvider) Read(path string) (*CredentialData, error) {
+	if err := ValidateSecretPath(path); err != nil {
+		return nil, err
+	}
+
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	endpoint := p.Address + "/v1/" + p.Mount + "/data/" + strings.Join(segments, "/")
+
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if p.Token != "" {
+		req.Header.Set("X-Vault-Token", p.Token)
+	}
+	if p.Namespace != "" {
+		req.Header.Set("X-Vault-Namespace", p.Namespace)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: secretStoreTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("secret store request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read secret store response: %w", err)
+	}
+
+	var payload struct {
+		Data struct {
+			Data map[string]interface{} `json:"data"`
+		} `json:"data"`
+		Errors []string `json:"errors"`
+	}
+	json.Unmarshal(body, &payload)
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, ErrSecretNotFound
+	case resp.StatusCode != http.StatusOK:
+		if len(payload.Errors) > 0 {
+			return nil, fmt.Errorf("secret store returned %d: %s", resp.StatusCode, strings.Join(payload.Errors, "; "))
+		}
+		return nil, fmt.Errorf("secret store returned %d", resp.StatusCode)
+	case payload.Data.Data == nil:
+		// Deleted or destroyed versions come back with null data
+		return nil, ErrSecretNotFound
+	}
+
+	field := func(name string) string {
+		value, _ := payload.Data.Data[name].(string)
+		return value
+	}
+	cred := &CredentialData{
+		Password:   field("password"),
+		PrivateKey: field("private_key"),
+		Passphrase: field("passphrase"),
+	}
+	if cred.Password == "" && cred.PrivateKey == "" {
+		return nil, fmt.Errorf("secret %q has no password or private_key field", path)
+	}
+	return cred, nil
+}
@@ -0,0 +1,272 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+
+	"farseer/config"
+)
+
+// serverKeyring holds the unwrapped server secrets, by version, in memory
+type serverKeyring struct {
+	mu       sync.RWMutex
+	provider KeyProvider // nil when the secrets are kept in the config file as is
+	current  int
+	secrets  map[int]string
+}
+
+var serverKeys = &serverKeyring{}
+
+// NewKeyProvider returns the key provider selected in the config, or nil for
+// secrets kept in the config file
+func NewKeyProvider(cfg *config.Config) (KeyProvider, error) {
+	token := cfg.KeyProviderToken
+	if envToken := os.Getenv("FARSEER_KEY_PROVIDER_TOKEN"); envToken != "" {
+		token = envToken
+	}
+
+	switch cfg.KeyProvider {
+	case "", "config":
+		return nil, nil
+	case "file":
+		return NewFileKeyProvider(cfg.KeyProviderFile)
+	case "env":
+		return NewEnvKeyProvider()
+	case "kms", "transit":
+		if cfg.KeyProviderAddress == "" || cfg.KeyProviderKeyName == "" {
+			return nil, fmt.Errorf("key provider %q needs an address and a key name", cfg.KeyProvider)
+		}
+		if cfg.KeyProvider == "kms" {
+			return NewKMSKeyProvider(cfg.KeyProviderAddress, cfg.KeyProviderKeyName, token)
+		}
+		return &TransitKeyProvider{Address: cfg.KeyProviderAddress, KeyName: cfg.KeyProviderKeyName, Token: token}, nil
+	default:
+		return nil, fmt.Errorf("unknown key provider %q", cfg.KeyProvider)
+	}
+}
+
+// InitServerKeys loads the server secrets through the configured key
+// provider, generating the first one on a new install. Secrets still kept in
+// the config file are moved under the provider when one is configured.
+func InitServerKeys() error {
+	cfg := config.GetConfig()
+	provider, err := NewKeyProvider(cfg)
+	if err != nil {
+		return err
+	}
+
+	if provider == nil {
+		if len(cfg.WrappedServerSecrets) > 0 {
+			return errors.New("server secrets are wrapped by a key provider, configure it to start")
+		}
+		if cfg.ServerSecret == "" {
+			secret, err := generateDataKey()
+			if err != nil {
+				return err
+			}
+			if err := cfg.UpdateServerSecrets(func(c *config.Config) { c.ServerSecret = secret }); err != nil {
+				return err
+			}
+		}
+
+		secrets := map[int]string{cfg.ServerSecretVersion: cfg.ServerSecret}
+		for version, secret := range cfg.RetiredServerSecrets {
+			secrets[version] = secret
+		}
+		serverKeys.load(nil, cfg.ServerSecretVersion, secrets)
+		return nil
+	}
+
+	if cfg.ServerSecret == "" && len(cfg.WrappedServerSecrets) == 0 {
+		secret, err := generateDataKey()
+		if err != nil {
+			return err
+		}
+		wrapped, err := provider.Wrap(secret)
+		if err != nil {
+			return fmt.Errorf("failed to wrap server secret: %w", err)
+		}
+		err = cfg.UpdateServerSecrets(func(c *config.Config) {
+			c.WrappedServerSecrets = map[int]string{c.ServerSecretVersion: wrapped}
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if cfg.ServerSecret != "" {
+		if err := wrapConfigSecrets(cfg, provider); err != nil {
+			return err
+		}
+	}
+
+	secrets := make(map[int]string, len(cfg.WrappedServerSecrets))
+	for version, wrapped := range cfg.WrappedServerSecrets {
+		secret, err := provider.Unwrap(wrapped)
+		if err != nil {
+			return fmt.Errorf("failed to unwrap server secret version %d: %w", version, err)
+		}
+		secrets[version] = secret
+	}
+	if _, ok := secrets[cfg.ServerSecretVersion]; !ok {
+		return fmt.Errorf("current server secret version %d is missing", cfg.ServerSecretVersion)
+	}
+	serverKeys.load(provider, cfg.ServerSecretVersion, secrets)
+	log.Printf("Server secrets unwrapped with the %s key provider", provider.Name())
+	return nil
+}
+
+// wrapConfigSecrets moves server secrets kept in the config file as is under a key provider
+func wrapConfigSecrets(cfg *config.Config, provider KeyProvider) error {
+	plain := map[int]string{cfg.ServerSecretVersion: cfg.ServerSecret}
+	for version, secret := range cfg.RetiredServerSecrets {
+		plain[version] = secret
+	}
+
+	wrapped := make(map[int]string, len(plain))
+	for version, secret := range plain {
+		w, err := provider.Wrap(secret)
+		if err != nil {
+			return fmt.Errorf("failed to wrap server secret: %w", err)
+		}
+		wrapped[version] = w
+	}
+
+	err := cfg.UpdateServerSecrets(func(c *config.Config) {
+		if c.WrappedServerSecrets == nil {
+			c.WrappedServerSecrets = make(map[int]string)
+		}
+		for version, w := range wrapped {
+			c.WrappedServerSecrets[version] = w
+		}
+		c.ServerSecret = ""
+		c.RetiredServerSecrets = nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Moved %d server secrets from the config file under the %s key provider", len(wrapped), provider.Name())
+	return nil
+}
+
+func (k *serverKeyring) load(provider KeyProvider, current int, secrets map[int]string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.provider, k.current, k.secrets = provider, current, secrets
+}
+
+// Current returns the version and value of the secret new data is sealed with
+func (k *serverKeyring) Current() (int, string) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.current, k.secrets[k.current]
+}
+
+// Secret returns the value of a version. Version 0 is data sealed before
+// versioning, which used the first secret.
+func (k *serverKeyring) Secret(version int) (string, bool) {
+	if version == 0 {
+		version = 1
+	}
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	secret, ok := k.secrets[version]
+	return secret, ok
+}
+
+// ProviderName names the key provider protecting the secrets at rest
+func (k *serverKeyring) ProviderName() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	if k.provider == nil {
+		return "config"
+	}
+	return k.provider.Name()
+}
+
+// Provider returns the key provider, or nil when the secrets are kept in the
+// config file as is
+func (k *serverKeyring) Provider() KeyProvider {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.provider
+}
+
+// RetiredVersions lists the versions kept for decryption only
+func (k *serverKeyring) RetiredVersions() []int {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	versions := make([]int, 0, len(k.secrets))
+	for version := range k.secrets {
+		if version != k.current {
+			versions = append(versions, version)
+		}
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+// Rotate makes a newly generated secret current, keeping the previous ones
+// for decryption, and saves it to the config. It returns the new version.
+func (k *serverKeyring) Rotate() (int, error) {
+	secret, err := generateDataKey()
+	if err != nil {
+		return 0, err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	stored := secret
+	if k.provider != nil {
+		if stored, err = k.provider.Wrap(secret); err != nil {
+			return 0, fmt.Errorf("failed to wrap server secret: %w", err)
+		}
+	}
+
+	version := k.current + 1
+	err = config.GetConfig().UpdateServerSecrets(func(c *config.Config) {
+		if k.provider == nil {
+			if c.RetiredServerSecrets == nil {
+				c.RetiredServerSecrets = make(map[int]string)
+			}
+			c.RetiredServerSecrets[c.ServerSecretVersion] = c.ServerSecret
+			c.ServerSecret = stored
+		} else {
+			if c.WrappedServerSecrets == nil {
+				c.WrappedServerSecrets = make(map[int]string)
+			}
+			c.WrappedServerSecrets[version] = stored
+		}
+		c.ServerSecretVersion = version
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	k.secrets[version] = secret
+	k.current = version
+	return version, nil
+}
+
+// Drop forgets a retired secret, in memory and in the config
+func (k *serverKeyring) Drop(version int) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if version == k.current {
+		return errors.New("cannot drop the current server secret")
+	}
+
+	err := config.GetConfig().UpdateServerSecrets(func(c *config.Config) {
+		delete(c.RetiredServerSecrets, version)
+		delete(c.WrappedServerSecrets, version)
+	})
+	if err != nil {
+		return err
+	}
+	delete(k.secrets, version)
+	return nil
+}
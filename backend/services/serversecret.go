@@ -0,0 +1,267 @@
+package services
+
+import (
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gorm.io/gorm"
+
+	"farseer/database"
+	"farseer/models"
+)
+
+// Everything sealed at rest records the version of the server secret it was
+// sealed with. Rotating the secret re-encrypts TOTP secrets at once; stored
+// credentials need their owner's key, so they move to the new version the
+// next time that user sends it. Retired secrets are dropped once unused.
+
+// retiredSecretGracePeriod is how long a retired server secret is kept after
+// its last use, so requests that read data before it was re-sealed still work
+const retiredSecretGracePeriod = time.Minute
+
+// keyVersionChecked remembers, per user ID, the server secret version their
+// stored credentials were last found to be fully sealed with
+var keyVersionChecked sync.Map
+
+// ServerSecretRotation is the outcome of a server secret rotation
+type ServerSecretRotation struct {
+	Version         int `json:"version"`
+	TOTPReencrypted int `json:"totp_reencrypted"`
+	TOTPFailed      int `json:"totp_failed"`
+}
+
+// ServerSecretStatus reports how far data has moved to the current server secret
+type ServerSecretStatus struct {
+	CurrentVersion  int           `json:"current_version"`
+	RetiredVersions []int         `json:"retired_versions"`
+	KeyProvider     string        `json:"key_provider"`
+	SealedByVersion map[int]int64 `json:"sealed_by_version"` // Encrypted values per server secret version
+	UsersTotal      int64         `json:"users_total"`
+	UsersPending    []string      `json:"users_pending"` // Users with credentials awaiting their key
+}
+
+// RotateServerSecret switches to a new server secret and re-encrypts every
+// TOTP secret and SSO client key with it (both counted as TOTP in the result).
+// Credentials are re-encrypted lazily by UnlockDataKey.
+func RotateServerSecret() (*ServerSecretRotation, error) {
+	version, err := serverKeys.Rotate()
+	if err != nil {
+		return nil, err
+	}
+	result := &ServerSecretRotation{Version: version}
+
+	var users []models.User
+	if err := database.DB.Select("id", "totp_secret", "totp_pending_secret", "client_key_sealed").Where("totp_secret <> '' OR totp_pending_secret <> '' OR client_key_sealed <> ''").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		for column, value := range map[string]string{"totp_secret": user.TOTPSecret, "totp_pending_secret": user.TOTPPendingSecret, "client_key_sealed": user.ClientKeySealed} {
+			if value == "" || KeyVersion([]byte(value)) == version {
+				continue
+			}
+			secret, err := DecryptTOTPSecret(value)
+			if err == nil {
+				var encrypted string
+				if encrypted, err = EncryptTOTPSecret(secret); err == nil {
+					err = database.DB.Model(&user).Update(column, encrypted).Error
+				}
+			}
+			if err != nil {
+				log.Printf("User %d: failed to re-encrypt %s: %v", user.ID, column, err)
+				result.TOTPFailed++
+				continue
+			}
+			result.TOTPReencrypted++
+		}
+	}
+
+	schedulePrune()
+	return result, nil
+}
+
+// upgradeKeyVersion re-seals a user's data key and stored credentials that
+// still use a retired server secret. clientKey unwraps the data key; key is
+// what the credentials are sealed with (the data key, or the client key for
+// users without one).
+func upgradeKeyVersion(user *models.User, clientKey, key string) error {
+	version, _ := serverKeys.Current()
+	if checked, ok := keyVersionChecked.Load(user.ID); ok && checked.(int) == version {
+		return nil
+	}
+
+	var resealed int
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if len(user.DataKeyEncrypted) > 0 && KeyVersion(user.DataKeyEncrypted) != version {
+			dataKey, err := openBytes(user.DataKeyEncrypted, clientKey)
+			if err != nil {
+				return err
+			}
+			wrapped, err := sealBytes(dataKey, clientKey)
+			if err != nil {
+				return err
+			}
+			if err := tx.Model(user).Update("data_key_encrypted", wrapped).Error; err != nil {
+				return err
+			}
+			user.DataKeyEncrypted = wrapped
+			resealed++
+		}
+
+		count, err := resealUserCredentials(tx, user.ID, func(blob []byte) ([]byte, error) {
+			if KeyVersion(blob) == version {
+				return nil, nil
+			}
+			return reseal(blob, key, key)
+		})
+		resealed += count
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	keyVersionChecked.Store(user.ID, version)
+	if resealed > 0 {
+		log.Printf("User %d: re-sealed %d values with server secret version %d", user.ID, resealed, version)
+		schedulePrune()
+	}
+	return nil
+}
+
+// GetServerSecretStatus reports which server secret versions data is sealed with
+func GetServerSecretStatus() (*ServerSecretStatus, error) {
+	version, _ := serverKeys.Current()
+
+	sealed, err := sealedValues()
+	if err != nil {
+		return nil, err
+	}
+
+	status := &ServerSecretStatus{
+		CurrentVersion:  version,
+		RetiredVersions: serverKeys.RetiredVersions(),
+		KeyProvider:     serverKeys.ProviderName(),
+		SealedByVersion: make(map[int]int64),
+		UsersPending:    []string{},
+	}
+	pendingIDs := make(map[uint]bool)
+	for _, s := range sealed {
+		status.SealedByVersion[s.version]++
+		if s.version != version && s.userKey {
+			pendingIDs[s.userID] = true
+		}
+	}
+
+	var users []models.User
+	if err := database.DB.Select("id", "username").Order("username").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	status.UsersTotal = int64(len(users))
+	for _, user := range users {
+		if pendingIDs[user.ID] {
+			status.UsersPending = append(status.UsersPending, user.Username)
+		}
+	}
+	return status, nil
+}
+
+type sealedValue struct {
+	userID  uint
+	version int
+	userKey bool // Needs the user's key to re-seal
+}
+
+// sealedValues lists the server secret version of every encrypted value at rest
+func sealedValues() ([]sealedValue, error) {
+	var sealed []sealedValue
+
+	var users []models.User
+	if err := database.DB.Select("id", "totp_secret", "totp_pending_secret", "client_key_sealed", "data_key_encrypted").Find(&users).Error; err != nil {
+		return nil, err
+	}
+	for _, user := range users {
+		if user.TOTPSecret != "" {
+			sealed = append(sealed, sealedValue{user.ID, KeyVersion([]byte(user.TOTPSecret)), false})
+		}
+		if user.TOTPPendingSecret != "" {
+			sealed = append(sealed, sealedValue{user.ID, KeyVersion([]byte(user.TOTPPendingSecret)), false})
+		}
+		if user.ClientKeySealed != "" {
+			sealed = append(sealed, sealedValue{user.ID, KeyVersion([]byte(user.ClientKeySealed)), false})
+		}
+		if len(user.DataKeyEncrypted) > 0 {
+			sealed = append(sealed, sealedValue{user.ID, KeyVersion(user.DataKeyEncrypted), true})
+		}
+	}
+
+	var machines []models.Machine
+	if err := database.DB.Select("id", "user_id", "credential_encrypted").Where("credential_encrypted IS NOT NULL").Find(&machines).Error; err != nil {
+		return nil, err
+	}
+	for _, machine := range machines {
+		sealed = append(sealed, sealedValue{machine.UserID, KeyVersion(machine.CredentialEncrypted), true})
+	}
+
+	var credentials []models.Credential
+	if err := database.DB.Select("id", "user_id", "secret_encrypted").Where("secret_encrypted IS NOT NULL").Find(&credentials).Error; err != nil {
+		return nil, err
+	}
+	for _, credential := range credentials {
+		sealed = append(sealed, sealedValue{credential.UserID, KeyVersion(credential.SecretEncrypted), true})
+	}
+
+	var tokens []models.APIToken
+	if err := database.DB.Select("id", "user_id", "data_key_sealed").Where("data_key_sealed IS NOT NULL").Find(&tokens).Error; err != nil {
+		return nil, err
+	}
+	for _, token := range tokens {
+		sealed = append(sealed, sealedValue{token.UserID, KeyVersion(token.DataKeySealed), true})
+	}
+
+	return sealed, nil
+}
+
+var pruneScheduled atomic.Bool
+
+// schedulePrune checks for unused retired server secrets after the grace
+// period, coalescing calls made while a check is pending
+func schedulePrune() {
+	if !pruneScheduled.CompareAndSwap(false, true) {
+		return
+	}
+	time.AfterFunc(retiredSecretGracePeriod, func() {
+		pruneScheduled.Store(false)
+		pruneRetiredServerSecrets()
+	})
+}
+
+// pruneRetiredServerSecrets forgets retired server secrets nothing is sealed with anymore
+func pruneRetiredServerSecrets() {
+	retired := serverKeys.RetiredVersions()
+	if len(retired) == 0 {
+		return
+	}
+
+	sealed, err := sealedValues()
+	if err != nil {
+		log.Printf("Failed to check server secret usage: %v", err)
+		return
+	}
+	inUse := make(map[int]bool)
+	for _, s := range sealed {
+		inUse[s.version] = true
+	}
+
+	for _, version := range retired {
+		if inUse[version] {
+			continue
+		}
+		if err := serverKeys.Drop(version); err != nil {
+			log.Printf("Failed to drop server secret version %d: %v", version, err)
+			continue
+		}
+		log.Printf("Dropped retired server secret version %d, nothing is sealed with it anymore", version)
+	}
+}
@@ -0,0 +1,301 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+
+	"farseer/database"
+	"farseer/models"
+)
+
+const (
+	// sessionSeenInterval is how often a session's last activity is recorded
+	sessionSeenInterval = time.Minute
+	// refreshReuseGrace is how long a refresh token may come back after being
+	// used, for tabs that refreshed at the same time. Later it means theft.
+	refreshReuseGrace = 30 * time.Second
+)
+
+var (
+	// ErrSessionRevoked is returned for tokens whose session has been revoked or has expired
+	ErrSessionRevoked = errors.New("session has been revoked")
+	// ErrSessionNotFound is returned when revoking a session the user does not have
+	ErrSessionNotFound = errors.New("session not found")
+	// ErrRefreshTokenReused is returned when a used refresh token is presented
+	// again; the session it belongs to has been revoked
+	ErrRefreshTokenReused = errors.New("refresh token reused")
+)
+
+// Terminal is an open SSH terminal, tracked so revoking the session or
+// user it belongs to can close it
+type Terminal struct {
+	UserID    uint
+	SessionID string // jti of the session that opened it, empty for API tokens and proxy users
+	Close     func()
+}
+
+var terminals sync.Map // *Terminal -> struct{}
+
+// TrackTerminal registers an open terminal until the returned func is called
+func TrackTerminal(t *Terminal) func() {
+	terminals.Store(t, struct{}{})
+	return func() { terminals.Delete(t) }
+}
+
+// closeTerminals closes the open terminals match selects and returns how many
+func closeTerminals(match func(t *Terminal) bool) int {
+	closed := 0
+	terminals.Range(func(key, _ interface{}) bool {
+		if t := key.(*Terminal); match(t) {
+			terminals.Delete(t)
+			t.Close()
+			closed++
+		}
+		return true
+	})
+	return closed
+}
+
+// CreateSession records a sign-in and returns the session, whose JTI goes in
+// the token. Expired sessions are cleared out on the way.
+func CreateSession(userID uint, method, ip, userAgent string, expiresAt time.Time) (*models.Session, error) {
+	jti := make([]byte, 16)
+	if _, err := rand.Read(jti); err != nil {
+		return nil, err
+	}
+	if len(userAgent) > 256 {
+		userAgent = userAgent[:256]
+	}
+
+	now := time.Now()
+	session := &models.Session{
+		UserID:     userID,
+		JTI:        hex.EncodeToString(jti),
+		Method:     method,
+		IPAddress:  ip,
+		UserAgent:  userAgent,
+		ExpiresAt:  expiresAt,
+		LastSeenAt: now,
+	}
+	if err := database.DB.Create(session).Error; err != nil {
+		return nil, err
+	}
+	expired := database.DB.Model(&models.Session{}).Select("id").Where("expires_at < ?", now)
+	database.DB.Where("session_id IN (?)", expired).Delete(&models.RefreshToken{})
+	database.DB.Where("expires_at < ?", now).Delete(&models.Session{})
+	return session, nil
+}
+
+// IssueRefreshToken creates the session's next refresh token
+func IssueRefreshToken(sessionID uint) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+	if err := database.DB.Create(&models.RefreshToken{SessionID: sessionID, TokenHash: hashToken(token)}).Error; err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RefreshSession exchanges a refresh token for the session it belongs to and
+// the token replacing it. Within the reuse grace period a used token still
+// returns the session, but no new token: the browser already has it. After
+// that, a used token revokes the session and ErrRefreshTokenReused is
+// returned along with it.
+func RefreshSession(token string) (*models.Session, string, error) {
+	var refresh models.RefreshToken
+	if err := database.DB.Where("token_hash = ?", hashToken(token)).First(&refresh).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, "", ErrSessionRevoked
+		}
+		return nil, "", err
+	}
+	var session models.Session
+	if err := database.DB.First(&session, refresh.SessionID).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, "", ErrSessionRevoked
+		}
+		return nil, "", err
+	}
+	now := time.Now()
+	if now.After(session.ExpiresAt) {
+		return nil, "", ErrSessionRevoked
+	}
+
+	// Only one request gets to use the token
+	used := database.DB.Model(&models.RefreshToken{}).Where("id = ? AND used_at IS NULL", refresh.ID).Update("used_at", now)
+	if used.Error != nil {
+		return nil, "", used.Error
+	}
+	if used.RowsAffected == 0 {
+		if refresh.UsedAt == nil || now.Sub(*refresh.UsedAt) <= refreshReuseGrace {
+			return &session, "", nil
+		}
+		if err := revokeSessionRow(&session); err != nil {
+			return nil, "", err
+		}
+		return &session, "", ErrRefreshTokenReused
+	}
+
+	next, err := IssueRefreshToken(session.ID)
+	if err != nil {
+		return nil, "", err
+	}
+	database.DB.Model(&session).Update("last_seen_at", now)
+	return &session, next, nil
+}
+
+// ValidateSession checks that the session a token was issued with is still
+// active, recording its use
+func ValidateSession(jti string, userID uint) error {
+	if jti == "" {
+		return ErrSessionRevoked
+	}
+	var session models.Session
+	if err := database.DB.Where("jti = ? AND user_id = ?", jti, userID).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSessionRevoked
+		}
+		return err
+	}
+	now := time.Now()
+	if now.After(session.ExpiresAt) {
+		return ErrSessionRevoked
+	}
+	if now.Sub(session.LastSeenAt) > sessionSeenInterval {
+		database.DB.Model(&session).Update("last_seen_at", now)
+	}
+	return nil
+}
+
+// ListSessions returns the user's active sessions, most recent first
+func ListSessions(userID uint) ([]models.Session, error) {
+	var sessions []models.Session
+	err := database.DB.Where("user_id = ? AND expires_at > ?", userID, time.Now()).Order("created_at DESC").Find(&sessions).Error
+	return sessions, err
+}
+
+// RevokeSession ends one of the user's sessions and closes its terminals
+func RevokeSession(userID, sessionID uint) (*models.Session, error) {
+	var session models.Session
+	if err := database.DB.Where("id = ? AND user_id = ?", sessionID, userID).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSessionNotFound
+		}
+		return nil, err
+	}
+	if err := revokeSessionRow(&session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// RevokeSessionByJTI ends the session a token was issued with, for logout
+func RevokeSessionByJTI(jti string) error {
+	var session models.Session
+	if err := database.DB.Where("jti = ?", jti).First(&session).Error; err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrSessionNotFound
+		}
+		return err
+	}
+	return revokeSessionRow(&session)
+}
+
+// RevokeOtherSessions ends every session of the user but the one with keepJTI
+func RevokeOtherSessions(userID uint, keepJTI string) (int64, error) {
+	var sessions []models.Session
+	if err := database.DB.Where("user_id = ? AND jti <> ?", userID, keepJTI).Find(&sessions).Error; err != nil {
+		return 0, err
+	}
+	for i := range sessions {
+		if err := revokeSessionRow(&sessions[i]); err != nil {
+			return 0, err
+		}
+	}
+	return int64(len(sessions)), nil
+}
+
+func revokeSessionRow(session *models.Session) error {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("session_id = ?", session.ID).Delete(&models.RefreshToken{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(session).Error
+	})
+	if err != nil {
+		return err
+	}
+	closeTerminals(func(t *Terminal) bool { return t.SessionID == session.JTI })
+	return nil
+}
+
+// RevokeUserSessions signs the user out everywhere: it ends their sessions,
+// invalidates any temp token mid-login and closes their open terminals,
+// including those opened with API tokens or through the proxy. user's
+// session version is updated so a token issued to them afterwards is valid.
+func RevokeUserSessions(user *models.User) error {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(user).UpdateColumn("session_version", gorm.Expr("session_version + 1")).Error; err != nil {
+			return err
+		}
+		sessions := tx.Model(&models.Session{}).Select("id").Where("user_id = ?", user.ID)
+		if err := tx.Where("session_id IN (?)", sessions).Delete(&models.RefreshToken{}).Error; err != nil {
+			return err
+		}
+		if err := tx.Where("user_id = ?", user.ID).Delete(&models.Session{}).Error; err != nil {
+			return err
+		}
+		return tx.Model(&models.User{}).Select("session_version").Where("id = ?", user.ID).Scan(&user.SessionVersion).Error
+	})
+	if err != nil {
+		return err
+	}
+	if closed := closeTerminals(func(t *Terminal) bool { return t.UserID == user.ID }); closed > 0 {
+		log.Printf("User %d: closed %d open terminals", user.ID, closed)
+	}
+	return nil
+}
+
+// DeleteUser deletes the user with their machines, groups, shared
+// credentials, rotation jobs, notifications and every way of signing in as
+// them: sessions and refresh tokens, API tokens, security keys and recovery
+// codes. It all goes in one transaction, so a failure leaves nothing behind
+// that still works for a half-deleted user. The audit log is kept.
+func DeleteUser(user *models.User) error {
+	err := database.DB.Transaction(func(tx *gorm.DB) error {
+		sessions := tx.Model(&models.Session{}).Select("id").Where("user_id = ?", user.ID)
+		if err := tx.Where("session_id IN (?)", sessions).Delete(&models.RefreshToken{}).Error; err != nil {
+			return err
+		}
+		jobs := tx.Model(&models.RotationJob{}).Select("id").Where("user_id = ?", user.ID)
+		if err := tx.Where("job_id IN (?)", jobs).Delete(&models.RotationResult{}).Error; err != nil {
+			return err
+		}
+		owned := []interface{}{
+			&models.Session{}, &models.APIToken{}, &models.WebAuthnCredential{}, &models.RecoveryCode{},
+			&models.RotationJob{}, &models.Notification{}, &models.Credential{}, &models.Machine{}, &models.Group{},
+		}
+		for _, model := range owned {
+			if err := tx.Where("user_id = ?", user.ID).Delete(model).Error; err != nil {
+				return err
+			}
+		}
+		return tx.Delete(user).Error
+	})
+	if err != nil {
+		return err
+	}
+	if closed := closeTerminals(func(t *Terminal) bool { return t.UserID == user.ID }); closed > 0 {
+		log.Printf("User %d: closed %d open terminals", user.ID, closed)
+	}
+	return nil
+}
@@ -0,0 +1,85 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"farseer/database"
+	"farseer/models"
+)
+
+// createOwnedRows gives the user one of everything DeleteUser removes,
+// returning their session and rotation job
+func createOwnedRows(t *testing.T, user *models.User) (sessionID, jobID uint) {
+	t.Helper()
+	tag := fmt.Sprintf("%s-%d", user.Username, user.ID)
+	session := &models.Session{UserID: user.ID, JTI: "jti-" + tag, ExpiresAt: time.Now().Add(time.Hour)}
+	job := &models.RotationJob{UserID: user.ID, Kind: models.RotationKindKey, Status: models.RotationStatusCompleted}
+	machine := &models.Machine{UserID: user.ID, Name: "machine-" + tag}
+	for _, row := range []interface{}{session, job, machine} {
+		if err := database.DB.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	rows := []interface{}{
+		&models.RefreshToken{SessionID: session.ID, TokenHash: "refresh-" + tag},
+		&models.RotationResult{JobID: job.ID, MachineID: machine.ID},
+		&models.APIToken{UserID: user.ID, Name: "token", Prefix: "fst_", TokenHash: "token-" + tag, Scopes: models.ScopeMachinesRead},
+		&models.WebAuthnCredential{UserID: user.ID, Name: "key", CredentialID: []byte("cred-" + tag), PublicKey: []byte("pk")},
+		&models.RecoveryCode{UserID: user.ID, CodeHash: "code"},
+		&models.Notification{UserID: user.ID, Title: "hello"},
+		&models.Credential{UserID: user.ID, Name: "shared", Type: models.AuthTypePassword},
+		&models.Group{UserID: user.ID, Name: "group"},
+	}
+	for _, row := range rows {
+		if err := database.DB.Create(row).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	return session.ID, job.ID
+}
+
+// ownedRows counts the user's rows in each table that can still be used
+func ownedRows(user *models.User, sessionID, jobID uint) map[string]int64 {
+	counts := map[string]int64{}
+	count := func(name string, model interface{}, query string, args ...interface{}) {
+		var n int64
+		database.DB.Model(model).Where(query, args...).Count(&n)
+		counts[name] = n
+	}
+	count("users", &models.User{}, "id = ?", user.ID)
+	count("sessions", &models.Session{}, "user_id = ?", user.ID)
+	count("refresh tokens", &models.RefreshToken{}, "session_id = ?", sessionID)
+	count("rotation jobs", &models.RotationJob{}, "user_id = ?", user.ID)
+	count("rotation results", &models.RotationResult{}, "job_id = ?", jobID)
+	count("API tokens", &models.APIToken{}, "user_id = ?", user.ID)
+	count("security keys", &models.WebAuthnCredential{}, "user_id = ?", user.ID)
+	count("recovery codes", &models.RecoveryCode{}, "user_id = ?", user.ID)
+	count("notifications", &models.Notification{}, "user_id = ?", user.ID)
+	count("credentials", &models.Credential{}, "user_id = ?", user.ID)
+	count("machines", &models.Machine{}, "user_id = ?", user.ID)
+	count("groups", &models.Group{}, "user_id = ?", user.ID)
+	return counts
+}
+
+func TestDeleteUser(t *testing.T) {
+	deleted := createTestUser(t, "delete-me", models.RoleUser)
+	kept := createTestUser(t, "keep-me", models.RoleUser)
+	deletedSession, deletedJob := createOwnedRows(t, deleted)
+	keptSession, keptJob := createOwnedRows(t, kept)
+
+	if err := DeleteUser(deleted); err != nil {
+		t.Fatal(err)
+	}
+	for table, n := range ownedRows(deleted, deletedSession, deletedJob) {
+		if n != 0 {
+			t.Errorf("%d %s left for the deleted user", n, table)
+		}
+	}
+	for table, n := range ownedRows(kept, keptSession, keptJob) {
+		if n != 1 {
+			t.Errorf("%d %s left for another user, want 1", n, table)
+		}
+	}
+}
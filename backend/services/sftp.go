@@ -25,12 +25,13 @@ type FileInfo struct {
 type SFTPClient struct {
 	sshClient  *ssh.Client
 	sftpClient *sftp.Client
+	HostKey    *HostKeyResult
 }
 
 // NewSFTPClient creates a new SFTP client from SSH config
 func NewSFTPClient(cfg *SSHConfig) (*SFTPClient, error) {
 	// First establish SSH connection
-	session, _, err := ConnectSSH(cfg)
+	session, hostKeyResult, err := ConnectSSH(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -45,6 +46,7 @@ func NewSFTPClient(cfg *SSHConfig) (*SFTPClient, error) {
 	return &SFTPClient{
 		sshClient:  session.Client,
 		sftpClient: sftpClient,
+		HostKey:    hostKeyResult,
 	}, nil
 }
 
@@ -5,10 +5,15 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"strings"
 	"sync"
 	"time"
 
 	"golang.org/x/crypto/ssh"
+
+	"farseer/config"
+	"farseer/database"
+	"farseer/models"
 )
 
 // SSHSession represents an active SSH session
@@ -23,14 +28,15 @@ type SSHSession struct {
 
 // SSHConfig holds the configuration for an SSH connection
 type SSHConfig struct {
-	Hostname        string
-	Port            int
-	Username        string
-	Password        string
-	PrivateKey      string
-	Passphrase      string
-	HostKey         string // Expected host key fingerprint (for verification)
-	SkipHostKeyCheck bool   // If true, don't fail on host key mismatch (for user confirmation flow)
+	Hostname         string
+	Port             int
+	Username         string
+	Password         string
+	PrivateKey       string
+	Passphrase       string
+	HostKey          string               // Expected host key fingerprint (for verification)
+	HostKeyPolicy    models.HostKeyPolicy // Effective policy, see ResolveHostKeyPolicy
+	SkipHostKeyCheck bool                 // If true, don't fail on new or mismatched keys (for user confirmation flow)
 }
 
 // HostKeyResult contains information about the host key verification
@@ -39,8 +45,37 @@ type HostKeyResult struct {
 	Status      string // "new", "match", "mismatch"
 }
 
-// ConnectSSH establishes an SSH connection
-func ConnectSSH(cfg *SSHConfig) (*SSHSession, *HostKeyResult, error) {
+// HostKeyError is returned by non-interactive connections when the host key
+// is not trusted under the effective policy. Callers can surface it to the
+// user as a trust prompt.
+type HostKeyError struct {
+	Status      string // "new" or "mismatch"
+	Fingerprint string
+	Expected    string
+	Policy      models.HostKeyPolicy
+}
+
+func (e *HostKeyError) Error() string {
+	if e.Status == "mismatch" {
+		return fmt.Sprintf("host key mismatch: expected %s, got %s", e.Expected, e.Fingerprint)
+	}
+	return fmt.Sprintf("host key %s is not trusted (policy: %s)", e.Fingerprint, e.Policy)
+}
+
+// ResolveHostKeyPolicy returns the machine's host key policy, falling back
+// to the global policy from the config
+func ResolveHostKeyPolicy(machinePolicy models.HostKeyPolicy) models.HostKeyPolicy {
+	if machinePolicy.IsValid() {
+		return machinePolicy
+	}
+	if policy := models.HostKeyPolicy(config.GetConfig().HostKeyPolicy); policy.IsValid() {
+		return policy
+	}
+	return models.HostKeyPolicyStrict
+}
+
+// buildAuthMethods returns the SSH auth methods for the configured credentials
+func buildAuthMethods(cfg *SSHConfig) ([]ssh.AuthMethod, error) {
 	var authMethods []ssh.AuthMethod
 
 	// Configure authentication
@@ -59,14 +94,24 @@ func ConnectSSH(cfg *SSHConfig) (*SSHSession, *HostKeyResult, error) {
 		}
 
 		if err != nil {
-			return nil, nil, fmt.Errorf("failed to parse private key: %w", err)
+			return nil, fmt.Errorf("failed to parse private key: %w", err)
 		}
 
 		authMethods = append(authMethods, ssh.PublicKeys(signer))
 	}
 
 	if len(authMethods) == 0 {
-		return nil, nil, errors.New("no authentication method provided")
+		return nil, errors.New("no authentication method provided")
+	}
+
+	return authMethods, nil
+}
+
+// ConnectSSH establishes an SSH connection
+func ConnectSSH(cfg *SSHConfig) (*SSHSession, *HostKeyResult, error) {
+	authMethods, err := buildAuthMethods(cfg)
+	if err != nil {
+		return nil, nil, err
 	}
 
 	// Host key callback for verification
@@ -76,22 +121,36 @@ func ConnectSSH(cfg *SSHConfig) (*SSHSession, *HostKeyResult, error) {
 	hostKeyCallback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
 		hostKeyResult.Fingerprint = ssh.FingerprintSHA256(key)
 
-		if cfg.HostKey == "" {
+		switch cfg.HostKey {
+		case "":
 			// First connection - new host key
 			hostKeyResult.Status = "new"
-		} else if cfg.HostKey == hostKeyResult.Fingerprint {
+		case hostKeyResult.Fingerprint:
 			// Host key matches
 			hostKeyResult.Status = "match"
-		} else {
+			return nil
+		default:
 			// Host key mismatch!
 			hostKeyResult.Status = "mismatch"
-			if !cfg.SkipHostKeyCheck {
-				hostKeyErr = fmt.Errorf("host key mismatch: expected %s, got %s", cfg.HostKey, hostKeyResult.Fingerprint)
-				return hostKeyErr
-			}
 		}
 
-		return nil
+		if cfg.SkipHostKeyCheck {
+			// Caller will ask the user for confirmation
+			return nil
+		}
+
+		// Without a user to ask, only accept-new may trust an unknown key
+		if hostKeyResult.Status == "new" && cfg.HostKeyPolicy == models.HostKeyPolicyAcceptNew {
+			return nil
+		}
+
+		hostKeyErr = &HostKeyError{
+			Status:      hostKeyResult.Status,
+			Fingerprint: hostKeyResult.Fingerprint,
+			Expected:    cfg.HostKey,
+			Policy:      cfg.HostKeyPolicy,
+		}
+		return hostKeyErr
 	}
 
 	sshConfig := &ssh.ClientConfig{
@@ -107,7 +166,7 @@ func ConnectSSH(cfg *SSHConfig) (*SSHSession, *HostKeyResult, error) {
 	if err != nil {
 		// If it's a host key error, still return the result for user confirmation
 		if hostKeyErr != nil {
-			return nil, hostKeyResult, err
+			return nil, hostKeyResult, hostKeyErr
 		}
 		return nil, nil, fmt.Errorf("failed to connect: %w", err)
 	}
@@ -117,6 +176,31 @@ func ConnectSSH(cfg *SSHConfig) (*SSHSession, *HostKeyResult, error) {
 	}, hostKeyResult, nil
 }
 
+// ConnectMachine opens a non-interactive connection to a saved machine.
+// Untrusted host keys fail closed with a *HostKeyError according to the
+// machine's host key policy; keys accepted under accept-new are saved.
+func ConnectMachine(machine *models.Machine, cred *CredentialData) (*SSHSession, error) {
+	session, hostKeyResult, err := ConnectSSH(&SSHConfig{
+		Hostname:      machine.Hostname,
+		Port:          machine.Port,
+		Username:      machine.Username,
+		Password:      cred.Password,
+		PrivateKey:    cred.PrivateKey,
+		Passphrase:    cred.Passphrase,
+		HostKey:       machine.HostKey,
+		HostKeyPolicy: ResolveHostKeyPolicy(machine.HostKeyPolicy),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if hostKeyResult.Status == "new" {
+		database.DB.Model(machine).Update("host_key", hostKeyResult.Fingerprint)
+	}
+
+	return session, nil
+}
+
 // StartShell starts an interactive shell session
 func (s *SSHSession) StartShell(rows, cols int) error {
 	s.mu.Lock()
@@ -173,6 +257,30 @@ func (s *SSHSession) StartShell(rows, cols int) error {
 	return nil
 }
 
+// Run executes a command in a new non-interactive session and returns its
+// combined output. stdin, if not empty, is written to the command's input.
+func (s *SSHSession) Run(cmd string, stdin string) (string, error) {
+	session, err := s.Client.NewSession()
+	if err != nil {
+		return "", fmt.Errorf("failed to create session: %w", err)
+	}
+	defer session.Close()
+
+	if stdin != "" {
+		session.Stdin = strings.NewReader(stdin)
+	}
+
+	output, err := session.CombinedOutput(cmd)
+	if err != nil {
+		if msg := strings.TrimSpace(string(output)); msg != "" {
+			return string(output), fmt.Errorf("%w: %s", err, msg)
+		}
+		return string(output), err
+	}
+
+	return string(output), nil
+}
+
 // Resize changes the terminal size
 func (s *SSHSession) Resize(rows, cols int) error {
 	s.mu.Lock()
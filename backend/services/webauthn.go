@@ -0,0 +1,352 @@
+package services
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+
+	"farseer/config"
+	"farseer/database"
+	"farseer/models"
+)
+
+// webAuthnCeremonyTimeout is how long the browser has to answer a challenge
+const webAuthnCeremonyTimeout = 5 * time.Minute
+
+// WebAuthn ceremonies a challenge can be issued for. A challenge is only
+// accepted by the ceremony it was issued for.
+const (
+	WebAuthnRegister = "register"
+	WebAuthnLogin    = "login"
+	WebAuthnVerify   = "verify" // Confirms a sensitive change from an active session
+)
+
+var (
+	// ErrWebAuthnNoChallenge is returned when no unexpired challenge is pending for the ceremony
+	ErrWebAuthnNoChallenge = errors.New("no security key challenge pending, start again")
+	// ErrWebAuthnFailed is returned when the browser's response does not verify
+	ErrWebAuthnFailed = errors.New("security key verification failed")
+	// ErrWebAuthnCloned is returned when a key's signature counter went backwards
+	ErrWebAuthnCloned = errors.New("security key signature counter went backwards, the key may have been cloned")
+	// ErrWebAuthnNoKeys is returned when a challenge is requested from a user without security keys
+	ErrWebAuthnNoKeys = errors.New("no security keys registered")
+	// ErrWebAuthnNotConfigured is returned when the relying party cannot be determined
+	ErrWebAuthnNotConfigured = errors.New("WebAuthn relying party is not configured")
+)
+
+// pendingCeremony is a challenge handed to the browser and not answered yet
+type pendingCeremony struct {
+	session webauthn.SessionData
+	name    string // Registration only: what to call the new key
+	expires time.Time
+}
+
+// pendingCeremonies holds outstanding challenges, keyed by "userID:ceremony"
+var pendingCeremonies sync.Map
+
+// webAuthnUser adapts a user and their registered keys to the webauthn library
+type webAuthnUser struct {
+	user        *models.User
+	credentials []models.WebAuthnCredential
+}
+
+func (u *webAuthnUser) WebAuthnID() []byte {
+	return []byte(strconv.FormatUint(uint64(u.user.ID), 10))
+}
+
+func (u *webAuthnUser) WebAuthnName() string        { return u.user.Username }
+func (u *webAuthnUser) WebAuthnDisplayName() string { return u.user.Username }
+func (u *webAuthnUser) WebAuthnIcon() string        { return "" }
+
+func (u *webAuthnUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, len(u.credentials))
+	for i, c := range u.credentials {
+		credentials[i] = webauthn.Credential{
+			ID:              c.CredentialID,
+			PublicKey:       c.PublicKey,
+			AttestationType: c.AttestationType,
+			Transport:       transportsFromString(c.Transports),
+			Flags:           webauthn.CredentialFlags{BackupEligible: c.BackupEligible},
+			Authenticator: webauthn.Authenticator{
+				AAGUID:    c.AAGUID,
+				SignCount: c.SignCount,
+			},
+		}
+	}
+	return credentials
+}
+
+func loadWebAuthnUser(user *models.User) (*webAuthnUser, error) {
+	var credentials []models.WebAuthnCredential
+	if err := database.DB.Where("user_id = ?", user.ID).Find(&credentials).Error; err != nil {
+		return nil, err
+	}
+	return &webAuthnUser{user: user, credentials: credentials}, nil
+}
+
+// newWebAuthn sets up the relying party from the config, falling back to the
+// origin the request came from
+func newWebAuthn(origin string) (*webauthn.WebAuthn, error) {
+	cfg := config.GetConfig()
+	rpID, origins := cfg.WebAuthnRPID, cfg.WebAuthnOrigins
+	if rpID == "" || len(origins) == 0 {
+		u, err := url.Parse(origin)
+		if origin == "" || err != nil || u.Hostname() == "" {
+			return nil, ErrWebAuthnNotConfigured
+		}
+		if rpID == "" {
+			rpID = u.Hostname()
+		}
+		if len(origins) == 0 {
+			origins = []string{u.Scheme + "://" + u.Host}
+		}
+	}
+
+	timeout := webauthn.TimeoutConfig{Enforce: true, Timeout: webAuthnCeremonyTimeout, TimeoutUVD: webAuthnCeremonyTimeout}
+	return webauthn.New(&webauthn.Config{
+		RPID:          rpID,
+		RPDisplayName: "Farseer",
+		RPOrigins:     origins,
+		Timeouts:      webauthn.TimeoutsConfig{Login: timeout, Registration: timeout},
+	})
+}
+
+// BeginWebAuthnRegistration returns the options for registering a new key
+// named name. Keys the user already has are excluded.
+func BeginWebAuthnRegistration(user *models.User, origin, name string) (*protocol.CredentialCreation, error) {
+	w, err := newWebAuthn(origin)
+	if err != nil {
+		return nil, err
+	}
+	wu, err := loadWebAuthnUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	exclude := make([]protocol.CredentialDescriptor, 0, len(wu.credentials))
+	for _, c := range wu.WebAuthnCredentials() {
+		exclude = append(exclude, c.Descriptor())
+	}
+	creation, session, err := w.BeginRegistration(wu,
+		webauthn.WithExclusions(exclude),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementDiscouraged),
+	)
+	if err != nil {
+		return nil, err
+	}
+	storeCeremony(user.ID, WebAuthnRegister, session, name)
+	return creation, nil
+}
+
+// FinishWebAuthnRegistration verifies the browser's answer to a registration
+// challenge and stores the new key
+func FinishWebAuthnRegistration(user *models.User, origin string, body []byte) (*models.WebAuthnCredential, error) {
+	pending, err := takeCeremony(user.ID, WebAuthnRegister)
+	if err != nil {
+		return nil, err
+	}
+	w, err := newWebAuthn(origin)
+	if err != nil {
+		return nil, err
+	}
+	wu, err := loadWebAuthnUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrWebAuthnFailed, webAuthnErrorDetails(err))
+	}
+	credential, err := w.CreateCredential(wu, pending.session, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrWebAuthnFailed, webAuthnErrorDetails(err))
+	}
+
+	transports := make([]string, len(credential.Transport))
+	for i, t := range credential.Transport {
+		transports[i] = string(t)
+	}
+	record := &models.WebAuthnCredential{
+		UserID:          user.ID,
+		Name:            pending.name,
+		CredentialID:    credential.ID,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		AAGUID:          credential.Authenticator.AAGUID,
+		Transports:      strings.Join(transports, ","),
+		SignCount:       credential.Authenticator.SignCount,
+		BackupEligible:  credential.Flags.BackupEligible,
+	}
+	if err := database.DB.Create(record).Error; err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+// BeginWebAuthnLogin returns the options for proving possession of one of the
+// user's keys, for the given ceremony (WebAuthnLogin or WebAuthnVerify)
+func BeginWebAuthnLogin(user *models.User, origin, ceremony string) (*protocol.CredentialAssertion, error) {
+	w, err := newWebAuthn(origin)
+	if err != nil {
+		return nil, err
+	}
+	wu, err := loadWebAuthnUser(user)
+	if err != nil {
+		return nil, err
+	}
+	if len(wu.credentials) == 0 {
+		return nil, ErrWebAuthnNoKeys
+	}
+
+	assertion, session, err := w.BeginLogin(wu)
+	if err != nil {
+		return nil, err
+	}
+	storeCeremony(user.ID, ceremony, session, "")
+	return assertion, nil
+}
+
+// FinishWebAuthnLogin verifies the browser's answer to a login or verify
+// challenge and records the key's new signature counter
+func FinishWebAuthnLogin(user *models.User, origin, ceremony string, body []byte) (*models.WebAuthnCredential, error) {
+	pending, err := takeCeremony(user.ID, ceremony)
+	if err != nil {
+		return nil, err
+	}
+	w, err := newWebAuthn(origin)
+	if err != nil {
+		return nil, err
+	}
+	wu, err := loadWebAuthnUser(user)
+	if err != nil {
+		return nil, err
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrWebAuthnFailed, webAuthnErrorDetails(err))
+	}
+	credential, err := w.ValidateLogin(wu, pending.session, parsed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrWebAuthnFailed, webAuthnErrorDetails(err))
+	}
+
+	var record *models.WebAuthnCredential
+	for i := range wu.credentials {
+		if bytes.Equal(wu.credentials[i].CredentialID, credential.ID) {
+			record = &wu.credentials[i]
+			break
+		}
+	}
+	if record == nil {
+		return nil, ErrWebAuthnFailed
+	}
+	if credential.Authenticator.CloneWarning {
+		log.Printf("User %d: security key %d signature counter went backwards (%d after %d)", user.ID, record.ID, parsed.Response.AuthenticatorData.Counter, record.SignCount)
+		return nil, ErrWebAuthnCloned
+	}
+
+	// Conditional on the counter read, so two concurrent logins with the
+	// same signature cannot both succeed
+	now := time.Now()
+	result := database.DB.Model(&models.WebAuthnCredential{}).
+		Where("id = ? AND sign_count = ?", record.ID, record.SignCount).
+		Updates(map[string]interface{}{
+			"sign_count":   credential.Authenticator.SignCount,
+			"last_used_at": now,
+		})
+	if result.Error != nil {
+		return nil, result.Error
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrWebAuthnCloned
+	}
+	record.SignCount = credential.Authenticator.SignCount
+	record.LastUsedAt = &now
+	return record, nil
+}
+
+// WebAuthnCredentialCount returns how many security keys a user has registered
+func WebAuthnCredentialCount(userID uint) int64 {
+	var count int64
+	database.DB.Model(&models.WebAuthnCredential{}).Where("user_id = ?", userID).Count(&count)
+	return count
+}
+
+// WebAuthnCredentialCountByUser counts registered security keys for every user that has any
+func WebAuthnCredentialCountByUser() map[uint]int64 {
+	var rows []struct {
+		UserID uint
+		Count  int64
+	}
+	database.DB.Model(&models.WebAuthnCredential{}).
+		Select("user_id, COUNT(*) AS count").
+		Group("user_id").
+		Scan(&rows)
+
+	counts := make(map[uint]int64, len(rows))
+	for _, row := range rows {
+		counts[row.UserID] = row.Count
+	}
+	return counts
+}
+
+func storeCeremony(userID uint, ceremony string, session *webauthn.SessionData, name string) {
+	pendingCeremonies.Store(ceremonyKey(userID, ceremony), &pendingCeremony{
+		session: *session,
+		name:    name,
+		expires: time.Now().Add(webAuthnCeremonyTimeout),
+	})
+}
+
+// ceremonyKey is the key of a pending challenge in pendingCeremonies
+func ceremonyKey(userID uint, ceremony string) string {
+	return fmt.Sprintf("%d:%s", userID, ceremony)
+}
+
+// takeCeremony removes and returns the pending challenge, so each can be answered once
+func takeCeremony(userID uint, ceremony string) (*pendingCeremony, error) {
+	value, ok := pendingCeremonies.LoadAndDelete(ceremonyKey(userID, ceremony))
+	if !ok {
+		return nil, ErrWebAuthnNoChallenge
+	}
+	pending := value.(*pendingCeremony)
+	if time.Now().After(pending.expires) {
+		return nil, ErrWebAuthnNoChallenge
+	}
+	return pending, nil
+}
+
+// webAuthnErrorDetails pulls the specific reason out of the library's errors
+func webAuthnErrorDetails(err error) string {
+	var protocolErr *protocol.Error
+	if errors.As(err, &protocolErr) {
+		if protocolErr.DevInfo != "" {
+			return protocolErr.Details + ": " + protocolErr.DevInfo
+		}
+		return protocolErr.Details
+	}
+	return err.Error()
+}
+
+func transportsFromString(s string) []protocol.AuthenticatorTransport {
+	if s == "" {
+		return nil
+	}
+	parts := strings.Split(s, ",")
+	transports := make([]protocol.AuthenticatorTransport, len(parts))
+	for i, p := range parts {
+		transports[i] = protocol.AuthenticatorTransport(p)
+	}
+	return transports
+}
@@ -0,0 +1,318 @@
+package services
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"farseer/models"
+)
+
+const webAuthnTestOrigin = "https://farseer.test"
+
+// softAuthenticator is a software security key: a P-256 key pair answering
+// WebAuthn ceremonies with "none" attestation
+type softAuthenticator struct {
+	credentialID []byte
+	key          *ecdsa.PrivateKey
+	counter      uint32
+}
+
+// ceremonyOptions is the part of the creation and assertion options the
+// authenticator needs
+type ceremonyOptions struct {
+	PublicKey struct {
+		Challenge string `json:"challenge"`
+		RPID      string `json:"rpId"`
+		RP        struct {
+			ID string `json:"id"`
+		} `json:"rp"`
+	} `json:"publicKey"`
+}
+
+func parseCeremonyOptions(t *testing.T, options interface{}) (challenge string, rpIDHash [32]byte) {
+	t.Helper()
+	encoded, err := json.Marshal(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var parsed ceremonyOptions
+	if err := json.Unmarshal(encoded, &parsed); err != nil {
+		t.Fatal(err)
+	}
+	rpID := parsed.PublicKey.RP.ID
+	if rpID == "" {
+		rpID = parsed.PublicKey.RPID
+	}
+	return parsed.PublicKey.Challenge, sha256.Sum256([]byte(rpID))
+}
+
+func cborHead(major byte, n int) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n < 256:
+		return []byte{major<<5 | 24, byte(n)}
+	default:
+		return []byte{major<<5 | 25, byte(n >> 8), byte(n)}
+	}
+}
+
+func cborInt(i int) []byte {
+	if i >= 0 {
+		return cborHead(0, i)
+	}
+	return cborHead(1, -1-i)
+}
+
+func cborBytes(b []byte) []byte { return append(cborHead(2, len(b)), b...) }
+func cborText(s string) []byte  { return append(cborHead(3, len(s)), s...) }
+
+func clientData(ceremony, challenge, origin string) []byte {
+	data, _ := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": origin})
+	return data
+}
+
+// create answers a registration challenge, generating a new key
+func (a *softAuthenticator) create(t *testing.T, options interface{}, origin string) []byte {
+	t.Helper()
+	challenge, rpIDHash := parseCeremonyOptions(t, options)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.key = key
+	a.credentialID = make([]byte, 16)
+	rand.Read(a.credentialID)
+
+	x, y := make([]byte, 32), make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	// COSE EC2 key: kty 2, alg ES256, crv P-256
+	coseKey := cborHead(5, 5)
+	for _, part := range [][]byte{cborInt(1), cborInt(2), cborInt(3), cborInt(-7), cborInt(-1), cborInt(1), cborInt(-2), cborBytes(x), cborInt(-3), cborBytes(y)} {
+		coseKey = append(coseKey, part...)
+	}
+
+	authData := append([]byte{}, rpIDHash[:]...)
+	authData = append(authData, 0x41, 0, 0, 0, 0) // user present, attested credential data
+	authData = append(authData, make([]byte, 16)...)
+	authData = append(authData, byte(len(a.credentialID)>>8), byte(len(a.credentialID)))
+	authData = append(authData, a.credentialID...)
+	authData = append(authData, coseKey...)
+
+	attestation := cborHead(5, 3)
+	for _, part := range [][]byte{cborText("fmt"), cborText("none"), cborText("attStmt"), cborHead(5, 0), cborText("authData"), cborBytes(authData)} {
+		attestation = append(attestation, part...)
+	}
+
+	return a.response(map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData("webauthn.create", challenge, origin)),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+	})
+}
+
+// get answers a login challenge, signing with the registered key and the
+// next signature counter
+func (a *softAuthenticator) get(t *testing.T, options interface{}, origin string) []byte {
+	t.Helper()
+	a.counter++
+	return a.getWithCounter(t, options, origin, a.counter)
+}
+
+func (a *softAuthenticator) getWithCounter(t *testing.T, options interface{}, origin string, counter uint32) []byte {
+	t.Helper()
+	challenge, rpIDHash := parseCeremonyOptions(t, options)
+
+	authData := append([]byte{}, rpIDHash[:]...)
+	authData = append(authData, 0x01, 0, 0, 0, 0) // user present
+	binary.BigEndian.PutUint32(authData[33:], counter)
+
+	data := clientData("webauthn.get", challenge, origin)
+	dataHash := sha256.Sum256(data)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), dataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a.response(map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(data),
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+		"signature":         base64.RawURLEncoding.EncodeToString(signature),
+	})
+}
+
+func (a *softAuthenticator) response(fields map[string]string) []byte {
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	body, _ := json.Marshal(map[string]interface{}{"id": id, "rawId": id, "type": "public-key", "response": fields})
+	return body
+}
+
+// registerSoftAuthenticator registers a new software key for the user
+func registerSoftAuthenticator(t *testing.T, user *models.User) *softAuthenticator {
+	t.Helper()
+	creation, err := BeginWebAuthnRegistration(user, webAuthnTestOrigin, "soft key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := &softAuthenticator{}
+	record, err := FinishWebAuthnRegistration(user, webAuthnTestOrigin, authenticator.create(t, creation, webAuthnTestOrigin))
+	if err != nil {
+		t.Fatalf("registration: %v", err)
+	}
+	if record.Name != "soft key" || record.UserID != user.ID {
+		t.Fatalf("stored key %+v", record)
+	}
+	return authenticator
+}
+
+func TestWebAuthnRegisterAndLogin(t *testing.T) {
+	user := createTestUser(t, "webauthn-login", models.RoleUser)
+	if _, err := BeginWebAuthnLogin(user, webAuthnTestOrigin, WebAuthnLogin); !errors.Is(err, ErrWebAuthnNoKeys) {
+		t.Fatalf("login without keys: %v", err)
+	}
+
+	authenticator := registerSoftAuthenticator(t, user)
+	if count := WebAuthnCredentialCount(user.ID); count != 1 {
+		t.Fatalf("%d keys registered, want 1", count)
+	}
+
+	for i := 1; i <= 2; i++ {
+		assertion, err := BeginWebAuthnLogin(user, webAuthnTestOrigin, WebAuthnLogin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		record, err := FinishWebAuthnLogin(user, webAuthnTestOrigin, WebAuthnLogin, authenticator.get(t, assertion, webAuthnTestOrigin))
+		if err != nil {
+			t.Fatalf("login %d: %v", i, err)
+		}
+		if record.SignCount != uint32(i) || record.LastUsedAt == nil {
+			t.Fatalf("login %d: sign count %d, last used %v", i, record.SignCount, record.LastUsedAt)
+		}
+	}
+}
+
+func TestWebAuthnRejectsBadAssertions(t *testing.T) {
+	user := createTestUser(t, "webauthn-reject", models.RoleUser)
+	authenticator := registerSoftAuthenticator(t, user)
+
+	login := func(answer func(options interface{}) []byte) error {
+		assertion, err := BeginWebAuthnLogin(user, webAuthnTestOrigin, WebAuthnLogin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = FinishWebAuthnLogin(user, webAuthnTestOrigin, WebAuthnLogin, answer(assertion))
+		return err
+	}
+
+	t.Run("wrong origin", func(t *testing.T) {
+		err := login(func(options interface{}) []byte {
+			return authenticator.get(t, options, "https://evil.test")
+		})
+		if !errors.Is(err, ErrWebAuthnFailed) {
+			t.Errorf("got %v, want ErrWebAuthnFailed", err)
+		}
+	})
+
+	t.Run("bad signature", func(t *testing.T) {
+		err := login(func(options interface{}) []byte {
+			other := &softAuthenticator{credentialID: authenticator.credentialID}
+			other.key, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			return other.getWithCounter(t, options, webAuthnTestOrigin, authenticator.counter+1)
+		})
+		if !errors.Is(err, ErrWebAuthnFailed) {
+			t.Errorf("got %v, want ErrWebAuthnFailed", err)
+		}
+	})
+
+	t.Run("answer to another challenge", func(t *testing.T) {
+		stale, err := BeginWebAuthnLogin(user, webAuthnTestOrigin, WebAuthnLogin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = login(func(interface{}) []byte {
+			return authenticator.get(t, stale, webAuthnTestOrigin)
+		})
+		if !errors.Is(err, ErrWebAuthnFailed) {
+			t.Errorf("got %v, want ErrWebAuthnFailed", err)
+		}
+	})
+
+	t.Run("counter went backwards", func(t *testing.T) {
+		if err := login(func(options interface{}) []byte { return authenticator.get(t, options, webAuthnTestOrigin) }); err != nil {
+			t.Fatal(err)
+		}
+		err := login(func(options interface{}) []byte {
+			return authenticator.getWithCounter(t, options, webAuthnTestOrigin, authenticator.counter-1)
+		})
+		if !errors.Is(err, ErrWebAuthnCloned) {
+			t.Errorf("got %v, want ErrWebAuthnCloned", err)
+		}
+	})
+}
+
+func TestWebAuthnChallenges(t *testing.T) {
+	user := createTestUser(t, "webauthn-challenge", models.RoleUser)
+	authenticator := registerSoftAuthenticator(t, user)
+
+	t.Run("single use", func(t *testing.T) {
+		assertion, err := BeginWebAuthnLogin(user, webAuthnTestOrigin, WebAuthnLogin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer := authenticator.get(t, assertion, webAuthnTestOrigin)
+		if _, err := FinishWebAuthnLogin(user, webAuthnTestOrigin, WebAuthnLogin, answer); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := FinishWebAuthnLogin(user, webAuthnTestOrigin, WebAuthnLogin, answer); !errors.Is(err, ErrWebAuthnNoChallenge) {
+			t.Errorf("replayed answer: %v, want ErrWebAuthnNoChallenge", err)
+		}
+	})
+
+	t.Run("bound to its ceremony", func(t *testing.T) {
+		assertion, err := BeginWebAuthnLogin(user, webAuthnTestOrigin, WebAuthnVerify)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answer := authenticator.get(t, assertion, webAuthnTestOrigin)
+		if _, err := FinishWebAuthnLogin(user, webAuthnTestOrigin, WebAuthnLogin, answer); !errors.Is(err, ErrWebAuthnNoChallenge) {
+			t.Errorf("verify challenge used to log in: %v, want ErrWebAuthnNoChallenge", err)
+		}
+		if _, err := FinishWebAuthnLogin(user, webAuthnTestOrigin, WebAuthnVerify, answer); err != nil {
+			t.Errorf("verify: %v", err)
+		}
+	})
+
+	t.Run("expires", func(t *testing.T) {
+		assertion, err := BeginWebAuthnLogin(user, webAuthnTestOrigin, WebAuthnLogin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		value, _ := pendingCeremonies.Load(ceremonyKey(user.ID, WebAuthnLogin))
+		value.(*pendingCeremony).expires = time.Now().Add(-time.Second)
+		answer := authenticator.get(t, assertion, webAuthnTestOrigin)
+		if _, err := FinishWebAuthnLogin(user, webAuthnTestOrigin, WebAuthnLogin, answer); !errors.Is(err, ErrWebAuthnNoChallenge) {
+			t.Errorf("expired challenge: %v, want ErrWebAuthnNoChallenge", err)
+		}
+	})
+
+	t.Run("registration excludes existing keys", func(t *testing.T) {
+		creation, err := BeginWebAuthnRegistration(user, webAuthnTestOrigin, "second")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(creation.Response.CredentialExcludeList) != 1 {
+			t.Errorf("exclude list has %d keys, want 1", len(creation.Response.CredentialExcludeList))
+		}
+		pendingCeremonies.Delete(ceremonyKey(user.ID, WebAuthnRegister))
+	})
+}
@@ -8,8 +8,11 @@ import FileManager from './components/FileManager';
 import UserManagement from './components/UserManagement';
 import AuditLogs from './components/AuditLogs';
 import Settings from './components/Settings';
+import CredentialManager from './components/CredentialManager';
+import Account from './components/Account';
+import Notifications from './components/Notifications';
 import type { Machine, User } from './types';
-import { getCurrentUser, listMachines } from './services/api';
+import { getCurrentUser, listMachines, listNotifications, startDuePasswordRotation, logout, setAccessToken, clearAccessToken } from './services/api';
 import { useKeyboardShortcuts, formatShortcut, type KeyboardShortcut } from './hooks/useKeyboardShortcuts';
 
 const FARSEER_LOGO = `
@@ -32,6 +35,10 @@ function App() {
   const [showUserManagement, setShowUserManagement] = useState(false);
   const [showAuditLogs, setShowAuditLogs] = useState(false);
   const [showSettings, setShowSettings] = useState(false);
+  const [showCredentials, setShowCredentials] = useState(false);
+  const [showAccount, setShowAccount] = useState(false);
+  const [showNotifications, setShowNotifications] = useState(false);
+  const [unreadNotifications, setUnreadNotifications] = useState(0);
   const [refreshKey, setRefreshKey] = useState(0);
   const [sessionStatuses, setSessionStatuses] = useState<Record<number, 'connecting' | 'connected' | 'disconnected' | 'error'>>({});
   const [showShortcutsHelp, setShowShortcutsHelp] = useState(false);
@@ -83,12 +90,14 @@ function App() {
     const token = localStorage.getItem('token');
     if (token) {
       setIsAuthenticated(true);
+      // Keep the token renewed; an expired one is refreshed on first use
+      setAccessToken(token);
       // Fetch current user info
       getCurrentUser()
         .then(setCurrentUser)
         .catch(() => {
           // Token might be invalid
-          localStorage.removeItem('token');
+          clearAccessToken();
           localStorage.removeItem('encryptionKey');
           localStorage.removeItem('userId');
           setIsAuthenticated(false);
@@ -120,6 +129,24 @@ function App() {
     return () => window.removeEventListener('beforeunload', handleBeforeUnload);
   }, [sessionStatuses]);
 
+  // Host key alerts and rotation reminders arrive in the background, so the
+  // unread count is polled
+  const fetchUnreadNotifications = useCallback(async () => {
+    try {
+      const unread = await listNotifications(true);
+      setUnreadNotifications(unread.length);
+    } catch {
+      // Keep the last count
+    }
+  }, []);
+
+  useEffect(() => {
+    if (!isAuthenticated) return;
+    fetchUnreadNotifications();
+    const interval = setInterval(fetchUnreadNotifications, 60000);
+    return () => clearInterval(interval);
+  }, [isAuthenticated, fetchUnreadNotifications]);
+
   // Fetch machines when authenticated
   useEffect(() => {
     if (isAuthenticated) {
@@ -130,10 +157,19 @@ function App() {
   const handleLogin = () => {
     setIsAuthenticated(true);
     getCurrentUser().then(setCurrentUser);
+    // A password account's overdue rotations need its encryption key, which the
+    // server never holds, so they run now rather than on the server's schedule
+    startDuePasswordRotation().catch(() => {});
   };
 
-  const handleLogout = () => {
-    localStorage.removeItem('token');
+  const handleLogout = async () => {
+    try {
+      // End the session server-side so the token stops working
+      await logout();
+    } catch {
+      // Signing out locally still works
+    }
+    clearAccessToken();
     localStorage.removeItem('encryptionKey');
     localStorage.removeItem('userId');
     setIsAuthenticated(false);
@@ -230,7 +266,7 @@ function App() {
   ], [handleAddMachine, selectedMachine, handleCloseSession, handleNextTab, handlePrevTab]);
 
   // Only enable shortcuts when authenticated and no modal is open
-  const shortcutsEnabled = isAuthenticated && !showMachineForm && !showFileManager && !showUserManagement && !showAuditLogs && !showSettings;
+  const shortcutsEnabled = isAuthenticated && !showMachineForm && !showFileManager && !showUserManagement && !showAuditLogs && !showSettings && !showCredentials && !showAccount && !showNotifications;
   useKeyboardShortcuts(shortcuts, { enabled: shortcutsEnabled });
 
   if (isLoading) {
@@ -267,13 +303,44 @@ function App() {
                 <div className="flex items-center gap-1">
                   {currentUser && (
                     <>
-                      <span className="text-term-fg-dim text-xs mr-1">{currentUser.username}</span>
+                      <button
+                        onClick={() => setShowAccount(true)}
+                        className="text-term-fg-dim hover:text-term-fg-bright text-xs mr-1 transition-colors"
+                        title="Account"
+                      >
+                        {currentUser.username}
+                      </button>
+                      {(currentUser.totp_enabled || currentUser.webauthn_credentials > 0) && currentUser.recovery_codes_left <= 2 && (
+                        <button
+                          onClick={() => setShowAccount(true)}
+                          className="text-term-yellow text-xs mr-1"
+                          title="Few recovery codes left, generate new ones"
+                        >
+                          [! {currentUser.recovery_codes_left} codes]
+                        </button>
+                      )}
                       {currentUser.role === 'admin' && (
                         <span className="text-term-magenta text-xs mr-1">[admin]</span>
                       )}
                       <span className="text-term-fg-muted text-xs mr-1">|</span>
                     </>
                   )}
+                  <button
+                    onClick={() => setShowNotifications(true)}
+                    className={`px-1.5 py-0.5 text-xs transition-colors ${
+                      unreadNotifications > 0 ? 'text-term-yellow hover:text-term-fg-bright' : 'text-term-fg-dim hover:text-term-fg-bright'
+                    }`}
+                    title="Notifications"
+                  >
+                    {unreadNotifications > 0 ? `[msg ${unreadNotifications}]` : '[msg]'}
+                  </button>
+                  <button
+                    onClick={() => setShowCredentials(true)}
+                    className="px-1.5 py-0.5 text-xs text-term-fg-dim hover:text-term-fg-bright transition-colors"
+                    title="Shared Credentials"
+                  >
+                    [key]
+                  </button>
                   {currentUser?.role === 'admin' && (
                     <>
                       <button
@@ -462,6 +529,28 @@ function App() {
                 <Settings onClose={() => setShowSettings(false)} />
               )}
 
+              {/* Account modal, kept open while the password has expired */}
+              {(showAccount || currentUser?.password_expired) && currentUser && (
+                <Account
+                  user={currentUser}
+                  onClose={() => setShowAccount(false)}
+                  onUpdated={() => getCurrentUser().then(setCurrentUser)}
+                />
+              )}
+
+              {/* Notifications modal */}
+              {showNotifications && (
+                <Notifications
+                  onClose={() => setShowNotifications(false)}
+                  onChange={fetchUnreadNotifications}
+                />
+              )}
+
+              {/* Shared credentials modal */}
+              {showCredentials && (
+                <CredentialManager onClose={() => setShowCredentials(false)} />
+              )}
+
               {/* Keyboard shortcuts help modal */}
               {showShortcutsHelp && (
                 <div className="fixed inset-0 bg-black/70 flex items-center justify-center z-50 p-4">
@@ -0,0 +1,683 @@
+import { useState, useEffect, useCallback } from 'react';
+import { QRCodeSVG } from 'qrcode.react';
+import {
+  regenerateRecoveryCodes,
+  startTOTPReenrollment,
+  confirmTOTPReenrollment,
+  listWebAuthnCredentials,
+  getWebAuthnChallenge,
+  beginWebAuthnRegistration,
+  finishWebAuthnRegistration,
+  deleteWebAuthnCredential,
+  updatePreferredFactor,
+  listAPITokens,
+  getAPITokenScopes,
+  createAPIToken,
+  deleteAPIToken,
+  listSessions,
+  revokeSession,
+  revokeOtherSessions,
+  changePassword,
+} from '../services/api';
+import { deriveEncryptionKey } from '../utils/crypto';
+import { createCredential, getAssertion, isWebAuthnSupported } from '../utils/webauthn';
+import type { User, WebAuthnCredential, APIToken, Session, FactorVerification, SecondFactor } from '../types';
+
+interface AccountProps {
+  user: User;
+  onClose: () => void;
+  onUpdated: () => void;
+}
+
+type VerifyMethod = 'totp' | 'recovery' | 'webauthn';
+
+const tokenExpiries = [
+  { days: 30, label: '30 days' },
+  { days: 90, label: '90 days' },
+  { days: 365, label: '1 year' },
+  { days: 0, label: 'never' },
+];
+
+export default function Account({ user, onClose, onUpdated }: AccountProps) {
+  const [verifyMethod, setVerifyMethod] = useState<VerifyMethod>(user.totp_enabled ? 'totp' : 'webauthn');
+  const [factorCode, setFactorCode] = useState('');
+  const [recoveryCodes, setRecoveryCodes] = useState<string[]>([]);
+  const [keys, setKeys] = useState<WebAuthnCredential[]>([]);
+  const [keyName, setKeyName] = useState('');
+  const [newSecret, setNewSecret] = useState('');
+  const [newQrUrl, setNewQrUrl] = useState('');
+  const [newCode, setNewCode] = useState('');
+  const [tokens, setTokens] = useState<APIToken[]>([]);
+  const [scopes, setScopes] = useState<string[]>([]);
+  const [tokenName, setTokenName] = useState('');
+  const [tokenScopes, setTokenScopes] = useState<string[]>([]);
+  const [tokenExpiry, setTokenExpiry] = useState(90);
+  const [newToken, setNewToken] = useState('');
+  const [sessions, setSessions] = useState<Session[]>([]);
+  const [currentPassword, setCurrentPassword] = useState('');
+  const [newPassword, setNewPassword] = useState('');
+  const [confirmPassword, setConfirmPassword] = useState('');
+  const [busy, setBusy] = useState(false);
+  const [error, setError] = useState('');
+  const [success, setSuccess] = useState('');
+
+  const fetchKeys = useCallback(async () => {
+    try {
+      setKeys(await listWebAuthnCredentials());
+    } catch {
+      // Non-critical, the count in the header still shows
+    }
+  }, []);
+
+  const fetchTokens = useCallback(async () => {
+    try {
+      setTokens(await listAPITokens());
+    } catch {
+      // Non-critical, creating a token still works
+    }
+  }, []);
+
+  const fetchSessions = useCallback(async () => {
+    try {
+      setSessions(await listSessions());
+    } catch {
+      // Non-critical, the list just stays empty
+    }
+  }, []);
+
+  useEffect(() => {
+    fetchKeys();
+    fetchTokens();
+    fetchSessions();
+    getAPITokenScopes().then(setScopes).catch(() => setScopes([]));
+  }, [fetchKeys, fetchTokens, fetchSessions]);
+
+  useEffect(() => {
+    const handleKeyDown = (e: KeyboardEvent) => {
+      if (e.key === 'Escape') onClose();
+    };
+    document.addEventListener('keydown', handleKeyDown);
+    return () => document.removeEventListener('keydown', handleKeyDown);
+  }, [onClose]);
+
+  // Proof of a current second factor for the action about to run
+  const verification = async (): Promise<FactorVerification> => {
+    if (verifyMethod === 'webauthn') {
+      return { assertion: await getAssertion(await getWebAuthnChallenge()) };
+    }
+    if (verifyMethod === 'recovery') {
+      return { recovery_code: factorCode.trim() };
+    }
+    return { code: factorCode };
+  };
+
+  const factorReady = verifyMethod === 'webauthn'
+    || (verifyMethod === 'recovery' ? factorCode.trim() !== '' : factorCode.length === 6);
+
+  // Runs an action, reporting failures and clearing the one-time factor input
+  const run = async (action: () => Promise<void>, failure: string) => {
+    setError('');
+    setSuccess('');
+    setBusy(true);
+    try {
+      await action();
+    } catch (err: unknown) {
+      const error = err as { response?: { data?: { error?: string } }; message?: string };
+      setError(error.response?.data?.error || error.message || failure);
+    } finally {
+      setFactorCode('');
+      setBusy(false);
+    }
+  };
+
+  const handleChangePassword = (e: React.FormEvent) => {
+    e.preventDefault();
+    if (newPassword !== confirmPassword) {
+      setError('New passwords do not match');
+      return;
+    }
+    run(async () => {
+      const result = await changePassword({ ...(await verification()), current_password: currentPassword, new_password: newPassword });
+      // The server re-wrapped our data key; keep the local key in step
+      if (!user.auth_provider) {
+        localStorage.setItem('encryptionKey', await deriveEncryptionKey(user.username, newPassword));
+      }
+      setCurrentPassword('');
+      setNewPassword('');
+      setConfirmPassword('');
+      setSuccess(`Password changed${result.sessions_revoked > 0 ? `, ${result.sessions_revoked} other sessions signed out` : ''}`);
+      fetchSessions();
+      onUpdated();
+    }, 'Failed to change password');
+  };
+
+  const handleRegenerate = () => run(async () => {
+    setRecoveryCodes(await regenerateRecoveryCodes(await verification()));
+    onUpdated();
+  }, 'Failed to generate recovery codes');
+
+  const handleStartTOTP = () => run(async () => {
+    const response = await startTOTPReenrollment(await verification());
+    setNewSecret(response.totp_secret || '');
+    setNewQrUrl(response.totp_qr_url || '');
+    onUpdated();
+  }, 'Failed to start TOTP setup');
+
+  const handleConfirmTOTP = async (e: React.FormEvent) => {
+    e.preventDefault();
+    await run(async () => {
+      await confirmTOTPReenrollment(newCode);
+      setNewSecret('');
+      setNewQrUrl('');
+      setSuccess(user.totp_enabled ? 'TOTP moved to your new device' : 'TOTP enabled');
+      onUpdated();
+    }, 'Failed to confirm new device');
+    setNewCode('');
+  };
+
+  const handleAddKey = () => run(async () => {
+    const options = await beginWebAuthnRegistration(keyName, await verification());
+    const key = await finishWebAuthnRegistration(await createCredential(options));
+    setKeyName('');
+    setSuccess(`Security key "${key.name}" added`);
+    fetchKeys();
+    onUpdated();
+  }, 'Failed to add security key');
+
+  const handleDeleteKey = (key: WebAuthnCredential) => {
+    if (!confirm(`Remove security key "${key.name}"?`)) return;
+    run(async () => {
+      await deleteWebAuthnCredential(key.id);
+      fetchKeys();
+      onUpdated();
+    }, 'Failed to remove security key');
+  };
+
+  const handleCreateToken = () => run(async () => {
+    // Users signed in through an external provider have no second factor to confirm with
+    const proof = hasFactor ? await verification() : {};
+    const created = await createAPIToken({ name: tokenName, scopes: tokenScopes, expires_in_days: tokenExpiry }, proof);
+    setNewToken(created.token);
+    setTokenName('');
+    setTokenScopes([]);
+    fetchTokens();
+  }, 'Failed to create API token');
+
+  const handleDeleteToken = (token: APIToken) => {
+    if (!confirm(`Revoke API token "${token.name}"? Scripts using it will stop working.`)) return;
+    run(async () => {
+      await deleteAPIToken(token.id);
+      fetchTokens();
+    }, 'Failed to revoke API token');
+  };
+
+  const handleRevokeSession = (session: Session) => run(async () => {
+    await revokeSession(session.id);
+    fetchSessions();
+  }, 'Failed to revoke session');
+
+  const handleRevokeOtherSessions = () => {
+    if (!confirm('Sign out every other session? Their open terminals will be closed.')) return;
+    run(async () => {
+      const { revoked } = await revokeOtherSessions();
+      setSuccess(`Signed out ${revoked} other session${revoked === 1 ? '' : 's'}`);
+      fetchSessions();
+    }, 'Failed to revoke sessions');
+  };
+
+  const toggleScope = (scope: string) => {
+    setTokenScopes((current) => current.includes(scope) ? current.filter((s) => s !== scope) : [...current, scope]);
+  };
+
+  const handlePreferred = (factor: SecondFactor) => run(async () => {
+    await updatePreferredFactor(factor);
+    onUpdated();
+  }, 'Failed to update preferred factor');
+
+  const codesLeft = user.recovery_codes_left;
+  const hasKeys = user.webauthn_credentials > 0;
+  const hasFactor = user.totp_enabled || hasKeys;
+  // Directory and proxy users have no password Farseer can change
+  const hasPassword = user.auth_provider !== 'ldap' && user.auth_provider !== 'proxy';
+  const methods: { value: VerifyMethod; label: string; available: boolean }[] = [
+    { value: 'totp', label: '2fa code', available: user.totp_enabled },
+    { value: 'webauthn', label: 'security key', available: hasKeys && isWebAuthnSupported() },
+    { value: 'recovery', label: 'recovery code', available: codesLeft > 0 },
+  ];
+
+  return (
+    <div className="fixed inset-0 bg-black/70 flex items-center justify-center p-4 z-50">
+      <div className="border border-term-border bg-term-surface w-full max-w-md max-h-[90vh] flex flex-col">
+        {/* Title bar */}
+        <div className="flex items-center justify-between px-3 py-1.5 bg-term-surface-alt border-b border-term-border">
+          <span className="text-term-fg-dim text-xs font-mono">--[ account ]--</span>
+          <button
+            onClick={onClose}
+            className="text-xs text-term-fg-dim hover:text-term-red font-mono"
+          >
+            [x]
+          </button>
+        </div>
+
+        <div className="p-4 space-y-4 overflow-auto">
+          {error && (
+            <div className="p-2 border border-term-red text-term-red text-xs">
+              [ERR] {error}
+            </div>
+          )}
+          {success && (
+            <div className="p-2 border border-term-green text-term-green text-xs">
+              [OK] {success}
+            </div>
+          )}
+          {user.password_expired && (
+            <div className="p-2 border border-term-yellow text-term-yellow text-xs">
+              [!] Your password has expired. Change it to continue.
+            </div>
+          )}
+
+          {/* Confirmation factor */}
+          <div>
+            <label className="block text-term-fg-dim text-xs mb-2">
+              Confirm Changes With
+            </label>
+            <div className="flex flex-wrap gap-1 mb-2">
+              {methods.filter((m) => m.available).map((m) => (
+                <button
+                  key={m.value}
+                  type="button"
+                  onClick={() => {
+                    setVerifyMethod(m.value);
+                    setFactorCode('');
+                  }}
+                  className={`px-2 py-0.5 text-xs font-mono border transition-colors ${
+                    verifyMethod === m.value
+                      ? 'border-term-cyan text-term-cyan bg-term-cyan/10'
+                      : 'border-term-border text-term-fg-dim hover:text-term-fg-bright hover:border-term-fg-dim'
+                  }`}
+                >
+                  {m.label}
+                </button>
+              ))}
+            </div>
+            {verifyMethod === 'webauthn' ? (
+              <p className="text-term-fg-muted text-xs">your security key will be asked to confirm</p>
+            ) : (
+              <div className="flex items-center gap-2">
+                <span className="text-term-cyan text-xs">&gt;</span>
+                <span className="text-term-fg-dim text-xs">{verifyMethod === 'recovery' ? 'recovery code:' : '2fa code:'}</span>
+                <input
+                  type="text"
+                  inputMode={verifyMethod === 'recovery' ? 'text' : 'numeric'}
+                  autoComplete="off"
+                  value={factorCode}
+                  onChange={(e) => setFactorCode(verifyMethod === 'recovery' ? e.target.value : e.target.value.replace(/\D/g, '').slice(0, 6))}
+                  className={`${verifyMethod === 'recovery' ? 'w-32' : 'w-20'} bg-term-black border border-term-border text-term-fg-bright text-xs py-1 px-2 focus:outline-none focus:border-term-cyan text-center tracking-widest`}
+                  placeholder={verifyMethod === 'recovery' ? 'xxxxx-xxxxx' : '______'}
+                  maxLength={verifyMethod === 'recovery' ? 16 : 6}
+                />
+              </div>
+            )}
+          </div>
+
+          {/* Password */}
+          {hasPassword && (
+            <form onSubmit={handleChangePassword}>
+              <label className="block text-term-fg-dim text-xs mb-2">
+                Password
+              </label>
+              <p className="text-term-fg-muted text-xs mb-3">
+                Your other sessions are signed out. Stored credentials stay readable.
+              </p>
+              <div className="space-y-2 mb-3">
+                {[
+                  { label: 'current:', value: currentPassword, set: setCurrentPassword, autoComplete: 'current-password' },
+                  { label: 'new:', value: newPassword, set: setNewPassword, autoComplete: 'new-password' },
+                  { label: 'confirm:', value: confirmPassword, set: setConfirmPassword, autoComplete: 'new-password' },
+                ].map((field) => (
+                  <div key={field.label} className="flex items-center gap-2">
+                    <span className="text-term-cyan text-xs">&gt;</span>
+                    <span className="text-term-fg-dim text-xs w-16">{field.label}</span>
+                    <input
+                      type="password"
+                      autoComplete={field.autoComplete}
+                      value={field.value}
+                      onChange={(e) => field.set(e.target.value)}
+                      className="flex-1 bg-term-black border border-term-border text-term-fg-bright text-xs py-1 px-2 focus:outline-none focus:border-term-cyan"
+                    />
+                  </div>
+                ))}
+              </div>
+              <button
+                type="submit"
+                disabled={busy || !factorReady || !currentPassword || !newPassword || !confirmPassword}
+                className="px-2 py-0.5 text-xs font-mono border border-term-cyan text-term-cyan hover:bg-term-cyan hover:text-term-black transition-colors disabled:opacity-50"
+              >
+                [ {busy ? 'changing...' : 'change password'} ]
+              </button>
+            </form>
+          )}
+
+          {/* Security Keys */}
+          <div>
+            <label className="block text-term-fg-dim text-xs mb-2">
+              Security Keys
+            </label>
+            <p className="text-term-fg-muted text-xs mb-3">
+              Hardware keys and passkeys, usable instead of a 2fa code at login.
+            </p>
+            {keys.length > 0 && (
+              <div className="border border-term-border mb-3">
+                {keys.map((key) => (
+                  <div key={key.id} className="flex items-center justify-between px-2 py-1 text-xs font-mono border-b border-term-border last:border-b-0">
+                    <span className="text-term-fg-bright">{key.name}</span>
+                    <span className="text-term-fg-muted">
+                      {key.last_used_at ? `used ${new Date(key.last_used_at).toLocaleDateString()}` : 'never used'}
+                    </span>
+                    <button
+                      onClick={() => handleDeleteKey(key)}
+                      disabled={busy}
+                      className="text-term-fg-dim hover:text-term-red"
+                      title="Remove"
+                    >
+                      [del]
+                    </button>
+                  </div>
+                ))}
+              </div>
+            )}
+            {isWebAuthnSupported() ? (
+              <div className="flex items-center gap-2">
+                <input
+                  type="text"
+                  value={keyName}
+                  onChange={(e) => setKeyName(e.target.value)}
+                  className="flex-1 bg-term-black border border-term-border text-term-fg-bright text-xs py-1 px-2 focus:outline-none focus:border-term-cyan"
+                  placeholder="name, e.g. yubikey"
+                  maxLength={64}
+                />
+                <button
+                  type="button"
+                  onClick={handleAddKey}
+                  disabled={busy || !factorReady}
+                  className="px-2 py-0.5 text-xs font-mono border border-term-cyan text-term-cyan hover:bg-term-cyan hover:text-term-black transition-colors disabled:opacity-50"
+                >
+                  [ add key ]
+                </button>
+              </div>
+            ) : (
+              <p className="text-term-yellow text-xs">this browser does not support security keys</p>
+            )}
+          </div>
+
+          {/* Preferred factor */}
+          {user.totp_enabled && hasKeys && (
+            <div>
+              <label className="block text-term-fg-dim text-xs mb-2">
+                Offer First At Login
+              </label>
+              <div className="flex gap-1">
+                {(['totp', 'webauthn'] as SecondFactor[]).map((factor) => (
+                  <button
+                    key={factor}
+                    type="button"
+                    onClick={() => handlePreferred(factor)}
+                    disabled={busy}
+                    className={`px-2 py-0.5 text-xs font-mono border transition-colors ${
+                      user.preferred_factor === factor
+                        ? 'border-term-cyan text-term-cyan bg-term-cyan/10'
+                        : 'border-term-border text-term-fg-dim hover:text-term-fg-bright hover:border-term-fg-dim'
+                    }`}
+                  >
+                    {factor === 'totp' ? '2fa code' : 'security key'}
+                  </button>
+                ))}
+              </div>
+            </div>
+          )}
+
+          {/* Authenticator */}
+          <div>
+            <label className="block text-term-fg-dim text-xs mb-2">
+              Authenticator App
+            </label>
+            {newQrUrl ? (
+              <form onSubmit={handleConfirmTOTP} className="space-y-3">
+                <p className="text-term-fg-muted text-xs">
+                  Scan this with the new device, then enter a code from it.
+                  {user.totp_enabled && ' Your old device keeps working until you confirm.'}
+                </p>
+                <div className="flex justify-center">
+                  <div className="bg-white p-2 inline-block">
+                    <QRCodeSVG value={newQrUrl} size={140} />
+                  </div>
+                </div>
+                <p className="text-center">
+                  <code className="text-term-green text-xs tracking-widest select-all">{newSecret}</code>
+                </p>
+                <div className="flex items-center gap-2">
+                  <span className="text-term-cyan text-xs">&gt;</span>
+                  <span className="text-term-fg-dim text-xs">new device code:</span>
+                  <input
+                    type="text"
+                    inputMode="numeric"
+                    autoComplete="one-time-code"
+                    value={newCode}
+                    onChange={(e) => setNewCode(e.target.value.replace(/\D/g, '').slice(0, 6))}
+                    className="w-20 bg-term-black border border-term-border text-term-fg-bright text-xs py-1 px-2 focus:outline-none focus:border-term-cyan text-center tracking-widest"
+                    placeholder="______"
+                    maxLength={6}
+                  />
+                  <button
+                    type="submit"
+                    disabled={busy || newCode.length !== 6}
+                    className="px-2 py-0.5 text-xs font-mono border border-term-cyan text-term-cyan hover:bg-term-cyan hover:text-term-black transition-colors disabled:opacity-50"
+                  >
+                    [ {busy ? 'confirming...' : 'confirm'} ]
+                  </button>
+                </div>
+              </form>
+            ) : (
+              <>
+                <p className="text-term-fg-muted text-xs mb-3">
+                  {user.totp_enabled ? 'Move TOTP to a new device.' : 'Add an authenticator app as a second factor.'}
+                </p>
+                <button
+                  type="button"
+                  onClick={handleStartTOTP}
+                  disabled={busy || !factorReady}
+                  className="px-2 py-0.5 text-xs font-mono border border-term-cyan text-term-cyan hover:bg-term-cyan hover:text-term-black transition-colors disabled:opacity-50"
+                >
+                  [ {user.totp_enabled ? 'new device' : 'set up TOTP'} ]
+                </button>
+              </>
+            )}
+          </div>
+
+          {/* Recovery Codes */}
+          <div>
+            <label className="block text-term-fg-dim text-xs mb-2">
+              Recovery Codes
+            </label>
+            <p className="text-term-fg-muted text-xs mb-3">
+              Each code signs you in once without your authenticator. Generating new codes invalidates the old ones.
+            </p>
+            <p className={`text-xs font-mono mb-3 ${codesLeft <= 2 ? 'text-term-yellow' : 'text-term-fg-bright'}`}>
+              {codesLeft} unused code{codesLeft === 1 ? '' : 's'} left
+            </p>
+
+            {recoveryCodes.length > 0 ? (
+              <div className="space-y-2">
+                <p className="text-term-fg-dim text-xs">
+                  save these now, they will not be shown again:
+                </p>
+                <div className="bg-term-surface-alt border border-term-border px-4 py-3 grid grid-cols-2 gap-x-6 gap-y-1 select-all">
+                  {recoveryCodes.map((code) => (
+                    <code key={code} className="text-term-green text-sm font-mono tracking-widest text-center">
+                      {code}
+                    </code>
+                  ))}
+                </div>
+              </div>
+            ) : (
+              <button
+                type="button"
+                onClick={handleRegenerate}
+                disabled={busy || !factorReady}
+                className="px-2 py-0.5 text-xs font-mono border border-term-cyan text-term-cyan hover:bg-term-cyan hover:text-term-black transition-colors disabled:opacity-50"
+              >
+                [ {busy ? 'generating...' : 'new codes'} ]
+              </button>
+            )}
+          </div>
+
+          {/* Sessions */}
+          <div>
+            <label className="block text-term-fg-dim text-xs mb-2">
+              Sessions
+            </label>
+            <div className="border border-term-border mb-2">
+              {sessions.map((session) => (
+                <div key={session.id} className="px-2 py-1 text-xs font-mono border-b border-term-border last:border-b-0">
+                  <div className="flex items-center justify-between">
+                    <span className="text-term-fg-bright">
+                      {session.method} <span className="text-term-fg-muted">from {session.ip_address}</span>
+                      {session.current && <span className="text-term-green"> (this session)</span>}
+                    </span>
+                    {!session.current && (
+                      <button
+                        onClick={() => handleRevokeSession(session)}
+                        disabled={busy}
+                        className="text-term-fg-dim hover:text-term-red"
+                        title="Sign out"
+                      >
+                        [del]
+                      </button>
+                    )}
+                  </div>
+                  <div className="text-term-fg-dim truncate" title={session.user_agent}>{session.user_agent || 'unknown client'}</div>
+                  <div className="text-term-fg-muted">
+                    signed in {new Date(session.created_at).toLocaleString()}
+                    {' · '}
+                    active {new Date(session.last_seen_at).toLocaleString()}
+                  </div>
+                </div>
+              ))}
+            </div>
+            {sessions.some((session) => !session.current) && (
+              <button
+                type="button"
+                onClick={handleRevokeOtherSessions}
+                disabled={busy}
+                className="px-2 py-0.5 text-xs font-mono border border-term-border text-term-fg-dim hover:text-term-red hover:border-term-red transition-colors disabled:opacity-50"
+              >
+                [ sign out other sessions ]
+              </button>
+            )}
+          </div>
+
+          {/* API Tokens */}
+          <div>
+            <label className="block text-term-fg-dim text-xs mb-2">
+              API Tokens
+            </label>
+            <p className="text-term-fg-muted text-xs mb-3">
+              For scripts: send as <code className="text-term-fg-bright">Authorization: Bearer &lt;token&gt;</code>. A token can only do what its scopes allow, and unlocks your stored credentials by itself.
+            </p>
+            {tokens.length > 0 && (
+              <div className="border border-term-border mb-3">
+                {tokens.map((token) => (
+                  <div key={token.id} className="px-2 py-1 text-xs font-mono border-b border-term-border last:border-b-0">
+                    <div className="flex items-center justify-between">
+                      <span className="text-term-fg-bright">{token.name} <span className="text-term-fg-muted">{token.prefix}...</span></span>
+                      <button
+                        onClick={() => handleDeleteToken(token)}
+                        disabled={busy}
+                        className="text-term-fg-dim hover:text-term-red"
+                        title="Revoke"
+                      >
+                        [del]
+                      </button>
+                    </div>
+                    <div className="text-term-fg-dim">{token.scopes.join(' ')}</div>
+                    <div className="text-term-fg-muted">
+                      {token.last_used_at ? `used ${new Date(token.last_used_at).toLocaleString()} from ${token.last_used_ip}` : 'never used'}
+                      {' · '}
+                      {token.expires_at
+                        ? (new Date(token.expires_at) < new Date() ? 'expired' : `expires ${new Date(token.expires_at).toLocaleDateString()}`)
+                        : 'no expiry'}
+                    </div>
+                  </div>
+                ))}
+              </div>
+            )}
+            {newToken ? (
+              <div className="space-y-2 mb-3">
+                <p className="text-term-fg-dim text-xs">
+                  copy the token now, it will not be shown again:
+                </p>
+                <div className="bg-term-surface-alt border border-term-border px-3 py-2 select-all break-all">
+                  <code className="text-term-green text-xs font-mono">{newToken}</code>
+                </div>
+                <button
+                  type="button"
+                  onClick={() => setNewToken('')}
+                  className="px-2 py-0.5 text-xs font-mono border border-term-border text-term-fg-dim hover:text-term-fg-bright"
+                >
+                  [ done ]
+                </button>
+              </div>
+            ) : (
+              <div className="space-y-2">
+                <input
+                  type="text"
+                  value={tokenName}
+                  onChange={(e) => setTokenName(e.target.value)}
+                  className="w-full bg-term-black border border-term-border text-term-fg-bright text-xs py-1 px-2 focus:outline-none focus:border-term-cyan"
+                  placeholder="name, e.g. backup script"
+                  maxLength={64}
+                />
+                <div className="flex flex-wrap gap-1">
+                  {scopes.filter((scope) => scope !== 'audit:read' || user.role === 'admin').map((scope) => (
+                    <button
+                      key={scope}
+                      type="button"
+                      onClick={() => toggleScope(scope)}
+                      className={`px-2 py-0.5 text-xs font-mono border transition-colors ${
+                        tokenScopes.includes(scope)
+                          ? 'border-term-cyan text-term-cyan bg-term-cyan/10'
+                          : 'border-term-border text-term-fg-dim hover:text-term-fg-bright hover:border-term-fg-dim'
+                      }`}
+                    >
+                      {scope}
+                    </button>
+                  ))}
+                </div>
+                <div className="flex items-center gap-2">
+                  <span className="text-term-fg-dim text-xs">expires:</span>
+                  <select
+                    value={tokenExpiry}
+                    onChange={(e) => setTokenExpiry(Number(e.target.value))}
+                    className="bg-term-black border border-term-border text-term-fg-bright text-xs py-1 px-2 focus:outline-none focus:border-term-cyan"
+                  >
+                    {tokenExpiries.map((expiry) => (
+                      <option key={expiry.days} value={expiry.days}>{expiry.label}</option>
+                    ))}
+                  </select>
+                  <button
+                    type="button"
+                    onClick={handleCreateToken}
+                    disabled={busy || (hasFactor && !factorReady) || !tokenName.trim() || tokenScopes.length === 0}
+                    className="px-2 py-0.5 text-xs font-mono border border-term-cyan text-term-cyan hover:bg-term-cyan hover:text-term-black transition-colors disabled:opacity-50"
+                  >
+                    [ create token ]
+                  </button>
+                </div>
+              </div>
+            )}
+          </div>
+        </div>
+      </div>
+    </div>
+  );
+}
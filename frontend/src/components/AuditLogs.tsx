@@ -24,6 +24,31 @@ const actionLabels: Record<AuditAction, string> = {
   user_update: 'User Update',
   user_delete: 'User Delete',
   totp_setup: 'TOTP Setup',
+  host_key_mismatch: 'Host Key Mismatch',
+  key_deploy: 'Key Deploy',
+  key_rotate: 'Key Rotate',
+  password_rotate: 'Password Rotate',
+  credential_create: 'Credential Create',
+  credential_update: 'Credential Update',
+  credential_delete: 'Credential Delete',
+  server_secret_rotate: 'Server Secret Rotate',
+  recovery_code_use: 'Recovery Code Use',
+  recovery_codes_regenerate: 'Recovery Codes Regenerate',
+  totp_reset: 'TOTP Reset',
+  webauthn_register: 'Security Key Register',
+  webauthn_delete: 'Security Key Delete',
+  user_disable: 'User Disable',
+  user_enable: 'User Enable',
+  saml_metadata_import: 'SAML IdP Import',
+  api_token_create: 'API Token Create',
+  api_token_revoke: 'API Token Revoke',
+  session_revoke: 'Session Revoke',
+  jwt_key_rotate: 'JWT Key Rotate',
+  login_failed: 'Login Failed',
+  totp_failed: '2FA Failed',
+  user_lock: 'User Lock',
+  user_unlock: 'User Unlock',
+  password_change: 'Password Change',
 };
 
 const actionColors: Record<string, string> = {
@@ -44,6 +69,31 @@ const actionColors: Record<string, string> = {
   user_update: 'text-term-fg-dim',
   user_delete: 'text-term-red',
   totp_setup: 'text-term-green',
+  host_key_mismatch: 'text-term-red',
+  key_deploy: 'text-term-green',
+  key_rotate: 'text-term-cyan',
+  password_rotate: 'text-term-cyan',
+  credential_create: 'text-term-green',
+  credential_update: 'text-term-yellow',
+  credential_delete: 'text-term-red',
+  server_secret_rotate: 'text-term-cyan',
+  recovery_code_use: 'text-term-yellow',
+  recovery_codes_regenerate: 'text-term-green',
+  totp_reset: 'text-term-yellow',
+  webauthn_register: 'text-term-green',
+  webauthn_delete: 'text-term-red',
+  user_disable: 'text-term-red',
+  user_enable: 'text-term-green',
+  saml_metadata_import: 'text-term-yellow',
+  api_token_create: 'text-term-yellow',
+  api_token_revoke: 'text-term-red',
+  session_revoke: 'text-term-red',
+  jwt_key_rotate: 'text-term-cyan',
+  login_failed: 'text-term-red',
+  totp_failed: 'text-term-red',
+  user_lock: 'text-term-red',
+  user_unlock: 'text-term-green',
+  password_change: 'text-term-yellow',
 };
 
 export default function AuditLogs({ onClose }: Props) {
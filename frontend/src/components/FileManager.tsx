@@ -1,6 +1,6 @@
 import { useState, useEffect, useCallback, useRef } from 'react';
-import { listDirectory, downloadFile, uploadFile, deleteFile, makeDirectory } from '../services/api';
-import type { Machine, FileInfo } from '../types';
+import { listDirectory, downloadFile, uploadFile, deleteFile, makeDirectory, updateHostKey } from '../services/api';
+import type { Machine, FileInfo, HostKeyErrorResponse } from '../types';
 
 interface FileManagerProps {
   machine: Machine;
@@ -24,6 +24,7 @@ export default function FileManager({ machine, onClose }: FileManagerProps) {
   const [files, setFiles] = useState<FileInfo[]>([]);
   const [loading, setLoading] = useState(true);
   const [error, setError] = useState('');
+  const [untrustedKey, setUntrustedKey] = useState<HostKeyErrorResponse | null>(null);
   const [selectedFiles, setSelectedFiles] = useState<Set<string>>(new Set());
   const [showNewFolderDialog, setShowNewFolderDialog] = useState(false);
   const [newFolderName, setNewFolderName] = useState('');
@@ -56,13 +57,27 @@ export default function FileManager({ machine, onClose }: FileManagerProps) {
       setFiles(result.files);
       setCurrentPath(result.path || result.cwd);
     } catch (err: unknown) {
-      const error = err as { response?: { data?: { error?: string } } };
+      const error = err as { response?: { status?: number; data?: { error?: string } } };
+      if (error.response?.status === 409) {
+        setUntrustedKey(error.response.data as HostKeyErrorResponse);
+      }
       setError(error.response?.data?.error || 'Failed to load directory');
     } finally {
       setLoading(false);
     }
   }, [machine.id]);
 
+  const handleTrustHostKey = async () => {
+    if (!untrustedKey) return;
+    try {
+      await updateHostKey(machine.id, untrustedKey.fingerprint);
+      setUntrustedKey(null);
+      fetchDirectory(currentPath);
+    } catch {
+      setError('Failed to trust host key');
+    }
+  };
+
   useEffect(() => {
     fetchDirectory('');
   }, [fetchDirectory]);
@@ -235,6 +250,34 @@ export default function FileManager({ machine, onClose }: FileManagerProps) {
             <div className="flex items-center justify-center h-full text-term-fg-dim text-xs font-mono">
               loading...
             </div>
+          ) : untrustedKey ? (
+            <div className="flex flex-col items-center justify-center h-full gap-3 text-xs font-mono px-4 text-center">
+              <span className={untrustedKey.host_key_status === 'mismatch' ? 'text-term-red' : 'text-term-yellow'}>
+                {untrustedKey.host_key_status === 'mismatch'
+                  ? '[WARN] host key has changed since it was last trusted'
+                  : '[WARN] host key is not trusted yet'}
+              </span>
+              <span className="text-term-fg-dim break-all">
+                fingerprint: <span className="text-term-cyan">{untrustedKey.fingerprint}</span>
+              </span>
+              {untrustedKey.stored_key && (
+                <span className="text-term-fg-dim break-all">stored: {untrustedKey.stored_key}</span>
+              )}
+              <div className="flex gap-3">
+                <button
+                  onClick={onClose}
+                  className="text-term-fg-dim hover:text-term-fg transition-colors"
+                >
+                  [ cancel ]
+                </button>
+                <button
+                  onClick={handleTrustHostKey}
+                  className="border border-term-cyan text-term-cyan hover:bg-term-cyan hover:text-term-black transition-colors px-2 py-0.5"
+                >
+                  [ trust key ]
+                </button>
+              </div>
+            </div>
           ) : error ? (
             <div className="flex items-center justify-center h-full text-term-red text-xs font-mono">
               [ERR] {error}
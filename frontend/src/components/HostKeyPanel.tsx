@@ -0,0 +1,130 @@
+import { useState, useEffect, useCallback } from 'react';
+import { scanHostKey, getHostKeyHistory, updateHostKey } from '../services/api';
+import type { HostKeyRecord } from '../types';
+
+interface HostKeyPanelProps {
+  machineId: number;
+  hostKey?: string;
+}
+
+const statusColors: Record<HostKeyRecord['status'], string> = {
+  new: 'text-term-yellow',
+  match: 'text-term-green',
+  mismatch: 'text-term-red',
+};
+
+// Shows a machine's trusted host key and every key seen on it, and scans for
+// the current one on demand
+export default function HostKeyPanel({ machineId, hostKey }: HostKeyPanelProps) {
+  const [trusted, setTrusted] = useState(hostKey || '');
+  const [history, setHistory] = useState<HostKeyRecord[]>([]);
+  const [scanned, setScanned] = useState<HostKeyRecord | null>(null);
+  const [scanning, setScanning] = useState(false);
+  const [error, setError] = useState('');
+
+  const fetchHistory = useCallback(async () => {
+    try {
+      setHistory(await getHostKeyHistory(machineId));
+    } catch {
+      setError('Failed to load host key history');
+    }
+  }, [machineId]);
+
+  useEffect(() => {
+    fetchHistory();
+  }, [fetchHistory]);
+
+  const handleScan = async () => {
+    setError('');
+    setScanned(null);
+    setScanning(true);
+    try {
+      const result = await scanHostKey(machineId);
+      setTrusted(result.host_key);
+      setScanned(result.scanned);
+      fetchHistory();
+    } catch (err: unknown) {
+      const error = err as { response?: { data?: { error?: string } } };
+      setError(error.response?.data?.error || 'Host key scan failed');
+    } finally {
+      setScanning(false);
+    }
+  };
+
+  const handleTrust = async (fingerprint: string) => {
+    setError('');
+    try {
+      await updateHostKey(machineId, fingerprint);
+      setTrusted(fingerprint);
+      setScanned(null);
+    } catch (err: unknown) {
+      const error = err as { response?: { data?: { error?: string } } };
+      setError(error.response?.data?.error || 'Failed to trust host key');
+    }
+  };
+
+  return (
+    <div>
+      <div className="flex items-center justify-between mb-1">
+        <label className="text-term-fg-dim text-xs block font-mono">Host Key</label>
+        <button
+          type="button"
+          onClick={handleScan}
+          className="text-xs text-term-fg-dim hover:text-term-cyan transition-colors font-mono disabled:opacity-50"
+          disabled={scanning}
+        >
+          {scanning ? '[ scanning... ]' : '[ scan ]'}
+        </button>
+      </div>
+      <div className="border border-term-border bg-term-black px-3 py-2 space-y-1">
+        <div className="text-xs font-mono text-term-fg-dim break-all">
+          trusted: <span className="text-term-cyan">{trusted || '-- none yet --'}</span>
+        </div>
+        {scanned && (
+          <div className="text-xs font-mono break-all">
+            <span className={statusColors[scanned.status]}>[{scanned.status}]</span>{' '}
+            <span className="text-term-fg">{scanned.fingerprint}</span>
+            {scanned.status !== 'match' && (
+              <button
+                type="button"
+                onClick={() => handleTrust(scanned.fingerprint)}
+                className="ml-2 text-term-yellow hover:text-term-fg-bright transition-colors"
+              >
+                [trust]
+              </button>
+            )}
+          </div>
+        )}
+        {error && <div className="text-term-red text-xs font-mono">! {error}</div>}
+        {history.length > 0 && (
+          <table className="w-full text-xs font-mono mt-1">
+            <thead>
+              <tr className="text-left text-term-fg-dim">
+                <th className="py-0.5 pr-2">Key</th>
+                <th className="py-0.5 pr-2">First seen</th>
+                <th className="py-0.5">Last seen</th>
+              </tr>
+            </thead>
+            <tbody>
+              {history.map((record) => (
+                <tr key={record.id} className="border-t border-term-border">
+                  <td className="py-0.5 pr-2 max-w-[14rem] truncate" title={record.fingerprint}>
+                    <span className={record.fingerprint === trusted ? 'text-term-cyan' : 'text-term-fg'}>
+                      {record.key_type} {record.fingerprint}
+                    </span>
+                  </td>
+                  <td className="py-0.5 pr-2 text-term-fg-dim whitespace-nowrap">
+                    {new Date(record.first_seen_at).toLocaleString()}
+                  </td>
+                  <td className="py-0.5 text-term-fg-dim whitespace-nowrap">
+                    {new Date(record.last_seen_at).toLocaleString()}
+                  </td>
+                </tr>
+              ))}
+            </tbody>
+          </table>
+        )}
+      </div>
+    </div>
+  );
+}
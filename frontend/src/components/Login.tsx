@@ -1,7 +1,24 @@
 import { useState, useRef, FormEvent, useEffect } from 'react';
 import { useNavigate } from 'react-router-dom';
-import { setup, login, verifyTOTP, checkSetupStatus } from '../services/api';
+import {
+  setup,
+  login,
+  verifyTOTP,
+  verifyRecoveryCode,
+  checkSetupStatus,
+  beginWebAuthnLogin,
+  finishWebAuthnLogin,
+  beginWebAuthnEnrollment,
+  finishWebAuthnEnrollment,
+  exchangeSSOTicket,
+  verifySSOPassword,
+  OIDC_LOGIN_URL,
+  SAML_LOGIN_URL,
+  proxyLogin,
+  setAccessToken,
+} from '../services/api';
 import { deriveEncryptionKey } from '../utils/crypto';
+import { createCredential, getAssertion, isWebAuthnSupported } from '../utils/webauthn';
 import { QRCodeSVG } from 'qrcode.react';
 import type { LoginResponse } from '../types';
 
@@ -9,7 +26,7 @@ interface LoginProps {
   onLogin: () => void;
 }
 
-type Step = 'credentials' | 'totp_setup' | 'totp_verify';
+type Step = 'credentials' | 'sso_password' | 'totp_setup' | 'totp_verify' | 'recovery_codes';
 
 const FARSEER_LOGO = `
  ███████╗ █████╗ ██████╗ ███████╗███████╗███████╗██████╗
@@ -34,13 +51,27 @@ export default function Login({ onLogin }: LoginProps) {
   const [error, setError] = useState('');
   const [submitting, setSubmitting] = useState(false);
   const [showSecret, setShowSecret] = useState(false);
+  const [useRecoveryCode, setUseRecoveryCode] = useState(false);
+  const [recoveryCode, setRecoveryCode] = useState('');
+  const [recoveryCodes, setRecoveryCodes] = useState<string[]>([]);
+  const [hasTotp, setHasTotp] = useState(false);
+  const [hasWebAuthn, setHasWebAuthn] = useState(false);
+  const [useSecurityKey, setUseSecurityKey] = useState(false);
+  const [oidcEnabled, setOidcEnabled] = useState(false);
+  const [samlEnabled, setSamlEnabled] = useState(false);
+  const [proxyUser, setProxyUser] = useState('');
+  const [passwordSetup, setPasswordSetup] = useState(false);
   const totpInputRef = useRef<HTMLInputElement>(null);
+  const ticketRedeemed = useRef(false);
   const navigate = useNavigate();
 
   useEffect(() => {
     checkSetupStatus()
       .then((status) => {
         setIsSetup(status.setup_complete);
+        setOidcEnabled(status.oidc_enabled);
+        setSamlEnabled(status.saml_enabled);
+        setProxyUser(status.proxy_user || '');
         setIsLoading(false);
       })
       .catch(() => {
@@ -48,6 +79,32 @@ export default function Login({ onLogin }: LoginProps) {
       });
   }, []);
 
+  // Back from single sign-on: the callback leaves a one-time ticket or an
+  // error in the URL fragment
+  useEffect(() => {
+    const params = new URLSearchParams(window.location.hash.slice(1));
+    const ticket = params.get('sso');
+    const ssoError = params.get('sso_error');
+    if (!ticket && !ssoError) return;
+    window.history.replaceState(null, '', window.location.pathname);
+    if (ssoError) {
+      setError(ssoError);
+      return;
+    }
+    if (!ticket || ticketRedeemed.current) return;
+    ticketRedeemed.current = true;
+
+    setSubmitting(true);
+    exchangeSSOTicket(ticket)
+      .then((response) => handleLoginResponse(response, ''))
+      .catch((err: unknown) => {
+        const error = err as { response?: { data?: { error?: string } } };
+        setError(error.response?.data?.error || 'Single sign-on failed');
+      })
+      .finally(() => setSubmitting(false));
+    // eslint-disable-next-line react-hooks/exhaustive-deps
+  }, []);
+
   // Auto-focus TOTP input when step changes
   useEffect(() => {
     if (step === 'totp_setup' || step === 'totp_verify') {
@@ -58,9 +115,16 @@ export default function Login({ onLogin }: LoginProps) {
   const handleLoginResponse = (response: LoginResponse, derivedKey: string) => {
     if (response.token && response.user) {
       // Full auth — login complete
-      localStorage.setItem('token', response.token);
-      localStorage.setItem('encryptionKey', derivedKey);
+      setAccessToken(response.token);
+      // Single sign-on users get their key from the server
+      localStorage.setItem('encryptionKey', response.encryption_key || derivedKey);
       localStorage.setItem('userId', response.user.id.toString());
+      if (response.recovery_codes?.length) {
+        // Fresh enrollment: show the recovery codes once before continuing
+        setRecoveryCodes(response.recovery_codes);
+        setStep('recovery_codes');
+        return;
+      }
       onLogin();
       navigate('/');
       return;
@@ -70,11 +134,22 @@ export default function Login({ onLogin }: LoginProps) {
     setEncryptionKey(derivedKey);
     setTempToken(response.temp_token || '');
 
-    if (response.requires_totp_setup) {
+    if (response.requires_password) {
+      setPasswordSetup(!!response.password_setup);
+      setPassword('');
+      setConfirmPassword('');
+      setStep('sso_password');
+    } else if (response.requires_totp_setup) {
       setTotpSecret(response.totp_secret || '');
       setTotpQrUrl(response.totp_qr_url || '');
       setStep('totp_setup');
-    } else if (response.requires_totp) {
+    } else if (response.requires_totp || response.requires_webauthn) {
+      const keys = !!response.requires_webauthn && isWebAuthnSupported();
+      setHasTotp(!!response.requires_totp);
+      setHasWebAuthn(keys);
+      setUseSecurityKey(keys && (response.preferred_factor === 'webauthn' || !response.requires_totp));
+      // Without TOTP or a usable key, a recovery code is the only way in
+      setUseRecoveryCode(!response.requires_totp && !keys);
       setStep('totp_verify');
     }
   };
@@ -110,29 +185,88 @@ export default function Login({ onLogin }: LoginProps) {
     }
   };
 
+  const handleProxyLogin = async () => {
+    setError('');
+    setSubmitting(true);
+    try {
+      handleLoginResponse(await proxyLogin(), '');
+    } catch (err: unknown) {
+      const error = err as { response?: { data?: { error?: string } } };
+      setError(error.response?.data?.error || 'Proxy sign-in failed');
+    } finally {
+      setSubmitting(false);
+    }
+  };
+
+  const handleSSOPasswordSubmit = async (e: FormEvent) => {
+    e.preventDefault();
+    setError('');
+
+    if (passwordSetup) {
+      if (password !== confirmPassword) {
+        setError('Passwords do not match');
+        return;
+      }
+      if (password.length < 8) {
+        setError('Password must be at least 8 characters');
+        return;
+      }
+    }
+
+    setSubmitting(true);
+    try {
+      handleLoginResponse(await verifySSOPassword(tempToken, password), '');
+    } catch (err: unknown) {
+      const error = err as { response?: { data?: { error?: string } } };
+      setError(error.response?.data?.error || 'Authentication failed');
+    } finally {
+      setSubmitting(false);
+    }
+  };
+
   const handleTotpSubmit = async (e: FormEvent) => {
     e.preventDefault();
     setError('');
 
-    if (totpCode.length !== 6) {
-      setError('Enter a 6-digit code');
+    if (useRecoveryCode ? !recoveryCode.trim() : totpCode.length !== 6) {
+      setError(useRecoveryCode ? 'Enter a recovery code' : 'Enter a 6-digit code');
       return;
     }
 
     setSubmitting(true);
     try {
-      const response = await verifyTOTP(tempToken, totpCode);
+      const response = useRecoveryCode
+        ? await verifyRecoveryCode(tempToken, recoveryCode.trim())
+        : await verifyTOTP(tempToken, totpCode);
       handleLoginResponse(response, encryptionKey);
     } catch (err: unknown) {
       const error = err as { response?: { data?: { error?: string } } };
       setError(error.response?.data?.error || 'Verification failed');
       setTotpCode('');
+      setRecoveryCode('');
       totpInputRef.current?.focus();
     } finally {
       setSubmitting(false);
     }
   };
 
+  // Signs in with a registered security key, or enrolls one during first login
+  const handleSecurityKey = async (enroll: boolean) => {
+    setError('');
+    setSubmitting(true);
+    try {
+      const response = enroll
+        ? await finishWebAuthnEnrollment(tempToken, await createCredential(await beginWebAuthnEnrollment(tempToken, '')))
+        : await finishWebAuthnLogin(tempToken, await getAssertion(await beginWebAuthnLogin(tempToken)));
+      handleLoginResponse(response, encryptionKey);
+    } catch (err: unknown) {
+      const error = err as { response?: { data?: { error?: string } }; message?: string };
+      setError(error.response?.data?.error || error.message || 'Security key verification failed');
+    } finally {
+      setSubmitting(false);
+    }
+  };
+
   const handleTotpCodeChange = (value: string) => {
     // Only allow digits, max 6
     const digits = value.replace(/\D/g, '').slice(0, 6);
@@ -149,7 +283,9 @@ export default function Login({ onLogin }: LoginProps) {
 
   const getStepTitle = () => {
     if (step === 'credentials') return isSetup ? 'login' : 'setup';
+    if (step === 'sso_password') return 'local password';
     if (step === 'totp_setup') return '2fa enrollment';
+    if (step === 'recovery_codes') return 'recovery codes';
     return '2fa verify';
   };
 
@@ -247,6 +383,93 @@ export default function Login({ onLogin }: LoginProps) {
                 <p className="text-term-fg-muted text-xs text-center">
                   {isSetup ? 'enter credentials to continue' : 'first run -- create admin account'}
                 </p>
+
+                {isSetup && oidcEnabled && (
+                  <div className="text-center">
+                    <a
+                      href={OIDC_LOGIN_URL}
+                      className="text-term-fg-muted text-xs hover:text-term-cyan transition-colors"
+                    >
+                      [ sign in with single sign-on ]
+                    </a>
+                  </div>
+                )}
+                {isSetup && proxyUser && (
+                  <div className="text-center">
+                    <button
+                      type="button"
+                      onClick={handleProxyLogin}
+                      disabled={submitting}
+                      className="text-term-fg-muted text-xs hover:text-term-cyan transition-colors disabled:opacity-50"
+                    >
+                      [ continue as {proxyUser} ]
+                    </button>
+                  </div>
+                )}
+                {isSetup && samlEnabled && (
+                  <div className="text-center">
+                    <a
+                      href={SAML_LOGIN_URL}
+                      className="text-term-fg-muted text-xs hover:text-term-cyan transition-colors"
+                    >
+                      [ sign in with SAML ]
+                    </a>
+                  </div>
+                )}
+              </form>
+            )}
+
+            {/* Step 1b: Local password after single sign-on */}
+            {step === 'sso_password' && (
+              <form onSubmit={handleSSOPasswordSubmit} className="space-y-4">
+                <div className="text-center mb-4">
+                  <p className="text-term-fg-dim text-xs">
+                    {passwordSetup ? 'choose a local password for this server' : 'enter your local password'}
+                  </p>
+                </div>
+
+                <div className="flex items-center gap-2">
+                  <span className="text-term-cyan text-sm flex-shrink-0">&gt;</span>
+                  <span className="text-term-fg-dim text-sm flex-shrink-0">password:</span>
+                  <input
+                    type="password"
+                    required
+                    value={password}
+                    onChange={(e) => setPassword(e.target.value)}
+                    className="flex-1 bg-transparent border-b border-term-border text-term-fg-bright text-sm py-1 px-0 focus:outline-none focus:border-term-cyan placeholder:text-term-fg-muted"
+                    placeholder="_"
+                    autoFocus
+                  />
+                </div>
+
+                {passwordSetup && (
+                  <div className="flex items-center gap-2">
+                    <span className="text-term-cyan text-sm flex-shrink-0">&gt;</span>
+                    <span className="text-term-fg-dim text-sm flex-shrink-0">confirm&nbsp;:</span>
+                    <input
+                      type="password"
+                      required
+                      value={confirmPassword}
+                      onChange={(e) => setConfirmPassword(e.target.value)}
+                      className="flex-1 bg-transparent border-b border-term-border text-term-fg-bright text-sm py-1 px-0 focus:outline-none focus:border-term-cyan placeholder:text-term-fg-muted"
+                      placeholder="_"
+                    />
+                  </div>
+                )}
+
+                <div className="pt-4">
+                  <button
+                    type="submit"
+                    disabled={submitting}
+                    className="w-full py-2 text-sm border border-term-cyan text-term-cyan hover:bg-term-cyan hover:text-term-black transition-colors duration-150 tracking-wider uppercase disabled:opacity-50"
+                  >
+                    [ {submitting ? 'Verifying...' : 'Continue'} ]
+                  </button>
+                </div>
+
+                <p className="text-term-fg-muted text-xs text-center">
+                  this server also requires its own password and 2fa
+                </p>
               </form>
             )}
 
@@ -319,11 +542,62 @@ export default function Login({ onLogin }: LoginProps) {
                     enter the 6-digit code from your authenticator
                   </p>
                 </form>
+
+                {isWebAuthnSupported() && (
+                  <div className="text-center">
+                    <button
+                      type="button"
+                      onClick={() => handleSecurityKey(true)}
+                      disabled={submitting}
+                      className="text-term-fg-muted text-xs hover:text-term-fg-dim transition-colors disabled:opacity-50"
+                    >
+                      [ use a security key instead ]
+                    </button>
+                  </div>
+                )}
               </div>
             )}
 
             {/* Step 2b: TOTP Verification (returning user) */}
-            {step === 'totp_verify' && (
+            {step === 'totp_verify' && useSecurityKey && (
+              <div className="space-y-4">
+                <div className="text-center mb-4">
+                  <p className="text-term-fg-dim text-xs">
+                    confirm with your security key
+                  </p>
+                </div>
+
+                <div className="pt-4">
+                  <button
+                    type="button"
+                    onClick={() => handleSecurityKey(false)}
+                    disabled={submitting}
+                    className="w-full py-2 text-sm border border-term-cyan text-term-cyan hover:bg-term-cyan hover:text-term-black transition-colors duration-150 tracking-wider uppercase disabled:opacity-50"
+                  >
+                    [ {submitting ? 'Waiting for key...' : 'Use Security Key'} ]
+                  </button>
+                </div>
+
+                <p className="text-term-fg-muted text-xs text-center">
+                  insert or touch your key when the browser asks
+                </p>
+                <div className="text-center">
+                  <button
+                    type="button"
+                    onClick={() => {
+                      setUseSecurityKey(false);
+                      setUseRecoveryCode(!hasTotp);
+                      setError('');
+                    }}
+                    className="text-term-fg-muted text-xs hover:text-term-fg-dim transition-colors"
+                  >
+                    [ {hasTotp ? 'use authenticator code' : 'lost your key? use a recovery code'} ]
+                  </button>
+                </div>
+              </div>
+            )}
+
+            {step === 'totp_verify' && !useSecurityKey && (
               <form onSubmit={handleTotpSubmit} className="space-y-4">
                 <div className="text-center mb-4">
                   <p className="text-term-fg-dim text-xs">
@@ -331,26 +605,43 @@ export default function Login({ onLogin }: LoginProps) {
                   </p>
                 </div>
 
-                <div className="flex items-center gap-2 justify-center">
-                  <span className="text-term-cyan text-sm flex-shrink-0">&gt;</span>
-                  <span className="text-term-fg-dim text-sm flex-shrink-0">2fa code:</span>
-                  <input
-                    ref={totpInputRef}
-                    type="text"
-                    inputMode="numeric"
-                    autoComplete="one-time-code"
-                    value={totpCode}
-                    onChange={(e) => handleTotpCodeChange(e.target.value)}
-                    className="w-32 bg-transparent border-b border-term-border text-term-fg-bright text-sm py-1 px-0 focus:outline-none focus:border-term-cyan text-center tracking-[0.5em] font-mono"
-                    placeholder="______"
-                    maxLength={6}
-                  />
-                </div>
+                {useRecoveryCode ? (
+                  <div className="flex items-center gap-2 justify-center">
+                    <span className="text-term-cyan text-sm flex-shrink-0">&gt;</span>
+                    <span className="text-term-fg-dim text-sm flex-shrink-0">recovery code:</span>
+                    <input
+                      ref={totpInputRef}
+                      type="text"
+                      autoComplete="off"
+                      value={recoveryCode}
+                      onChange={(e) => setRecoveryCode(e.target.value)}
+                      className="w-40 bg-transparent border-b border-term-border text-term-fg-bright text-sm py-1 px-0 focus:outline-none focus:border-term-cyan text-center tracking-widest font-mono"
+                      placeholder="xxxxx-xxxxx"
+                      maxLength={16}
+                    />
+                  </div>
+                ) : (
+                  <div className="flex items-center gap-2 justify-center">
+                    <span className="text-term-cyan text-sm flex-shrink-0">&gt;</span>
+                    <span className="text-term-fg-dim text-sm flex-shrink-0">2fa code:</span>
+                    <input
+                      ref={totpInputRef}
+                      type="text"
+                      inputMode="numeric"
+                      autoComplete="one-time-code"
+                      value={totpCode}
+                      onChange={(e) => handleTotpCodeChange(e.target.value)}
+                      className="w-32 bg-transparent border-b border-term-border text-term-fg-bright text-sm py-1 px-0 focus:outline-none focus:border-term-cyan text-center tracking-[0.5em] font-mono"
+                      placeholder="______"
+                      maxLength={6}
+                    />
+                  </div>
+                )}
 
                 <div className="pt-4">
                   <button
                     type="submit"
-                    disabled={submitting || totpCode.length !== 6}
+                    disabled={submitting || (useRecoveryCode ? !recoveryCode.trim() : totpCode.length !== 6)}
                     className="w-full py-2 text-sm border border-term-cyan text-term-cyan hover:bg-term-cyan hover:text-term-black transition-colors duration-150 tracking-wider uppercase disabled:opacity-50"
                   >
                     [ {submitting ? 'Verifying...' : 'Verify'} ]
@@ -358,10 +649,72 @@ export default function Login({ onLogin }: LoginProps) {
                 </div>
 
                 <p className="text-term-fg-muted text-xs text-center">
-                  open your authenticator app for the code
+                  {useRecoveryCode ? 'each recovery code works only once' : 'open your authenticator app for the code'}
                 </p>
+                <div className="text-center">
+                  {(hasTotp || !useRecoveryCode) && (
+                    <button
+                      type="button"
+                      onClick={() => {
+                        setUseRecoveryCode(!useRecoveryCode);
+                        setError('');
+                        setTimeout(() => totpInputRef.current?.focus(), 0);
+                      }}
+                      className="text-term-fg-muted text-xs hover:text-term-fg-dim transition-colors"
+                    >
+                      [ {useRecoveryCode ? 'use authenticator code' : 'lost your device? use a recovery code'} ]
+                    </button>
+                  )}
+                  {hasWebAuthn && (
+                    <button
+                      type="button"
+                      onClick={() => {
+                        setUseSecurityKey(true);
+                        setError('');
+                      }}
+                      className="block mx-auto mt-1 text-term-fg-muted text-xs hover:text-term-fg-dim transition-colors"
+                    >
+                      [ use security key ]
+                    </button>
+                  )}
+                </div>
               </form>
             )}
+
+            {/* Step 3: Recovery codes (shown once after enrollment) */}
+            {step === 'recovery_codes' && (
+              <div className="space-y-4">
+                <div className="text-center space-y-2">
+                  <p className="text-term-fg-dim text-xs">
+                    save these recovery codes somewhere safe
+                  </p>
+                  <p className="text-term-fg-muted text-xs">
+                    each one signs you in once if you lose your authenticator. they will not be shown again.
+                  </p>
+                </div>
+
+                <div className="bg-term-surface-alt border border-term-border px-4 py-3 grid grid-cols-2 gap-x-6 gap-y-1 select-all">
+                  {recoveryCodes.map((code) => (
+                    <code key={code} className="text-term-green text-sm font-mono tracking-widest text-center">
+                      {code}
+                    </code>
+                  ))}
+                </div>
+
+                <div className="pt-2">
+                  <button
+                    type="button"
+                    onClick={() => {
+                      onLogin();
+                      navigate('/');
+                    }}
+                    className="w-full py-2 text-sm border border-term-cyan text-term-cyan hover:bg-term-cyan hover:text-term-black transition-colors duration-150 tracking-wider uppercase"
+                  >
+                    [ I have saved them, continue ]
+                  </button>
+                </div>
+              </div>
+            )}
           </div>
         </div>
       </div>
@@ -2,6 +2,9 @@ import { useState, useEffect, useMemo } from 'react';
 import { listMachines, deleteMachine, listGroups, createGroup, deleteGroup } from '../services/api';
 import type { Machine, Group } from '../types';
 
+// Credentials older than this are flagged in the list
+const CREDENTIAL_MAX_AGE_DAYS = 90;
+
 interface MachineListProps {
   selectedMachine: Machine | null;
   onSelectMachine: (machine: Machine | null) => void;
@@ -147,6 +150,12 @@ export default function MachineList({
     return <span className="text-term-fg-muted">-</span>;
   };
 
+  // Days since the machine's credential was last set or rotated
+  const credentialAge = (machine: Machine): number | null => {
+    if (!machine.credential_rotated_at) return null;
+    return Math.floor((Date.now() - new Date(machine.credential_rotated_at).getTime()) / 86400000);
+  };
+
   const renderMachine = (machine: Machine, inGroup: boolean, isLast: boolean) => {
     const status = getMachineStatus(machine.id);
     const isSelected = selectedMachine?.id === machine.id;
@@ -173,6 +182,24 @@ export default function MachineList({
           {machine.name}
         </span>
 
+        {machine.credential_missing && (
+          <span
+            className="text-term-red flex-shrink-0"
+            title="Credential was cleared by a password reset; edit the machine to enter it again"
+          >
+            [no cred]
+          </span>
+        )}
+
+        {(credentialAge(machine) ?? 0) >= CREDENTIAL_MAX_AGE_DAYS && (
+          <span
+            className="text-term-yellow flex-shrink-0"
+            title={`Credential last rotated ${credentialAge(machine)} days ago`}
+          >
+            {credentialAge(machine)}d
+          </span>
+        )}
+
         <span className="text-term-fg-muted truncate ml-auto text-right max-w-20 hidden group-hover:hidden">
           {machine.hostname}
         </span>
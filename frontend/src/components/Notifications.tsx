@@ -0,0 +1,137 @@
+import { useState, useEffect, useCallback } from 'react';
+import type { Notification } from '../types';
+import { listNotifications, markNotificationRead, markAllNotificationsRead } from '../services/api';
+
+interface Props {
+  onClose: () => void;
+  onChange: () => void;
+}
+
+const typeColors: Record<string, string> = {
+  host_key_mismatch: 'text-term-red',
+  password_rotation_due: 'text-term-yellow',
+  credentials_reset: 'text-term-yellow',
+};
+
+export default function Notifications({ onClose, onChange }: Props) {
+  const [notifications, setNotifications] = useState<Notification[]>([]);
+  const [loading, setLoading] = useState(true);
+  const [error, setError] = useState('');
+
+  const fetchNotifications = useCallback(async () => {
+    try {
+      setNotifications(await listNotifications());
+    } catch {
+      setError('Failed to fetch notifications');
+    } finally {
+      setLoading(false);
+    }
+  }, []);
+
+  useEffect(() => {
+    fetchNotifications();
+  }, [fetchNotifications]);
+
+  useEffect(() => {
+    const handleKeyDown = (e: KeyboardEvent) => {
+      if (e.key === 'Escape') {
+        onClose();
+      }
+    };
+    window.addEventListener('keydown', handleKeyDown);
+    return () => window.removeEventListener('keydown', handleKeyDown);
+  }, [onClose]);
+
+  const handleRead = async (id: number) => {
+    try {
+      const read = await markNotificationRead(id);
+      setNotifications((prev) => prev.map((n) => (n.id === id ? read : n)));
+      onChange();
+    } catch {
+      setError('Failed to mark notification read');
+    }
+  };
+
+  const handleReadAll = async () => {
+    try {
+      await markAllNotificationsRead();
+      await fetchNotifications();
+      onChange();
+    } catch {
+      setError('Failed to mark notifications read');
+    }
+  };
+
+  const unread = notifications.filter((n) => !n.read_at).length;
+
+  return (
+    <div className="fixed inset-0 bg-black/70 flex items-center justify-center z-50 p-4">
+      <div className="border border-term-border bg-term-surface w-full max-w-2xl max-h-[80vh] flex flex-col">
+        <div className="flex items-center justify-between px-3 py-1.5 bg-term-surface-alt border-b border-term-border">
+          <span className="text-xs text-term-fg-dim font-mono">--[ notifications ]--</span>
+          <div className="flex items-center gap-3">
+            {unread > 0 && (
+              <button
+                onClick={handleReadAll}
+                className="text-xs text-term-fg-dim hover:text-term-fg-bright font-mono"
+              >
+                [read all]
+              </button>
+            )}
+            <button
+              onClick={onClose}
+              className="text-xs text-term-fg-dim hover:text-term-red font-mono"
+            >
+              [x]
+            </button>
+          </div>
+        </div>
+
+        <div className="flex-1 overflow-auto px-3 py-2">
+          {error && (
+            <div className="text-term-red text-xs font-mono border border-term-red/30 px-2 py-1.5 mb-3">
+              ! {error}
+            </div>
+          )}
+
+          {loading ? (
+            <div className="flex items-center justify-center py-12">
+              <span className="text-term-fg-dim text-xs font-mono animate-pulse">Loading notifications..._</span>
+            </div>
+          ) : notifications.length === 0 ? (
+            <div className="text-center text-term-fg-dim text-xs font-mono py-12">
+              -- no notifications --
+            </div>
+          ) : (
+            <div className="space-y-2">
+              {notifications.map((n) => (
+                <div
+                  key={n.id}
+                  className={`border border-term-border px-3 py-2 font-mono ${n.read_at ? 'opacity-60' : ''}`}
+                >
+                  <div className="flex items-center justify-between gap-2">
+                    <span className={`text-xs ${typeColors[n.type] || 'text-term-fg'}`}>
+                      {n.read_at ? '' : '* '}{n.title}
+                    </span>
+                    <span className="text-term-fg-dim text-xs whitespace-nowrap">
+                      {new Date(n.created_at).toLocaleString()}
+                    </span>
+                  </div>
+                  <p className="text-term-fg text-xs mt-1 break-words">{n.message}</p>
+                  {!n.read_at && (
+                    <button
+                      onClick={() => handleRead(n.id)}
+                      className="text-xs text-term-fg-dim hover:text-term-fg-bright mt-1"
+                    >
+                      [mark read]
+                    </button>
+                  )}
+                </div>
+              ))}
+            </div>
+          )}
+        </div>
+      </div>
+    </div>
+  );
+}
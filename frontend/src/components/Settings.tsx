@@ -1,6 +1,6 @@
 import { useState, useEffect } from 'react';
-import { getSettings, updateSettings } from '../services/api';
-import type { AppSettings } from '../types';
+import { getSettings, updateSettings, getServerSecretStatus, rotateServerSecret, getJWTKeyStatus, rotateJWTKey, getSAMLSettings, importSAMLMetadata } from '../services/api';
+import type { AppSettings, HostKeyPolicy, JWTKeyStatus, SAMLSettings, ServerSecretStatus } from '../types';
 
 interface SettingsProps {
   onClose: () => void;
@@ -17,19 +17,57 @@ const PRESET_DURATIONS = [
   { label: '30 days', value: 720 },
 ];
 
+const HOST_KEY_POLICIES: { label: string; value: HostKeyPolicy; description: string }[] = [
+  { label: 'strict', value: 'strict', description: 'Only connect to hosts whose key was trusted beforehand.' },
+  { label: 'confirm', value: 'tofu', description: 'Ask before trusting new or changed keys.' },
+  { label: 'accept-new', value: 'accept-new', description: 'Trust new keys automatically, reject changed keys.' },
+];
+
 export default function Settings({ onClose }: SettingsProps) {
   const [settings, setSettings] = useState<AppSettings | null>(null);
   const [sessionHours, setSessionHours] = useState(24);
+  const [hostKeyPolicy, setHostKeyPolicy] = useState<HostKeyPolicy>('tofu');
+  const [scanEnabled, setScanEnabled] = useState(true);
+  const [scanMinutes, setScanMinutes] = useState(360);
+  const [lockoutThreshold, setLockoutThreshold] = useState(10);
+  const [lockoutMinutes, setLockoutMinutes] = useState(15);
+  const [passwordMinLength, setPasswordMinLength] = useState(8);
+  const [passwordMinClasses, setPasswordMinClasses] = useState(0);
+  const [passwordMaxAge, setPasswordMaxAge] = useState(0);
   const [loading, setLoading] = useState(true);
   const [saving, setSaving] = useState(false);
   const [error, setError] = useState('');
   const [success, setSuccess] = useState('');
+  const [secretStatus, setSecretStatus] = useState<ServerSecretStatus | null>(null);
+  const [rotating, setRotating] = useState(false);
+  const [jwtStatus, setJwtStatus] = useState<JWTKeyStatus | null>(null);
+  const [rotatingJwt, setRotatingJwt] = useState(false);
+  const [samlSettings, setSamlSettings] = useState<SAMLSettings | null>(null);
+  const [samlSource, setSamlSource] = useState('');
+  const [importing, setImporting] = useState(false);
 
   useEffect(() => {
+    getServerSecretStatus()
+      .then(setSecretStatus)
+      .catch(() => {});
+    getJWTKeyStatus()
+      .then(setJwtStatus)
+      .catch(() => {});
+    getSAMLSettings()
+      .then(setSamlSettings)
+      .catch(() => {});
     getSettings()
       .then((data) => {
         setSettings(data);
         setSessionHours(data.session_duration_hours);
+        setHostKeyPolicy(data.host_key_policy);
+        setScanEnabled(data.host_key_scan_enabled);
+        setScanMinutes(data.host_key_scan_interval_minutes);
+        setLockoutThreshold(data.lockout_threshold);
+        setLockoutMinutes(data.lockout_minutes);
+        setPasswordMinLength(data.password_min_length);
+        setPasswordMinClasses(data.password_min_classes);
+        setPasswordMaxAge(data.password_max_age_days);
       })
       .catch(() => setError('Failed to load settings'))
       .finally(() => setLoading(false));
@@ -48,7 +86,17 @@ export default function Settings({ onClose }: SettingsProps) {
     setSuccess('');
     setSaving(true);
     try {
-      const updated = await updateSettings({ session_duration_hours: sessionHours });
+      const updated = await updateSettings({
+        session_duration_hours: sessionHours,
+        host_key_policy: hostKeyPolicy,
+        host_key_scan_enabled: scanEnabled,
+        host_key_scan_interval_minutes: scanMinutes,
+        lockout_threshold: lockoutThreshold,
+        lockout_minutes: lockoutMinutes,
+        password_min_length: passwordMinLength,
+        password_min_classes: passwordMinClasses,
+        password_max_age_days: passwordMaxAge,
+      });
       setSettings(updated);
       setSuccess('Settings saved');
       setTimeout(() => setSuccess(''), 2000);
@@ -60,7 +108,76 @@ export default function Settings({ onClose }: SettingsProps) {
     }
   };
 
-  const hasChanges = settings !== null && sessionHours !== settings.session_duration_hours;
+  const handleRotateSecret = async () => {
+    if (!confirm('Rotate the server secret? TOTP secrets are re-encrypted now; stored credentials move over as each user next uses them.')) {
+      return;
+    }
+    setError('');
+    setSuccess('');
+    setRotating(true);
+    try {
+      const result = await rotateServerSecret();
+      setSuccess(`Server secret rotated to v${result.version}` +
+        (result.totp_failed > 0 ? ` (${result.totp_failed} TOTP secrets failed)` : ''));
+      setSecretStatus(await getServerSecretStatus());
+    } catch (err: unknown) {
+      const error = err as { response?: { data?: { error?: string } } };
+      setError(error.response?.data?.error || 'Failed to rotate server secret');
+    } finally {
+      setRotating(false);
+    }
+  };
+
+  const handleRotateJWTKey = async () => {
+    if (!confirm('Rotate the JWT signing key? Tokens signed by the current key keep working until the overlap ends.')) {
+      return;
+    }
+    setError('');
+    setSuccess('');
+    setRotatingJwt(true);
+    try {
+      const status = await rotateJWTKey();
+      setJwtStatus(status);
+      setSuccess(`Now signing tokens with ${status.keys[0].alg} key ${status.keys[0].kid}`);
+    } catch (err: unknown) {
+      const error = err as { response?: { data?: { error?: string } } };
+      setError(error.response?.data?.error || 'Failed to rotate JWT signing key');
+    } finally {
+      setRotatingJwt(false);
+    }
+  };
+
+  const handleImportSAML = async () => {
+    const source = samlSource.trim();
+    setError('');
+    setSuccess('');
+    setImporting(true);
+    try {
+      const updated = await importSAMLMetadata(
+        source.startsWith('<') ? { metadata: source } : { url: source }
+      );
+      setSamlSettings(updated);
+      setSamlSource('');
+      setSuccess(`Trusting identity provider ${updated.idp_entity_id}`);
+    } catch (err: unknown) {
+      const error = err as { response?: { data?: { error?: string } } };
+      setError(error.response?.data?.error || 'Failed to import metadata');
+    } finally {
+      setImporting(false);
+    }
+  };
+
+  const hasChanges = settings !== null && (
+    sessionHours !== settings.session_duration_hours ||
+    hostKeyPolicy !== settings.host_key_policy ||
+    scanEnabled !== settings.host_key_scan_enabled ||
+    scanMinutes !== settings.host_key_scan_interval_minutes ||
+    lockoutThreshold !== settings.lockout_threshold ||
+    lockoutMinutes !== settings.lockout_minutes ||
+    passwordMinLength !== settings.password_min_length ||
+    passwordMinClasses !== settings.password_min_classes ||
+    passwordMaxAge !== settings.password_max_age_days
+  );
 
   return (
     <div className="fixed inset-0 bg-black/70 flex items-center justify-center p-4 z-50">
@@ -100,7 +217,7 @@ export default function Settings({ onClose }: SettingsProps) {
                   Session Duration
                 </label>
                 <p className="text-term-fg-muted text-xs mb-3">
-                  How long users stay logged in before re-authentication is required.
+                  How long users stay logged in before re-authentication is required, however active they are. Applies to new sign-ins.
                 </p>
 
                 {/* Preset buttons */}
@@ -137,6 +254,251 @@ export default function Settings({ onClose }: SettingsProps) {
                 </div>
               </div>
 
+              {/* Host Key Policy */}
+              <div>
+                <label className="block text-term-fg-dim text-xs mb-2">
+                  Host Key Policy
+                </label>
+                <p className="text-term-fg-muted text-xs mb-3">
+                  {HOST_KEY_POLICIES.find((p) => p.value === hostKeyPolicy)?.description}
+                </p>
+                <div className="flex flex-wrap gap-1">
+                  {HOST_KEY_POLICIES.map((policy) => (
+                    <button
+                      key={policy.value}
+                      type="button"
+                      onClick={() => setHostKeyPolicy(policy.value)}
+                      className={`px-2 py-0.5 text-xs font-mono border transition-colors ${
+                        hostKeyPolicy === policy.value
+                          ? 'border-term-cyan text-term-cyan bg-term-cyan/10'
+                          : 'border-term-border text-term-fg-dim hover:text-term-fg-bright hover:border-term-fg-dim'
+                      }`}
+                    >
+                      {policy.label}
+                    </button>
+                  ))}
+                </div>
+              </div>
+
+              {/* Host Key Scanning */}
+              <div>
+                <label className="block text-term-fg-dim text-xs mb-2">
+                  Host Key Scanning
+                </label>
+                <p className="text-term-fg-muted text-xs mb-3">
+                  Periodically fetch each machine's host key and alert when it changes.
+                </p>
+                <div className="flex items-center gap-2">
+                  <button
+                    type="button"
+                    onClick={() => setScanEnabled(!scanEnabled)}
+                    className={`px-2 py-0.5 text-xs font-mono border transition-colors ${
+                      scanEnabled
+                        ? 'border-term-cyan text-term-cyan bg-term-cyan/10'
+                        : 'border-term-border text-term-fg-dim hover:text-term-fg-bright hover:border-term-fg-dim'
+                    }`}
+                  >
+                    {scanEnabled ? '[x] enabled' : '[ ] enabled'}
+                  </button>
+                  <span className="text-term-fg-dim text-xs">every</span>
+                  <input
+                    type="number"
+                    min={5}
+                    max={10080}
+                    value={scanMinutes}
+                    disabled={!scanEnabled}
+                    onChange={(e) => setScanMinutes(Math.max(5, Math.min(10080, parseInt(e.target.value) || 5)))}
+                    className="w-20 bg-term-black border border-term-border text-term-fg-bright text-xs py-1 px-2 focus:outline-none focus:border-term-cyan text-center disabled:opacity-50"
+                  />
+                  <span className="text-term-fg-dim text-xs">minutes</span>
+                </div>
+              </div>
+
+              {/* Password Policy */}
+              <div>
+                <label className="block text-term-fg-dim text-xs mb-2">
+                  Password Policy
+                </label>
+                <p className="text-term-fg-muted text-xs mb-3">
+                  Applies to new passwords. Classes are lowercase, uppercase, digits and symbols.
+                  {settings && settings.breached_passwords > 0
+                    ? ` Checked against ${settings.breached_passwords.toLocaleString()} breached passwords.`
+                    : ' No breached password list is configured.'}
+                </p>
+                <div className="flex flex-wrap items-center gap-2">
+                  <span className="text-term-fg-dim text-xs">min length</span>
+                  <input
+                    type="number"
+                    min={8}
+                    max={128}
+                    value={passwordMinLength}
+                    onChange={(e) => setPasswordMinLength(Math.max(8, Math.min(128, parseInt(e.target.value) || 8)))}
+                    className="w-16 bg-term-black border border-term-border text-term-fg-bright text-xs py-1 px-2 focus:outline-none focus:border-term-cyan text-center"
+                  />
+                  <span className="text-term-fg-dim text-xs">classes</span>
+                  <input
+                    type="number"
+                    min={0}
+                    max={4}
+                    value={passwordMinClasses}
+                    onChange={(e) => setPasswordMinClasses(Math.max(0, Math.min(4, parseInt(e.target.value) || 0)))}
+                    className="w-12 bg-term-black border border-term-border text-term-fg-bright text-xs py-1 px-2 focus:outline-none focus:border-term-cyan text-center"
+                  />
+                  <span className="text-term-fg-dim text-xs">max age</span>
+                  <input
+                    type="number"
+                    min={0}
+                    max={3650}
+                    value={passwordMaxAge}
+                    onChange={(e) => setPasswordMaxAge(Math.max(0, Math.min(3650, parseInt(e.target.value) || 0)))}
+                    className="w-16 bg-term-black border border-term-border text-term-fg-bright text-xs py-1 px-2 focus:outline-none focus:border-term-cyan text-center"
+                  />
+                  <span className="text-term-fg-dim text-xs">days (0 = never)</span>
+                </div>
+              </div>
+
+              {/* Account Lockout */}
+              <div>
+                <label className="block text-term-fg-dim text-xs mb-2">
+                  Account Lockout
+                </label>
+                <p className="text-term-fg-muted text-xs mb-3">
+                  Failed passwords and second factors slow further attempts down, then lock the account.
+                  A successful sign-in or an admin unlock resets the count.
+                </p>
+                <div className="flex items-center gap-2">
+                  <span className="text-term-fg-dim text-xs">lock after</span>
+                  <input
+                    type="number"
+                    min={3}
+                    max={100}
+                    value={lockoutThreshold}
+                    onChange={(e) => setLockoutThreshold(Math.max(3, Math.min(100, parseInt(e.target.value) || 3)))}
+                    className="w-16 bg-term-black border border-term-border text-term-fg-bright text-xs py-1 px-2 focus:outline-none focus:border-term-cyan text-center"
+                  />
+                  <span className="text-term-fg-dim text-xs">failures for</span>
+                  <input
+                    type="number"
+                    min={1}
+                    max={1440}
+                    value={lockoutMinutes}
+                    onChange={(e) => setLockoutMinutes(Math.max(1, Math.min(1440, parseInt(e.target.value) || 1)))}
+                    className="w-20 bg-term-black border border-term-border text-term-fg-bright text-xs py-1 px-2 focus:outline-none focus:border-term-cyan text-center"
+                  />
+                  <span className="text-term-fg-dim text-xs">minutes</span>
+                </div>
+              </div>
+
+              {/* Server Secret */}
+              {secretStatus && (
+                <div>
+                  <label className="block text-term-fg-dim text-xs mb-2">
+                    Server Secret
+                  </label>
+                  <p className="text-term-fg-muted text-xs mb-3">
+                    Mixed into every stored encryption key. Older versions are kept until nothing uses them.
+                  </p>
+                  <div className="flex items-center gap-2">
+                    <span className="text-term-fg-bright text-xs font-mono">v{secretStatus.current_version}</span>
+                    <span className="text-term-fg-dim text-xs font-mono">[{secretStatus.key_provider}]</span>
+                    {secretStatus.retired_versions.length > 0 && (
+                      <span className="text-term-fg-dim text-xs font-mono">
+                        retired: {secretStatus.retired_versions.map((v) => `v${v}`).join(', ')}
+                      </span>
+                    )}
+                    <button
+                      type="button"
+                      onClick={handleRotateSecret}
+                      disabled={rotating}
+                      className="ml-auto px-2 py-0.5 text-xs font-mono border border-term-border text-term-fg-dim hover:text-term-yellow hover:border-term-yellow disabled:opacity-50"
+                    >
+                      {rotating ? '[ rotating... ]' : '[ rotate ]'}
+                    </button>
+                  </div>
+                  {secretStatus.users_pending.length > 0 && (
+                    <p className="text-term-yellow text-xs mt-2">
+                      {secretStatus.users_total - secretStatus.users_pending.length}/{secretStatus.users_total} users re-encrypted,
+                      waiting for: {secretStatus.users_pending.join(', ')}
+                    </p>
+                  )}
+                </div>
+              )}
+
+              {/* JWT signing keys */}
+              {jwtStatus && (
+                <div>
+                  <label className="block text-term-fg-dim text-xs mb-2">
+                    JWT Signing Keys
+                  </label>
+                  <p className="text-term-fg-muted text-xs mb-3">
+                    Rotated every {jwtStatus.rotation_days} days, next on {new Date(jwtStatus.next_rotation).toLocaleDateString()}.
+                    Public keys are published at /.well-known/jwks.json.
+                  </p>
+                  {jwtStatus.keys.map((key) => (
+                    <div key={key.kid} className="flex items-center gap-2">
+                      <span className={`text-xs font-mono ${key.current ? 'text-term-fg-bright' : 'text-term-fg-dim'}`}>{key.kid}</span>
+                      <span className="text-term-fg-dim text-xs font-mono">[{key.alg}]</span>
+                      {key.current ? (
+                        <button
+                          type="button"
+                          onClick={handleRotateJWTKey}
+                          disabled={rotatingJwt}
+                          className="ml-auto px-2 py-0.5 text-xs font-mono border border-term-border text-term-fg-dim hover:text-term-yellow hover:border-term-yellow disabled:opacity-50"
+                        >
+                          {rotatingJwt ? '[ rotating... ]' : '[ rotate ]'}
+                        </button>
+                      ) : key.expires_at && (
+                        <span className="text-term-fg-dim text-xs font-mono">
+                          retired, verifies until {new Date(key.expires_at).toLocaleString()}
+                        </span>
+                      )}
+                    </div>
+                  ))}
+                  {jwtStatus.keys[0]?.alg !== jwtStatus.algorithm && (
+                    <p className="text-term-yellow text-xs mt-2">
+                      The next key will use {jwtStatus.algorithm}
+                    </p>
+                  )}
+                </div>
+              )}
+
+              {/* SAML identity provider */}
+              {samlSettings?.entity_id && (
+                <div>
+                  <label className="block text-term-fg-dim text-xs mb-2">
+                    SAML Identity Provider
+                  </label>
+                  <p className="text-term-fg-muted text-xs mb-3">
+                    Register <span className="text-term-fg-bright break-all">{samlSettings.metadata_url}</span> with
+                    the identity provider, then paste its metadata XML or metadata URL here.
+                  </p>
+                  <p className="text-xs font-mono mb-2">
+                    {samlSettings.idp_entity_id ? (
+                      <span className="text-term-green break-all">trusting: {samlSettings.idp_entity_id}</span>
+                    ) : (
+                      <span className="text-term-yellow">no identity provider imported</span>
+                    )}
+                  </p>
+                  <textarea
+                    value={samlSource}
+                    onChange={(e) => setSamlSource(e.target.value)}
+                    rows={3}
+                    placeholder="https://idp.example.com/metadata or <EntityDescriptor ...>"
+                    className="w-full bg-term-black border border-term-border text-term-fg-bright text-xs py-1 px-2 font-mono focus:outline-none focus:border-term-cyan"
+                  />
+                  <div className="flex justify-end mt-1">
+                    <button
+                      type="button"
+                      onClick={handleImportSAML}
+                      disabled={importing || !samlSource.trim()}
+                      className="px-2 py-0.5 text-xs font-mono border border-term-border text-term-fg-dim hover:text-term-cyan hover:border-term-cyan disabled:opacity-50"
+                    >
+                      {importing ? '[ importing... ]' : '[ import ]'}
+                    </button>
+                  </div>
+                </div>
+              )}
+
               {/* Actions */}
               <div className="flex justify-end gap-2 pt-2 border-t border-term-border">
                 <button
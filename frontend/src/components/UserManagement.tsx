@@ -1,6 +1,7 @@
 import { useState, useEffect, useCallback } from 'react';
-import { listUsers, createUser, updateUser, deleteUser } from '../services/api';
-import type { User, UserInput, Role } from '../types';
+import { listUsers, createUser, updateUser, deleteUser, resetUserTOTP, unlockUser, listUserSessions, revokeUserSession, revokeAllUserSessions, syncLDAP, checkSetupStatus } from '../services/api';
+import { deriveEncryptionKey } from '../utils/crypto';
+import type { User, UserInput, Role, Session } from '../types';
 
 interface UserManagementProps {
   onClose: () => void;
@@ -20,6 +21,10 @@ export default function UserManagement({ onClose, currentUserId }: UserManagemen
   });
   const [formError, setFormError] = useState('');
   const [saving, setSaving] = useState(false);
+  const [syncing, setSyncing] = useState(false);
+  const [proxyEnabled, setProxyEnabled] = useState(false);
+  const [sessionsUser, setSessionsUser] = useState<User | null>(null);
+  const [sessions, setSessions] = useState<Session[]>([]);
 
   const fetchUsers = useCallback(async () => {
     try {
@@ -38,6 +43,12 @@ export default function UserManagement({ onClose, currentUserId }: UserManagemen
     fetchUsers();
   }, [fetchUsers]);
 
+  useEffect(() => {
+    checkSetupStatus()
+      .then((status) => setProxyEnabled(status.proxy_enabled))
+      .catch(() => {});
+  }, []);
+
   // Handle Escape key
   useEffect(() => {
     const handleKeyDown = (e: KeyboardEvent) => {
@@ -68,6 +79,73 @@ export default function UserManagement({ onClose, currentUserId }: UserManagemen
     setShowForm(true);
   };
 
+  const handleResetTOTP = async (user: User) => {
+    if (!confirm(`Reset 2FA for "${user.username}"? Their authenticator and security keys are removed, they will be signed out everywhere and must enroll a new authenticator or security key at next login.`)) {
+      return;
+    }
+    try {
+      await resetUserTOTP(user.id);
+      fetchUsers();
+    } catch {
+      alert('Failed to reset 2FA');
+    }
+  };
+
+  const handleUnlock = async (user: User) => {
+    try {
+      await unlockUser(user.id);
+      fetchUsers();
+    } catch {
+      alert('Failed to unlock user');
+    }
+  };
+
+  const handleShowSessions = async (user: User) => {
+    try {
+      setSessions(await listUserSessions(user.id));
+      setSessionsUser(user);
+    } catch {
+      alert('Failed to fetch sessions');
+    }
+  };
+
+  const handleRevokeSession = async (session: Session) => {
+    if (!sessionsUser) return;
+    try {
+      await revokeUserSession(sessionsUser.id, session.id);
+      setSessions(await listUserSessions(sessionsUser.id));
+    } catch {
+      alert('Failed to revoke session');
+    }
+  };
+
+  const handleRevokeAllSessions = async () => {
+    if (!sessionsUser) return;
+    if (!confirm(`Sign "${sessionsUser.username}" out everywhere? Their open terminals will be closed.`)) {
+      return;
+    }
+    try {
+      await revokeAllUserSessions(sessionsUser.id);
+      setSessions([]);
+    } catch {
+      alert('Failed to revoke sessions');
+    }
+  };
+
+  const handleSyncLDAP = async () => {
+    setSyncing(true);
+    try {
+      const result = await syncLDAP();
+      alert(`Directory sync: ${result.checked} users checked, ${result.disabled} disabled, ${result.enabled} enabled, ${result.role_changed} role changes`);
+      fetchUsers();
+    } catch (err: unknown) {
+      const error = err as { response?: { data?: { error?: string } } };
+      alert(error.response?.data?.error || 'Directory sync failed');
+    } finally {
+      setSyncing(false);
+    }
+  };
+
   const handleDelete = async (user: User) => {
     if (user.id === currentUserId) {
       alert('Cannot delete your own account');
@@ -101,7 +179,16 @@ export default function UserManagement({ onClose, currentUserId }: UserManagemen
         if (formData.role !== editingUser.role) {
           updates.role = formData.role;
         }
+        const isSelf = editingUser.id === currentUserId;
+        if (updates.password && !isSelf &&
+            !confirm(`Reset the password of "${editingUser.username}"? Their stored machine secrets cannot be recovered without the old password and will be cleared.`)) {
+          return;
+        }
         await updateUser(editingUser.id, updates);
+        if (updates.password && isSelf) {
+          // The server re-wrapped our data key; keep the local key in step
+          localStorage.setItem('encryptionKey', await deriveEncryptionKey(formData.username, formData.password));
+        }
       } else {
         await createUser(formData);
       }
@@ -133,12 +220,24 @@ export default function UserManagement({ onClose, currentUserId }: UserManagemen
         {/* Toolbar */}
         <div className="flex items-center justify-between px-3 py-1.5 border-b border-term-border">
           <span className="text-term-fg-dim text-xs">{users.length} users</span>
-          <button
-            onClick={handleAdd}
-            className="px-2 py-0.5 text-xs border border-term-cyan text-term-cyan hover:bg-term-cyan hover:text-term-black font-mono"
-          >
-            [ + add user ]
-          </button>
+          <div className="flex items-center gap-2">
+            {users.some((u) => u.auth_provider === 'ldap') && (
+              <button
+                onClick={handleSyncLDAP}
+                disabled={syncing}
+                className="px-2 py-0.5 text-xs border border-term-border text-term-fg-dim hover:text-term-cyan hover:border-term-cyan font-mono disabled:opacity-50"
+                title="Disable users removed from the directory and update roles from its groups"
+              >
+                {syncing ? '[ syncing... ]' : '[ sync directory ]'}
+              </button>
+            )}
+            <button
+              onClick={handleAdd}
+              className="px-2 py-0.5 text-xs border border-term-cyan text-term-cyan hover:bg-term-cyan hover:text-term-black font-mono"
+            >
+              [ + add user ]
+            </button>
+          </div>
         </div>
 
         {/* User list */}
@@ -173,6 +272,44 @@ export default function UserManagement({ onClose, currentUserId }: UserManagemen
                             (you)
                           </span>
                         )}
+                        {user.auth_provider === 'oidc' && (
+                          <span className="text-xs text-term-fg-dim font-mono" title="Signs in with single sign-on">
+                            [sso]
+                          </span>
+                        )}
+                        {user.auth_provider === 'ldap' && (
+                          <span className="text-xs text-term-fg-dim font-mono" title="Signs in with the directory password">
+                            [ldap]
+                          </span>
+                        )}
+                        {user.auth_provider === 'proxy' && (
+                          <span className="text-xs text-term-fg-dim font-mono" title="Signs in through the reverse proxy">
+                            [proxy]
+                          </span>
+                        )}
+                        {user.auth_provider === 'saml' && (
+                          <span className="text-xs text-term-fg-dim font-mono" title="Signs in with SAML single sign-on">
+                            [saml]
+                          </span>
+                        )}
+                        {user.disabled && (
+                          <span className="text-xs text-term-red font-mono" title="Removed from the directory">
+                            [disabled]
+                          </span>
+                        )}
+                        {user.locked_until && (
+                          <span
+                            className="text-xs text-term-red font-mono"
+                            title={`Locked after failed sign-ins until ${new Date(user.locked_until).toLocaleString()}`}
+                          >
+                            [locked]
+                          </span>
+                        )}
+                        {user.password_expired && (
+                          <span className="text-xs text-term-yellow font-mono" title="Password is past its maximum age">
+                            [pw expired]
+                          </span>
+                        )}
                       </div>
                     </td>
                     <td className="px-3 py-2">
@@ -186,10 +323,25 @@ export default function UserManagement({ onClose, currentUserId }: UserManagemen
                     </td>
                     <td className="px-3 py-2">
                       <span className={`text-xs font-mono ${
-                        user.totp_enabled ? 'text-term-green' : 'text-term-yellow'
+                        user.totp_enabled || user.webauthn_credentials > 0 ? 'text-term-green' : 'text-term-yellow'
                       }`}>
-                        {user.totp_enabled ? '[2fa]' : '[no 2fa]'}
+                        {user.totp_enabled || user.webauthn_credentials > 0 ? '[2fa]' : '[no 2fa]'}
                       </span>
+                      {user.webauthn_credentials > 0 && (
+                        <span className="ml-1 text-xs font-mono text-term-fg-dim" title="Security keys">
+                          {user.webauthn_credentials} key{user.webauthn_credentials === 1 ? '' : 's'}
+                        </span>
+                      )}
+                      {(user.totp_enabled || user.webauthn_credentials > 0) && (
+                        <span
+                          className={`ml-1 text-xs font-mono ${
+                            user.recovery_codes_left <= 2 ? 'text-term-yellow' : 'text-term-fg-dim'
+                          }`}
+                          title="Unused recovery codes"
+                        >
+                          {user.recovery_codes_left} rc
+                        </span>
+                      )}
                     </td>
                     <td className="px-3 py-2 text-term-fg-dim text-xs">
                       {new Date(user.created_at).toLocaleDateString()}
@@ -203,6 +355,31 @@ export default function UserManagement({ onClose, currentUserId }: UserManagemen
                         >
                           [edit]
                         </button>
+                        <button
+                          onClick={() => handleShowSessions(user)}
+                          className="text-xs text-term-fg-dim hover:text-term-cyan font-mono"
+                          title="Sessions"
+                        >
+                          [sess]
+                        </button>
+                        {user.locked_until && (
+                          <button
+                            onClick={() => handleUnlock(user)}
+                            className="text-xs text-term-fg-dim hover:text-term-green font-mono"
+                            title="Unlock"
+                          >
+                            [unlock]
+                          </button>
+                        )}
+                        {user.id !== currentUserId && (user.totp_enabled || user.webauthn_credentials > 0) && (
+                          <button
+                            onClick={() => handleResetTOTP(user)}
+                            className="text-xs text-term-fg-dim hover:text-term-yellow font-mono"
+                            title="Reset 2FA"
+                          >
+                            [2fa]
+                          </button>
+                        )}
                         {user.id !== currentUserId && (
                           <button
                             onClick={() => handleDelete(user)}
@@ -221,6 +398,70 @@ export default function UserManagement({ onClose, currentUserId }: UserManagemen
           )}
         </div>
 
+        {/* Sessions Modal */}
+        {sessionsUser && (
+          <div className="absolute inset-0 bg-black/70 flex items-center justify-center">
+            <div className="border border-term-border bg-term-surface w-[32rem]">
+              <div className="px-3 py-1.5 bg-term-surface-alt border-b border-term-border flex items-center justify-between">
+                <span className="text-term-fg-dim text-xs font-mono">
+                  --[ sessions: {sessionsUser.username} ]--
+                </span>
+              </div>
+
+              <div className="p-4 space-y-3">
+                {sessions.length === 0 ? (
+                  <p className="text-term-fg-dim text-xs">No active sessions.</p>
+                ) : (
+                  <div className="border border-term-border max-h-80 overflow-y-auto">
+                    {sessions.map((session) => (
+                      <div key={session.id} className="px-2 py-1 text-xs font-mono border-b border-term-border last:border-b-0">
+                        <div className="flex items-center justify-between">
+                          <span className="text-term-fg-bright">
+                            {session.method} <span className="text-term-fg-muted">from {session.ip_address}</span>
+                            {session.current && <span className="text-term-green"> (this session)</span>}
+                          </span>
+                          <button
+                            onClick={() => handleRevokeSession(session)}
+                            className="text-term-fg-dim hover:text-term-red"
+                            title="Sign out"
+                          >
+                            [del]
+                          </button>
+                        </div>
+                        <div className="text-term-fg-dim truncate" title={session.user_agent}>{session.user_agent || 'unknown client'}</div>
+                        <div className="text-term-fg-muted">
+                          signed in {new Date(session.created_at).toLocaleString()}
+                          {' · '}
+                          active {new Date(session.last_seen_at).toLocaleString()}
+                        </div>
+                      </div>
+                    ))}
+                  </div>
+                )}
+
+                <div className="flex justify-end gap-2">
+                  <button
+                    type="button"
+                    onClick={() => setSessionsUser(null)}
+                    className="text-term-fg-dim hover:text-term-fg text-xs font-mono"
+                  >
+                    [ close ]
+                  </button>
+                  {sessions.length > 0 && (
+                    <button
+                      type="button"
+                      onClick={handleRevokeAllSessions}
+                      className="border border-term-red text-term-red hover:bg-term-red hover:text-term-black text-xs font-mono px-2 py-0.5"
+                    >
+                      [ sign out everywhere ]
+                    </button>
+                  )}
+                </div>
+              </div>
+            </div>
+          </div>
+        )}
+
         {/* Add/Edit Form Modal */}
         {showForm && (
           <div className="absolute inset-0 bg-black/70 flex items-center justify-center">
@@ -247,25 +488,53 @@ export default function UserManagement({ onClose, currentUserId }: UserManagemen
                       type="text"
                       value={formData.username}
                       onChange={(e) => setFormData({ ...formData, username: e.target.value })}
-                      className="w-full bg-term-black border border-term-border text-term-fg-bright text-xs py-1.5 px-2 focus:outline-none focus:border-term-cyan"
+                      className="w-full bg-term-black border border-term-border text-term-fg-bright text-xs py-1.5 px-2 focus:outline-none focus:border-term-cyan disabled:opacity-50"
                       required
                       minLength={3}
+                      disabled={editingUser?.auth_provider === 'ldap' || editingUser?.auth_provider === 'proxy'}
                     />
                   </div>
 
-                  <div>
-                    <label className="block text-term-fg-dim text-xs mb-1">
-                      Password {editingUser && <span className="text-term-fg-dim">(leave empty to keep current)</span>}
-                    </label>
-                    <input
-                      type="password"
-                      value={formData.password}
-                      onChange={(e) => setFormData({ ...formData, password: e.target.value })}
-                      className="w-full bg-term-black border border-term-border text-term-fg-bright text-xs py-1.5 px-2 focus:outline-none focus:border-term-cyan"
-                      required={!editingUser}
-                      minLength={8}
-                    />
-                  </div>
+                  {!editingUser && proxyEnabled && (
+                    <button
+                      type="button"
+                      onClick={() => setFormData({
+                        ...formData,
+                        auth_provider: formData.auth_provider === 'proxy' ? undefined : 'proxy',
+                      })}
+                      className={`px-2 py-0.5 text-xs font-mono border transition-colors ${
+                        formData.auth_provider === 'proxy'
+                          ? 'border-term-cyan text-term-cyan bg-term-cyan/10'
+                          : 'border-term-border text-term-fg-dim hover:text-term-fg-bright hover:border-term-fg-dim'
+                      }`}
+                    >
+                      {formData.auth_provider === 'proxy' ? '[x]' : '[ ]'} signs in through the proxy
+                    </button>
+                  )}
+
+                  {editingUser?.auth_provider === 'ldap' ? (
+                    <p className="text-term-fg-dim text-xs">
+                      The username and password are managed in the directory.
+                    </p>
+                  ) : editingUser?.auth_provider === 'proxy' || (!editingUser && formData.auth_provider === 'proxy') ? (
+                    <p className="text-term-fg-dim text-xs">
+                      The reverse proxy authenticates this user by their username; there is no password.
+                    </p>
+                  ) : (
+                    <div>
+                      <label className="block text-term-fg-dim text-xs mb-1">
+                        Password {editingUser && <span className="text-term-fg-dim">(leave empty to keep current, required when renaming)</span>}
+                      </label>
+                      <input
+                        type="password"
+                        value={formData.password}
+                        onChange={(e) => setFormData({ ...formData, password: e.target.value })}
+                        className="w-full bg-term-black border border-term-border text-term-fg-bright text-xs py-1.5 px-2 focus:outline-none focus:border-term-cyan"
+                        required={!editingUser}
+                        minLength={8}
+                      />
+                    </div>
+                  )}
 
                   <div>
                     <label className="block text-term-fg-dim text-xs mb-1">
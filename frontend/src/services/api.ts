@@ -1,5 +1,6 @@
 import axios from 'axios';
-import type { LoginResponse, AppSettings, Machine, MachineInput, SetupStatus, User, UserInput, DirectoryListing, Group, GroupInput, AuditLogResponse, AuditAction } from '../types';
+import type { CreationOptionsJSON, RequestOptionsJSON } from '../utils/webauthn';
+import type { LoginResponse, FactorVerification, PasswordChange, SecondFactor, WebAuthnCredential, APIToken, APITokenInput, APITokenCreated, Session, AppSettings, ServerSecretStatus, ServerSecretRotation, JWTKeyStatus, LDAPSyncResult, SAMLSettings, Machine, MachineInput, DeployKeyInput, DeployKeyResponse, ProbeResult, SetupStatus, User, UserInput, DirectoryListing, Group, GroupInput, Credential, CredentialInput, AuditLogResponse, AuditAction, HostKeyRecord, Notification, RotationInput, RotationJob } from '../types';
 
 const api = axios.create({
   baseURL: '/api',
@@ -18,12 +19,73 @@ api.interceptors.request.use((config) => {
   return config;
 });
 
+// Access tokens are short-lived. The session's HttpOnly refresh cookie
+// renews them shortly before they expire, and after a 401.
+let refreshing: Promise<string> | null = null;
+let refreshTimer: ReturnType<typeof setTimeout> | undefined;
+
+const tokenExpiry = (token: string): number => {
+  try {
+    const payload = token.split('.')[1].replace(/-/g, '+').replace(/_/g, '/');
+    return JSON.parse(atob(payload)).exp * 1000;
+  } catch {
+    return 0;
+  }
+};
+
+// Stores an access token and schedules its renewal a minute before it expires
+export const setAccessToken = (token: string) => {
+  localStorage.setItem('token', token);
+  clearTimeout(refreshTimer);
+  const delay = tokenExpiry(token) - Date.now() - 60_000;
+  if (delay > 0) {
+    refreshTimer = setTimeout(() => {
+      refreshAccessToken().catch(() => {
+        // The next request finds out and signs out
+      });
+    }, delay);
+  }
+};
+
+export const clearAccessToken = () => {
+  clearTimeout(refreshTimer);
+  localStorage.removeItem('token');
+};
+
+// Concurrent callers share one refresh, as the cookie can only be used once
+export const refreshAccessToken = (): Promise<string> => {
+  if (!refreshing) {
+    refreshing = axios.post('/api/auth/refresh')
+      .then((response) => {
+        setAccessToken(response.data.token);
+        return response.data.token as string;
+      })
+      .finally(() => {
+        refreshing = null;
+      });
+  }
+  return refreshing;
+};
+
+// Sign-in steps answer 401 for a wrong code; refreshing cannot help there
+const isSignInRequest = (url?: string) => /^\/(login|setup|auth)\b/.test(url || '');
+
 // Handle 401 errors
 api.interceptors.response.use(
   (response) => response,
-  (error) => {
+  async (error) => {
+    const request = error.config;
+    if (error.response?.status === 401 && request && !request._retried && localStorage.getItem('token') && !isSignInRequest(request.url)) {
+      request._retried = true;
+      try {
+        await refreshAccessToken();
+        return api(request);
+      } catch {
+        // The session has ended, sign out below
+      }
+    }
     if (error.response?.status === 401) {
-      localStorage.removeItem('token');
+      clearAccessToken();
       localStorage.removeItem('encryptionKey');
       window.location.href = '/login';
     }
@@ -47,6 +109,29 @@ export const login = async (username: string, password: string): Promise<LoginRe
   return response.data;
 };
 
+// Single sign-on: the browser is sent to OIDC_LOGIN_URL or SAML_LOGIN_URL and
+// comes back to /login with a one-time ticket in the URL fragment
+export const OIDC_LOGIN_URL = '/api/auth/oidc/login';
+export const SAML_LOGIN_URL = '/api/auth/saml/login';
+
+export const exchangeSSOTicket = async (ticket: string): Promise<LoginResponse> => {
+  const response = await api.post('/auth/oidc/exchange', { ticket });
+  return response.data;
+};
+
+// Sign in as the user the reverse proxy has authenticated
+export const proxyLogin = async (): Promise<LoginResponse> => {
+  const response = await api.post('/auth/proxy');
+  return response.data;
+};
+
+export const verifySSOPassword = async (tempToken: string, password: string): Promise<LoginResponse> => {
+  const response = await api.post('/auth/oidc/password', { password }, {
+    headers: { Authorization: `Bearer ${tempToken}` },
+  });
+  return response.data;
+};
+
 export const verifyTOTP = async (tempToken: string, code: string): Promise<LoginResponse> => {
   const response = await api.post('/login/totp', { code }, {
     headers: { Authorization: `Bearer ${tempToken}` },
@@ -54,6 +139,133 @@ export const verifyTOTP = async (tempToken: string, code: string): Promise<Login
   return response.data;
 };
 
+export const verifyRecoveryCode = async (tempToken: string, recoveryCode: string): Promise<LoginResponse> => {
+  const response = await api.post('/login/totp', { recovery_code: recoveryCode }, {
+    headers: { Authorization: `Bearer ${tempToken}` },
+  });
+  return response.data;
+};
+
+export const regenerateRecoveryCodes = async (verification: FactorVerification): Promise<string[]> => {
+  const response = await api.post('/user/recovery-codes', verification);
+  return response.data.recovery_codes;
+};
+
+// Returns a fresh access token for this session, already put in place
+export const changePassword = async (change: PasswordChange): Promise<{ sessions_revoked: number }> => {
+  const response = await api.post('/user/password', change);
+  if (response.data.token) {
+    setAccessToken(response.data.token);
+  }
+  return response.data;
+};
+
+// WebAuthn login (temp token)
+export const beginWebAuthnLogin = async (tempToken: string): Promise<RequestOptionsJSON> => {
+  const response = await api.post('/login/webauthn/begin', {}, {
+    headers: { Authorization: `Bearer ${tempToken}` },
+  });
+  return response.data;
+};
+
+export const finishWebAuthnLogin = async (tempToken: string, assertion: unknown): Promise<LoginResponse> => {
+  const response = await api.post('/login/webauthn', assertion, {
+    headers: { Authorization: `Bearer ${tempToken}` },
+  });
+  return response.data;
+};
+
+export const beginWebAuthnEnrollment = async (tempToken: string, name: string): Promise<CreationOptionsJSON> => {
+  const response = await api.post('/login/webauthn/register/begin', { name }, {
+    headers: { Authorization: `Bearer ${tempToken}` },
+  });
+  return response.data;
+};
+
+export const finishWebAuthnEnrollment = async (tempToken: string, credential: unknown): Promise<LoginResponse> => {
+  const response = await api.post('/login/webauthn/register', credential, {
+    headers: { Authorization: `Bearer ${tempToken}` },
+  });
+  return response.data;
+};
+
+// Security keys of the current user
+export const listWebAuthnCredentials = async (): Promise<WebAuthnCredential[]> => {
+  const response = await api.get('/user/webauthn');
+  return response.data;
+};
+
+export const getWebAuthnChallenge = async (): Promise<RequestOptionsJSON> => {
+  const response = await api.post('/user/webauthn/challenge');
+  return response.data;
+};
+
+export const beginWebAuthnRegistration = async (name: string, verification: FactorVerification): Promise<CreationOptionsJSON> => {
+  const response = await api.post('/user/webauthn/register/begin', { ...verification, name });
+  return response.data;
+};
+
+export const finishWebAuthnRegistration = async (credential: unknown): Promise<WebAuthnCredential> => {
+  const response = await api.post('/user/webauthn/register', credential);
+  return response.data;
+};
+
+export const deleteWebAuthnCredential = async (id: number): Promise<void> => {
+  await api.delete(`/user/webauthn/${id}`);
+};
+
+// API tokens of the current user
+export const listAPITokens = async (): Promise<APIToken[]> => {
+  const response = await api.get('/user/api-tokens');
+  return response.data;
+};
+
+export const getAPITokenScopes = async (): Promise<string[]> => {
+  const response = await api.get('/user/api-tokens/scopes');
+  return response.data;
+};
+
+export const createAPIToken = async (input: APITokenInput, verification: FactorVerification): Promise<APITokenCreated> => {
+  const response = await api.post('/user/api-tokens', { ...verification, ...input });
+  return response.data;
+};
+
+export const deleteAPIToken = async (id: number): Promise<void> => {
+  await api.delete(`/user/api-tokens/${id}`);
+};
+
+export const listSessions = async (): Promise<Session[]> => {
+  const response = await api.get('/user/sessions');
+  return response.data;
+};
+
+export const revokeSession = async (id: number): Promise<void> => {
+  await api.delete(`/user/sessions/${id}`);
+};
+
+export const revokeOtherSessions = async (): Promise<{ revoked: number }> => {
+  const response = await api.delete('/user/sessions');
+  return response.data;
+};
+
+export const logout = async (): Promise<void> => {
+  await api.post('/logout');
+};
+
+export const updatePreferredFactor = async (factor: SecondFactor): Promise<User> => {
+  const response = await api.put('/user/preferred-factor', { factor });
+  return response.data;
+};
+
+export const startTOTPReenrollment = async (verification: FactorVerification): Promise<LoginResponse> => {
+  const response = await api.post('/user/totp/reenroll', verification);
+  return response.data;
+};
+
+export const confirmTOTPReenrollment = async (code: string): Promise<void> => {
+  await api.post('/user/totp/confirm', { code });
+};
+
 export const getCurrentUser = async (): Promise<User> => {
   const response = await api.get('/user');
   return response.data;
@@ -79,6 +291,29 @@ export const deleteUser = async (id: number): Promise<void> => {
   await api.delete(`/users/${id}`);
 };
 
+export const resetUserTOTP = async (id: number): Promise<User> => {
+  const response = await api.post(`/users/${id}/totp/reset`);
+  return response.data;
+};
+
+export const unlockUser = async (id: number): Promise<User> => {
+  const response = await api.post(`/users/${id}/unlock`);
+  return response.data;
+};
+
+export const listUserSessions = async (id: number): Promise<Session[]> => {
+  const response = await api.get(`/users/${id}/sessions`);
+  return response.data;
+};
+
+export const revokeUserSession = async (id: number, sessionId: number): Promise<void> => {
+  await api.delete(`/users/${id}/sessions/${sessionId}`);
+};
+
+export const revokeAllUserSessions = async (id: number): Promise<void> => {
+  await api.delete(`/users/${id}/sessions`);
+};
+
 // Machine endpoints
 export const listMachines = async (): Promise<Machine[]> => {
   const response = await api.get('/machines/');
@@ -95,11 +330,21 @@ export const createMachine = async (machine: MachineInput): Promise<Machine> =>
   return response.data;
 };
 
+export const testMachineConnection = async (machine: MachineInput): Promise<ProbeResult> => {
+  const response = await api.post('/machines/test', machine);
+  return response.data;
+};
+
 export const updateMachine = async (id: number, machine: Partial<MachineInput>): Promise<Machine> => {
   const response = await api.put(`/machines/${id}`, machine);
   return response.data;
 };
 
+export const deployKey = async (id: number, input: DeployKeyInput): Promise<DeployKeyResponse> => {
+  const response = await api.post(`/machines/${id}/deploy-key`, input);
+  return response.data;
+};
+
 export const deleteMachine = async (id: number): Promise<void> => {
   await api.delete(`/machines/${id}`);
 };
@@ -124,6 +369,31 @@ export const deleteGroup = async (id: number): Promise<void> => {
   await api.delete(`/groups/${id}`);
 };
 
+// Shared credential endpoints
+export const listCredentials = async (): Promise<Credential[]> => {
+  const response = await api.get('/credentials/');
+  return response.data;
+};
+
+export const createCredential = async (credential: CredentialInput): Promise<Credential> => {
+  const response = await api.post('/credentials/', credential);
+  return response.data;
+};
+
+export const updateCredential = async (id: number, credential: Partial<CredentialInput>): Promise<Credential> => {
+  const response = await api.put(`/credentials/${id}`, credential);
+  return response.data;
+};
+
+export const deleteCredential = async (id: number): Promise<void> => {
+  await api.delete(`/credentials/${id}`);
+};
+
+export const getCredentialMachines = async (id: number): Promise<Machine[]> => {
+  const response = await api.get(`/credentials/${id}/machines`);
+  return response.data;
+};
+
 // SSH endpoints
 export const getHostKey = async (id: number): Promise<{ host_key: string }> => {
   const response = await api.get(`/ssh/${id}/hostkey`);
@@ -134,6 +404,60 @@ export const updateHostKey = async (id: number, hostKey: string): Promise<void>
   await api.put(`/ssh/${id}/hostkey`, { host_key: hostKey });
 };
 
+export const scanHostKey = async (id: number): Promise<{ host_key: string; scanned: HostKeyRecord }> => {
+  const response = await api.post(`/ssh/${id}/hostkey/scan`);
+  return response.data;
+};
+
+export const getHostKeyHistory = async (id: number): Promise<HostKeyRecord[]> => {
+  const response = await api.get(`/ssh/${id}/hostkey/history`);
+  return response.data;
+};
+
+// Credential rotation endpoints
+export const startKeyRotation = async (input: RotationInput): Promise<RotationJob> => {
+  const response = await api.post('/rotations/keys', input);
+  return response.data;
+};
+
+export const startPasswordRotation = async (input: RotationInput): Promise<RotationJob> => {
+  const response = await api.post('/rotations/passwords', input);
+  return response.data;
+};
+
+// Runs any overdue scheduled password rotations; resolves to null when none are due
+export const startDuePasswordRotation = async (): Promise<RotationJob | null> => {
+  const response = await api.post('/rotations/passwords/due');
+  return response.status === 204 ? null : response.data;
+};
+
+export const listRotationJobs = async (): Promise<RotationJob[]> => {
+  const response = await api.get('/rotations/');
+  return response.data;
+};
+
+export const getRotationJob = async (id: number): Promise<RotationJob> => {
+  const response = await api.get(`/rotations/${id}`);
+  return response.data;
+};
+
+// Notification endpoints
+export const listNotifications = async (unreadOnly = false): Promise<Notification[]> => {
+  const response = await api.get('/notifications/', {
+    params: unreadOnly ? { unread: 'true' } : undefined,
+  });
+  return response.data;
+};
+
+export const markNotificationRead = async (id: number): Promise<Notification> => {
+  const response = await api.post(`/notifications/${id}/read`);
+  return response.data;
+};
+
+export const markAllNotificationsRead = async (): Promise<void> => {
+  await api.post('/notifications/read');
+};
+
 // SFTP endpoints
 export const listDirectory = async (machineId: number, path?: string): Promise<DirectoryListing> => {
   const response = await api.get(`/sftp/${machineId}/ls`, {
@@ -214,6 +538,41 @@ export const updateSettings = async (settings: Partial<AppSettings>): Promise<Ap
   return response.data;
 };
 
+export const getServerSecretStatus = async (): Promise<ServerSecretStatus> => {
+  const response = await api.get('/settings/server-secret');
+  return response.data;
+};
+
+export const rotateServerSecret = async (): Promise<ServerSecretRotation> => {
+  const response = await api.post('/settings/server-secret/rotate');
+  return response.data;
+};
+
+export const getJWTKeyStatus = async (): Promise<JWTKeyStatus> => {
+  const response = await api.get('/settings/jwt-keys');
+  return response.data;
+};
+
+export const rotateJWTKey = async (): Promise<JWTKeyStatus> => {
+  const response = await api.post('/settings/jwt-keys/rotate');
+  return response.data;
+};
+
+export const syncLDAP = async (): Promise<LDAPSyncResult> => {
+  const response = await api.post('/settings/ldap/sync');
+  return response.data;
+};
+
+export const getSAMLSettings = async (): Promise<SAMLSettings> => {
+  const response = await api.get('/settings/saml');
+  return response.data;
+};
+
+export const importSAMLMetadata = async (source: { metadata?: string; url?: string }): Promise<SAMLSettings> => {
+  const response = await api.put('/settings/saml/idp-metadata', source);
+  return response.data;
+};
+
 // Helper to get WebSocket URL (no longer includes encryption key for security)
 export const getSSHWebSocketUrl = (machineId: number, userId: number): string => {
   const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
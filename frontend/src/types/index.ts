@@ -5,15 +5,84 @@ export interface User {
   username: string;
   role: Role;
   totp_enabled: boolean;
+  recovery_codes_left: number;
+  webauthn_credentials: number;
+  preferred_factor?: SecondFactor;
+  auth_provider?: 'oidc' | 'ldap' | 'saml' | 'proxy';
+  disabled?: boolean;
+  locked_until?: string;
+  password_expired?: boolean;
   created_at: string;
 }
 
+export type SecondFactor = 'totp' | 'webauthn';
+
+export interface WebAuthnCredential {
+  id: number;
+  name: string;
+  sign_count: number;
+  backup_eligible: boolean;
+  last_used_at?: string | null;
+  created_at: string;
+}
+
+// Personal access token for scripts; the token itself is only shown once
+export interface APIToken {
+  id: number;
+  name: string;
+  prefix: string;
+  scopes: string[];
+  expires_at: string | null;
+  last_used_at: string | null;
+  last_used_ip?: string;
+  created_at: string;
+}
+
+export interface APITokenInput {
+  name: string;
+  scopes: string[];
+  expires_in_days: number; // 0 for a token that does not expire
+}
+
+export interface APITokenCreated {
+  token: string;
+  api_token: APIToken;
+}
+
+// A sign-in; revoking it signs that browser out and closes its terminals
+export interface Session {
+  id: number;
+  user_id: number;
+  method: string;
+  ip_address: string;
+  user_agent: string;
+  expires_at: string;
+  last_seen_at: string;
+  created_at: string;
+  current: boolean;
+}
+
+// Proof of a current second factor, required for sensitive account changes
+export interface FactorVerification {
+  code?: string;
+  recovery_code?: string;
+  assertion?: unknown;
+}
+
+export interface PasswordChange extends FactorVerification {
+  current_password: string;
+  new_password: string;
+}
+
 export interface UserInput {
   username: string;
   password: string;
   role: Role;
+  auth_provider?: 'proxy';
 }
 
+export type HostKeyPolicy = 'strict' | 'tofu' | 'accept-new';
+
 export interface Machine {
   id: number;
   group_id?: number | null;
@@ -22,7 +91,15 @@ export interface Machine {
   port: number;
   username: string;
   auth_type: 'password' | 'key';
+  credential_id?: number | null;
+  secret_path?: string;
+  credential_missing?: boolean;
+  public_key?: string;
+  credential_rotated_at?: string;
+  password_rotation_days: number;
   host_key?: string;
+  host_key_policy?: HostKeyPolicy;
+  host_key_scanned_at?: string;
   created_at: string;
   updated_at: string;
 }
@@ -34,8 +111,85 @@ export interface MachineInput {
   port: number;
   username: string;
   auth_type: 'password' | 'key';
+  credential_id?: number | null;
+  secret_path?: string;
   credential: string;
   passphrase?: string;
+  host_key?: string;
+  host_key_policy?: HostKeyPolicy | '';
+  password_rotation_days?: number;
+}
+
+// Returned with HTTP 409 when a non-interactive connection meets an untrusted host key
+export interface HostKeyErrorResponse {
+  error: string;
+  host_key_status: 'new' | 'mismatch';
+  fingerprint: string;
+  stored_key?: string;
+  policy: HostKeyPolicy;
+}
+
+export type ProbeStepName = 'dns' | 'tcp' | 'handshake' | 'host_key' | 'auth';
+
+export interface ProbeStep {
+  name: ProbeStepName;
+  status: 'ok' | 'failed' | 'skipped';
+  message?: string;
+  duration_ms: number;
+}
+
+export interface ProbeResult {
+  success: boolean;
+  steps: ProbeStep[];
+  fingerprint?: string;
+  host_key_status?: 'new' | 'match' | 'mismatch';
+  banner?: string;
+}
+
+export interface DeployKeyInput {
+  key_type?: 'ed25519' | 'rsa';
+  bits?: number;
+  password?: string;
+}
+
+export interface DeployKeyResponse {
+  machine: Machine;
+  public_key: string;
+  fingerprint: string;
+}
+
+export type RotationKind = 'key' | 'password';
+
+export interface RotationInput {
+  machine_ids?: number[];
+  group_ids?: number[];
+  key_type?: 'ed25519' | 'rsa';
+  bits?: number;
+}
+
+export interface RotationResult {
+  id: number;
+  job_id: number;
+  machine_id: number;
+  machine_name: string;
+  status: 'success' | 'failed' | 'rolled_back' | 'skipped';
+  message?: string;
+  fingerprint?: string;
+  created_at: string;
+}
+
+export interface RotationJob {
+  id: number;
+  user_id: number;
+  kind: RotationKind;
+  status: 'running' | 'completed' | 'failed';
+  total: number;
+  succeeded: number;
+  failed: number;
+  skipped: number;
+  results?: RotationResult[];
+  created_at: string;
+  finished_at?: string;
 }
 
 export interface Group {
@@ -46,6 +200,25 @@ export interface Group {
   created_at: string;
 }
 
+// A shared credential that several machines can link to
+export interface Credential {
+  id: number;
+  name: string;
+  type: 'password' | 'key';
+  rotated_at?: string;
+  secret_missing?: boolean;
+  machine_count: number;
+  created_at: string;
+  updated_at: string;
+}
+
+export interface CredentialInput {
+  name: string;
+  type: 'password' | 'key';
+  secret: string;
+  passphrase?: string;
+}
+
 export interface GroupInput {
   name: string;
   color?: string;
@@ -60,16 +233,29 @@ export interface LoginResponse {
   // Full auth (returned after TOTP verification)
   token?: string;
   user?: User;
-  // Partial auth (needs TOTP)
+  // Partial auth (needs TOTP or a security key)
   requires_totp?: boolean;
+  requires_webauthn?: boolean;
+  preferred_factor?: SecondFactor;
   requires_totp_setup?: boolean;
   temp_token?: string;
   totp_secret?: string;
   totp_qr_url?: string;
+  // Shown once, after TOTP enrollment completes
+  recovery_codes?: string[];
+  // Credential key of single sign-on users, who have no password to derive it from
+  encryption_key?: string;
+  // Single sign-on that still needs the local password (to be chosen if password_setup)
+  requires_password?: boolean;
+  password_setup?: boolean;
 }
 
 export interface SetupStatus {
   setup_complete: boolean;
+  oidc_enabled: boolean;
+  saml_enabled: boolean;
+  proxy_enabled: boolean;
+  proxy_user?: string;
 }
 
 export interface FileInfo {
@@ -109,7 +295,32 @@ export type AuditAction =
   | 'user_create'
   | 'user_update'
   | 'user_delete'
-  | 'totp_setup';
+  | 'totp_setup'
+  | 'host_key_mismatch'
+  | 'key_deploy'
+  | 'key_rotate'
+  | 'password_rotate'
+  | 'credential_create'
+  | 'credential_update'
+  | 'credential_delete'
+  | 'server_secret_rotate'
+  | 'recovery_code_use'
+  | 'recovery_codes_regenerate'
+  | 'totp_reset'
+  | 'webauthn_register'
+  | 'webauthn_delete'
+  | 'user_disable'
+  | 'user_enable'
+  | 'saml_metadata_import'
+  | 'api_token_create'
+  | 'api_token_revoke'
+  | 'session_revoke'
+  | 'jwt_key_rotate'
+  | 'login_failed'
+  | 'totp_failed'
+  | 'user_lock'
+  | 'user_unlock'
+  | 'password_change';
 
 export interface AuditLog {
   id: number;
@@ -132,4 +343,81 @@ export interface AuditLogResponse {
 
 export interface AppSettings {
   session_duration_hours: number;
+  host_key_policy: HostKeyPolicy;
+  host_key_scan_enabled: boolean;
+  host_key_scan_interval_minutes: number;
+  lockout_threshold: number;
+  lockout_minutes: number;
+  password_min_length: number;
+  password_min_classes: number;
+  password_max_age_days: number;
+  breached_passwords: number;
+}
+
+export interface ServerSecretStatus {
+  current_version: number;
+  retired_versions: number[];
+  key_provider: string;
+  sealed_by_version: Record<string, number>;
+  users_total: number;
+  users_pending: string[];
+}
+
+export interface ServerSecretRotation {
+  version: number;
+  totp_reencrypted: number;
+  totp_failed: number;
+}
+
+export interface JWTKeyInfo {
+  kid: string;
+  alg: string;
+  created_at: string;
+  retired_at?: string;
+  expires_at?: string;
+  current: boolean;
+}
+
+export interface JWTKeyStatus {
+  keys: JWTKeyInfo[];
+  algorithm: string;
+  rotation_days: number;
+  next_rotation: string;
+}
+
+export interface SAMLSettings {
+  enabled: boolean;
+  entity_id?: string;
+  metadata_url?: string;
+  acs_url?: string;
+  idp_entity_id?: string;
+  idp_sso_url?: string;
+}
+
+export interface LDAPSyncResult {
+  checked: number;
+  disabled: number;
+  enabled: number;
+  role_changed: number;
+}
+
+export interface HostKeyRecord {
+  id: number;
+  machine_id: number;
+  fingerprint: string;
+  key_type: string;
+  status: 'new' | 'match' | 'mismatch';
+  first_seen_at: string;
+  last_seen_at: string;
+}
+
+export interface Notification {
+  id: number;
+  user_id: number;
+  type: 'host_key_mismatch' | 'password_rotation_due' | 'credentials_reset';
+  title: string;
+  message: string;
+  machine_id?: number;
+  read_at?: string;
+  created_at: string;
 }
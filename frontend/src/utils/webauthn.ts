@@ -0,0 +1,108 @@
+/**
+ * Bridges the server's WebAuthn options, which carry binary fields as
+ * base64url strings, and the browser's navigator.credentials API.
+ */
+
+function fromBase64url(value: string): ArrayBuffer {
+  const base64 = value.replace(/-/g, '+').replace(/_/g, '/');
+  const padded = base64 + '='.repeat((4 - (base64.length % 4)) % 4);
+  const binary = atob(padded);
+  const bytes = new Uint8Array(binary.length);
+  for (let i = 0; i < binary.length; i++) {
+    bytes[i] = binary.charCodeAt(i);
+  }
+  return bytes.buffer;
+}
+
+function toBase64url(buffer: ArrayBuffer): string {
+  const bytes = new Uint8Array(buffer);
+  let binary = '';
+  for (let i = 0; i < bytes.length; i++) {
+    binary += String.fromCharCode(bytes[i]);
+  }
+  return btoa(binary).replace(/\+/g, '-').replace(/\//g, '_').replace(/=+$/, '');
+}
+
+interface CredentialDescriptorJSON {
+  type: PublicKeyCredentialType;
+  id: string;
+  transports?: AuthenticatorTransport[];
+}
+
+interface CreationOptionsJSON {
+  publicKey: Omit<PublicKeyCredentialCreationOptions, 'challenge' | 'user' | 'excludeCredentials'> & {
+    challenge: string;
+    user: { id: string; name: string; displayName: string };
+    excludeCredentials?: CredentialDescriptorJSON[];
+  };
+}
+
+interface RequestOptionsJSON {
+  publicKey: Omit<PublicKeyCredentialRequestOptions, 'challenge' | 'allowCredentials'> & {
+    challenge: string;
+    allowCredentials?: CredentialDescriptorJSON[];
+  };
+}
+
+const toDescriptor = (d: CredentialDescriptorJSON): PublicKeyCredentialDescriptor => ({
+  type: d.type,
+  id: fromBase64url(d.id),
+  transports: d.transports,
+});
+
+export const isWebAuthnSupported = (): boolean =>
+  typeof window !== 'undefined' && !!window.PublicKeyCredential;
+
+/** Registers a new security key, returning the attestation for the server */
+export async function createCredential(options: CreationOptionsJSON): Promise<unknown> {
+  const { publicKey } = options;
+  const credential = await navigator.credentials.create({
+    publicKey: {
+      ...publicKey,
+      challenge: fromBase64url(publicKey.challenge),
+      user: { ...publicKey.user, id: fromBase64url(publicKey.user.id) },
+      excludeCredentials: publicKey.excludeCredentials?.map(toDescriptor),
+    },
+  }) as PublicKeyCredential | null;
+  if (!credential) throw new Error('No credential was created');
+
+  const response = credential.response as AuthenticatorAttestationResponse;
+  return {
+    id: credential.id,
+    rawId: toBase64url(credential.rawId),
+    type: credential.type,
+    response: {
+      clientDataJSON: toBase64url(response.clientDataJSON),
+      attestationObject: toBase64url(response.attestationObject),
+      transports: response.getTransports?.() ?? [],
+    },
+  };
+}
+
+/** Asks a registered security key to sign the challenge, returning the assertion for the server */
+export async function getAssertion(options: RequestOptionsJSON): Promise<unknown> {
+  const { publicKey } = options;
+  const credential = await navigator.credentials.get({
+    publicKey: {
+      ...publicKey,
+      challenge: fromBase64url(publicKey.challenge),
+      allowCredentials: publicKey.allowCredentials?.map(toDescriptor),
+    },
+  }) as PublicKeyCredential | null;
+  if (!credential) throw new Error('No security key responded');
+
+  const response = credential.response as AuthenticatorAssertionResponse;
+  return {
+    id: credential.id,
+    rawId: toBase64url(credential.rawId),
+    type: credential.type,
+    response: {
+      clientDataJSON: toBase64url(response.clientDataJSON),
+      authenticatorData: toBase64url(response.authenticatorData),
+      signature: toBase64url(response.signature),
+      userHandle: response.userHandle ? toBase64url(response.userHandle) : undefined,
+    },
+  };
+}
+
+export type { CreationOptionsJSON, RequestOptionsJSON };